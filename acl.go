@@ -0,0 +1,856 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aclUser is a user of the ACL system. Users are never modified once
+// registered: ACL SETUSER replaces them with an updated copy, so a user
+// looked up under aclMu can be read after releasing it.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// passwords holds the SHA-256 digests of the user's passwords, hex
+	// encoded, in the order they were added.
+	passwords []string
+	// commands holds the commands the user may run, named as commandName
+	// names them. commandRules are the rules that built it, for ACL GETUSER
+	// and ACL LIST.
+	commands     map[string]bool
+	commandRules []string
+	keys         []aclKeyPattern
+	channels     []string
+}
+
+// aclKeyPattern is a key pattern of a user and the permissions it grants:
+// ~pattern grants both, %R~pattern and %W~pattern one of them.
+type aclKeyPattern struct {
+	pattern string
+	perm    int
+}
+
+const RESP_ERR_NO_ACLFILE string = "-ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."
+
+// Reasons for denying a command, as ACL LOG reports them.
+const (
+	aclDeniedCommand = "command"
+	aclDeniedKey     = "key"
+	aclDeniedChannel = "channel"
+	aclDeniedAuth    = "auth"
+)
+
+// aclLogMaxLen is how many entries ACL LOG keeps, and aclLogGrouping how
+// recent an entry must be for a similar denial to be counted in it.
+const (
+	aclLogMaxLen   = 128
+	aclLogGrouping = 60 * time.Second
+)
+
+// aclLogEntry is an entry of ACL LOG: count denials of the same kind.
+type aclLogEntry struct {
+	id         int64
+	count      int
+	reason     string
+	context    string
+	object     string
+	username   string
+	clientInfo string
+	created    time.Time
+	updated    time.Time
+}
+
+// newACLUser returns a user as ACL SETUSER creates it: disabled, without
+// passwords, and allowed no command, key or channel.
+func newACLUser(name string) *aclUser {
+	return &aclUser{name: name, commands: map[string]bool{}}
+}
+
+// newDefaultUser returns the default user of a fresh server, which every
+// connection starts authenticated as: it needs no password and may do
+// anything.
+func newDefaultUser() *aclUser {
+	u := newACLUser("default")
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		u.applyRule(rule)
+	}
+	return u
+}
+
+func (u *aclUser) clone() *aclUser {
+	c := *u
+	c.passwords = append([]string(nil), u.passwords...)
+	c.commands = make(map[string]bool, len(u.commands))
+	for name := range u.commands {
+		c.commands[name] = true
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	c.keys = append([]aclKeyPattern(nil), u.keys...)
+	c.channels = append([]string(nil), u.channels...)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// validPasswordHash reports whether hash is a SHA-256 digest as the #
+// and ! rules take it: 64 lower case hexadecimal characters.
+func validPasswordHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	for i := 0; i < len(hash); i++ {
+		if (hash[i] < '0' || hash[i] > '9') && (hash[i] < 'a' || hash[i] > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRule applies an ACL SETUSER rule to the user, returning why the rule
+// is invalid, or "".
+func (u *aclUser) applyRule(rule string) string {
+	switch lower := strings.ToLower(rule); {
+	case rule == "":
+		return "Syntax error"
+	case lower == "on":
+		u.enabled = true
+	case lower == "off":
+		u.enabled = false
+	case lower == "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case lower == "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case lower == "allkeys":
+		u.keys = []aclKeyPattern{{pattern: "*", perm: keyRead | keyWrite}}
+	case lower == "resetkeys":
+		u.keys = nil
+	case lower == "allchannels":
+		u.channels = []string{"*"}
+	case lower == "resetchannels":
+		u.channels = nil
+	case lower == "allcommands":
+		return u.applyCommandRule("+@all")
+	case lower == "nocommands":
+		return u.applyCommandRule("-@all")
+	case lower == "reset":
+		*u = *newACLUser(u.name)
+
+	case rule[0] == '>' || rule[0] == '#':
+		hash := rule[1:]
+		if rule[0] == '>' {
+			hash = hashPassword(hash)
+		} else if !validPasswordHash(hash) {
+			return "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"
+		}
+		u.nopass = false
+		for _, p := range u.passwords {
+			if p == hash {
+				return ""
+			}
+		}
+		u.passwords = append(u.passwords, hash)
+	case rule[0] == '<' || rule[0] == '!':
+		hash := rule[1:]
+		if rule[0] == '<' {
+			hash = hashPassword(hash)
+		} else if !validPasswordHash(hash) {
+			return "The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters"
+		}
+		for i, p := range u.passwords {
+			if p == hash {
+				u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+				return ""
+			}
+		}
+		return "The password you are trying to remove from the user does not exist"
+
+	case rule[0] == '~':
+		u.keys = append(u.keys, aclKeyPattern{pattern: rule[1:], perm: keyRead | keyWrite})
+	case rule[0] == '%':
+		flags, pattern, ok := strings.Cut(rule[1:], "~")
+		if !ok || flags == "" {
+			return "Syntax error"
+		}
+		perm := 0
+		for _, flag := range strings.ToUpper(flags) {
+			switch flag {
+			case 'R':
+				perm |= keyRead
+			case 'W':
+				perm |= keyWrite
+			default:
+				return "Syntax error"
+			}
+		}
+		u.keys = append(u.keys, aclKeyPattern{pattern: pattern, perm: perm})
+	case rule[0] == '&':
+		u.channels = append(u.channels, rule[1:])
+
+	case rule[0] == '+' || rule[0] == '-':
+		return u.applyCommandRule(lower)
+	default:
+		return "Syntax error"
+	}
+	return ""
+}
+
+// applyCommandRule applies a +command, -command, +@category or -@category
+// rule. A subcommand is named command|subcommand, and naming the command of
+// subcommands names them all.
+func (u *aclUser) applyCommandRule(rule string) string {
+	allow := rule[0] == '+'
+	target := rule[1:]
+
+	var names []string
+	if category, ok := strings.CutPrefix(target, "@"); ok {
+		if category == "all" {
+			u.commands = map[string]bool{}
+			if allow {
+				forEachCommand(func(name string, _ int) { u.commands[name] = true })
+			}
+			u.commandRules = []string{rule}
+			return ""
+		}
+		bit := aclCategoryBit(category)
+		if bit == 0 {
+			return "Unknown command or category name in ACL"
+		}
+		forEachCommand(func(name string, categories int) {
+			if categories&bit != 0 {
+				names = append(names, name)
+			}
+		})
+	} else {
+		names = aclCommandsNamed(target)
+		if names == nil {
+			return "Unknown command or category name in ACL"
+		}
+	}
+
+	for _, name := range names {
+		if allow {
+			u.commands[name] = true
+		} else {
+			delete(u.commands, name)
+		}
+	}
+	u.commandRules = append(u.commandRules, rule)
+	return ""
+}
+
+// forEachCommand calls fn with the name and ACL categories of every command
+// and subcommand rules can refer to.
+func forEachCommand(fn func(name string, categories int)) {
+	for cmd, spec := range commandTable {
+		name := strings.ToLower(cmd)
+		if spec.subcommands == nil {
+			fn(name, spec.categories)
+			continue
+		}
+		for sub, subSpec := range spec.subcommands {
+			fn(name+"|"+sub, subSpec.categories)
+		}
+	}
+}
+
+// aclCommandsNamed returns the commands an ACL rule naming target covers,
+// or nil when there is no such command.
+func aclCommandsNamed(target string) []string {
+	cmd, sub, hasSub := strings.Cut(target, "|")
+	spec, ok := commandTable[strings.ToUpper(cmd)]
+	switch {
+	case !ok:
+		return nil
+	case hasSub:
+		if _, ok := spec.subcommands[sub]; !ok {
+			return nil
+		}
+		return []string{target}
+	case spec.subcommands != nil:
+		names := make([]string, 0, len(spec.subcommands))
+		for sub := range spec.subcommands {
+			names = append(names, cmd+"|"+sub)
+		}
+		return names
+	}
+	return []string{cmd}
+}
+
+// aclCategoryBit returns the bit of the named ACL category, or 0.
+func aclCategoryBit(name string) int {
+	for i, category := range aclCategoryNames {
+		if category == name {
+			return 1 << i
+		}
+	}
+	return 0
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(password))
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// check reports why the user may not run args, and on what, or returns ""
+// when it may. args must be a known command with valid arity.
+func (u *aclUser) check(args []string) (reason, object string) {
+	spec := commandTable[strings.ToUpper(args[0])]
+	name, _ := commandName(spec, args)
+	// An unknown subcommand is left to its command to reject.
+	if !u.commands[name] && (spec.subcommands == nil || strings.Contains(name, "|")) {
+		return aclDeniedCommand, name
+	}
+
+	for _, ref := range commandKeys(spec, args) {
+		if !u.keyAllowed(ref.key, ref.perm) {
+			return aclDeniedKey, ref.key
+		}
+	}
+
+	channels, literal := commandChannels(args)
+	for _, channel := range channels {
+		if !u.channelAllowed(channel, literal) {
+			return aclDeniedChannel, channel
+		}
+	}
+	return "", ""
+}
+
+func (u *aclUser) keyAllowed(key string, perm int) bool {
+	for _, p := range u.keys {
+		if p.perm&perm == perm && globMatch(p.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// channelAllowed reports whether the user may use channel. A pattern
+// subscribed to with PSUBSCRIBE must be literally one of the user's.
+func (u *aclUser) channelAllowed(channel string, literal bool) bool {
+	for _, p := range u.channels {
+		if p == "*" || p == channel || (!literal && globMatch(p, channel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// commandChannels returns the channels args publishes or subscribes to, and
+// whether they are patterns, to be matched literally.
+func commandChannels(args []string) ([]string, bool) {
+	switch strings.ToUpper(args[0]) {
+	case RESP_COMMAND_PUBLISH, RESP_COMMAND_SPUBLISH:
+		return args[1:2], false
+	case RESP_COMMAND_SUBSCRIBE, RESP_COMMAND_SSUBSCRIBE:
+		return args[1:], false
+	case RESP_COMMAND_PSUBSCRIBE:
+		return args[1:], true
+	}
+	return nil, false
+}
+
+// describeKeys renders the key patterns of the user as rules.
+func (u *aclUser) describeKeys() string {
+	rules := make([]string, len(u.keys))
+	for i, p := range u.keys {
+		switch p.perm {
+		case keyRead:
+			rules[i] = "%R~" + p.pattern
+		case keyWrite:
+			rules[i] = "%W~" + p.pattern
+		default:
+			rules[i] = "~" + p.pattern
+		}
+	}
+	return strings.Join(rules, " ")
+}
+
+func (u *aclUser) describeChannels() string {
+	rules := make([]string, len(u.channels))
+	for i, channel := range u.channels {
+		rules[i] = "&" + channel
+	}
+	return strings.Join(rules, " ")
+}
+
+// describeCommands renders the command rules of the user, which start from
+// -@all unless they start from +@all.
+func (u *aclUser) describeCommands() string {
+	rules := u.commandRules
+	if len(rules) == 0 || (rules[0] != "+@all" && rules[0] != "-@all") {
+		rules = append([]string{"-@all"}, rules...)
+	}
+	return strings.Join(rules, " ")
+}
+
+// describe renders the user as ACL LIST does and the ACL file stores it.
+func (u *aclUser) describe() string {
+	parts := []string{"user", u.name, "off"}
+	if u.enabled {
+		parts[2] = "on"
+	}
+	if u.nopass {
+		parts = append(parts, "nopass")
+	}
+	for _, p := range u.passwords {
+		parts = append(parts, "#"+p)
+	}
+	if len(u.keys) > 0 {
+		parts = append(parts, u.describeKeys())
+	}
+	if len(u.channels) > 0 {
+		parts = append(parts, u.describeChannels())
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.describeCommands())
+	return strings.Join(parts, " ")
+}
+
+// aclUser returns the registered user called name, or nil.
+func (st *RedisState) aclUser(name string) *aclUser {
+	st.aclMu.RLock()
+	defer st.aclMu.RUnlock()
+	return st.users[name]
+}
+
+// authenticate checks username and password against the ACL users.
+func (st *RedisState) authenticate(username, password string) bool {
+	u := st.aclUser(username)
+	return u != nil && u.enabled && u.checkPassword(password)
+}
+
+// defaultUserNeedsAuth reports whether new connections must authenticate,
+// because the default user they start as is disabled or has a password.
+func (st *RedisState) defaultUserNeedsAuth() bool {
+	u := st.aclUser("default")
+	return u == nil || !u.enabled || !u.nopass
+}
+
+// setDefaultUserPassword makes password the only password of the default
+// user, as setting requirepass does. An empty password means none.
+func (st *RedisState) setDefaultUserPassword(password string) {
+	st.aclMu.Lock()
+	defer st.aclMu.Unlock()
+	u := st.users["default"].clone()
+	u.applyRule("resetpass")
+	if password == "" {
+		u.applyRule("nopass")
+	} else {
+		u.applyRule(">" + password)
+	}
+	st.users["default"] = u
+}
+
+// userName returns the ACL user the connection is authenticated as, or ""
+// for the link to the master, which is not subject to ACLs.
+func (s *RedisServer) userName() string {
+	if s.client == nil {
+		return ""
+	}
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+	return s.client.user
+}
+
+func (s *RedisServer) setUser(name string) {
+	s.client.mu.Lock()
+	s.client.user = name
+	s.client.mu.Unlock()
+	s.authenticated = true
+}
+
+// checkPermissions returns the -NOPERM error to reply with when the user of
+// the connection may not run args, after recording the attempt in ACL LOG,
+// or "" when it may. Unknown commands and wrong arities are left to the
+// command to reject.
+func (s *RedisServer) checkPermissions(args []string) string {
+	name := s.userName()
+	if name == "" || allowedBeforeAuth(strings.ToUpper(args[0])) || checkCommand(args) != "" {
+		return ""
+	}
+
+	u := s.state.aclUser(name)
+	reason, object := aclDeniedCommand, strings.ToLower(args[0])
+	if u != nil {
+		reason, object = u.check(args)
+	}
+	if reason == "" {
+		return ""
+	}
+	s.logACLDenial(reason, object, name)
+
+	switch reason {
+	case aclDeniedKey:
+		return "-NOPERM No permissions to access a key"
+	case aclDeniedChannel:
+		return "-NOPERM No permissions to access a channel"
+	}
+	return "-NOPERM User " + name + " has no permissions to run the '" + object + "' command"
+}
+
+// logACLDenial records in ACL LOG that the connection was denied object for
+// reason, counting it in a recent entry for the same denial if there is
+// one.
+func (s *RedisServer) logACLDenial(reason, object, username string) {
+	context := "toplevel"
+	if s.inScript {
+		context = "lua"
+	} else if s.inExec {
+		context = "multi"
+	}
+	now := time.Now()
+	s.state.channelsMu.RLock()
+	clientInfo := strings.TrimSuffix(s.clientListLine(now), "\n")
+	s.state.channelsMu.RUnlock()
+
+	st := s.state
+	st.aclMu.Lock()
+	defer st.aclMu.Unlock()
+	for i, entry := range st.aclLog {
+		if entry.reason == reason && entry.context == context && entry.object == object &&
+			entry.username == username && now.Sub(entry.updated) < aclLogGrouping {
+			entry.count++
+			entry.updated = now
+			entry.clientInfo = clientInfo
+			copy(st.aclLog[1:i+1], st.aclLog[:i])
+			st.aclLog[0] = entry
+			return
+		}
+	}
+
+	st.aclLogNextID++
+	entry := &aclLogEntry{
+		id:         st.aclLogNextID - 1,
+		count:      1,
+		reason:     reason,
+		context:    context,
+		object:     object,
+		username:   username,
+		clientInfo: clientInfo,
+		created:    now,
+		updated:    now,
+	}
+	st.aclLog = append([]*aclLogEntry{entry}, st.aclLog...)
+	if len(st.aclLog) > aclLogMaxLen {
+		st.aclLog = st.aclLog[:aclLogMaxLen]
+	}
+}
+
+// disconnectUsers disconnects the clients authenticated as users that no
+// longer exist. Only the reading side of the connections is shut down, so
+// that they finish the command they are running, the caller's included.
+func (st *RedisState) disconnectUsers() {
+	st.aclMu.RLock()
+	users := st.users
+	st.aclMu.RUnlock()
+
+	st.clientsMu.Lock()
+	defer st.clientsMu.Unlock()
+	for c := range st.clients {
+		if _, ok := users[c.userName()]; ok {
+			continue
+		}
+		if conn, ok := c.conn.(*net.TCPConn); ok {
+			conn.CloseRead()
+		} else {
+			c.conn.Close()
+		}
+	}
+}
+
+func (s *RedisServer) aclCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("ACL")
+	}
+
+	st := s.state
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "SETUSER" && len(args) >= 3:
+		return st.aclSetUser(args[2], args[3:])
+
+	case sub == "GETUSER" && len(args) == 3:
+		u := st.aclUser(args[2])
+		if u == nil {
+			return CommandResponse{Response: RESP_NULL_ARRAY}
+		}
+		flags := []string{"off"}
+		if u.enabled {
+			flags[0] = "on"
+		}
+		if u.nopass {
+			flags = append(flags, "nopass")
+		}
+		var b strings.Builder
+		b.WriteString("*12\r\n")
+		b.WriteString(toRespStr("flags") + toRespStrArr(flags))
+		b.WriteString(toRespStr("passwords") + toRespStrArr(u.passwords))
+		b.WriteString(toRespStr("commands") + toRespStr(u.describeCommands()))
+		b.WriteString(toRespStr("keys") + toRespStr(u.describeKeys()))
+		b.WriteString(toRespStr("channels") + toRespStr(u.describeChannels()))
+		b.WriteString(toRespStr("selectors") + "*0\r\n")
+		return CommandResponse{Response: b.String()}
+
+	case sub == "DELUSER" && len(args) >= 3:
+		for _, name := range args[2:] {
+			if name == "default" {
+				return CommandResponse{Error: "-ERR The 'default' user cannot be removed"}
+			}
+		}
+		st.aclMu.Lock()
+		deleted := 0
+		for _, name := range args[2:] {
+			if _, ok := st.users[name]; ok {
+				delete(st.users, name)
+				deleted++
+			}
+		}
+		st.aclMu.Unlock()
+		if deleted > 0 {
+			st.disconnectUsers()
+		}
+		return CommandResponse{Response: toRespInt(int64(deleted))}
+
+	case sub == "LIST" && len(args) == 2:
+		users := st.sortedACLUsers()
+		lines := make([]string, len(users))
+		for i, u := range users {
+			lines[i] = u.describe()
+		}
+		return CommandResponse{Response: toRespStrArr(lines)}
+
+	case sub == "USERS" && len(args) == 2:
+		users := st.sortedACLUsers()
+		names := make([]string, len(users))
+		for i, u := range users {
+			names[i] = u.name
+		}
+		return CommandResponse{Response: toRespStrArr(names)}
+
+	case sub == "WHOAMI" && len(args) == 2:
+		return CommandResponse{Response: toRespStr(s.userName())}
+
+	case sub == "CAT" && len(args) <= 3:
+		if len(args) == 2 {
+			return CommandResponse{Response: toRespStrArr(aclCategoryNames)}
+		}
+		bit := aclCategoryBit(strings.ToLower(args[2]))
+		if bit == 0 {
+			return CommandResponse{Error: "-ERR Unknown category '" + args[2] + "'"}
+		}
+		var names []string
+		forEachCommand(func(name string, categories int) {
+			if categories&bit != 0 {
+				names = append(names, name)
+			}
+		})
+		sort.Strings(names)
+		return CommandResponse{Response: toRespStrArr(names)}
+
+	case sub == "LOG" && len(args) <= 3:
+		return st.aclLogCommand(args[2:])
+
+	case sub == "DRYRUN" && len(args) >= 4:
+		u := st.aclUser(args[2])
+		if u == nil {
+			return CommandResponse{Error: "-ERR User '" + args[2] + "' not found"}
+		}
+		command := args[3:]
+		if _, ok := commandTable[strings.ToUpper(command[0])]; !ok {
+			return CommandResponse{Error: "-ERR Command '" + command[0] + "' not found"}
+		}
+		if errMsg := checkCommand(command); errMsg != "" {
+			return CommandResponse{Error: errMsg}
+		}
+		switch reason, object := u.check(command); reason {
+		case aclDeniedCommand:
+			return CommandResponse{Response: toRespStr("User " + u.name + " has no permissions to run the '" + object + "' command")}
+		case aclDeniedKey:
+			return CommandResponse{Response: toRespStr("No permissions to access the '" + object + "' key")}
+		case aclDeniedChannel:
+			return CommandResponse{Response: toRespStr("No permissions to access the '" + object + "' channel")}
+		}
+		return CommandResponse{Response: "+OK\r\n"}
+
+	case sub == "SAVE" && len(args) == 2:
+		path := st.config.aclFile
+		if path == "" {
+			return CommandResponse{Error: RESP_ERR_NO_ACLFILE}
+		}
+		if err := st.saveACLFile(path); err != nil {
+			fmt.Printf("Failed saving the ACL file: %v\n", err)
+			return CommandResponse{Error: "-ERR There was an error trying to save the ACLs. Please check the server logs for more information"}
+		}
+		return CommandResponse{Response: "+OK\r\n"}
+
+	case sub == "LOAD" && len(args) == 2:
+		path := st.config.aclFile
+		if path == "" {
+			return CommandResponse{Error: RESP_ERR_NO_ACLFILE}
+		}
+		if err := st.loadACLFile(path); err != nil {
+			return CommandResponse{Error: "-ERR " + err.Error()}
+		}
+		st.disconnectUsers()
+		return CommandResponse{Response: "+OK\r\n"}
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try ACL HELP."}
+}
+
+// aclSetUser creates or modifies the user called name by applying rules to
+// it, in order. Either all rules apply or the user is left untouched.
+func (st *RedisState) aclSetUser(name string, rules []string) CommandResponse {
+	if strings.ContainsAny(name, " \x00") {
+		return CommandResponse{Error: "-ERR Usernames can't contain spaces or null characters"}
+	}
+
+	st.aclMu.Lock()
+	defer st.aclMu.Unlock()
+	u := newACLUser(name)
+	if existing, ok := st.users[name]; ok {
+		u = existing.clone()
+	}
+	for _, rule := range rules {
+		if reason := u.applyRule(rule); reason != "" {
+			return CommandResponse{Error: "-ERR Error in ACL SETUSER modifier '" + rule + "': " + reason}
+		}
+	}
+	st.users[name] = u
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (st *RedisState) sortedACLUsers() []*aclUser {
+	st.aclMu.RLock()
+	users := make([]*aclUser, 0, len(st.users))
+	for _, u := range st.users {
+		users = append(users, u)
+	}
+	st.aclMu.RUnlock()
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+// aclLogCommand implements ACL LOG [count | RESET].
+func (st *RedisState) aclLogCommand(args []string) CommandResponse {
+	count := 10
+	if len(args) == 1 {
+		if strings.ToUpper(args[0]) == "RESET" {
+			st.aclMu.Lock()
+			st.aclLog = nil
+			st.aclMu.Unlock()
+			return CommandResponse{Response: "+OK\r\n"}
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = n
+	}
+
+	st.aclMu.RLock()
+	defer st.aclMu.RUnlock()
+	entries := st.aclLog
+	if count < len(entries) {
+		entries = entries[:count]
+	}
+
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(entries))
+	for _, entry := range entries {
+		b.WriteString("*20\r\n")
+		b.WriteString(toRespStr("count") + toRespInt(int64(entry.count)))
+		b.WriteString(toRespStr("reason") + toRespStr(entry.reason))
+		b.WriteString(toRespStr("context") + toRespStr(entry.context))
+		b.WriteString(toRespStr("object") + toRespStr(entry.object))
+		b.WriteString(toRespStr("username") + toRespStr(entry.username))
+		age := now.Sub(entry.created).Seconds()
+		b.WriteString(toRespStr("age-seconds") + toRespStr(strconv.FormatFloat(age, 'f', 3, 64)))
+		b.WriteString(toRespStr("client-info") + toRespStr(entry.clientInfo))
+		b.WriteString(toRespStr("entry-id") + toRespInt(entry.id))
+		b.WriteString(toRespStr("timestamp-created") + toRespInt(entry.created.UnixMilli()))
+		b.WriteString(toRespStr("timestamp-last-updated") + toRespInt(entry.updated.UnixMilli()))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+// loadACLFile replaces the users with those of the ACL file at path, one
+// "user <name> <rule> ..." line each. Nothing changes if any line is
+// invalid. The default user is reset to its initial rules unless the file
+// defines it.
+func (st *RedisState) loadACLFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: line should start with user keyword", path, line)
+		}
+		name := fields[1]
+		if _, ok := users[name]; ok {
+			return fmt.Errorf("%s:%d: Duplicate user '%s' found", path, line, name)
+		}
+		u := newACLUser(name)
+		for _, rule := range fields[2:] {
+			if reason := u.applyRule(rule); reason != "" {
+				return fmt.Errorf("%s:%d: Error in user declaration '%s': %s", path, line, rule, reason)
+			}
+		}
+		users[name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"] = newDefaultUser()
+	}
+
+	st.aclMu.Lock()
+	st.users = users
+	st.aclMu.Unlock()
+	return nil
+}
+
+// saveACLFile writes every user to the ACL file at path, atomically.
+func (st *RedisState) saveACLFile(path string) error {
+	var b strings.Builder
+	for _, u := range st.sortedACLUsers() {
+		b.WriteString(u.describe() + "\n")
+	}
+
+	// The file holds password hashes, so only the server's user may read it.
+	return replaceFile(path, fmt.Sprintf("%s.temp-%d", path, os.Getpid()), []byte(b.String()), 0o600)
+}
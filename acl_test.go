@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResetReturnsToDefaultUser(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(okReply, "ACL", "SETUSER", "alice", "on", ">pw", "~app:*", "+get", "+acl|whoami", "+reset")
+	c.expect(okReply, "AUTH", "alice", "pw")
+	c.expect(bulk("alice"), "ACL", "WHOAMI")
+	if got := c.do("SET", "app:1", "v"); !strings.HasPrefix(got, "-NOPERM") {
+		t.Fatalf("alice ran SET: %q", got)
+	}
+
+	c.expect("+RESET\r\n", "RESET")
+	c.expect(bulk("default"), "ACL", "WHOAMI")
+	c.expect(okReply, "SET", "app:1", "v")
+}
+
+func TestResetWithProtectedDefaultUser(t *testing.T) {
+	ts := startTestServer(t, withRequirePass("secret"))
+	c := ts.client(t)
+	c.expect(okReply, "AUTH", "secret")
+	c.expect(okReply, "ACL", "SETUSER", "alice", "on", ">pw", "allkeys", "allcommands")
+	c.expect(okReply, "AUTH", "alice", "pw")
+
+	c.expect("+RESET\r\n", "RESET")
+	c.expect(RESP_ERR_NOAUTH+"\r\n", "ACL", "WHOAMI")
+}
+
+func TestACLSaveIsPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.acl")
+	// A file left readable by an older server is replaced, not rewritten in
+	// place with its old mode.
+	if err := os.WriteFile(path, []byte("user default on nopass ~* &* +@all\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ts := startTestServer(t, func(st *RedisState) { st.config.aclFile = path })
+	c := ts.client(t)
+	c.expect(okReply, "ACL", "SETUSER", "alice", "on", ">pw")
+	c.expect(okReply, "ACL", "SAVE")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("ACL file has mode %o, want 600", mode)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "user alice on #") {
+		t.Errorf("ACL file does not hold alice's password hash:\n%s", data)
+	}
+	if leftovers, _ := filepath.Glob(path + ".temp-*"); len(leftovers) != 0 {
+		t.Errorf("temporary files left behind: %q", leftovers)
+	}
+}
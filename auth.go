@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	RESP_ERR_NOAUTH    string = "-NOAUTH Authentication required."
+	RESP_ERR_WRONGPASS string = "-WRONGPASS invalid username-password pair or user is disabled."
+)
+
+// allowedBeforeAuth reports whether cmd may run on a connection that has not
+// authenticated yet. QUIT is handled before the check.
+func allowedBeforeAuth(cmd string) bool {
+	return cmd == RESP_COMMAND_AUTH || cmd == RESP_COMMAND_HELLO
+}
+
+// login authenticates the connection as username, if password is one of
+// the user's. A failed attempt is recorded in ACL LOG.
+func (s *RedisServer) login(username, password string) bool {
+	if !s.state.authenticate(username, password) {
+		s.logACLDenial(aclDeniedAuth, RESP_COMMAND_AUTH, username)
+		return false
+	}
+	s.setUser(username)
+	return true
+}
+
+func (s *RedisServer) authCommand(args []string) CommandResponse {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("AUTH")
+	}
+
+	username, password := "default", args[1]
+	if len(args) == 3 {
+		username, password = args[1], args[2]
+	} else if !s.state.defaultUserNeedsAuth() {
+		return CommandResponse{Error: "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"}
+	}
+
+	if !s.login(username, password) {
+		return CommandResponse{Error: RESP_ERR_WRONGPASS}
+	}
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+// helloCommand implements HELLO [protover [AUTH username password] [SETNAME
+// clientname]]. Only RESP2 is spoken, so protocol 3 is refused.
+func (s *RedisServer) helloCommand(args []string) CommandResponse {
+	if len(args) > 1 {
+		version, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return CommandResponse{Error: "-ERR Protocol version is not an integer or out of range"}
+		}
+		if version != 2 {
+			return CommandResponse{Error: "-NOPROTO unsupported protocol version"}
+		}
+	}
+
+	var username, password, name string
+	authGiven, nameGiven := false, false
+	for i := 2; i < len(args); i++ {
+		remaining := len(args) - i - 1
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "AUTH" && remaining >= 2:
+			username, password = args[i+1], args[i+2]
+			authGiven = true
+			i += 2
+		case opt == "SETNAME" && remaining >= 1:
+			name = args[i+1]
+			nameGiven = true
+			i++
+		default:
+			return CommandResponse{Error: "-ERR Syntax error in HELLO option '" + args[i] + "'"}
+		}
+	}
+
+	if authGiven {
+		if !s.login(username, password) {
+			return CommandResponse{Error: RESP_ERR_WRONGPASS}
+		}
+	}
+	if !s.authenticated {
+		return CommandResponse{Error: "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"}
+	}
+
+	if nameGiven {
+		if !validClientName(name) {
+			return CommandResponse{Error: "-ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+		s.client.mu.Lock()
+		s.client.name = name
+		s.client.mu.Unlock()
+	}
+
+	role := "master"
+	if !s.state.serverIsMaster {
+		role = "replica"
+	}
+	var b strings.Builder
+	b.WriteString("*14\r\n")
+	b.WriteString(toRespStr("server") + toRespStr("redis"))
+	b.WriteString(toRespStr("version") + toRespStr("7.4.0"))
+	b.WriteString(toRespStr("proto") + toRespInt(2))
+	b.WriteString(toRespStr("id") + toRespInt(s.client.id))
+	b.WriteString(toRespStr("mode") + toRespStr("standalone"))
+	b.WriteString(toRespStr("role") + toRespStr(role))
+	b.WriteString(toRespStr("modules") + "*0\r\n")
+	return CommandResponse{Response: b.String()}
+}
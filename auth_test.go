@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+// withRequirePass sets requirepass, as the command line flag does.
+func withRequirePass(password string) func(st *RedisState) {
+	return func(st *RedisState) {
+		st.config.requirepass.Store(password)
+		st.setDefaultUserPassword(password)
+	}
+}
+
+func TestResetDeauthenticates(t *testing.T) {
+	ts := startTestServer(t, withRequirePass("secret"))
+	c := ts.client(t)
+	c.expect(RESP_ERR_NOAUTH+"\r\n", "SET", "k", "v")
+	c.expect(okReply, "AUTH", "secret")
+	c.expect(okReply, "SET", "k", "v")
+
+	c.expect("+RESET\r\n", "RESET")
+	c.expect(RESP_ERR_NOAUTH+"\r\n", "GET", "k")
+	c.expect(okReply, "AUTH", "secret")
+	c.expect(bulk("v"), "GET", "k")
+}
+
+func TestResetWithoutRequirePassStaysAuthenticated(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect("+RESET\r\n", "RESET")
+	c.expect(okReply, "SET", "k", "v")
+}
+
+func TestAuthErrors(t *testing.T) {
+	ts := startTestServer(t, withRequirePass("secret"))
+	c := ts.client(t)
+	c.expect(RESP_ERR_WRONGPASS+"\r\n", "AUTH", "wrong")
+	c.expect(RESP_ERR_WRONGPASS+"\r\n", "AUTH", "nobody", "secret")
+	c.expect("-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n", "HELLO", "2")
+	c.expect("-NOPROTO unsupported protocol version\r\n", "HELLO", "3")
+
+	other := ts.client(t)
+	other.expect(okReply, "AUTH", "default", "secret")
+	other.expect("+PONG\r\n", "PING")
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBitOffset is the largest bit offset a string of maxStringLength bytes
+// can hold.
+const maxBitOffset = maxStringLength*8 - 1
+
+// parseBitOffset parses the offset of SETBIT and GETBIT.
+func parseBitOffset(arg string) (uint64, bool) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 || n > maxBitOffset {
+		return 0, false
+	}
+	return uint64(n), true
+}
+
+// bitmapAt returns the string at key as a []byte to be modified in place,
+// converting it to the raw encoding and zero-padding it to size bytes. A
+// missing key yields a new string, which the caller stores with storeBitmap.
+func (st *RedisState) bitmapAt(key string, size int) (buf []byte, value storageVal, wrongType bool) {
+	value, exists := st.lookupKey(key)
+	if !exists {
+		value = newStorageVal([]byte(nil), time.Time{})
+	}
+	buf, ok := mutableString(value.val)
+	if !ok {
+		return nil, value, true
+	}
+	return growString(buf, size), value, false
+}
+
+func (st *RedisState) storeBitmap(key string, value storageVal, buf []byte) {
+	value.val = buf
+	st.storage[key] = value
+}
+
+func getBit(buf []byte, offset uint64) int {
+	byteIdx := offset >> 3
+	if byteIdx >= uint64(len(buf)) {
+		return 0
+	}
+	return int(buf[byteIdx]>>(7-offset&7)) & 1
+}
+
+func (s *RedisServer) setbitCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("SETBIT")
+	}
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return CommandResponse{Error: "-ERR bit offset is not an integer or out of range"}
+	}
+	if args[3] != "0" && args[3] != "1" {
+		return CommandResponse{Error: "-ERR bit is not an integer or out of range"}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	buf, value, wrongType := s.state.bitmapAt(args[1], int(offset>>3)+1)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	old := getBit(buf, offset)
+	mask := byte(1) << (7 - offset&7)
+	if args[3] == "1" {
+		buf[offset>>3] |= mask
+	} else {
+		buf[offset>>3] &^= mask
+	}
+	s.state.storeBitmap(args[1], value, buf)
+	s.state.keyModified(notifyString, "setbit", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(old))}
+}
+
+func (s *RedisServer) getbitCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("GETBIT")
+	}
+	offset, ok := parseBitOffset(args[2])
+	if !ok {
+		return CommandResponse{Error: "-ERR bit offset is not an integer or out of range"}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	value, exists := s.state.lookupKey(args[1])
+	if !exists {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	switch v := value.val.(type) {
+	case []byte:
+		return CommandResponse{Response: toRespInt(int64(getBit(v, offset)))}
+	}
+	str, ok := valueString(value.val)
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	return CommandResponse{Response: toRespInt(int64(getBit([]byte(str), offset)))}
+}
+
+// bitRange resolves the optional "start end [BYTE|BIT]" arguments of BITCOUNT
+// and BITPOS against a string of strLen bytes, returning the inclusive bit
+// range they cover. empty is set when the range selects nothing.
+func bitRange(args []string, strLen int) (first, last int64, empty bool, errResp string) {
+	start, err1 := strconv.ParseInt(args[0], 10, 64)
+	end := int64(math.MaxInt64)
+	var err2 error
+	if len(args) > 1 {
+		end, err2 = strconv.ParseInt(args[1], 10, 64)
+	}
+	if err1 != nil || err2 != nil {
+		return 0, 0, false, RESP_ERR_NOT_INTEGER
+	}
+	isBit := false
+	if len(args) > 2 {
+		switch strings.ToUpper(args[2]) {
+		case "BYTE":
+		case "BIT":
+			isBit = true
+		default:
+			return 0, 0, false, RESP_ERR_SYNTAX
+		}
+	}
+
+	total := int64(strLen)
+	if isBit {
+		total *= 8
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	start, end = max(start, 0), max(end, 0)
+	end = min(end, total-1)
+	if start > end {
+		return 0, 0, true, ""
+	}
+	if isBit {
+		return start, end, false, ""
+	}
+	return start * 8, end*8 + 7, false, ""
+}
+
+// countBits counts the set bits of buf between the bit offsets first and last
+// inclusive.
+func countBits(buf []byte, first, last int64) int64 {
+	firstByte, lastByte := first>>3, last>>3
+	count := 0
+	for i := firstByte; i <= lastByte; i++ {
+		b := buf[i]
+		if i == firstByte {
+			b &= 0xFF >> (first & 7)
+		}
+		if i == lastByte {
+			b &= 0xFF << (7 - last&7)
+		}
+		count += bits.OnesCount8(b)
+	}
+	return int64(count)
+}
+
+func (s *RedisServer) bitcountCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("BITCOUNT")
+	}
+	if len(args) == 3 || len(args) > 5 {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	buf, found, wrongType := s.state.bitmapBytes(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	first, last := int64(0), int64(len(buf))*8-1
+	if len(args) > 2 {
+		var empty bool
+		var errResp string
+		first, last, empty, errResp = bitRange(args[2:], len(buf))
+		if errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		if empty {
+			return CommandResponse{Response: ":0\r\n"}
+		}
+	}
+	if !found || len(buf) == 0 {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(countBits(buf, first, last))}
+}
+
+// bitmapBytes returns the bytes of the string at key for reading. Only the
+// raw encoding is returned without a copy.
+func (st *RedisState) bitmapBytes(key string) (buf []byte, found bool, wrongType bool) {
+	value, exists := st.lookupKey(key)
+	if !exists {
+		return nil, false, false
+	}
+	if v, ok := value.val.([]byte); ok {
+		return v, true, false
+	}
+	str, ok := valueString(value.val)
+	if !ok {
+		return nil, true, true
+	}
+	return []byte(str), true, false
+}
+
+func (s *RedisServer) bitposCommand(args []string) CommandResponse {
+	if len(args) < 3 || len(args) > 6 {
+		return wrongArgsError("BITPOS")
+	}
+	bit, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+	if bit != 0 && bit != 1 {
+		return CommandResponse{Error: "-ERR The bit argument must be 1 or 0."}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	buf, found, wrongType := s.state.bitmapBytes(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	first, last := int64(0), int64(len(buf))*8-1
+	if len(args) > 3 {
+		var empty bool
+		var errResp string
+		first, last, empty, errResp = bitRange(args[3:], len(buf))
+		if errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		if empty {
+			return CommandResponse{Response: ":-1\r\n"}
+		}
+	}
+	if !found {
+		// A missing key is an endless run of clear bits.
+		if bit == 1 {
+			return CommandResponse{Response: ":-1\r\n"}
+		}
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	// Whole bytes holding none of the wanted bit are skipped at once.
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xFF
+	}
+	for i := first; i <= last; i++ {
+		if i&7 == 0 && i+7 <= last && buf[i>>3] == skip {
+			i += 7
+			continue
+		}
+		if int64(getBit(buf, uint64(i))) == bit {
+			return CommandResponse{Response: toRespInt(i)}
+		}
+	}
+
+	// Looking for a clear bit without an explicit end, the string counts as
+	// padded with zeros to the right.
+	if bit == 0 && len(args) < 5 {
+		return CommandResponse{Response: toRespInt(last + 1)}
+	}
+	return CommandResponse{Response: ":-1\r\n"}
+}
+
+func (s *RedisServer) bitopCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("BITOP")
+	}
+	op := strings.ToUpper(args[1])
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(args) != 4 {
+			return CommandResponse{Error: "-ERR BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+	dest, keys := args[2], args[3:]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	sources := make([][]byte, len(keys))
+	maxLen := 0
+	for i, key := range keys {
+		buf, _, wrongType := s.state.bitmapBytes(key)
+		if wrongType {
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		sources[i] = buf
+		maxLen = max(maxLen, len(buf))
+	}
+
+	// Shorter strings count as padded with zero bytes.
+	result := make([]byte, maxLen)
+	for j := range result {
+		byteAt := func(src []byte) byte {
+			if j < len(src) {
+				return src[j]
+			}
+			return 0
+		}
+		acc := byteAt(sources[0])
+		for _, src := range sources[1:] {
+			switch op {
+			case "AND":
+				acc &= byteAt(src)
+			case "OR":
+				acc |= byteAt(src)
+			case "XOR":
+				acc ^= byteAt(src)
+			}
+		}
+		if op == "NOT" {
+			acc = ^acc
+		}
+		result[j] = acc
+	}
+
+	if maxLen == 0 {
+		s.state.deleteKey(dest)
+	} else {
+		s.state.storage[dest] = newStorageVal(result, time.Time{})
+		s.state.keyModified(notifyString, "set", dest)
+	}
+	s.state.propagate(args)
+	return CommandResponse{Response: toRespInt(int64(maxLen))}
+}
+
+// Overflow behaviours of BITFIELD SET and INCRBY.
+const (
+	bitfieldWrap = iota
+	bitfieldSat
+	bitfieldFail
+)
+
+type bitfieldOp struct {
+	op       string // GET, SET or INCRBY
+	signed   bool
+	bits     uint
+	offset   uint64
+	arg      int64
+	overflow int
+}
+
+// parseBitfieldType parses a type such as i16 or u8. Unsigned fields go up
+// to 63 bits, so every value fits an int64 reply.
+func parseBitfieldType(arg string) (signed bool, width uint, ok bool) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'u' && arg[0] != 'I' && arg[0] != 'U') {
+		return false, 0, false
+	}
+	signed = arg[0] == 'i' || arg[0] == 'I'
+	n, err := strconv.Atoi(arg[1:])
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, false
+	}
+	return signed, uint(n), true
+}
+
+// parseBitfieldOffset parses an offset in bits, or in multiples of the field
+// width when prefixed with "#".
+func parseBitfieldOffset(arg string, width uint) (uint64, bool) {
+	multiply := strings.HasPrefix(arg, "#")
+	n, err := strconv.ParseInt(strings.TrimPrefix(arg, "#"), 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	if multiply {
+		if n > maxBitOffset/int64(width) {
+			return 0, false
+		}
+		n *= int64(width)
+	}
+	if n > maxBitOffset-int64(width)+1 {
+		return 0, false
+	}
+	return uint64(n), true
+}
+
+func parseBitfieldOps(args []string, readOnly bool) ([]bitfieldOp, string) {
+	var ops []bitfieldOp
+	overflow := bitfieldWrap
+	for i := 0; i < len(args); i++ {
+		sub := strings.ToUpper(args[i])
+		moreArgs := len(args) - i - 1
+		switch {
+		case sub == "OVERFLOW" && moreArgs >= 1:
+			switch strings.ToUpper(args[i+1]) {
+			case "WRAP":
+				overflow = bitfieldWrap
+			case "SAT":
+				overflow = bitfieldSat
+			case "FAIL":
+				overflow = bitfieldFail
+			default:
+				return nil, "-ERR Invalid OVERFLOW type specified"
+			}
+			i++
+			continue
+		case sub == "GET" && moreArgs >= 2:
+		case (sub == "SET" || sub == "INCRBY") && moreArgs >= 3:
+			if readOnly {
+				return nil, "-ERR BITFIELD_RO only supports the GET subcommand"
+			}
+		default:
+			return nil, RESP_ERR_SYNTAX
+		}
+
+		signed, width, ok := parseBitfieldType(args[i+1])
+		if !ok {
+			return nil, "-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is."
+		}
+		offset, ok := parseBitfieldOffset(args[i+2], width)
+		if !ok {
+			return nil, "-ERR bit offset is not an integer or out of range"
+		}
+		op := bitfieldOp{op: sub, signed: signed, bits: width, offset: offset, overflow: overflow}
+		i += 2
+		if sub != "GET" {
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return nil, RESP_ERR_NOT_INTEGER
+			}
+			op.arg = n
+			i++
+		}
+		ops = append(ops, op)
+	}
+	return ops, ""
+}
+
+// readBitfield reads width bits at offset as an unsigned number; bits past
+// the end of buf read as zero.
+func readBitfield(buf []byte, offset uint64, width uint) uint64 {
+	var v uint64
+	for i := uint64(0); i < uint64(width); i++ {
+		v = v<<1 | uint64(getBit(buf, offset+i))
+	}
+	return v
+}
+
+func writeBitfield(buf []byte, offset uint64, width uint, v uint64) {
+	for i := uint64(0); i < uint64(width); i++ {
+		pos := offset + i
+		mask := byte(1) << (7 - pos&7)
+		if v>>(uint64(width)-1-i)&1 == 1 {
+			buf[pos>>3] |= mask
+		} else {
+			buf[pos>>3] &^= mask
+		}
+	}
+}
+
+// bitfieldValue reads a field, sign-extending it when signed.
+func bitfieldValue(buf []byte, op bitfieldOp) int64 {
+	v := readBitfield(buf, op.offset, op.bits)
+	if op.signed && op.bits < 64 && v&(1<<(op.bits-1)) != 0 {
+		v |= math.MaxUint64 << op.bits
+	}
+	return int64(v)
+}
+
+// bitfieldAdd adds incr to value in a field of the given width and
+// signedness, applying the overflow behaviour. ok is false when the result
+// overflows under FAIL. This follows Redis' checkSignedBitfieldOverflow and
+// checkUnsignedBitfieldOverflow.
+func bitfieldAdd(value, incr int64, signed bool, width uint, overflow int) (result int64, ok bool) {
+	if signed {
+		maxV := int64(math.MaxInt64)
+		if width < 64 {
+			maxV = 1<<(width-1) - 1
+		}
+		minV := -maxV - 1
+		maxIncr, minIncr := maxV-value, minV-value
+
+		var limit int64
+		switch {
+		case value > maxV || (width != 64 && incr > maxIncr) || (value >= 0 && incr > 0 && incr > maxIncr):
+			limit = maxV
+		case value < minV || (width != 64 && incr < minIncr) || (value < 0 && incr < 0 && incr < minIncr):
+			limit = minV
+		default:
+			return value + incr, true
+		}
+		switch overflow {
+		case bitfieldSat:
+			return limit, true
+		case bitfieldFail:
+			return 0, false
+		}
+		// Wrap: add as unsigned, then sign-extend from the field width.
+		c := uint64(value) + uint64(incr)
+		if width < 64 {
+			mask := uint64(math.MaxUint64) << width
+			if c&(1<<(width-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		return int64(c), true
+	}
+
+	maxV := uint64(1)<<width - 1
+	uvalue := uint64(value)
+	maxIncr, minIncr := int64(maxV-uvalue), -value
+
+	var limit uint64
+	switch {
+	case uvalue > maxV || (incr > 0 && incr > maxIncr):
+		limit = maxV
+	case incr < 0 && incr < minIncr:
+		limit = 0
+	default:
+		return value + incr, true
+	}
+	switch overflow {
+	case bitfieldSat:
+		return int64(limit), true
+	case bitfieldFail:
+		return 0, false
+	}
+	return int64((uvalue + uint64(incr)) &^ (math.MaxUint64 << width)), true
+}
+
+// bitfieldCommand backs BITFIELD and, with readOnly set, BITFIELD_RO.
+func (s *RedisServer) bitfieldCommand(args []string, readOnly bool) CommandResponse {
+	name := "BITFIELD"
+	if readOnly {
+		name = "BITFIELD_RO"
+	}
+	if len(args) < 2 {
+		return wrongArgsError(name)
+	}
+	key := args[1]
+	ops, errResp := parseBitfieldOps(args[2:], readOnly)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	// Writes grow the string up front to fit the furthest field written.
+	size := 0
+	for _, op := range ops {
+		if op.op != "GET" {
+			size = max(size, int((op.offset+uint64(op.bits)-1)>>3)+1)
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	var buf []byte
+	var value storageVal
+	var wrongType bool
+	if size > 0 {
+		buf, value, wrongType = s.state.bitmapAt(key, size)
+	} else {
+		buf, _, wrongType = s.state.bitmapBytes(key)
+	}
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(ops)) + "\r\n")
+	for _, op := range ops {
+		current := bitfieldValue(buf, op)
+		if op.op == "GET" {
+			b.WriteString(toRespInt(current))
+			continue
+		}
+
+		var result int64
+		ok := true
+		if op.op == "SET" {
+			// Setting is adding the new value to nothing, so it overflows
+			// the same way.
+			result, ok = bitfieldAdd(op.arg, 0, op.signed, op.bits, op.overflow)
+		} else {
+			result, ok = bitfieldAdd(current, op.arg, op.signed, op.bits, op.overflow)
+		}
+		if !ok {
+			b.WriteString(RESP_NULL_BULK)
+			continue
+		}
+		writeBitfield(buf, op.offset, op.bits, uint64(result))
+		if op.op == "SET" {
+			b.WriteString(toRespInt(current))
+		} else {
+			b.WriteString(toRespInt(result))
+		}
+	}
+
+	if size > 0 {
+		s.state.storeBitmap(key, value, buf)
+		s.state.keyModified(notifyString, "setbit", key)
+		s.state.propagate(args)
+	}
+	return CommandResponse{Response: b.String()}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a connection parked in a blocking command until one of its
+// keys can serve it or its timeout fires.
+type blockedClient struct {
+	keys []string
+	// serve tries to complete the command against key. It runs with
+	// storageMu held and reports whether the client was served.
+	serve func(key string) (CommandResponse, bool)
+	reply chan CommandResponse
+}
+
+// parseBlockTimeout parses the timeout argument of a blocking command, given
+// in seconds with an optional fractional part. Zero means block forever.
+func parseBlockTimeout(arg string) (time.Duration, string) {
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) || secs > math.MaxInt64/float64(time.Second) {
+		return 0, "-ERR timeout is not a float or out of range"
+	}
+	if secs < 0 {
+		return 0, "-ERR timeout is negative"
+	}
+	return time.Duration(secs * float64(time.Second)), ""
+}
+
+// parseBlockMillis parses a BLOCK option given in whole milliseconds, as the
+// stream commands take it. Zero means block forever.
+func parseBlockMillis(arg string) (time.Duration, string) {
+	ms, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, "-ERR timeout is not an integer or out of range"
+	}
+	if ms < 0 {
+		return 0, "-ERR timeout is negative"
+	}
+	return time.Duration(ms) * time.Millisecond, ""
+}
+
+// blockClient queues a new waiter on every key, behind the clients that
+// blocked earlier. The caller must hold storageMu for writing.
+func (st *RedisState) blockClient(keys []string, serve func(key string) (CommandResponse, bool)) *blockedClient {
+	client := &blockedClient{keys: keys, serve: serve, reply: make(chan CommandResponse, 1)}
+	for _, key := range keys {
+		st.blocked[key] = append(st.blocked[key], client)
+	}
+	return client
+}
+
+// unblockClient removes client from every key it waits on. The caller must
+// hold storageMu for writing.
+func (st *RedisState) unblockClient(client *blockedClient) {
+	for _, key := range client.keys {
+		waiters := st.blocked[key]
+		for i, c := range waiters {
+			if c == client {
+				waiters = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(waiters) == 0 {
+			delete(st.blocked, key)
+		} else {
+			st.blocked[key] = waiters
+		}
+	}
+}
+
+// signalKeyReady records that key received data which may unblock waiters.
+// They are served by serveBlockedClients once the current command (or the
+// whole transaction) has finished. The caller must hold storageMu.
+func (st *RedisState) signalKeyReady(key string) {
+	if len(st.blocked[key]) == 0 {
+		return
+	}
+	for _, k := range st.readyKeys {
+		if k == key {
+			return
+		}
+	}
+	st.readyKeys = append(st.readyKeys, key)
+	st.hasReadyKeys.Store(true)
+}
+
+// serveBlockedClients hands the data pushed to ready keys to the clients
+// blocked on them, oldest waiter first. A waiter that cannot be served (the
+// key ran dry, or holds a type it does not pop) is skipped, so list and
+// sorted set waiters on the same key do not hold each other up. Serving a
+// client can make further keys ready (BLMOVE pushes into its destination),
+// so it loops until no ready keys remain.
+func (st *RedisState) serveBlockedClients() {
+	if !st.hasReadyKeys.Load() {
+		return
+	}
+
+	st.storageMu.Lock()
+	defer st.storageMu.Unlock()
+
+	for len(st.readyKeys) > 0 {
+		keys := st.readyKeys
+		st.readyKeys = nil
+
+		for _, key := range keys {
+			waiters := append([]*blockedClient(nil), st.blocked[key]...)
+			for _, client := range waiters {
+				resp, served := client.serve(key)
+				if !served {
+					continue
+				}
+				st.unblockClient(client)
+				client.reply <- resp
+			}
+		}
+	}
+	st.hasReadyKeys.Store(false)
+}
+
+// waitBlocked parks the calling connection until client is served or timeout
+// elapses, returning timeoutResp in the latter case. storageMu must not be
+// held, so other connections can keep pushing while this one waits. If the
+// peer disconnects meanwhile the client is unblocked with an empty reply, so
+// no data is handed to a dead socket.
+func (s *RedisServer) waitBlocked(client *blockedClient, timeout time.Duration, timeoutResp string) CommandResponse {
+	// The command runs under txMu for reading, which must not be held while
+	// parked or a transaction could never start.
+	s.state.txMu.RUnlock()
+	defer s.state.txMu.RLock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	gone, stop := s.watchDisconnect()
+	defer stop()
+
+	select {
+	case resp := <-client.reply:
+		return resp
+	case <-expired:
+	case <-gone:
+		timeoutResp = ""
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	// A push may have served the client while the lock was being taken.
+	select {
+	case resp := <-client.reply:
+		return resp
+	default:
+	}
+	s.state.unblockClient(client)
+	return CommandResponse{Response: timeoutResp}
+}
+
+// watchDisconnect closes gone when the peer hangs up while the connection is
+// parked. The read loop is idle meanwhile, so a goroutine can peek at the
+// buffered reader; pipelined commands stay buffered for the loop to read.
+// stop interrupts the peek and must be called before the loop resumes.
+func (s *RedisServer) watchDisconnect() (gone <-chan struct{}, stop func()) {
+	if s.reader == nil {
+		return nil, func() {}
+	}
+
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := s.reader.Peek(1)
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			close(closed)
+		}
+	}()
+
+	return closed, func() {
+		s.conn.SetReadDeadline(time.Now())
+		<-done
+		s.conn.SetReadDeadline(time.Time{})
+	}
+}
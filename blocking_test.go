@@ -0,0 +1,176 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockingMoveInsideMulti(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	// Nothing can push while EXEC runs, so a missing source replies as a
+	// timeout would, rather than block.
+	runSteps(t, c, []testStep{
+		{cmd("MULTI"), okReply},
+		{cmd("BLMOVE", "missing", "dst", "LEFT", "RIGHT", "0"), queuedReply},
+		{cmd("BRPOPLPUSH", "missing", "dst", "0"), queuedReply},
+		{cmd("RPUSH", "src", "a", "b"), queuedReply},
+		{cmd("BLMOVE", "src", "dst", "LEFT", "RIGHT", "0"), queuedReply},
+		{cmd("BRPOPLPUSH", "src", "dst", "0"), queuedReply},
+		{cmd("EXEC"), array(nilArrayReply, nilArrayReply, integer(2), bulk("a"), bulk("b"))},
+		{cmd("LRANGE", "dst", "0", "-1"), bulks("b", "a")},
+		{cmd("TYPE", "src"), "+none\r\n"},
+	})
+}
+
+// waitForBlocked waits until n clients are blocked on key.
+func waitForBlocked(t *testing.T, ts *testServer, key string, n int) {
+	t.Helper()
+	ok := eventually(t, 5*time.Second, func() bool {
+		ts.state.storageMu.RLock()
+		defer ts.state.storageMu.RUnlock()
+		return len(ts.state.blocked[key]) == n
+	})
+	if !ok {
+		t.Fatalf("%d clients never blocked on %s", n, key)
+	}
+}
+
+func TestBlockingPopServesImmediately(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("RPUSH", "b", "1", "2", "3"), integer(3)},
+		{cmd("BLPOP", "a", "b", "0"), bulks("b", "1")},
+		{cmd("BRPOP", "a", "b", "0"), bulks("b", "3")},
+		{cmd("BLMPOP", "0", "2", "a", "b", "LEFT", "COUNT", "5"), array(bulk("b"), bulks("2"))},
+		{cmd("SET", "s", "v"), okReply},
+		{cmd("BLPOP", "s", "0"), errorReply(RESP_ERR_WRONGTYPE)},
+		{cmd("BLPOP", "a", "-1"), errorReply("-ERR timeout is negative")},
+		{cmd("BLPOP", "a", "soon"), errorReply("-ERR timeout is not a float or out of range")},
+		{cmd("BLMPOP", "0", "0", "a", "LEFT"), errorReply("-ERR numkeys should be greater than 0")},
+	})
+}
+
+func TestBlockingPopTimesOut(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  []string
+	}{
+		{"BLPOP", cmd("BLPOP", "a", "b", "0.1")},
+		{"BRPOP", cmd("BRPOP", "a", "0.1")},
+		{"BLMOVE", cmd("BLMOVE", "a", "b", "LEFT", "LEFT", "0.1")},
+		{"BRPOPLPUSH", cmd("BRPOPLPUSH", "a", "b", "0.1")},
+		{"BLMPOP", cmd("BLMPOP", "0.1", "1", "a", "RIGHT")},
+	}
+	ts := startTestServer(t, nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ts.client(t)
+			start := time.Now()
+			c.expect(nilArrayReply, tt.cmd...)
+			if waited := time.Since(start); waited < 100*time.Millisecond || waited > 2*time.Second {
+				t.Errorf("timed out after %v", waited)
+			}
+			waitForBlocked(t, ts, "a", 0)
+		})
+	}
+}
+
+func TestBlockingPopWakesInFIFOOrder(t *testing.T) {
+	ts := startTestServer(t, nil)
+	first, second, third := ts.client(t), ts.client(t), ts.client(t)
+	first.send("BLPOP", "q", "0")
+	waitForBlocked(t, ts, "q", 1)
+	second.send("BRPOP", "other", "q", "0")
+	waitForBlocked(t, ts, "q", 2)
+	third.send("BLPOP", "q", "0")
+	waitForBlocked(t, ts, "q", 3)
+
+	// Blocked clients do not hold the keyspace: others keep running
+	// commands meanwhile.
+	c := ts.client(t)
+	c.expect(okReply, "SET", "k", "v")
+	c.expect(integer(2), "RPUSH", "q", "x", "y")
+
+	if got, want := first.read(), bulks("q", "x"); got != want {
+		t.Errorf("first waiter got %q, want %q", got, want)
+	}
+	if got, want := second.read(), bulks("q", "y"); got != want {
+		t.Errorf("second waiter got %q, want %q", got, want)
+	}
+	if reply, err := third.readWithin(100 * time.Millisecond); err == nil {
+		t.Errorf("third waiter got %q with the list empty", reply)
+	}
+	c.expect(integer(1), "LPUSH", "q", "z")
+	if got, want := third.read(), bulks("q", "z"); got != want {
+		t.Errorf("third waiter got %q, want %q", got, want)
+	}
+	c.expect(integer(0), "LLEN", "q")
+}
+
+func TestBlockingPopOnSeveralKeys(t *testing.T) {
+	ts := startTestServer(t, nil)
+	waiter := ts.client(t)
+	waiter.send("BLMPOP", "0", "3", "a", "b", "c", "RIGHT", "COUNT", "2")
+	waitForBlocked(t, ts, "c", 1)
+
+	c := ts.client(t)
+	c.expect(integer(3), "RPUSH", "c", "1", "2", "3")
+	if got, want := waiter.read(), array(bulk("c"), bulks("3", "2")); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Served, it waits on none of its keys any more.
+	for _, key := range []string{"a", "b", "c"} {
+		waitForBlocked(t, ts, key, 0)
+	}
+}
+
+func TestBlockingMoveWakesOnPush(t *testing.T) {
+	ts := startTestServer(t, nil)
+	mover, popper := ts.client(t), ts.client(t)
+	mover.send("BLMOVE", "src", "dst", "RIGHT", "LEFT", "0")
+	waitForBlocked(t, ts, "src", 1)
+	// The element BLMOVE pushes to dst wakes whoever waits there.
+	popper.send("BRPOPLPUSH", "dst", "final", "0")
+	waitForBlocked(t, ts, "dst", 1)
+
+	c := ts.client(t)
+	c.expect(integer(1), "RPUSH", "src", "job")
+	if got := mover.read(); got != bulk("job") {
+		t.Errorf("BLMOVE got %q", got)
+	}
+	if got := popper.read(); got != bulk("job") {
+		t.Errorf("BRPOPLPUSH got %q", got)
+	}
+	c.expect(bulks("job"), "LRANGE", "final", "0", "-1")
+	c.expect(integer(0), "LLEN", "dst")
+}
+
+func TestBlockingPopInsideMulti(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("MULTI"), okReply},
+		{cmd("BLPOP", "q", "0"), queuedReply},
+		{cmd("BLMPOP", "0", "1", "q", "LEFT"), queuedReply},
+		{cmd("RPUSH", "q", "x"), queuedReply},
+		{cmd("BRPOP", "q", "0"), queuedReply},
+		{cmd("EXEC"), array(nilArrayReply, nilArrayReply, integer(1), bulks("q", "x"))},
+	})
+}
+
+func TestBlockedClientDisconnecting(t *testing.T) {
+	ts := startTestServer(t, nil)
+	gone := ts.client(t)
+	gone.send("BLPOP", "q", "0")
+	waitForBlocked(t, ts, "q", 1)
+	gone.conn.Close()
+	waitForBlocked(t, ts, "q", 0)
+
+	// The element is kept for the next reader rather than handed to the
+	// dead connection.
+	c := ts.client(t)
+	c.expect(integer(1), "RPUSH", "q", "x")
+	c.expect(bulks("q", "x"), "BLPOP", "q", "0")
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clientInfo is what CLIENT LIST reports about a connection. The connection's
+// own goroutine updates it as it runs commands while others read it, so the
+// mutable fields are guarded by mu.
+type clientInfo struct {
+	id        int64
+	createdAt time.Time
+
+	mu   sync.Mutex
+	name string
+	// user is the ACL user the connection is authenticated as.
+	user       string
+	lastActive time.Time
+	lastCmd    string
+	// multi is the number of queued commands inside MULTI, or -1.
+	multi int
+}
+
+// registerClient assigns the connection an ID and adds it to the client list.
+func (st *RedisState) registerClient(s *RedisServer) {
+	now := time.Now()
+	s.client = &clientInfo{
+		id:         st.nextClientID.Add(1),
+		createdAt:  now,
+		lastActive: now,
+		lastCmd:    "NULL",
+		user:       "default",
+		multi:      -1,
+	}
+	st.clientsMu.Lock()
+	st.clients[s] = struct{}{}
+	st.clientsMu.Unlock()
+}
+
+func (st *RedisState) unregisterClient(s *RedisServer) {
+	st.clientsMu.Lock()
+	delete(st.clients, s)
+	st.clientsMu.Unlock()
+}
+
+// closeClient releases what a disconnecting client holds in the shared
+// state: its transaction and watched keys, its subscriptions and its client
+// list entry.
+// Blocked commands unregister themselves once waitBlocked notices the peer
+// hung up.
+func (s *RedisServer) closeClient() {
+	s.discardTransaction()
+	s.unwatchAll()
+	s.state.removePubsubClient(s.pubsub)
+	s.state.unregisterClient(s)
+}
+
+// resetClient returns the connection to the state of a fresh one, as RESET
+// does. The client keeps its ID, name and output queue, but goes back to the
+// default user, and is no longer authenticated if that user needs a
+// password.
+func (s *RedisServer) resetClient() {
+	s.discardTransaction()
+	s.unwatchAll()
+	if s.pubsub != nil {
+		s.state.unsubscribeAll(s.pubsub)
+	}
+	s.SubscribedMode = false
+	if s.client != nil {
+		s.setUser("default")
+	}
+	s.authenticated = !s.state.defaultUserNeedsAuth()
+}
+
+// discardTransaction leaves MULTI, dropping the queued commands.
+func (s *RedisServer) discardTransaction() {
+	s.MultiOn = false
+	s.multiQueue = nil
+	s.multiFailed = false
+}
+
+// touchClient records that the connection is running cmd.
+func (s *RedisServer) touchClient(args []string) {
+	if s.client == nil {
+		return
+	}
+	cmd := strings.ToLower(args[0])
+	if len(args) > 1 && (cmd == "client" || cmd == "config" || cmd == "pubsub" || cmd == "object" || cmd == "xinfo" || cmd == "xgroup" || cmd == "script" || cmd == "function" || cmd == "acl") {
+		cmd += "|" + strings.ToLower(args[1])
+	}
+
+	s.client.mu.Lock()
+	defer s.client.mu.Unlock()
+	s.client.lastActive = time.Now()
+	s.client.lastCmd = cmd
+	s.client.multi = -1
+	if s.MultiOn {
+		s.client.multi = len(s.multiQueue)
+	}
+}
+
+// clientListLine renders a connection the way CLIENT LIST does. The caller
+// must hold channelsMu for reading, as the subscription counts live in the
+// pub/sub registry.
+func (s *RedisServer) clientListLine(now time.Time) string {
+	sub, psub, ssub := 0, 0, 0
+	if s.pubsub != nil {
+		sub = len(s.pubsub.subs[pubsubChannel])
+		psub = len(s.pubsub.subs[pubsubPattern])
+		ssub = len(s.pubsub.subs[pubsubShard])
+	}
+
+	c := s.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flags := ""
+	if sub+psub+ssub > 0 {
+		flags += "P"
+	}
+	if c.multi >= 0 {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	fields := []string{
+		"id=" + strconv.FormatInt(c.id, 10),
+		"addr=" + s.conn.RemoteAddr().String(),
+		"laddr=" + s.conn.LocalAddr().String(),
+		"name=" + c.name,
+		"age=" + strconv.Itoa(int(now.Sub(c.createdAt)/time.Second)),
+		"idle=" + strconv.Itoa(int(now.Sub(c.lastActive)/time.Second)),
+		"flags=" + flags,
+		"db=0",
+		"sub=" + strconv.Itoa(sub),
+		"psub=" + strconv.Itoa(psub),
+		"ssub=" + strconv.Itoa(ssub),
+		"multi=" + strconv.Itoa(c.multi),
+		"cmd=" + c.lastCmd,
+		"user=" + c.user,
+	}
+	return strings.Join(fields, " ") + "\n"
+}
+
+// validClientName reports whether name may be set with CLIENT SETNAME: it
+// must not contain spaces, newlines or other special characters.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RedisServer) clientCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("CLIENT")
+	}
+
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "ID" && len(args) == 2:
+		return CommandResponse{Response: toRespInt(s.client.id)}
+
+	case sub == "GETNAME" && len(args) == 2:
+		s.client.mu.Lock()
+		name := s.client.name
+		s.client.mu.Unlock()
+		if name == "" {
+			return CommandResponse{Response: RESP_NULL_BULK}
+		}
+		return CommandResponse{Response: toRespStr(name)}
+
+	case sub == "SETNAME" && len(args) == 3:
+		if !validClientName(args[2]) {
+			return CommandResponse{Error: "-ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+		s.client.mu.Lock()
+		s.client.name = args[2]
+		s.client.mu.Unlock()
+		return CommandResponse{Response: "+OK\r\n"}
+
+	case sub == "INFO" && len(args) == 2:
+		s.state.channelsMu.RLock()
+		line := s.clientListLine(time.Now())
+		s.state.channelsMu.RUnlock()
+		return CommandResponse{Response: toRespStr(line)}
+
+	case sub == "LIST" && len(args) == 2:
+		s.state.clientsMu.Lock()
+		clients := make([]*RedisServer, 0, len(s.state.clients))
+		for c := range s.state.clients {
+			clients = append(clients, c)
+		}
+		s.state.clientsMu.Unlock()
+		sort.Slice(clients, func(i, j int) bool { return clients[i].client.id < clients[j].client.id })
+
+		now := time.Now()
+		var b strings.Builder
+		s.state.channelsMu.RLock()
+		for _, c := range clients {
+			b.WriteString(c.clientListLine(now))
+		}
+		s.state.channelsMu.RUnlock()
+		return CommandResponse{Response: toRespStr(b.String())}
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try CLIENT HELP."}
+}
+
+// infoSections lists the INFO sections in the order they are rendered.
+var infoSections = []string{"clients", "stats", "replication"}
+
+func (s *RedisServer) infoCommand(args []string) CommandResponse {
+	wanted := map[string]bool{}
+	for _, arg := range args[1:] {
+		switch section := strings.ToLower(arg); section {
+		case "all", "everything", "default":
+			for _, name := range infoSections {
+				wanted[name] = true
+			}
+		default:
+			wanted[section] = true
+		}
+	}
+	if len(args) == 1 {
+		for _, name := range infoSections {
+			wanted[name] = true
+		}
+	}
+
+	var sections []string
+	for _, name := range infoSections {
+		if !wanted[name] {
+			continue
+		}
+		var lines []string
+		switch name {
+		case "clients":
+			s.state.clientsMu.Lock()
+			connected := len(s.state.clients)
+			pubsubClients := 0
+			s.state.channelsMu.RLock()
+			for c := range s.state.clients {
+				if c.pubsub != nil && c.pubsub.total() > 0 {
+					pubsubClients++
+				}
+			}
+			s.state.channelsMu.RUnlock()
+			s.state.clientsMu.Unlock()
+			lines = []string{
+				"# Clients",
+				"connected_clients:" + strconv.Itoa(connected),
+				"pubsub_clients:" + strconv.Itoa(pubsubClients),
+			}
+		case "stats":
+			s.state.channelsMu.RLock()
+			lines = []string{
+				"# Stats",
+				"pubsub_channels:" + strconv.Itoa(len(s.state.channels)),
+				"pubsub_patterns:" + strconv.Itoa(len(s.state.patterns)),
+				"pubsubshard_channels:" + strconv.Itoa(len(s.state.shardChannels)),
+			}
+			s.state.channelsMu.RUnlock()
+		case "replication":
+			role := "role:master"
+			if !s.state.serverIsMaster {
+				role = "role:slave"
+			}
+			lines = []string{
+				"# Replication",
+				role,
+				"master_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb",
+				"master_repl_offset:0",
+			}
+		}
+		sections = append(sections, strings.Join(lines, "\r\n")+"\r\n")
+	}
+	return CommandResponse{Response: toRespStr(strings.Join(sections, "\r\n"))}
+}
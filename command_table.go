@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// commandSpec describes a command independently of its handler.
+type commandSpec struct {
+	// arity counts the arguments including the command name, as Redis does:
+	// a positive arity is exact, a negative one a minimum of -arity.
+	arity int
+	flags int
+	// categories holds the ACL categories of the command. Commands with
+	// subcommands have none of their own: each subcommand has its spec,
+	// keyed by lower case name, of which only the categories are used.
+	categories  int
+	subcommands map[string]commandSpec
+	// keys locates the key arguments, for ACL key patterns. Commands whose
+	// keys cannot be described by ranges find them with getKeys instead.
+	keys    []keyRange
+	getKeys func(args []string) []keyRef
+}
+
+// Command flags.
+const (
+	cmdWrite    = 1 << iota // may modify the keyspace
+	cmdNoScript             // refused from scripts
+)
+
+// ACL categories, as listed by ACL CAT.
+const (
+	aclKeyspace = 1 << iota
+	aclRead
+	aclWrite
+	aclSet
+	aclSortedSet
+	aclList
+	aclHash
+	aclString
+	aclBitmap
+	aclHyperLogLog
+	aclGeo
+	aclStream
+	aclPubsub
+	aclAdmin
+	aclFast
+	aclSlow
+	aclBlocking
+	aclDangerous
+	aclConnection
+	aclTransaction
+	aclScripting
+)
+
+// aclCategoryNames names the ACL categories in the order of their bits.
+var aclCategoryNames = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast",
+	"slow", "blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+// Key permissions, needed on a key by a command and granted by a key
+// pattern.
+const (
+	keyRead = 1 << iota
+	keyWrite
+)
+
+// keyRange locates key arguments: every step-th argument from first to last,
+// where a negative last counts back from the end. When numKeys is set, the
+// number of keys is read from that argument instead of last.
+type keyRange struct {
+	first, last, step int
+	numKeys           int
+	perm              int
+}
+
+// keyRef is a key argument and the permissions the command needs on it.
+type keyRef struct {
+	key  string
+	perm int
+}
+
+var (
+	firstKeyRead      = []keyRange{{first: 1, last: 1, step: 1, perm: keyRead}}
+	firstKeyWrite     = []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}}
+	firstKeyReadWrite = []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}}
+)
+
+// commandTable lists every command the server understands. Keys are upper
+// case, like the RESP_COMMAND_* constants.
+var commandTable = map[string]commandSpec{
+	RESP_COMMAND_PING:             {arity: -1, categories: aclFast | aclConnection},
+	RESP_COMMAND_ECHO:             {arity: 2, categories: aclFast | aclConnection},
+	RESP_COMMAND_QUIT:             {arity: -1, flags: cmdNoScript, categories: aclFast | aclConnection},
+	RESP_COMMAND_RESET:            {arity: 1, flags: cmdNoScript, categories: aclFast | aclConnection},
+	RESP_COMMAND_MULTI:            {arity: 1, flags: cmdNoScript, categories: aclFast | aclTransaction},
+	RESP_COMMAND_EXEC:             {arity: 1, flags: cmdNoScript, categories: aclSlow | aclTransaction},
+	RESP_COMMAND_DISCARD:          {arity: 1, flags: cmdNoScript, categories: aclFast | aclTransaction},
+	RESP_COMMAND_WATCH:            {arity: -2, flags: cmdNoScript, categories: aclFast | aclTransaction, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_UNWATCH:          {arity: 1, flags: cmdNoScript, categories: aclFast | aclTransaction},
+	RESP_COMMAND_CONFIG:           {arity: -2, flags: cmdNoScript, subcommands: configSubcommands},
+	RESP_COMMAND_INFO:             {arity: -1, categories: aclSlow | aclDangerous},
+	RESP_COMMAND_CLIENT:           {arity: -2, flags: cmdNoScript, subcommands: clientSubcommands},
+	RESP_COMMAND_SAVE:             {arity: 1, flags: cmdNoScript, categories: aclAdmin | aclSlow | aclDangerous},
+	RESP_COMMAND_BGSAVE:           {arity: -1, flags: cmdNoScript, categories: aclAdmin | aclSlow | aclDangerous},
+	RESP_COMMAND_REPLCONF:         {arity: -1, flags: cmdNoScript, categories: aclAdmin | aclSlow | aclDangerous},
+	RESP_COMMAND_PSYNC:            {arity: -3, flags: cmdNoScript, categories: aclAdmin | aclSlow | aclDangerous},
+	RESP_COMMAND_KEYS:             {arity: 2, categories: aclKeyspace | aclRead | aclSlow | aclDangerous},
+	RESP_COMMAND_TYPE:             {arity: 2, categories: aclKeyspace | aclRead | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_OBJECT:           {arity: -2, categories: aclKeyspace | aclRead | aclSlow, keys: []keyRange{{first: 2, last: 2, step: 1, perm: keyRead}}},
+	RESP_COMMAND_FLUSHALL:         {arity: -1, flags: cmdWrite, categories: aclKeyspace | aclWrite | aclSlow | aclDangerous},
+	RESP_COMMAND_FLUSHDB:          {arity: -1, flags: cmdWrite, categories: aclKeyspace | aclWrite | aclSlow | aclDangerous},
+	RESP_COMMAND_SET:              {arity: -3, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, getKeys: setKeys},
+	RESP_COMMAND_GET:              {arity: 2, categories: aclRead | aclString | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_SETNX:            {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_SETEX:            {arity: 4, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, keys: firstKeyWrite},
+	RESP_COMMAND_PSETEX:           {arity: 4, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, keys: firstKeyWrite},
+	RESP_COMMAND_GETSET:           {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_GETDEL:           {arity: 2, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_GETEX:            {arity: -2, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_MGET:             {arity: -2, categories: aclRead | aclString | aclFast, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_MSET:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 2, perm: keyWrite}}},
+	RESP_COMMAND_MSETNX:           {arity: -3, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 2, perm: keyWrite}}},
+	RESP_COMMAND_APPEND:           {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_STRLEN:           {arity: 2, categories: aclRead | aclString | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_GETRANGE:         {arity: 4, categories: aclRead | aclString | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_SETRANGE:         {arity: 4, flags: cmdWrite, categories: aclWrite | aclString | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_LCS:              {arity: -3, categories: aclRead | aclString | aclSlow, keys: []keyRange{{first: 1, last: 2, step: 1, perm: keyRead}}},
+	RESP_COMMAND_INCR:             {arity: 2, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_DECR:             {arity: 2, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_INCRBY:           {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_DECRBY:           {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_INCRBYFLOAT:      {arity: 3, flags: cmdWrite, categories: aclWrite | aclString | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_SETBIT:           {arity: 4, flags: cmdWrite, categories: aclWrite | aclBitmap | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_GETBIT:           {arity: 3, categories: aclRead | aclBitmap | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_BITCOUNT:         {arity: -2, categories: aclRead | aclBitmap | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_BITPOS:           {arity: -3, categories: aclRead | aclBitmap | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_BITOP:            {arity: -4, flags: cmdWrite, categories: aclWrite | aclBitmap | aclSlow, keys: []keyRange{{first: 2, last: 2, step: 1, perm: keyWrite}, {first: 3, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_BITFIELD:         {arity: -2, flags: cmdWrite, categories: aclWrite | aclBitmap | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_BITFIELD_RO:      {arity: -2, categories: aclRead | aclBitmap | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_PFADD:            {arity: -2, flags: cmdWrite, categories: aclWrite | aclHyperLogLog | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_PFCOUNT:          {arity: -2, categories: aclRead | aclHyperLogLog | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_PFMERGE:          {arity: -2, flags: cmdWrite, categories: aclWrite | aclHyperLogLog | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_RPUSH:            {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_LPUSH:            {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_RPUSHX:           {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_LPUSHX:           {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_LRANGE:           {arity: 4, categories: aclRead | aclList | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_LLEN:             {arity: 2, categories: aclRead | aclList | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_LPOP:             {arity: -2, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_RPOP:             {arity: -2, flags: cmdWrite, categories: aclWrite | aclList | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_LINDEX:           {arity: 3, categories: aclRead | aclList | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_LSET:             {arity: 4, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_LINSERT:          {arity: 5, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_LREM:             {arity: 4, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_LTRIM:            {arity: 4, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_LPOS:             {arity: -3, categories: aclRead | aclList | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_RPOPLPUSH:        {arity: 3, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: 2, step: 1, perm: keyWrite}}},
+	RESP_COMMAND_LMPOP:            {arity: -4, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_LMOVE:            {arity: 5, flags: cmdWrite, categories: aclWrite | aclList | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: 2, step: 1, perm: keyWrite}}},
+	RESP_COMMAND_BLPOP:            {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclSlow | aclBlocking, keys: []keyRange{{first: 1, last: -2, step: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_BRPOP:            {arity: -3, flags: cmdWrite, categories: aclWrite | aclList | aclSlow | aclBlocking, keys: []keyRange{{first: 1, last: -2, step: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_BLMOVE:           {arity: 6, flags: cmdWrite, categories: aclWrite | aclList | aclSlow | aclBlocking, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: 2, step: 1, perm: keyWrite}}},
+	RESP_COMMAND_BRPOPLPUSH:       {arity: 4, flags: cmdWrite, categories: aclWrite | aclList | aclSlow | aclBlocking, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: 2, step: 1, perm: keyWrite}}},
+	RESP_COMMAND_BLMPOP:           {arity: -5, flags: cmdWrite, categories: aclWrite | aclList | aclSlow | aclBlocking, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_HSET:             {arity: -4, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_HMSET:            {arity: -4, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_HSETNX:           {arity: 4, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_HGET:             {arity: 3, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HMGET:            {arity: -3, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HGETALL:          {arity: 2, categories: aclRead | aclHash | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_HKEYS:            {arity: 2, categories: aclRead | aclHash | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_HVALS:            {arity: 2, categories: aclRead | aclHash | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_HDEL:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HEXISTS:          {arity: 3, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HLEN:             {arity: 2, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HSTRLEN:          {arity: 3, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HINCRBY:          {arity: 4, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HINCRBYFLOAT:     {arity: 4, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HRANDFIELD:       {arity: -2, categories: aclRead | aclHash | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_HSCAN:            {arity: -3, categories: aclRead | aclHash | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_HEXPIRE:          {arity: -6, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HPEXPIRE:         {arity: -6, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HEXPIREAT:        {arity: -6, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HPEXPIREAT:       {arity: -6, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_HTTL:             {arity: -5, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HPTTL:            {arity: -5, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HEXPIRETIME:      {arity: -5, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HPEXPIRETIME:     {arity: -5, categories: aclRead | aclHash | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_HPERSIST:         {arity: -5, flags: cmdWrite, categories: aclWrite | aclHash | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_SADD:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclSet | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_SREM:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_SISMEMBER:        {arity: 3, categories: aclRead | aclSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_SMISMEMBER:       {arity: -3, categories: aclRead | aclSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_SMEMBERS:         {arity: 2, categories: aclRead | aclSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_SCARD:            {arity: 2, categories: aclRead | aclSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_SPOP:             {arity: -2, flags: cmdWrite, categories: aclWrite | aclSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_SRANDMEMBER:      {arity: -2, categories: aclRead | aclSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_SMOVE:            {arity: 4, flags: cmdWrite, categories: aclWrite | aclSet | aclFast, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyRead | keyWrite}, {first: 2, last: 2, step: 1, perm: keyWrite}}},
+	RESP_COMMAND_SUNION:           {arity: -2, categories: aclRead | aclSet | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SINTER:           {arity: -2, categories: aclRead | aclSet | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SDIFF:            {arity: -2, categories: aclRead | aclSet | aclSlow, keys: []keyRange{{first: 1, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SUNIONSTORE:      {arity: -3, flags: cmdWrite, categories: aclWrite | aclSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 2, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SINTERSTORE:      {arity: -3, flags: cmdWrite, categories: aclWrite | aclSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 2, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SDIFFSTORE:       {arity: -3, flags: cmdWrite, categories: aclWrite | aclSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 2, last: -1, step: 1, perm: keyRead}}},
+	RESP_COMMAND_SINTERCARD:       {arity: -3, categories: aclRead | aclSet | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead}}},
+	RESP_COMMAND_ZADD:             {arity: -4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_ZINCRBY:          {arity: 4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZSCORE:           {arity: 3, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZMSCORE:          {arity: -3, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZCARD:            {arity: 2, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZCOUNT:           {arity: 4, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZRANK:            {arity: -3, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZREVRANK:         {arity: -3, categories: aclRead | aclSortedSet | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_ZREM:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZRANGE:           {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZREVRANGE:        {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZRANGEBYSCORE:    {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZREVRANGEBYSCORE: {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZRANGEBYLEX:      {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZREVRANGEBYLEX:   {arity: -4, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZRANGESTORE:      {arity: -5, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 2, last: 2, step: 1, perm: keyRead}}},
+	RESP_COMMAND_ZPOPMIN:          {arity: -2, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZPOPMAX:          {arity: -2, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZREMRANGEBYRANK:  {arity: 4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZREMRANGEBYSCORE: {arity: 4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZREMRANGEBYLEX:   {arity: 4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_ZRANDMEMBER:      {arity: -2, categories: aclRead | aclSortedSet | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_ZMPOP:            {arity: -4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_BZPOPMIN:         {arity: -3, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast | aclBlocking, keys: []keyRange{{first: 1, last: -2, step: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_BZPOPMAX:         {arity: -3, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclFast | aclBlocking, keys: []keyRange{{first: 1, last: -2, step: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_BZMPOP:           {arity: -5, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow | aclBlocking, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_ZUNION:           {arity: -3, categories: aclRead | aclSortedSet | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead}}},
+	RESP_COMMAND_ZINTER:           {arity: -3, categories: aclRead | aclSortedSet | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead}}},
+	RESP_COMMAND_ZDIFF:            {arity: -3, categories: aclRead | aclSortedSet | aclSlow, keys: []keyRange{{first: 2, numKeys: 1, perm: keyRead}}},
+	RESP_COMMAND_ZUNIONSTORE:      {arity: -4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_ZINTERSTORE:      {arity: -4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_ZDIFFSTORE:       {arity: -4, flags: cmdWrite, categories: aclWrite | aclSortedSet | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_GEOADD:           {arity: -5, flags: cmdWrite, categories: aclWrite | aclGeo | aclSlow, keys: firstKeyWrite},
+	RESP_COMMAND_GEOPOS:           {arity: -2, categories: aclRead | aclGeo | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_GEODIST:          {arity: -4, categories: aclRead | aclGeo | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_GEOHASH:          {arity: -2, categories: aclRead | aclGeo | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_GEOSEARCH:        {arity: -7, categories: aclRead | aclGeo | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_GEOSEARCHSTORE:   {arity: -8, flags: cmdWrite, categories: aclWrite | aclGeo | aclSlow, keys: []keyRange{{first: 1, last: 1, step: 1, perm: keyWrite}, {first: 2, last: 2, step: 1, perm: keyRead}}},
+	RESP_COMMAND_XADD:             {arity: -5, flags: cmdWrite, categories: aclWrite | aclStream | aclFast, keys: firstKeyWrite},
+	RESP_COMMAND_XLEN:             {arity: 2, categories: aclRead | aclStream | aclFast, keys: firstKeyRead},
+	RESP_COMMAND_XRANGE:           {arity: -4, categories: aclRead | aclStream | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_XREVRANGE:        {arity: -4, categories: aclRead | aclStream | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_XREAD:            {arity: -4, categories: aclRead | aclStream | aclSlow | aclBlocking, getKeys: streamsKeys},
+	RESP_COMMAND_XDEL:             {arity: -3, flags: cmdWrite, categories: aclWrite | aclStream | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_XTRIM:            {arity: -4, flags: cmdWrite, categories: aclWrite | aclStream | aclSlow, keys: firstKeyReadWrite},
+	RESP_COMMAND_XINFO:            {arity: -2, categories: aclRead | aclStream | aclSlow, keys: []keyRange{{first: 2, last: 2, step: 1, perm: keyRead}}},
+	RESP_COMMAND_XGROUP:           {arity: -2, flags: cmdWrite, categories: aclWrite | aclStream | aclSlow, keys: []keyRange{{first: 2, last: 2, step: 1, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_XREADGROUP:       {arity: -7, flags: cmdWrite, categories: aclWrite | aclStream | aclSlow | aclBlocking, getKeys: streamsKeys},
+	RESP_COMMAND_XACK:             {arity: -4, flags: cmdWrite, categories: aclWrite | aclStream | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_XPENDING:         {arity: -3, categories: aclRead | aclStream | aclSlow, keys: firstKeyRead},
+	RESP_COMMAND_XCLAIM:           {arity: -6, flags: cmdWrite, categories: aclWrite | aclStream | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_XAUTOCLAIM:       {arity: -6, flags: cmdWrite, categories: aclWrite | aclStream | aclFast, keys: firstKeyReadWrite},
+	RESP_COMMAND_SUBSCRIBE:        {arity: -2, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_UNSUBSCRIBE:      {arity: -1, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_PSUBSCRIBE:       {arity: -2, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_PUNSUBSCRIBE:     {arity: -1, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_SSUBSCRIBE:       {arity: -2, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_SUNSUBSCRIBE:     {arity: -1, flags: cmdNoScript, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_PUBLISH:          {arity: 3, categories: aclPubsub | aclFast},
+	RESP_COMMAND_SPUBLISH:         {arity: 3, categories: aclPubsub | aclFast},
+	RESP_COMMAND_PUBSUB:           {arity: -2, categories: aclPubsub | aclSlow},
+	RESP_COMMAND_EVAL:             {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_EVALSHA:          {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_EVAL_RO:          {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_EVALSHA_RO:       {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_SCRIPT:           {arity: -2, flags: cmdNoScript, subcommands: scriptSubcommands},
+	RESP_COMMAND_FUNCTION:         {arity: -2, flags: cmdNoScript, subcommands: functionSubcommands},
+	RESP_COMMAND_FCALL:            {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead | keyWrite}}},
+	RESP_COMMAND_FCALL_RO:         {arity: -3, flags: cmdNoScript, categories: aclSlow | aclScripting, keys: []keyRange{{first: 3, numKeys: 2, perm: keyRead}}},
+	RESP_COMMAND_AUTH:             {arity: -2, flags: cmdNoScript, categories: aclFast | aclConnection},
+	RESP_COMMAND_ACL:              {arity: -2, flags: cmdNoScript, subcommands: aclSubcommands},
+	RESP_COMMAND_HELLO:            {arity: -1, flags: cmdNoScript, categories: aclFast | aclConnection},
+}
+
+var configSubcommands = map[string]commandSpec{
+	"get": {categories: aclAdmin | aclSlow | aclDangerous},
+	"set": {categories: aclAdmin | aclSlow | aclDangerous},
+}
+
+var clientSubcommands = map[string]commandSpec{
+	"id":      {categories: aclSlow | aclConnection},
+	"getname": {categories: aclSlow | aclConnection},
+	"setname": {categories: aclSlow | aclConnection},
+	"info":    {categories: aclSlow | aclConnection},
+	"list":    {categories: aclAdmin | aclSlow | aclDangerous | aclConnection},
+}
+
+var scriptSubcommands = map[string]commandSpec{
+	"load":   {categories: aclSlow | aclScripting},
+	"exists": {categories: aclSlow | aclScripting},
+	"flush":  {categories: aclSlow | aclScripting},
+	"kill":   {categories: aclSlow | aclScripting},
+}
+
+var functionSubcommands = map[string]commandSpec{
+	"load":    {categories: aclWrite | aclSlow | aclScripting},
+	"delete":  {categories: aclWrite | aclSlow | aclScripting},
+	"flush":   {categories: aclWrite | aclSlow | aclScripting},
+	"list":    {categories: aclSlow | aclScripting},
+	"dump":    {categories: aclSlow | aclScripting},
+	"restore": {categories: aclWrite | aclSlow | aclScripting},
+	"kill":    {categories: aclSlow | aclScripting},
+	"stats":   {categories: aclSlow | aclScripting},
+}
+
+var aclSubcommands = map[string]commandSpec{
+	"cat":     {categories: aclSlow},
+	"deluser": {categories: aclAdmin | aclSlow | aclDangerous},
+	"dryrun":  {categories: aclAdmin | aclSlow | aclDangerous},
+	"getuser": {categories: aclAdmin | aclSlow | aclDangerous},
+	"list":    {categories: aclAdmin | aclSlow | aclDangerous},
+	"load":    {categories: aclAdmin | aclSlow | aclDangerous},
+	"log":     {categories: aclAdmin | aclSlow | aclDangerous},
+	"save":    {categories: aclAdmin | aclSlow | aclDangerous},
+	"setuser": {categories: aclAdmin | aclSlow | aclDangerous},
+	"users":   {categories: aclAdmin | aclSlow | aclDangerous},
+	"whoami":  {categories: aclSlow},
+}
+
+// checkCommand looks args up in commandTable and returns the error to reply
+// with when the command is unknown or has the wrong number of arguments, or
+// "" when it may run.
+func checkCommand(args []string) string {
+	name := strings.ToUpper(args[0])
+	spec, ok := commandTable[name]
+	if !ok {
+		return unknownCommandError(args)
+	}
+	if (spec.arity > 0 && len(args) != spec.arity) || (spec.arity < 0 && len(args) < -spec.arity) {
+		return wrongArgsError(name).Error
+	}
+	return ""
+}
+
+// commandName returns the name of the command args runs, in lower case as
+// ACL rules spell it: "get", or "config|set" for a subcommand, along with
+// its ACL categories. spec is the entry of args[0] in commandTable.
+func commandName(spec commandSpec, args []string) (string, int) {
+	name := strings.ToLower(args[0])
+	if spec.subcommands == nil || len(args) < 2 {
+		return name, spec.categories
+	}
+	sub := strings.ToLower(args[1])
+	if subSpec, ok := spec.subcommands[sub]; ok {
+		return name + "|" + sub, subSpec.categories
+	}
+	return name, spec.categories
+}
+
+// commandKeys returns the key arguments of args, along with the permissions
+// the command needs on each.
+func commandKeys(spec commandSpec, args []string) []keyRef {
+	if spec.getKeys != nil {
+		return spec.getKeys(args)
+	}
+	var keys []keyRef
+	for _, r := range spec.keys {
+		last := r.last
+		step := r.step
+		if r.numKeys > 0 {
+			if r.numKeys >= len(args) {
+				continue
+			}
+			n, err := strconv.Atoi(args[r.numKeys])
+			if err != nil || n <= 0 {
+				continue
+			}
+			last, step = r.first+n-1, 1
+		} else if last < 0 {
+			last += len(args)
+		}
+		for i := r.first; i <= last && i < len(args); i += step {
+			keys = append(keys, keyRef{key: args[i], perm: r.perm})
+		}
+	}
+	return keys
+}
+
+// setKeys is the key of SET, which it only reads when asked for the old
+// value with GET.
+func setKeys(args []string) []keyRef {
+	perm := keyWrite
+	for _, arg := range args[3:] {
+		if strings.ToUpper(arg) == "GET" {
+			perm |= keyRead
+		}
+	}
+	return []keyRef{{key: args[1], perm: perm}}
+}
+
+// streamsKeys returns the keys of XREAD and XREADGROUP: the first half of
+// the arguments after STREAMS, the second being their IDs.
+func streamsKeys(args []string) []keyRef {
+	perm := keyRead
+	if strings.ToUpper(args[0]) == RESP_COMMAND_XREADGROUP {
+		perm |= keyWrite
+	}
+	for i := 1; i < len(args); i++ {
+		if strings.ToUpper(args[i]) != "STREAMS" {
+			continue
+		}
+		streams := args[i+1:]
+		keys := make([]keyRef, 0, len(streams)/2)
+		for _, key := range streams[:len(streams)/2] {
+			keys = append(keys, keyRef{key: key, perm: perm})
+		}
+		return keys
+	}
+	return nil
+}
+
+// unknownCommandError is the reply to a command missing from commandTable.
+func unknownCommandError(args []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-ERR unknown command '%s', with args beginning with: ", args[0])
+	for _, arg := range args[1:] {
+		fmt.Fprintf(&b, "'%s' ", arg)
+	}
+	return b.String()
+}
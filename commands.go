@@ -1,15 +1,8 @@
 package main
 
 import (
-	"encoding/hex"
 	"fmt"
-	"net"
-	"path"
-	"strconv"
 	"strings"
-	"time"
-
-	"github.com/wangjia184/sortedset"
 )
 
 type CommandResponse struct {
@@ -18,35 +11,203 @@ type CommandResponse struct {
 }
 
 const (
-	RESP_COMMAND_UNKNOWN     string = "UNKNOWN"
-	RESP_COMMAND_PING        string = "PING"
-	RESP_COMMAND_ECHO        string = "ECHO"
-	RESP_COMMAND_SET         string = "SET"
-	RESP_COMMAND_GET         string = "GET"
-	RESP_COMMAND_CONFIG      string = "CONFIG"
-	RESP_COMMAND_KEYS        string = "KEYS"
-	RESP_COMMAND_INFO        string = "INFO"
-	RESP_COMMAND_REPLCONF    string = "REPLCONF"
-	RESP_COMMAND_PSYNC       string = "PSYNC"
-	RESP_COMMAND_TYPE        string = "TYPE"
-	RESP_COMMAND_INCR        string = "INCR"
-	RESP_COMMAND_MULTI       string = "MULTI"
-	RESP_COMMAND_EXEC        string = "EXEC"
-	RESP_COMMAND_DISCARD     string = "DISCARD"
-	RESP_COMMAND_RPUSH       string = "RPUSH"
-	RESP_COMMAND_LRANGE      string = "LRANGE"
-	RESP_COMMAND_LPUSH       string = "LPUSH"
-	RESP_COMMAND_LPOP        string = "LPOP"
-	RESP_COMMAND_LLEN        string = "LLEN"
-	RESP_COMMAND_SUBSCRIBE   string = "SUBSCRIBE"
-	RESP_COMMAND_PUBLISH     string = "PUBLISH"
-	RESP_COMMAND_UNSUBSCRIBE string = "UNSUBSCRIBE"
-	RESP_COMMAND_ZADD        string = "ZADD"
-	RESP_COMMAND_ZRANK       string = "ZRANK"
-	RESP_COMMAND_ZRANGE      string = "ZRANGE"
-	RESP_COMMAND_ZCARD       string = "ZCARD"
-	RESP_COMMAND_ZSCORE      string = "ZSCORE"
-	RESP_COMMAND_ZREM        string = "ZREM"
+	RESP_COMMAND_UNKNOWN          string = "UNKNOWN"
+	RESP_COMMAND_PING             string = "PING"
+	RESP_COMMAND_ECHO             string = "ECHO"
+	RESP_COMMAND_SET              string = "SET"
+	RESP_COMMAND_GET              string = "GET"
+	RESP_COMMAND_CONFIG           string = "CONFIG"
+	RESP_COMMAND_FLUSHALL         string = "FLUSHALL"
+	RESP_COMMAND_FLUSHDB          string = "FLUSHDB"
+	RESP_COMMAND_KEYS             string = "KEYS"
+	RESP_COMMAND_INFO             string = "INFO"
+	RESP_COMMAND_REPLCONF         string = "REPLCONF"
+	RESP_COMMAND_PSYNC            string = "PSYNC"
+	RESP_COMMAND_TYPE             string = "TYPE"
+	RESP_COMMAND_INCR             string = "INCR"
+	RESP_COMMAND_MULTI            string = "MULTI"
+	RESP_COMMAND_EXEC             string = "EXEC"
+	RESP_COMMAND_QUIT             string = "QUIT"
+	RESP_COMMAND_RESET            string = "RESET"
+	RESP_COMMAND_WATCH            string = "WATCH"
+	RESP_COMMAND_UNWATCH          string = "UNWATCH"
+	RESP_COMMAND_DISCARD          string = "DISCARD"
+	RESP_COMMAND_RPUSH            string = "RPUSH"
+	RESP_COMMAND_LRANGE           string = "LRANGE"
+	RESP_COMMAND_LPUSH            string = "LPUSH"
+	RESP_COMMAND_LPOP             string = "LPOP"
+	RESP_COMMAND_LLEN             string = "LLEN"
+	RESP_COMMAND_SUBSCRIBE        string = "SUBSCRIBE"
+	RESP_COMMAND_PUBLISH          string = "PUBLISH"
+	RESP_COMMAND_PSUBSCRIBE       string = "PSUBSCRIBE"
+	RESP_COMMAND_PUNSUBSCRIBE     string = "PUNSUBSCRIBE"
+	RESP_COMMAND_UNSUBSCRIBE      string = "UNSUBSCRIBE"
+	RESP_COMMAND_SSUBSCRIBE       string = "SSUBSCRIBE"
+	RESP_COMMAND_SUNSUBSCRIBE     string = "SUNSUBSCRIBE"
+	RESP_COMMAND_SPUBLISH         string = "SPUBLISH"
+	RESP_COMMAND_PUBSUB           string = "PUBSUB"
+	RESP_COMMAND_CLIENT           string = "CLIENT"
+	RESP_COMMAND_ZADD             string = "ZADD"
+	RESP_COMMAND_ZRANK            string = "ZRANK"
+	RESP_COMMAND_ZRANGE           string = "ZRANGE"
+	RESP_COMMAND_ZCARD            string = "ZCARD"
+	RESP_COMMAND_ZSCORE           string = "ZSCORE"
+	RESP_COMMAND_ZREM             string = "ZREM"
+	RESP_COMMAND_ZINCRBY          string = "ZINCRBY"
+	RESP_COMMAND_ZMSCORE          string = "ZMSCORE"
+	RESP_COMMAND_ZCOUNT           string = "ZCOUNT"
+	RESP_COMMAND_ZREVRANK         string = "ZREVRANK"
+	RESP_COMMAND_ZREVRANGE        string = "ZREVRANGE"
+	RESP_COMMAND_ZRANGEBYSCORE    string = "ZRANGEBYSCORE"
+	RESP_COMMAND_ZREVRANGEBYSCORE string = "ZREVRANGEBYSCORE"
+	RESP_COMMAND_ZRANGEBYLEX      string = "ZRANGEBYLEX"
+	RESP_COMMAND_ZREVRANGEBYLEX   string = "ZREVRANGEBYLEX"
+	RESP_COMMAND_ZRANGESTORE      string = "ZRANGESTORE"
+	RESP_COMMAND_ZPOPMIN          string = "ZPOPMIN"
+	RESP_COMMAND_ZPOPMAX          string = "ZPOPMAX"
+	RESP_COMMAND_ZREMRANGEBYRANK  string = "ZREMRANGEBYRANK"
+	RESP_COMMAND_ZREMRANGEBYSCORE string = "ZREMRANGEBYSCORE"
+	RESP_COMMAND_ZREMRANGEBYLEX   string = "ZREMRANGEBYLEX"
+	RESP_COMMAND_ZRANDMEMBER      string = "ZRANDMEMBER"
+	RESP_COMMAND_ZUNION           string = "ZUNION"
+	RESP_COMMAND_ZINTER           string = "ZINTER"
+	RESP_COMMAND_ZDIFF            string = "ZDIFF"
+	RESP_COMMAND_ZUNIONSTORE      string = "ZUNIONSTORE"
+	RESP_COMMAND_ZINTERSTORE      string = "ZINTERSTORE"
+	RESP_COMMAND_ZDIFFSTORE       string = "ZDIFFSTORE"
+	RESP_COMMAND_ZMPOP            string = "ZMPOP"
+	RESP_COMMAND_BZPOPMIN         string = "BZPOPMIN"
+	RESP_COMMAND_BZPOPMAX         string = "BZPOPMAX"
+	RESP_COMMAND_BZMPOP           string = "BZMPOP"
+	RESP_COMMAND_XADD             string = "XADD"
+	RESP_COMMAND_XLEN             string = "XLEN"
+	RESP_COMMAND_XRANGE           string = "XRANGE"
+	RESP_COMMAND_XREVRANGE        string = "XREVRANGE"
+	RESP_COMMAND_XREAD            string = "XREAD"
+	RESP_COMMAND_XDEL             string = "XDEL"
+	RESP_COMMAND_XTRIM            string = "XTRIM"
+	RESP_COMMAND_XINFO            string = "XINFO"
+	RESP_COMMAND_XGROUP           string = "XGROUP"
+	RESP_COMMAND_XREADGROUP       string = "XREADGROUP"
+	RESP_COMMAND_XACK             string = "XACK"
+	RESP_COMMAND_XPENDING         string = "XPENDING"
+	RESP_COMMAND_XCLAIM           string = "XCLAIM"
+	RESP_COMMAND_XAUTOCLAIM       string = "XAUTOCLAIM"
+	RESP_COMMAND_SETBIT           string = "SETBIT"
+	RESP_COMMAND_GETBIT           string = "GETBIT"
+	RESP_COMMAND_BITCOUNT         string = "BITCOUNT"
+	RESP_COMMAND_BITPOS           string = "BITPOS"
+	RESP_COMMAND_BITOP            string = "BITOP"
+	RESP_COMMAND_BITFIELD         string = "BITFIELD"
+	RESP_COMMAND_BITFIELD_RO      string = "BITFIELD_RO"
+	RESP_COMMAND_PFADD            string = "PFADD"
+	RESP_COMMAND_PFCOUNT          string = "PFCOUNT"
+	RESP_COMMAND_PFMERGE          string = "PFMERGE"
+	RESP_COMMAND_GEOADD           string = "GEOADD"
+	RESP_COMMAND_GEOPOS           string = "GEOPOS"
+	RESP_COMMAND_GEODIST          string = "GEODIST"
+	RESP_COMMAND_GEOHASH          string = "GEOHASH"
+	RESP_COMMAND_GEOSEARCH        string = "GEOSEARCH"
+	RESP_COMMAND_GEOSEARCHSTORE   string = "GEOSEARCHSTORE"
+	RESP_COMMAND_SETNX            string = "SETNX"
+	RESP_COMMAND_SETEX            string = "SETEX"
+	RESP_COMMAND_PSETEX           string = "PSETEX"
+	RESP_COMMAND_GETSET           string = "GETSET"
+	RESP_COMMAND_GETDEL           string = "GETDEL"
+	RESP_COMMAND_GETEX            string = "GETEX"
+	RESP_COMMAND_MGET             string = "MGET"
+	RESP_COMMAND_MSET             string = "MSET"
+	RESP_COMMAND_MSETNX           string = "MSETNX"
+	RESP_COMMAND_APPEND           string = "APPEND"
+	RESP_COMMAND_STRLEN           string = "STRLEN"
+	RESP_COMMAND_GETRANGE         string = "GETRANGE"
+	RESP_COMMAND_SETRANGE         string = "SETRANGE"
+	RESP_COMMAND_DECR             string = "DECR"
+	RESP_COMMAND_INCRBY           string = "INCRBY"
+	RESP_COMMAND_DECRBY           string = "DECRBY"
+	RESP_COMMAND_INCRBYFLOAT      string = "INCRBYFLOAT"
+	RESP_COMMAND_LCS              string = "LCS"
+	RESP_COMMAND_OBJECT           string = "OBJECT"
+	RESP_COMMAND_RPOP             string = "RPOP"
+	RESP_COMMAND_LMOVE            string = "LMOVE"
+	RESP_COMMAND_BLPOP            string = "BLPOP"
+	RESP_COMMAND_BRPOP            string = "BRPOP"
+	RESP_COMMAND_BLMOVE           string = "BLMOVE"
+	RESP_COMMAND_BRPOPLPUSH       string = "BRPOPLPUSH"
+	RESP_COMMAND_BLMPOP           string = "BLMPOP"
+	RESP_COMMAND_LINDEX           string = "LINDEX"
+	RESP_COMMAND_LSET             string = "LSET"
+	RESP_COMMAND_LINSERT          string = "LINSERT"
+	RESP_COMMAND_LREM             string = "LREM"
+	RESP_COMMAND_LTRIM            string = "LTRIM"
+	RESP_COMMAND_LPOS             string = "LPOS"
+	RESP_COMMAND_RPOPLPUSH        string = "RPOPLPUSH"
+	RESP_COMMAND_LPUSHX           string = "LPUSHX"
+	RESP_COMMAND_RPUSHX           string = "RPUSHX"
+	RESP_COMMAND_LMPOP            string = "LMPOP"
+	RESP_COMMAND_SAVE             string = "SAVE"
+	RESP_COMMAND_BGSAVE           string = "BGSAVE"
+	RESP_COMMAND_SADD             string = "SADD"
+	RESP_COMMAND_SREM             string = "SREM"
+	RESP_COMMAND_SISMEMBER        string = "SISMEMBER"
+	RESP_COMMAND_SMISMEMBER       string = "SMISMEMBER"
+	RESP_COMMAND_SMEMBERS         string = "SMEMBERS"
+	RESP_COMMAND_SCARD            string = "SCARD"
+	RESP_COMMAND_SPOP             string = "SPOP"
+	RESP_COMMAND_SRANDMEMBER      string = "SRANDMEMBER"
+	RESP_COMMAND_SMOVE            string = "SMOVE"
+	RESP_COMMAND_SINTER           string = "SINTER"
+	RESP_COMMAND_SINTERSTORE      string = "SINTERSTORE"
+	RESP_COMMAND_SINTERCARD       string = "SINTERCARD"
+	RESP_COMMAND_SUNION           string = "SUNION"
+	RESP_COMMAND_SUNIONSTORE      string = "SUNIONSTORE"
+	RESP_COMMAND_SDIFF            string = "SDIFF"
+	RESP_COMMAND_SDIFFSTORE       string = "SDIFFSTORE"
+	RESP_COMMAND_HSET             string = "HSET"
+	RESP_COMMAND_HMSET            string = "HMSET"
+	RESP_COMMAND_HSETNX           string = "HSETNX"
+	RESP_COMMAND_HGET             string = "HGET"
+	RESP_COMMAND_HMGET            string = "HMGET"
+	RESP_COMMAND_HGETALL          string = "HGETALL"
+	RESP_COMMAND_HDEL             string = "HDEL"
+	RESP_COMMAND_HEXISTS          string = "HEXISTS"
+	RESP_COMMAND_HLEN             string = "HLEN"
+	RESP_COMMAND_HKEYS            string = "HKEYS"
+	RESP_COMMAND_HVALS            string = "HVALS"
+	RESP_COMMAND_HINCRBY          string = "HINCRBY"
+	RESP_COMMAND_HINCRBYFLOAT     string = "HINCRBYFLOAT"
+	RESP_COMMAND_HSTRLEN          string = "HSTRLEN"
+	RESP_COMMAND_HRANDFIELD       string = "HRANDFIELD"
+	RESP_COMMAND_HSCAN            string = "HSCAN"
+	RESP_COMMAND_HEXPIRE          string = "HEXPIRE"
+	RESP_COMMAND_HPEXPIRE         string = "HPEXPIRE"
+	RESP_COMMAND_HEXPIREAT        string = "HEXPIREAT"
+	RESP_COMMAND_HPEXPIREAT       string = "HPEXPIREAT"
+	RESP_COMMAND_HTTL             string = "HTTL"
+	RESP_COMMAND_HPTTL            string = "HPTTL"
+	RESP_COMMAND_HEXPIRETIME      string = "HEXPIRETIME"
+	RESP_COMMAND_HPEXPIRETIME     string = "HPEXPIRETIME"
+	RESP_COMMAND_HPERSIST         string = "HPERSIST"
+	RESP_COMMAND_EVAL             string = "EVAL"
+	RESP_COMMAND_EVALSHA          string = "EVALSHA"
+	RESP_COMMAND_EVAL_RO          string = "EVAL_RO"
+	RESP_COMMAND_EVALSHA_RO       string = "EVALSHA_RO"
+	RESP_COMMAND_SCRIPT           string = "SCRIPT"
+	RESP_COMMAND_FUNCTION         string = "FUNCTION"
+	RESP_COMMAND_FCALL            string = "FCALL"
+	RESP_COMMAND_FCALL_RO         string = "FCALL_RO"
+	RESP_COMMAND_AUTH             string = "AUTH"
+	RESP_COMMAND_HELLO            string = "HELLO"
+	RESP_COMMAND_ACL              string = "ACL"
+)
+
+const (
+	RESP_NULL_BULK       string = "$-1\r\n"
+	RESP_NULL_ARRAY      string = "*-1\r\n"
+	RESP_ERR_WRONGTYPE   string = "-WRONGTYPE Operation against a key holding the wrong kind of value"
+	RESP_ERR_SYNTAX      string = "-ERR syntax error"
+	RESP_ERR_NOT_INTEGER string = "-ERR value is not an integer or out of range"
+	RESP_ERR_NOT_FLOAT   string = "-ERR value is not a valid float"
 )
 
 func (s *RedisServer) executeCommand(tempArr []string) CommandResponse {
@@ -56,12 +217,18 @@ func (s *RedisServer) executeCommand(tempArr []string) CommandResponse {
 
 	cmd := strings.ToUpper(tempArr[0])
 
+	if errMsg := s.checkPermissions(tempArr); errMsg != "" {
+		return CommandResponse{Error: errMsg}
+	}
+
 	if s.SubscribedMode {
 		allowed := map[string]bool{
 			"SUBSCRIBE":    true,
 			"UNSUBSCRIBE":  true,
 			"PSUBSCRIBE":   true,
 			"PUNSUBSCRIBE": true,
+			"SSUBSCRIBE":   true,
+			"SUNSUBSCRIBE": true,
 			"PING":         true,
 			"QUIT":         true,
 		}
@@ -88,113 +255,94 @@ func (s *RedisServer) executeCommand(tempArr []string) CommandResponse {
 		}
 
 	case RESP_COMMAND_ECHO:
-		if len(tempArr) < 2 {
+		if len(tempArr) != 2 {
 			return CommandResponse{Error: "-ERR wrong number of arguments for 'echo' command"}
 		}
-		tempStr := tempArr[1]
-		for i := 2; i < len(tempArr); i++ {
-			tempStr += " " + tempArr[i]
-		}
-		response := fmt.Sprintf("$%d\r\n%s", len(tempStr), tempStr)
-		return CommandResponse{Response: response}
+		return CommandResponse{Response: toRespStr(tempArr[1])}
 
 	case RESP_COMMAND_SET:
-		if len(tempArr) < 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'SET' command"}
-		}
-		var val storageVal
+		return s.setCommand(tempArr)
 
-		if len(tempArr) > 3 && strings.ToUpper(tempArr[3]) == "PX" {
-			px, _ := strconv.Atoi(tempArr[4])
-			val = storageVal{val: tempArr[2], px: px, t: time.Now()}
-		} else {
-			val = storageVal{val: tempArr[2], px: -1, t: time.Now()}
-		}
-		s.state.storageMu.Lock()
-		s.state.storage[tempArr[1]] = val
-		s.state.storageMu.Unlock()
+	case RESP_COMMAND_GET:
+		return s.getCommand(tempArr)
 
-		s.state.replicaMu.RLock()
-		for _, replica := range s.state.replicaConns {
-			replica.Write(encodeBulkArray(tempArr))
-		}
-		s.state.replicaMu.RUnlock()
+	case RESP_COMMAND_SETNX:
+		return s.setnxCommand(tempArr)
 
-		return CommandResponse{Response: "+OK"}
+	case RESP_COMMAND_SETEX:
+		return s.setexCommand(tempArr, "EX")
 
-	case RESP_COMMAND_GET:
-		if len(tempArr) < 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'GET' command"}
-		}
-		s.state.storageMu.RLock()
-		value, ok := s.state.storage[tempArr[1]]
-		s.state.storageMu.RUnlock()
-		if ok {
-			if value.px != -1 &&
-				time.Now().After(value.t.Add(time.Millisecond*time.Duration(value.px))) {
-				s.state.storageMu.Lock()
-				delete(s.state.storage, tempArr[1])
-				s.state.storageMu.Unlock()
-				return CommandResponse{Response: "$-1"}
-			} else {
-				resp := fmt.Sprintf("$%d\r\n%s", len(value.val.(string)), value.val)
-				return CommandResponse{Response: resp}
-			}
-		} else {
-			return CommandResponse{Response: "$-1"}
-		}
+	case RESP_COMMAND_PSETEX:
+		return s.setexCommand(tempArr, "PX")
+
+	case RESP_COMMAND_GETSET:
+		return s.getsetCommand(tempArr)
+
+	case RESP_COMMAND_GETDEL:
+		return s.getdelCommand(tempArr)
+
+	case RESP_COMMAND_GETEX:
+		return s.getexCommand(tempArr)
+
+	case RESP_COMMAND_MGET:
+		return s.mgetCommand(tempArr)
+
+	case RESP_COMMAND_MSET:
+		return s.msetCommand(tempArr)
+
+	case RESP_COMMAND_MSETNX:
+		return s.msetnxCommand(tempArr)
+
+	case RESP_COMMAND_APPEND:
+		return s.appendCommand(tempArr)
+
+	case RESP_COMMAND_STRLEN:
+		return s.strlenCommand(tempArr)
+
+	case RESP_COMMAND_GETRANGE:
+		return s.getrangeCommand(tempArr)
+
+	case RESP_COMMAND_SETRANGE:
+		return s.setrangeCommand(tempArr)
+
+	case RESP_COMMAND_LCS:
+		return s.lcsCommand(tempArr)
+
+	case RESP_COMMAND_OBJECT:
+		return s.objectCommand(tempArr)
 
 	case RESP_COMMAND_CONFIG:
-		if len(tempArr) < 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'CONFIG' command"}
-		}
-		if strings.ToUpper(tempArr[1]) == "GET" && strings.ToUpper(tempArr[2]) == "DIR" {
-			resp := fmt.Sprintf("*2\r\n$3\r\ndir\r\n$%d\r\n%s", len(s.state.config.Directory), s.state.config.Directory)
-			return CommandResponse{Response: resp}
-		}
-		if strings.ToUpper(tempArr[1]) == "GET" && strings.ToUpper(tempArr[2]) == "DBFILENAME" {
-			dbFileName := s.state.config.dbFileName
-			if dbFileName == "" {
-				dbFileName = "dump.rdb"
-			}
-			resp := fmt.Sprintf("*2\r\n$10\r\ndbfilename\r\n$%d\r\n%s", len(dbFileName), dbFileName)
-			return CommandResponse{Response: resp}
-		}
-		return CommandResponse{Error: "-ERR unsupported CONFIG subcommand"}
+		return s.configCommand(tempArr)
 
 	case RESP_COMMAND_KEYS:
-		if len(tempArr) < 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'KEYS' command"}
-		}
-		if tempArr[1] == "*" {
-			filePath := path.Join(s.state.config.Directory, s.state.config.dbFileName)
-			dataMapKeys, _, err := readRDB(filePath)
-			if err != nil {
-				fmt.Println("failed to load RDB file")
-			}
-			response := fmt.Sprintf("*%d", len(dataMapKeys))
-			for key := range dataMapKeys {
-				response += fmt.Sprintf("\r\n$%d\r\n%s", len(key), key)
-			}
-			return CommandResponse{Response: response}
-		}
-		return CommandResponse{Error: "-ERR unsupported KEYS pattern"}
+		return s.keysCommand(tempArr)
+
+	case RESP_COMMAND_FLUSHALL, RESP_COMMAND_FLUSHDB:
+		return s.flushCommand(tempArr)
+
+	case RESP_COMMAND_WATCH:
+		return s.watchCommand(tempArr)
+
+	case RESP_COMMAND_UNWATCH:
+		return s.unwatchCommand(tempArr)
+
+	case RESP_COMMAND_SAVE:
+		return s.saveCommand(tempArr)
+
+	case RESP_COMMAND_BGSAVE:
+		return s.bgsaveCommand(tempArr)
 
 	case RESP_COMMAND_INFO:
-		var role string
-		if s.state.serverIsMaster {
-			role = "role:master"
-		} else {
-			role = "role:slave"
-		}
-		info := role + "\nmaster_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\nmaster_repl_offset:0"
-		resp := fmt.Sprintf("$%d\r\n%s", len(info), info)
-		return CommandResponse{Response: resp}
+		return s.infoCommand(tempArr)
 
 	case RESP_COMMAND_REPLCONF:
 		if !s.state.serverIsMaster {
 			return CommandResponse{Error: "-ERR not allowed to slaves"}
 		}
+		// Replicas stream ACKs without reading replies, so none is sent.
+		if len(tempArr) > 1 && strings.ToUpper(tempArr[1]) == "ACK" {
+			return CommandResponse{}
+		}
 		return CommandResponse{Response: "+OK"}
 
 	case RESP_COMMAND_PSYNC:
@@ -202,595 +350,451 @@ func (s *RedisServer) executeCommand(tempArr []string) CommandResponse {
 			return CommandResponse{Error: "-ERR not allowed to slaves"}
 		}
 		// This is a special case that needs direct connection handling
-		s.conn.Write([]byte("+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n"))
-		RDBContent, _ := hex.DecodeString("524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2")
-		s.conn.Write([]byte(fmt.Sprintf("$%v\r\n%v", len(string(RDBContent)), string(RDBContent))))
-		s.state.replicaConns = append(s.state.replicaConns, s.conn)
+		s.state.syncReplica(s.conn)
 		return CommandResponse{}
 
 	case RESP_COMMAND_TYPE:
-		if len(tempArr) < 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'TYPE' command"}
-		}
-		s.state.storageMu.RLock()
-		_, ok := s.state.storage[tempArr[1]]
-		s.state.storageMu.RUnlock()
-		if ok {
-			return CommandResponse{Response: "+string"}
-		} else {
-			return CommandResponse{Response: "+none"}
-		}
+		return s.typeCommand(tempArr)
 
 	case RESP_COMMAND_INCR:
-		if len(tempArr) < 2 {
+		if len(tempArr) != 2 {
 			return CommandResponse{Error: "-ERR wrong number of arguments for 'INCR' command"}
 		}
-		s.state.storageMu.Lock()
-		val, ok := s.state.storage[tempArr[1]]
-
-		if ok {
-			value, err := strconv.Atoi(val.val.(string))
-			if err != nil {
-				s.state.storageMu.Unlock()
-				return CommandResponse{Error: "-ERR value is not an integer or out of range"}
-			} else {
-				value++
-				s.state.storage[tempArr[1]] = storageVal{val: strconv.Itoa(value), px: -1, t: time.Now()}
-				resp := fmt.Sprintf(":%d", value)
-				s.state.storageMu.Unlock()
-
-				s.state.replicaMu.RLock()
-				for _, replica := range s.state.replicaConns {
-					replica.Write(encodeBulkArray(tempArr))
-				}
-				s.state.replicaMu.RUnlock()
-
-				return CommandResponse{Response: resp}
-			}
-		} else {
-			val := storageVal{val: "1", px: -1, t: time.Now()}
-			s.state.storage[tempArr[1]] = val
-			s.state.storageMu.Unlock()
+		return s.incrBy(tempArr, 1)
 
-			s.state.replicaMu.RLock()
-			for _, replica := range s.state.replicaConns {
-				replica.Write(encodeBulkArray(tempArr))
-			}
-			s.state.replicaMu.RUnlock()
-
-			return CommandResponse{Response: ":1"}
+	case RESP_COMMAND_DECR:
+		if len(tempArr) != 2 {
+			return CommandResponse{Error: "-ERR wrong number of arguments for 'DECR' command"}
 		}
+		return s.incrBy(tempArr, -1)
 
-	case RESP_COMMAND_RPUSH:
-		if len(tempArr) < 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'RPUSH' command"}
-		}
+	case RESP_COMMAND_INCRBY:
+		return s.incrbyCommand(tempArr, RESP_COMMAND_INCRBY)
 
-		key := tempArr[1]
-		newElems := tempArr[2:]
+	case RESP_COMMAND_DECRBY:
+		return s.incrbyCommand(tempArr, RESP_COMMAND_DECRBY)
 
-		s.state.storageMu.Lock()
-		value, ok := s.state.storage[key]
+	case RESP_COMMAND_INCRBYFLOAT:
+		return s.incrbyfloatCommand(tempArr)
 
-		if ok {
-			if list, ok := value.val.([]string); ok {
-				list = append(list, newElems...)
-				value.val = list
-				s.state.storage[key] = value
-			} else {
-				s.state.storageMu.Unlock()
-				return CommandResponse{Error: "-ERR wrong type of value for 'RPUSH' command"}
-			}
-		} else {
-			s.state.storage[key] = storageVal{
-				val: newElems,
-				px:  -1,
-				t:   time.Now(),
-			}
-		}
-		listLen := len(s.state.storage[key].val.([]string))
-		s.state.storageMu.Unlock()
+	case RESP_COMMAND_RPUSH:
+		return s.pushCommand(tempArr, false, false)
 
-		return CommandResponse{
-			Response: ":" + strconv.Itoa(listLen) + "\r\n",
-		}
+	case RESP_COMMAND_LPUSH:
+		return s.pushCommand(tempArr, true, false)
+
+	case RESP_COMMAND_RPUSHX:
+		return s.pushCommand(tempArr, false, true)
+
+	case RESP_COMMAND_LPUSHX:
+		return s.pushCommand(tempArr, true, true)
 
 	case RESP_COMMAND_LRANGE:
-		if len(tempArr) < 4 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'LRANGE' command"}
-		}
+		return s.lrangeCommand(tempArr)
 
-		key := tempArr[1]
-		startIdx, err1 := strconv.Atoi(tempArr[2])
-		endIdx, err2 := strconv.Atoi(tempArr[3])
+	case RESP_COMMAND_LLEN:
+		return s.llenCommand(tempArr)
 
-		if err1 != nil || err2 != nil {
-			return CommandResponse{Error: "-ERR value is not an integer or out of range"}
-		}
+	case RESP_COMMAND_LPOP:
+		return s.popCommand(tempArr, true)
 
-		s.state.storageMu.RLock()
-		value, ok := s.state.storage[key]
-		s.state.storageMu.RUnlock()
+	case RESP_COMMAND_RPOP:
+		return s.popCommand(tempArr, false)
 
-		if !ok {
-			return CommandResponse{Response: "*0\r\n"}
-		}
+	case RESP_COMMAND_LINDEX:
+		return s.lindexCommand(tempArr)
 
-		list, ok := value.val.([]string)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'LRANGE' command"}
-		}
+	case RESP_COMMAND_LSET:
+		return s.lsetCommand(tempArr)
 
-		listLen := len(list)
+	case RESP_COMMAND_LINSERT:
+		return s.linsertCommand(tempArr)
 
-		if startIdx < 0 {
-			startIdx = listLen + startIdx
-			if startIdx < 0 {
-				startIdx = 0
-			}
-		}
-		if endIdx < 0 {
-			endIdx = listLen + endIdx
-			if endIdx < 0 {
-				endIdx = 0
-			}
-		}
+	case RESP_COMMAND_LREM:
+		return s.lremCommand(tempArr)
 
-		if startIdx >= listLen || startIdx > endIdx {
-			return CommandResponse{Response: "*0\r\n"}
-		}
-		if endIdx >= listLen {
-			endIdx = listLen - 1
-		}
+	case RESP_COMMAND_LTRIM:
+		return s.ltrimCommand(tempArr)
 
-		result := list[startIdx : endIdx+1]
+	case RESP_COMMAND_LPOS:
+		return s.lposCommand(tempArr)
 
-		resp := "*" + strconv.Itoa(len(result)) + "\r\n"
-		for _, elem := range result {
-			resp += "$" + strconv.Itoa(len(elem)) + "\r\n" + elem + "\r\n"
-		}
+	case RESP_COMMAND_RPOPLPUSH:
+		return s.rpoplpushCommand(tempArr)
 
-		return CommandResponse{Response: resp}
+	case RESP_COMMAND_LMPOP:
+		return s.lmpopCommand(tempArr)
 
-	case RESP_COMMAND_LPUSH:
-		if len(tempArr) < 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'LPUSH' command"}
-		}
+	case RESP_COMMAND_LMOVE:
+		return s.lmoveCommand(tempArr)
 
-		key := tempArr[1]
-		newElems := tempArr[2:]
+	case RESP_COMMAND_BLPOP:
+		return s.blockingPop(tempArr, true)
 
-		s.state.storageMu.Lock()
-		value, ok := s.state.storage[key]
+	case RESP_COMMAND_BRPOP:
+		return s.blockingPop(tempArr, false)
 
-		if ok {
-			list, ok := value.val.([]string)
-			if !ok {
-				s.state.storageMu.Unlock()
-				return CommandResponse{Error: "-ERR wrong type of value for 'LPUSH' command"}
-			}
-			for _, elem := range newElems {
-				list = append([]string{elem}, list...)
-			}
-			value.val = list
-			s.state.storage[key] = value
-		} else {
-			rev := make([]string, len(newElems))
-			for i, v := range newElems {
-				rev[len(newElems)-1-i] = v
-			}
-			s.state.storage[key] = storageVal{val: rev, px: -1, t: time.Now()}
-		}
-		listLen := len(s.state.storage[key].val.([]string))
-		s.state.storageMu.Unlock()
+	case RESP_COMMAND_BLMOVE:
+		return s.blmoveCommand(tempArr)
 
-		return CommandResponse{Response: ":" + strconv.Itoa(listLen) + "\r\n"}
+	case RESP_COMMAND_BRPOPLPUSH:
+		return s.brpoplpushCommand(tempArr)
 
-	case RESP_COMMAND_LLEN:
-		if len(tempArr) != 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'LLEN' command"}
-		}
+	case RESP_COMMAND_BLMPOP:
+		return s.blmpopCommand(tempArr)
 
-		key := tempArr[1]
+	case RESP_COMMAND_HSET, RESP_COMMAND_HMSET:
+		return s.hsetCommand(tempArr)
 
-		s.state.storageMu.RLock()
-		value, ok := s.state.storage[key]
-		s.state.storageMu.RUnlock()
+	case RESP_COMMAND_HSETNX:
+		return s.hsetnxCommand(tempArr)
 
-		if !ok {
-			return CommandResponse{Response: ":0\r\n"}
-		}
+	case RESP_COMMAND_HGET:
+		return s.hgetCommand(tempArr)
 
-		list, ok := value.val.([]string)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'LLEN' command"}
-		}
+	case RESP_COMMAND_HMGET:
+		return s.hmgetCommand(tempArr)
 
-		return CommandResponse{Response: ":" + strconv.Itoa(len(list)) + "\r\n"}
+	case RESP_COMMAND_HGETALL:
+		return s.hashDump(tempArr, true, true)
 
-	case RESP_COMMAND_LPOP:
-		if len(tempArr) < 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'LPOP' command"}
-		}
+	case RESP_COMMAND_HKEYS:
+		return s.hashDump(tempArr, true, false)
 
-		key := tempArr[1]
+	case RESP_COMMAND_HVALS:
+		return s.hashDump(tempArr, false, true)
 
-		s.state.storageMu.Lock()
-		value, ok := s.state.storage[key]
-		if !ok {
-			s.state.storageMu.Unlock()
-			return CommandResponse{Response: "$-1\r\n"}
-		}
+	case RESP_COMMAND_HDEL:
+		return s.hdelCommand(tempArr)
 
-		list, ok := value.val.([]string)
-		if !ok || len(list) == 0 {
-			s.state.storageMu.Unlock()
-			return CommandResponse{Response: "$-1\r\n"}
-		}
+	case RESP_COMMAND_HEXISTS:
+		return s.hexistsCommand(tempArr)
 
-		count := 1
-		if len(tempArr) == 3 {
-			var err error
-			count, err = strconv.Atoi(tempArr[2])
-			if err != nil || count < 0 {
-				s.state.storageMu.Unlock()
-				return CommandResponse{Error: "-ERR value is not an integer or out of range"}
-			}
-		}
+	case RESP_COMMAND_HLEN:
+		return s.hlenCommand(tempArr)
 
-		if count == 0 {
-			s.state.storageMu.Unlock()
-			return CommandResponse{Response: "*0\r\n"}
-		}
-		if count > len(list) {
-			count = len(list)
-		}
+	case RESP_COMMAND_HSTRLEN:
+		return s.hstrlenCommand(tempArr)
 
-		removed := list[:count]
-		remaining := list[count:]
+	case RESP_COMMAND_HINCRBY:
+		return s.hincrbyCommand(tempArr)
 
-		if len(remaining) == 0 {
-			delete(s.state.storage, key)
-		} else {
-			value.val = remaining
-			s.state.storage[key] = value
-		}
-		s.state.storageMu.Unlock()
+	case RESP_COMMAND_HINCRBYFLOAT:
+		return s.hincrbyfloatCommand(tempArr)
 
-		if count == 1 && len(tempArr) == 2 {
-			elem := removed[0]
-			return CommandResponse{Response: "$" + strconv.Itoa(len(elem)) + "\r\n" + elem + "\r\n"}
-		}
+	case RESP_COMMAND_HRANDFIELD:
+		return s.hrandfieldCommand(tempArr)
 
-		resp := "*" + strconv.Itoa(len(removed)) + "\r\n"
-		for _, elem := range removed {
-			resp += "$" + strconv.Itoa(len(elem)) + "\r\n" + elem + "\r\n"
-		}
-		return CommandResponse{Response: resp}
+	case RESP_COMMAND_HSCAN:
+		return s.hscanCommand(tempArr)
 
-	case RESP_COMMAND_SUBSCRIBE:
-		if len(tempArr) < 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'SUBSCRIBE' command"}
-		}
+	case RESP_COMMAND_HEXPIRE, RESP_COMMAND_HPEXPIRE, RESP_COMMAND_HEXPIREAT, RESP_COMMAND_HPEXPIREAT:
+		return s.hexpireCommand(tempArr)
 
-		s.SubscribedMode = true
-
-		responses := ""
-		for _, chName := range tempArr[1:] {
-			s.state.channelsMu.Lock()
-			channel, exists := s.state.channels[chName]
-
-			if !exists {
-				channel = Channel{name: chName, connections: []*net.Conn{&s.conn}}
-				s.state.channels[chName] = channel
-			} else {
-				channel.mu.Lock()
-				already := false
-				for _, c := range channel.connections {
-					if *c == s.conn {
-						already = true
-						break
-					}
-				}
-				if !already {
-					channel.connections = append(channel.connections, &s.conn)
-					s.state.channels[chName] = channel
-				}
-				channel.mu.Unlock()
-			}
-			s.state.channelsMu.Unlock()
-
-			s.state.channelsMu.RLock()
-			subCount := 0
-			for _, ch := range s.state.channels {
-				ch.mu.RLock()
-				for _, c := range ch.connections {
-					if *c == s.conn {
-						subCount++
-						break
-					}
-				}
-				ch.mu.RUnlock()
-			}
-			s.state.channelsMu.RUnlock()
+	case RESP_COMMAND_HTTL, RESP_COMMAND_HPTTL, RESP_COMMAND_HEXPIRETIME, RESP_COMMAND_HPEXPIRETIME:
+		return s.httlCommand(tempArr)
 
-			resp := "*3\r\n" +
-				"$9\r\nsubscribe\r\n" +
-				"$" + strconv.Itoa(len(chName)) + "\r\n" + chName + "\r\n" +
-				":" + strconv.Itoa(subCount) + "\r\n"
+	case RESP_COMMAND_HPERSIST:
+		return s.hpersistCommand(tempArr)
 
-			responses += resp
-		}
+	case RESP_COMMAND_SADD:
+		return s.saddCommand(tempArr)
 
-		return CommandResponse{Response: responses}
+	case RESP_COMMAND_SREM:
+		return s.sremCommand(tempArr)
 
-	case RESP_COMMAND_PUBLISH:
-		if len(tempArr) < 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'PUBLISH' command"}
-		}
+	case RESP_COMMAND_SISMEMBER:
+		return s.sismemberCommand(tempArr)
 
-		channelName := tempArr[1]
-		message := tempArr[2]
+	case RESP_COMMAND_SMISMEMBER:
+		return s.smismemberCommand(tempArr)
 
-		channel, exists := s.state.channels[channelName]
-		if !exists {
-			return CommandResponse{Response: ":0\r\n"}
-		}
+	case RESP_COMMAND_SMEMBERS:
+		return s.smembersCommand(tempArr)
 
-		deliver := "*3\r\n" +
-			"$7\r\nmessage\r\n" +
-			"$" + strconv.Itoa(len(channelName)) + "\r\n" + channelName + "\r\n" +
-			"$" + strconv.Itoa(len(message)) + "\r\n" + message + "\r\n"
+	case RESP_COMMAND_SCARD:
+		return s.scardCommand(tempArr)
 
-		for _, conn := range channel.connections {
-			(*conn).Write([]byte(deliver))
-		}
+	case RESP_COMMAND_SPOP:
+		return s.spopCommand(tempArr)
 
-		count := len(channel.connections)
-		return CommandResponse{Response: ":" + strconv.Itoa(count) + "\r\n"}
+	case RESP_COMMAND_SRANDMEMBER:
+		return s.srandmemberCommand(tempArr)
+
+	case RESP_COMMAND_SMOVE:
+		return s.smoveCommand(tempArr)
+
+	case RESP_COMMAND_SUNION:
+		return s.setAlgebraCommand(tempArr, setOpUnion)
+
+	case RESP_COMMAND_SINTER:
+		return s.setAlgebraCommand(tempArr, setOpInter)
+
+	case RESP_COMMAND_SDIFF:
+		return s.setAlgebraCommand(tempArr, setOpDiff)
+
+	case RESP_COMMAND_SUNIONSTORE:
+		return s.setAlgebraStoreCommand(tempArr, setOpUnion)
+
+	case RESP_COMMAND_SINTERSTORE:
+		return s.setAlgebraStoreCommand(tempArr, setOpInter)
+
+	case RESP_COMMAND_SDIFFSTORE:
+		return s.setAlgebraStoreCommand(tempArr, setOpDiff)
+
+	case RESP_COMMAND_SINTERCARD:
+		return s.sintercardCommand(tempArr)
+
+	case RESP_COMMAND_SUBSCRIBE:
+		return s.subscribeCommand(tempArr, pubsubChannel)
 
 	case RESP_COMMAND_UNSUBSCRIBE:
-		s.SubscribedMode = true
-
-		responses := ""
-		channelsToUnsub := tempArr[1:]
-		if len(channelsToUnsub) == 0 {
-			for chName, channel := range s.state.channels {
-				newConns := []*net.Conn{}
-				for _, c := range channel.connections {
-					if *c != s.conn {
-						newConns = append(newConns, c)
-					}
-				}
-				channel.connections = newConns
-				s.state.channels[chName] = channel
-
-				subCount := 0
-				for _, ch := range s.state.channels {
-					for _, c := range ch.connections {
-						if *c == s.conn {
-							subCount++
-							break
-						}
-					}
-				}
-
-				resp := "*3\r\n" +
-					"$11\r\nunsubscribe\r\n" +
-					"$" + strconv.Itoa(len(chName)) + "\r\n" + chName + "\r\n" +
-					":" + strconv.Itoa(subCount) + "\r\n"
-
-				responses += resp
-			}
-			return CommandResponse{Response: responses}
-		}
+		return s.unsubscribeCommand(tempArr, pubsubChannel)
 
-		// Otherwise unsubscribe from the given channels
-		for _, chName := range channelsToUnsub {
-			channel, exists := s.state.channels[chName]
-			if exists {
-				newConns := []*net.Conn{}
-				for _, c := range channel.connections {
-					if *c != s.conn {
-						newConns = append(newConns, c)
-					}
-				}
-				channel.connections = newConns
-				s.state.channels[chName] = channel
-			}
+	case RESP_COMMAND_PUBLISH:
+		return s.publishCommand(tempArr, false)
 
-			// Count how many channels remain for this client
-			subCount := 0
-			for _, ch := range s.state.channels {
-				for _, c := range ch.connections {
-					if *c == s.conn {
-						subCount++
-						break
-					}
-				}
-			}
+	case RESP_COMMAND_SSUBSCRIBE:
+		return s.subscribeCommand(tempArr, pubsubShard)
 
-			resp := "*3\r\n" +
-				"$11\r\nunsubscribe\r\n" +
-				"$" + strconv.Itoa(len(chName)) + "\r\n" + chName + "\r\n" +
-				":" + strconv.Itoa(subCount) + "\r\n"
+	case RESP_COMMAND_SUNSUBSCRIBE:
+		return s.unsubscribeCommand(tempArr, pubsubShard)
 
-			responses += resp
-		}
+	case RESP_COMMAND_SPUBLISH:
+		return s.publishCommand(tempArr, true)
 
-		return CommandResponse{Response: responses}
+	case RESP_COMMAND_PUBSUB:
+		return s.pubsubCommand(tempArr)
 
-	case RESP_COMMAND_ZADD:
-		if len(tempArr) < 4 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'ZADD' command"}
-		}
+	case RESP_COMMAND_CLIENT:
+		return s.clientCommand(tempArr)
 
-		key := tempArr[1]
-		scoreStr := tempArr[2]
-		member := tempArr[3]
+	case RESP_COMMAND_PSUBSCRIBE:
+		return s.subscribeCommand(tempArr, pubsubPattern)
 
-		score, err := strconv.ParseFloat(scoreStr, 64)
-		if err != nil {
-			return CommandResponse{Error: "-ERR value is not a valid float"}
-		}
+	case RESP_COMMAND_PUNSUBSCRIBE:
+		return s.unsubscribeCommand(tempArr, pubsubPattern)
 
-		value, exists := s.state.storage[key]
-		var zset *sortedset.SortedSet
+	case RESP_COMMAND_ZADD:
+		return s.zaddCommand(tempArr)
 
-		if exists {
-			var ok bool
-			zset, ok = value.val.(*sortedset.SortedSet)
-			if !ok {
-				return CommandResponse{Error: "-ERR wrong type of value for 'ZADD' command"}
-			}
-		} else {
-			zset = sortedset.New()
-			s.state.storage[key] = storageVal{val: zset, px: -1, t: time.Now()}
-		}
+	case RESP_COMMAND_ZINCRBY:
+		return s.zincrbyCommand(tempArr)
 
-		added := zset.AddOrUpdate(member, sortedset.SCORE(score), nil)
+	case RESP_COMMAND_ZSCORE:
+		return s.zscoreCommand(tempArr)
 
-		if added {
-			return CommandResponse{Response: ":1\r\n"}
-		} else {
-			return CommandResponse{Response: ":0\r\n"}
-		}
+	case RESP_COMMAND_ZMSCORE:
+		return s.zmscoreCommand(tempArr)
+
+	case RESP_COMMAND_ZCARD:
+		return s.zcardCommand(tempArr)
+
+	case RESP_COMMAND_ZCOUNT:
+		return s.zcountCommand(tempArr)
 
 	case RESP_COMMAND_ZRANK:
-		if len(tempArr) != 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'ZRANK' command"}
-		}
+		return s.zrankCommand(tempArr, false)
 
-		key := tempArr[1]
-		member := tempArr[2]
+	case RESP_COMMAND_ZREVRANK:
+		return s.zrankCommand(tempArr, true)
 
-		value, exists := s.state.storage[key]
-		if !exists {
-			return CommandResponse{Response: "$-1"}
-		}
+	case RESP_COMMAND_ZREM:
+		return s.zremCommand(tempArr)
 
-		zset, ok := value.val.(*sortedset.SortedSet)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'ZRANK' command"}
-		}
+	case RESP_COMMAND_ZRANGE:
+		return s.zrangeCommand(tempArr, zrangeByRank, false, "BYSCORE BYLEX REV LIMIT WITHSCORES")
 
-		r1 := zset.FindRank(member)
-		if r1 == 0 {
-			return CommandResponse{Response: "$-1"}
-		}
+	case RESP_COMMAND_ZREVRANGE:
+		return s.zrangeCommand(tempArr, zrangeByRank, true, "WITHSCORES")
 
-		return CommandResponse{Response: fmt.Sprintf(":%d", r1-1)}
+	case RESP_COMMAND_ZRANGEBYSCORE:
+		return s.zrangeCommand(tempArr, zrangeByScore, false, "LIMIT WITHSCORES")
 
-	case RESP_COMMAND_ZRANGE:
-		if len(tempArr) < 4 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'ZRANGE' command"}
-		}
+	case RESP_COMMAND_ZREVRANGEBYSCORE:
+		return s.zrangeCommand(tempArr, zrangeByScore, true, "LIMIT WITHSCORES")
 
-		key := tempArr[1]
-		startIdx, err1 := strconv.Atoi(tempArr[2])
-		stopIdx, err2 := strconv.Atoi(tempArr[3])
-		if err1 != nil || err2 != nil {
-			return CommandResponse{Error: "-ERR value is not an integer or out of range"}
-		}
+	case RESP_COMMAND_ZRANGEBYLEX:
+		return s.zrangeCommand(tempArr, zrangeByLex, false, "LIMIT")
 
-		value, exists := s.state.storage[key]
-		if !exists {
-			return CommandResponse{Response: "*0\r\n"}
-		}
+	case RESP_COMMAND_ZREVRANGEBYLEX:
+		return s.zrangeCommand(tempArr, zrangeByLex, true, "LIMIT")
 
-		zset, ok := value.val.(*sortedset.SortedSet)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'ZRANGE' command"}
-		}
+	case RESP_COMMAND_ZRANGESTORE:
+		return s.zrangestoreCommand(tempArr)
 
-		start, stop := convertIndexes(zset, startIdx, stopIdx)
-		if start > stop || start > zset.GetCount() {
-			return CommandResponse{Response: "*0\r\n"}
-		}
+	case RESP_COMMAND_ZPOPMIN:
+		return s.zpopCommand(tempArr, false)
 
-		nodes := zset.GetByRankRange(start, stop, false)
+	case RESP_COMMAND_ZPOPMAX:
+		return s.zpopCommand(tempArr, true)
 
-		var b strings.Builder
-		b.WriteString(fmt.Sprintf("*%d\r\n", len(nodes)))
-		for _, node := range nodes {
-			b.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(node.Key()), node.Key()))
-		}
+	case RESP_COMMAND_ZREMRANGEBYRANK:
+		return s.zremrangeCommand(tempArr, zrangeByRank)
 
-		return CommandResponse{Response: b.String()}
+	case RESP_COMMAND_ZREMRANGEBYSCORE:
+		return s.zremrangeCommand(tempArr, zrangeByScore)
 
-	case RESP_COMMAND_ZCARD:
-		if len(tempArr) != 2 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'ZCARD' command"}
-		}
+	case RESP_COMMAND_ZREMRANGEBYLEX:
+		return s.zremrangeCommand(tempArr, zrangeByLex)
 
-		key := tempArr[1]
-		value, exists := s.state.storage[key]
-		if !exists {
-			return CommandResponse{Response: ":0\r\n"}
-		}
+	case RESP_COMMAND_ZRANDMEMBER:
+		return s.zrandmemberCommand(tempArr)
 
-		zset, ok := value.val.(*sortedset.SortedSet)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'ZCARD' command"}
-		}
+	case RESP_COMMAND_ZMPOP:
+		return s.zmpopCommand(tempArr)
 
-		count := zset.GetCount()
-		return CommandResponse{Response: fmt.Sprintf(":%d\r\n", count)}
+	case RESP_COMMAND_BZPOPMIN:
+		return s.bzpopCommand(tempArr, false)
 
-	// case RESP_COMMAND_ZSCORE:
-	// 	if len(tempArr) != 3 {
-	// 		return CommandResponse{Error: "-ERR wrong number of arguments for 'ZSCORE' command"}
-	// 	}
+	case RESP_COMMAND_BZPOPMAX:
+		return s.bzpopCommand(tempArr, true)
 
-	// 	key := tempArr[1]
-	// 	member := tempArr[2]
+	case RESP_COMMAND_BZMPOP:
+		return s.bzmpopCommand(tempArr)
 
-	// 	wz, ok := s.getZSet(key)
-	// 	if !ok {
-	// 		// key doesn't exist -> nil bulk string
-	// 		return CommandResponse{Response: "$-1\r\n"}
-	// 	}
+	case RESP_COMMAND_XADD:
+		return s.xaddCommand(tempArr)
 
-	// 	// First try to return preserved original score string if present
-	// 	if sstr, found := wz.scoreStr[member]; found {
-	// 		return CommandResponse{Response: fmt.Sprintf("$%d\r\n%s\r\n", len(sstr), sstr)}
-	// 	}
+	case RESP_COMMAND_XLEN:
+		return s.xlenCommand(tempArr)
 
-	// 	// Fallback: check the node in sortedset (if wrapper doesn't have score string)
-	// 	node := wz.set.GetByKey(member)
-	// 	if node == nil {
-	// 		return CommandResponse{Response: "$-1\r\n"}
-	// 	}
+	case RESP_COMMAND_XRANGE:
+		return s.xrangeCommand(tempArr, false)
 
-	// 	// If we fall here, format the numeric score (best-effort)
-	// 	scoreStrFormatted := strconv.FormatFloat(float64(node.Score()), 'f', -1, 64)
-	// 	return CommandResponse{Response: fmt.Sprintf("$%d\r\n%s\r\n", len(scoreStrFormatted), scoreStrFormatted)}
+	case RESP_COMMAND_XREVRANGE:
+		return s.xrangeCommand(tempArr, true)
 
-	case RESP_COMMAND_ZREM:
-		if len(tempArr) != 3 {
-			return CommandResponse{Error: "-ERR wrong number of arguments for 'ZREM' command"}
-		}
+	case RESP_COMMAND_XREAD:
+		return s.xreadCommand(tempArr)
 
-		key := tempArr[1]
-		member := tempArr[2]
+	case RESP_COMMAND_XDEL:
+		return s.xdelCommand(tempArr)
 
-		value, exists := s.state.storage[key]
-		if !exists {
-			return CommandResponse{Response: ":0\r\n"}
-		}
+	case RESP_COMMAND_XTRIM:
+		return s.xtrimCommand(tempArr)
 
-		zset, ok := value.val.(*sortedset.SortedSet)
-		if !ok {
-			return CommandResponse{Error: "-ERR wrong type of value for 'ZREM' command"}
-		}
+	case RESP_COMMAND_XINFO:
+		return s.xinfoCommand(tempArr)
 
-		removed := zset.Remove(member)
-		if removed == nil {
-			return CommandResponse{Response: ":0\r\n"}
-		}
-		return CommandResponse{Response: ":1\r\n"}
+	case RESP_COMMAND_XGROUP:
+		return s.xgroupCommand(tempArr)
+
+	case RESP_COMMAND_XREADGROUP:
+		return s.xreadgroupCommand(tempArr)
+
+	case RESP_COMMAND_XACK:
+		return s.xackCommand(tempArr)
+
+	case RESP_COMMAND_XPENDING:
+		return s.xpendingCommand(tempArr)
+
+	case RESP_COMMAND_XCLAIM:
+		return s.xclaimCommand(tempArr)
+
+	case RESP_COMMAND_XAUTOCLAIM:
+		return s.xautoclaimCommand(tempArr)
+
+	case RESP_COMMAND_SETBIT:
+		return s.setbitCommand(tempArr)
+
+	case RESP_COMMAND_GETBIT:
+		return s.getbitCommand(tempArr)
+
+	case RESP_COMMAND_BITCOUNT:
+		return s.bitcountCommand(tempArr)
+
+	case RESP_COMMAND_BITPOS:
+		return s.bitposCommand(tempArr)
+
+	case RESP_COMMAND_BITOP:
+		return s.bitopCommand(tempArr)
+
+	case RESP_COMMAND_BITFIELD:
+		return s.bitfieldCommand(tempArr, false)
+
+	case RESP_COMMAND_BITFIELD_RO:
+		return s.bitfieldCommand(tempArr, true)
+
+	case RESP_COMMAND_PFADD:
+		return s.pfaddCommand(tempArr)
+
+	case RESP_COMMAND_PFCOUNT:
+		return s.pfcountCommand(tempArr)
+
+	case RESP_COMMAND_PFMERGE:
+		return s.pfmergeCommand(tempArr)
+
+	case RESP_COMMAND_GEOADD:
+		return s.geoaddCommand(tempArr)
+
+	case RESP_COMMAND_GEOPOS:
+		return s.geoposCommand(tempArr)
+
+	case RESP_COMMAND_GEODIST:
+		return s.geodistCommand(tempArr)
+
+	case RESP_COMMAND_GEOHASH:
+		return s.geohashCommand(tempArr)
+
+	case RESP_COMMAND_GEOSEARCH:
+		return s.geoSearchCommand(tempArr, false)
+
+	case RESP_COMMAND_GEOSEARCHSTORE:
+		return s.geoSearchCommand(tempArr, true)
+
+	case RESP_COMMAND_ZUNION:
+		return s.zsetAlgebraCommand(tempArr, setOpUnion)
+
+	case RESP_COMMAND_ZINTER:
+		return s.zsetAlgebraCommand(tempArr, setOpInter)
+
+	case RESP_COMMAND_ZDIFF:
+		return s.zsetAlgebraCommand(tempArr, setOpDiff)
+
+	case RESP_COMMAND_ZUNIONSTORE:
+		return s.zsetAlgebraStoreCommand(tempArr, setOpUnion)
+
+	case RESP_COMMAND_ZINTERSTORE:
+		return s.zsetAlgebraStoreCommand(tempArr, setOpInter)
+
+	case RESP_COMMAND_ZDIFFSTORE:
+		return s.zsetAlgebraStoreCommand(tempArr, setOpDiff)
+
+	case RESP_COMMAND_EVAL:
+		return s.evalCommand(tempArr, false)
+
+	case RESP_COMMAND_EVALSHA:
+		return s.evalShaCommand(tempArr, false)
+
+	case RESP_COMMAND_EVAL_RO:
+		return s.evalCommand(tempArr, true)
+
+	case RESP_COMMAND_EVALSHA_RO:
+		return s.evalShaCommand(tempArr, true)
+
+	case RESP_COMMAND_SCRIPT:
+		return s.scriptCommand(tempArr)
+
+	case RESP_COMMAND_FUNCTION:
+		return s.functionCommand(tempArr)
+
+	case RESP_COMMAND_FCALL:
+		return s.fcallCommand(tempArr, false)
+
+	case RESP_COMMAND_FCALL_RO:
+		return s.fcallCommand(tempArr, true)
+
+	case RESP_COMMAND_AUTH:
+		return s.authCommand(tempArr)
+
+	case RESP_COMMAND_HELLO:
+		return s.helloCommand(tempArr)
+
+	case RESP_COMMAND_ACL:
+		return s.aclCommand(tempArr)
 
 	default:
-		return CommandResponse{Error: "-ERR unknown command"}
+		return CommandResponse{Error: unknownCommandError(tempArr)}
 	}
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// configParam is a parameter exposed through CONFIG GET and CONFIG SET.
+type configParam struct {
+	get func(st *RedisState) string
+	// parse validates a new value and returns the function applying it. It
+	// is nil for parameters fixed at startup.
+	parse func(value string) (apply func(st *RedisState), errMsg string)
+}
+
+var configParams = map[string]configParam{
+	"dir": {
+		get: func(st *RedisState) string { return st.config.Directory },
+	},
+	"dbfilename": {
+		get: func(st *RedisState) string {
+			if st.config.dbFileName == "" {
+				return "dump.rdb"
+			}
+			return st.config.dbFileName
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(st *RedisState) string {
+			return keyspaceEventsString(int(st.config.notifyKeyspaceEvents.Load()))
+		},
+		parse: func(value string) (func(st *RedisState), string) {
+			flags, ok := parseKeyspaceEvents(value)
+			if !ok {
+				return nil, "Invalid event class character. Use 'Ag$lshzxetmKE'."
+			}
+			return func(st *RedisState) { st.config.notifyKeyspaceEvents.Store(int32(flags)) }, ""
+		},
+	},
+	"requirepass": {
+		get: func(st *RedisState) string { return st.config.requirePass() },
+		parse: func(value string) (func(st *RedisState), string) {
+			return func(st *RedisState) {
+				st.config.requirepass.Store(value)
+				st.setDefaultUserPassword(value)
+			}, ""
+		},
+	},
+	"masterauth": {
+		get: func(st *RedisState) string { return st.config.masterAuth() },
+		parse: func(value string) (func(st *RedisState), string) {
+			return func(st *RedisState) { st.config.masterauth.Store(value) }, ""
+		},
+	},
+	"masteruser": {
+		get: func(st *RedisState) string { return st.config.masterUser() },
+		parse: func(value string) (func(st *RedisState), string) {
+			return func(st *RedisState) { st.config.masteruser.Store(value) }, ""
+		},
+	},
+	"aclfile": {
+		get: func(st *RedisState) string { return st.config.aclFile },
+	},
+	"busy-reply-threshold": busyReplyThresholdParam,
+	// lua-time-limit is the name busy-reply-threshold had before Redis 7.
+	"lua-time-limit": busyReplyThresholdParam,
+}
+
+var busyReplyThresholdParam = configParam{
+	get: func(st *RedisState) string {
+		return strconv.FormatInt(st.config.busyReplyThreshold.Load(), 10)
+	},
+	parse: func(value string) (func(st *RedisState), string) {
+		ms, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || ms < 0 {
+			return nil, "argument couldn't be parsed into an integer"
+		}
+		return func(st *RedisState) { st.config.busyReplyThreshold.Store(ms) }, ""
+	},
+}
+
+func (s *RedisServer) configCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("CONFIG")
+	}
+
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "GET" && len(args) >= 3:
+		return s.configGetCommand(args[2:])
+	case sub == "SET" && len(args) >= 4 && len(args)%2 == 0:
+		return s.configSetCommand(args[2:])
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try CONFIG HELP."}
+}
+
+// configGetCommand replies with the name and value of every parameter that
+// matches one of the glob patterns.
+func (s *RedisServer) configGetCommand(patterns []string) CommandResponse {
+	var names []string
+	for name := range configParams {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), name) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	reply := make([]string, 0, 2*len(names))
+	for _, name := range names {
+		reply = append(reply, name, configParams[name].get(s.state))
+	}
+	return CommandResponse{Response: toRespStrArr(reply)}
+}
+
+// configSetCommand sets every name/value pair, or none of them if any name
+// is unknown or any value invalid.
+func (s *RedisServer) configSetCommand(pairs []string) CommandResponse {
+	applies := make([]func(st *RedisState), 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		name := strings.ToLower(pairs[i])
+		param, ok := configParams[name]
+		if !ok || param.parse == nil {
+			return CommandResponse{Error: "-ERR Unknown option or number of arguments for CONFIG SET - '" + pairs[i] + "'"}
+		}
+		apply, errMsg := param.parse(pairs[i+1])
+		if errMsg != "" {
+			return CommandResponse{Error: "-ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + errMsg}
+		}
+		applies = append(applies, apply)
+	}
+
+	for _, apply := range applies {
+		apply(s.state)
+	}
+	return CommandResponse{Response: "+OK\r\n"}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"time"
+)
+
+// The active expire cycle mirrors Redis' serverCron: every
+// activeExpirePeriod it samples keys with a TTL, expiring the ones whose
+// time has come, and keeps sampling while more than a quarter of a sample
+// turns out expired, within activeExpireBudget.
+const (
+	activeExpirePeriod     = 100 * time.Millisecond
+	activeExpireBudget     = 25 * time.Millisecond
+	activeExpireSampleSize = 20
+	// activeExpireMaxLookups bounds the keys looked at for one sample, so
+	// a keyspace with few volatile keys is not walked end to end.
+	activeExpireMaxLookups = 20 * activeExpireSampleSize
+)
+
+// expireKey removes key, whose TTL has elapsed, raising an expired event.
+// The caller must hold storageMu for writing.
+func (st *RedisState) expireKey(key string) {
+	delete(st.storage, key)
+	st.keyModified(notifyExpired, "expired", key)
+}
+
+// activeExpireLoop runs the active expire cycle forever. Only a master
+// runs it: replicas wait for the DEL their master sends for each key.
+func (st *RedisState) activeExpireLoop() {
+	ticker := time.NewTicker(activeExpirePeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		st.activeExpireCycle()
+	}
+}
+
+// activeExpireCycle expires keys nobody reads, so that their expired events
+// fire and their memory is reclaimed without waiting for a lookup. A cycle
+// is skipped while a transaction or script runs, since neither may see keys
+// disappear under it.
+func (st *RedisState) activeExpireCycle() {
+	if !st.txMu.TryRLock() {
+		return
+	}
+	defer st.txMu.RUnlock()
+	st.storageMu.Lock()
+	defer st.storageMu.Unlock()
+
+	start := time.Now()
+	for time.Since(start) < activeExpireBudget {
+		sampled, expired := st.activeExpireSample(time.Now())
+		if sampled == 0 || expired*4 <= sampled {
+			return
+		}
+	}
+}
+
+// activeExpireSample looks at up to activeExpireSampleSize keys with a
+// TTL, or hashes with field TTLs, starting from a random point of the
+// keyspace, and expires the keys and fields due at now. Each expired key is
+// propagated as a DEL, and the expired fields of a hash as an HDEL.
+func (st *RedisState) activeExpireSample(now time.Time) (sampled, expired int) {
+	lookups := 0
+	for key, value := range st.storage {
+		if lookups++; lookups > activeExpireMaxLookups || sampled == activeExpireSampleSize {
+			break
+		}
+		hash, _ := value.val.(*hashValue)
+		fieldTTLs := hash != nil && hash.ttlFields > 0
+		if value.px == -1 && !fieldTTLs {
+			continue
+		}
+		sampled++
+		if value.expired(now) {
+			st.expireKey(key)
+			st.propagate([]string{"DEL", key})
+			expired++
+		} else if fieldTTLs && st.expireHashFields(key, hash, now.UnixMilli()) {
+			expired++
+		}
+	}
+	return sampled, expired
+}
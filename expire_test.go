@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withKeyspaceEvents enables the notify-keyspace-events classes in flags.
+func withKeyspaceEvents(t *testing.T, flags string) func(st *RedisState) {
+	return func(st *RedisState) {
+		classes, ok := parseKeyspaceEvents(flags)
+		if !ok {
+			t.Fatalf("bad notify-keyspace-events %q", flags)
+		}
+		st.config.notifyKeyspaceEvents.Store(int32(classes))
+	}
+}
+
+func TestActiveExpireNotifiesUnreadKeys(t *testing.T) {
+	ts := startTestServer(t, withKeyspaceEvents(t, "Ex"))
+	sub := ts.client(t)
+	sub.expect(array(bulk("subscribe"), bulk("__keyevent@0__:expired"), integer(1)), "SUBSCRIBE", "__keyevent@0__:expired")
+
+	c := ts.client(t)
+	c.expect(okReply, "SET", "session:1", "v", "PX", "50")
+	c.expect(okReply, "SET", "session:2", "v")
+
+	// Nobody reads session:1 again; the event must still arrive.
+	want := bulks("message", "__keyevent@0__:expired", "session:1")
+	if got := sub.read(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	ts.state.storageMu.RLock()
+	_, stored := ts.state.storage["session:1"]
+	ts.state.storageMu.RUnlock()
+	if stored {
+		t.Errorf("expired key still stored")
+	}
+	c.expect(bulk("v"), "GET", "session:2")
+}
+
+func TestActiveExpirePropagatesDel(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(okReply, "SET", "k", "v", "PX", "200")
+
+	// Stand in for a replica that has just synced.
+	replica, master := net.Pipe()
+	t.Cleanup(func() { replica.Close(); master.Close() })
+	ts.state.replicaMu.Lock()
+	ts.state.replicas = append(ts.state.replicas, &replicaLink{conn: master})
+	ts.state.replicaMu.Unlock()
+
+	replica.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _, err := readRESPCommand(bufio.NewReader(replica))
+	if err != nil {
+		t.Fatalf("read propagated command: %v", err)
+	}
+	if len(got) != 2 || got[0] != "DEL" || got[1] != "k" {
+		t.Fatalf("propagated %q, want DEL k", got)
+	}
+}
+
+func TestActiveExpireSkipsRunningTransactions(t *testing.T) {
+	st := newRedisState()
+	st.storage["k"] = newStorageVal("v", time.Now().Add(-time.Second))
+
+	st.txMu.Lock()
+	st.activeExpireCycle()
+	st.txMu.Unlock()
+	if _, ok := st.storage["k"]; !ok {
+		t.Fatalf("key expired while a transaction held txMu")
+	}
+
+	st.activeExpireCycle()
+	if _, ok := st.storage["k"]; ok {
+		t.Fatalf("key not expired by the cycle")
+	}
+}
+
+// propagated returns the commands sent to a replica link that is still
+// buffering, emptying its backlog.
+func propagated(t *testing.T, link *replicaLink) [][]string {
+	t.Helper()
+	link.mu.Lock()
+	backlog := link.backlog
+	link.backlog = nil
+	link.mu.Unlock()
+
+	var cmds [][]string
+	r := bufio.NewReader(bytes.NewReader(backlog))
+	for {
+		args, _, err := readRESPCommand(r)
+		if err == io.EOF {
+			return cmds
+		}
+		if err != nil {
+			t.Fatalf("read propagated command: %v", err)
+		}
+		cmds = append(cmds, args)
+	}
+}
+
+func TestHashFieldExpiry(t *testing.T) {
+	st := newRedisState()
+	st.serverIsMaster = true
+	link := &replicaLink{syncing: true}
+	st.replicas = append(st.replicas, link)
+	s := &RedisServer{state: st}
+	run := func(args ...string) string {
+		t.Helper()
+		resp := s.executeCommand(args)
+		if resp.Error != "" {
+			t.Fatalf("%q: %s", args, resp.Error)
+		}
+		return resp.Response
+	}
+	// expireField backdates the TTL of a field, as if it had run out.
+	expireField := func(key, field string) {
+		hash := st.storage[key].val.(*hashValue)
+		hash.setExpire(hash.entries[field], time.Now().Add(-time.Second).UnixMilli())
+	}
+
+	run("HSET", "h", "a", "1", "b", "2", "c", "3")
+	run("HPEXPIRE", "h", "100000", "FIELDS", "1", "c")
+	expireField("h", "a")
+	run("HSET", "gone", "x", "1")
+	expireField("gone", "x")
+	propagated(t, link)
+
+	// Reads leave expired fields out, but neither delete nor propagate.
+	reads := []testStep{
+		{cmd("HGET", "h", "a"), nilBulkReply},
+		{cmd("HMGET", "h", "a", "b"), array(nilBulkReply, bulk("2"))},
+		{cmd("HGETALL", "h"), bulks("b", "2", "c", "3")},
+		{cmd("HKEYS", "h"), bulks("b", "c")},
+		{cmd("HLEN", "h"), integer(2)},
+		{cmd("HEXISTS", "h", "a"), integer(0)},
+		{cmd("HSTRLEN", "h", "a"), integer(0)},
+		{cmd("HTTL", "h", "FIELDS", "2", "a", "c"), array(integer(-2), integer(100))},
+		{cmd("HSCAN", "h", "0", "MATCH", "a"), array(bulk("0"), emptyArrayReply)},
+		{cmd("HGETALL", "gone"), emptyArrayReply},
+		{cmd("HRANDFIELD", "gone"), nilBulkReply},
+	}
+	for _, step := range reads {
+		if got := run(step.cmd...); got != step.want {
+			t.Errorf("%q:\n got %q\nwant %q", step.cmd, got, step.want)
+		}
+	}
+	if hash := st.storage["h"].val.(*hashValue); hash.Len() != 3 {
+		t.Errorf("reads deleted fields: %d left", hash.Len())
+	}
+	if cmds := propagated(t, link); len(cmds) != 0 {
+		t.Errorf("reads propagated %q", cmds)
+	}
+
+	// Writes delete the expired fields first.
+	run("HSET", "h", "d", "4")
+	want := [][]string{{"HDEL", "h", "a"}, {"HSET", "h", "d", "4"}}
+	if got := propagated(t, link); !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("HSET propagated %q, want %q", got, want)
+	}
+
+	// The active cycle deletes the others, and keys left with no field.
+	expireField("h", "c")
+	st.activeExpireCycle()
+	if hash := st.storage["h"].val.(*hashValue); hash.Len() != 2 || hash.ttlFields != 0 {
+		t.Errorf("the cycle left %d fields, %d with a TTL", hash.Len(), hash.ttlFields)
+	}
+	if _, ok := st.storage["gone"]; ok {
+		t.Errorf("the cycle kept a hash whose fields all expired")
+	}
+	got := propagated(t, link)
+	slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[1], b[1]) })
+	want = [][]string{{"HDEL", "gone", "x"}, {"HDEL", "h", "c"}}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("the cycle propagated %q, want %q", got, want)
+	}
+}
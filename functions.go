@@ -0,0 +1,631 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Function flags, set with the flags field of redis.register_function.
+const (
+	functionNoWrites = 1 << iota
+	functionAllowOOM
+	functionAllowStale
+	functionNoCluster
+	functionAllowCrossSlotKeys
+)
+
+var functionFlagNames = []struct {
+	name string
+	flag int
+}{
+	{"no-writes", functionNoWrites},
+	{"allow-oom", functionAllowOOM},
+	{"allow-stale", functionAllowStale},
+	{"no-cluster", functionNoCluster},
+	{"allow-cross-slot-keys", functionAllowCrossSlotKeys},
+}
+
+// functionLoadTimeout bounds how long the code of a library may run while it
+// registers its functions.
+const functionLoadTimeout = 500 * time.Millisecond
+
+// functionLibrary is a library loaded with FUNCTION LOAD.
+type functionLibrary struct {
+	name      string
+	code      string
+	functions map[string]*scriptFunction
+}
+
+// scriptFunction is a function registered by a library.
+type scriptFunction struct {
+	name        string
+	library     *functionLibrary
+	callback    *lua.LFunction
+	description string
+	flags       int
+}
+
+// functionRegistry holds the loaded libraries, and their functions by name,
+// which are unique across libraries.
+type functionRegistry struct {
+	libraries map[string]*functionLibrary
+	functions map[string]*scriptFunction
+}
+
+func newFunctionRegistry() *functionRegistry {
+	return &functionRegistry{
+		libraries: make(map[string]*functionLibrary),
+		functions: make(map[string]*scriptFunction),
+	}
+}
+
+func (r *functionRegistry) clone() *functionRegistry {
+	c := newFunctionRegistry()
+	for name, lib := range r.libraries {
+		c.libraries[name] = lib
+	}
+	for name, fn := range r.functions {
+		c.functions[name] = fn
+	}
+	return c
+}
+
+// add installs lib, replacing the library of the same name if replace is
+// set.
+func (r *functionRegistry) add(lib *functionLibrary, replace bool) error {
+	old, exists := r.libraries[lib.name]
+	if exists && !replace {
+		return fmt.Errorf("Library '%s' already exists", lib.name)
+	}
+	for name := range lib.functions {
+		if fn, ok := r.functions[name]; ok && fn.library != old {
+			return fmt.Errorf("Function %s already exists", name)
+		}
+	}
+
+	if exists {
+		r.remove(old.name)
+	}
+	r.libraries[lib.name] = lib
+	for name, fn := range lib.functions {
+		r.functions[name] = fn
+	}
+	return nil
+}
+
+func (r *functionRegistry) remove(name string) bool {
+	lib, ok := r.libraries[name]
+	if !ok {
+		return false
+	}
+	for fn := range lib.functions {
+		delete(r.functions, fn)
+	}
+	delete(r.libraries, name)
+	return true
+}
+
+// sortedLibraries returns the libraries ordered by name.
+func (r *functionRegistry) sortedLibraries() []*functionLibrary {
+	libs := make([]*functionLibrary, 0, len(r.libraries))
+	for _, lib := range r.libraries {
+		libs = append(libs, lib)
+	}
+	sort.Slice(libs, func(i, j int) bool { return libs[i].name < libs[j].name })
+	return libs
+}
+
+// functionsState returns the interpreter functions run in, creating it on
+// first use. It is separate from the one for EVAL, so SCRIPT FLUSH leaves
+// functions alone. The caller must hold scriptMu.
+func (st *RedisState) functionsState() *lua.LState {
+	if st.functionsVM == nil {
+		st.functionsVM = newLuaVM(map[string]lua.LGFunction{
+			"register_function": luaRegisterFunction,
+		})
+	}
+	return st.functionsVM
+}
+
+// loadingLibraryKey keys the library being loaded in the context of the
+// functions interpreter, where redis.register_function finds it.
+type loadingLibraryKey struct{}
+
+func validFunctionName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseLibraryMetadata parses the "#!lua name=<library>" line a library
+// starts with, returning the library name and the code that follows.
+func parseLibraryMetadata(code string) (name, body string, err error) {
+	if !strings.HasPrefix(code, "#!") {
+		return "", "", errors.New("Missing library metadata")
+	}
+	line, body, _ := strings.Cut(code, "\n")
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 || !strings.EqualFold(fields[0], "lua") {
+		engine := ""
+		if len(fields) > 0 {
+			engine = fields[0]
+		}
+		return "", "", fmt.Errorf("Engine '%s' not found", engine)
+	}
+	for _, field := range fields[1:] {
+		value, ok := strings.CutPrefix(field, "name=")
+		if !ok {
+			return "", "", fmt.Errorf("Invalid metadata value given: %s", field)
+		}
+		name = value
+	}
+	if name == "" {
+		return "", "", errors.New("Library name was not given")
+	}
+	if !validFunctionName(name) {
+		return "", "", errors.New("Library names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+	}
+	// Keep the metadata line, blanked, so error line numbers stay right.
+	return name, "\n" + body, nil
+}
+
+// loadLibrary runs the code of a library, collecting the functions it
+// registers. The library is not installed. The caller must hold scriptMu.
+func (st *RedisState) loadLibrary(code string) (*functionLibrary, error) {
+	name, body, err := parseLibraryMetadata(code)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := compileScript(body, "user_function")
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling function: %s", firstLine(err.Error()))
+	}
+
+	lib := &functionLibrary{name: name, code: code, functions: make(map[string]*scriptFunction)}
+	L := st.functionsState()
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = scriptEnv(L)
+
+	ctx, cancel := context.WithTimeout(context.Background(), functionLoadTimeout)
+	defer cancel()
+	L.SetContext(context.WithValue(ctx, loadingLibraryKey{}, lib))
+	defer L.RemoveContext()
+
+	L.Push(fn)
+	if err := L.PCall(0, 0, nil); err != nil {
+		if ctx.Err() != nil {
+			return nil, errors.New("FUNCTION LOAD timeout")
+		}
+		msg := err.Error()
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			msg = apiErr.Object.String()
+		}
+		return nil, fmt.Errorf("Error registering functions: %s", msg)
+	}
+	if len(lib.functions) == 0 {
+		return nil, errors.New("No functions registered")
+	}
+	return lib, nil
+}
+
+// luaRegisterFunction implements redis.register_function, in both its forms:
+// (name, callback) and a table with function_name, callback, flags and
+// description fields.
+func luaRegisterFunction(L *lua.LState) int {
+	var lib *functionLibrary
+	if ctx := L.Context(); ctx != nil {
+		lib, _ = ctx.Value(loadingLibraryKey{}).(*functionLibrary)
+	}
+	if lib == nil {
+		L.RaiseError("redis.register_function can only be called on FUNCTION LOAD command")
+		return 0
+	}
+
+	fn := &scriptFunction{library: lib}
+	if tbl, ok := L.Get(1).(*lua.LTable); ok && L.GetTop() == 1 {
+		var badField string
+		tbl.ForEach(func(k, v lua.LValue) {
+			switch k.String() {
+			case "function_name":
+				fn.name = v.String()
+			case "callback":
+				fn.callback, _ = v.(*lua.LFunction)
+			case "description":
+				fn.description = v.String()
+			case "flags":
+				flags, ok := v.(*lua.LTable)
+				if !ok {
+					badField = "flags argument to redis.register_function must be a table representing function flags"
+					return
+				}
+				flags.ForEach(func(_, flag lua.LValue) {
+					found := false
+					for _, f := range functionFlagNames {
+						if f.name == flag.String() {
+							fn.flags |= f.flag
+							found = true
+						}
+					}
+					if !found {
+						badField = "unknown flag given"
+					}
+				})
+			default:
+				badField = "unknown argument given to redis.register_function"
+			}
+		})
+		if badField != "" {
+			L.RaiseError("%s", badField)
+			return 0
+		}
+		if fn.name == "" {
+			L.RaiseError("redis.register_function must get a function name argument")
+			return 0
+		}
+		if fn.callback == nil {
+			L.RaiseError("redis.register_function must get a callback argument")
+			return 0
+		}
+	} else {
+		fn.name = L.CheckString(1)
+		fn.callback = L.CheckFunction(2)
+	}
+
+	if !validFunctionName(fn.name) {
+		L.RaiseError("Function names can only contain letters, numbers, or underscores(_) and must be at least one character long")
+		return 0
+	}
+	if _, ok := lib.functions[fn.name]; ok {
+		L.RaiseError("Function already exists in the library")
+		return 0
+	}
+	lib.functions[fn.name] = fn
+	return 0
+}
+
+func (s *RedisServer) fcallCommand(args []string, readOnly bool) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	name := args[1]
+	keys, argv, errResp := splitScriptKeys(args[2:])
+	if errResp.Error != "" {
+		return errResp
+	}
+
+	return s.runScript(func(st *RedisState) (*scriptCall, CommandResponse) {
+		fn, ok := st.functions.functions[name]
+		if !ok {
+			return nil, CommandResponse{Error: "-ERR Function not found"}
+		}
+		noWrites := fn.flags&functionNoWrites != 0
+		if readOnly && !noWrites {
+			return nil, CommandResponse{Error: "-ERR Can not execute a script with write flag using *_ro command."}
+		}
+		if !st.serverIsMaster && !noWrites {
+			return nil, CommandResponse{Error: "-READONLY You can't write against a read only replica."}
+		}
+
+		L := st.functionsState()
+		return &scriptCall{
+			L:          L,
+			fn:         fn.callback,
+			args:       []lua.LValue{luaStringArray(L, keys), luaStringArray(L, argv)},
+			name:       fn.name,
+			command:    args,
+			isFunction: true,
+			readOnly:   noWrites,
+		}, CommandResponse{}
+	})
+}
+
+func (s *RedisServer) functionCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("FUNCTION")
+	}
+
+	switch sub := strings.ToUpper(args[1]); sub {
+	case "LOAD":
+		return s.functionLoadCommand(args)
+	case "DELETE":
+		return s.functionDeleteCommand(args)
+	case "FLUSH":
+		return s.functionFlushCommand(args)
+	case "LIST":
+		return s.functionListCommand(args)
+	case "DUMP":
+		return s.functionDumpCommand(args)
+	case "RESTORE":
+		return s.functionRestoreCommand(args)
+	case "KILL":
+		if len(args) == 2 {
+			return s.state.killScript(true)
+		}
+	case "STATS":
+		if len(args) == 2 {
+			return s.functionStatsCommand()
+		}
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try FUNCTION HELP."}
+}
+
+func (s *RedisServer) functionLoadCommand(args []string) CommandResponse {
+	replace := false
+	if len(args) == 4 && strings.ToUpper(args[2]) == "REPLACE" {
+		replace = true
+	} else if len(args) != 3 {
+		return wrongArgsError("FUNCTION|LOAD")
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	lib, err := s.state.loadLibrary(args[len(args)-1])
+	if err == nil {
+		err = s.state.functions.add(lib, replace)
+	}
+	if err != nil {
+		return CommandResponse{Error: "-ERR " + err.Error()}
+	}
+	s.state.propagate(args)
+	return CommandResponse{Response: toRespStr(lib.name)}
+}
+
+func (s *RedisServer) functionDeleteCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("FUNCTION|DELETE")
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	if !s.state.functions.remove(args[2]) {
+		return CommandResponse{Error: "-ERR Library not found"}
+	}
+	s.state.propagate(args)
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) functionFlushCommand(args []string) CommandResponse {
+	if len(args) > 3 {
+		return wrongArgsError("FUNCTION|FLUSH")
+	}
+	if len(args) == 3 {
+		if mode := strings.ToUpper(args[2]); mode != "ASYNC" && mode != "SYNC" {
+			return CommandResponse{Error: "-ERR FUNCTION FLUSH only supports SYNC|ASYNC option"}
+		}
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	s.state.flushFunctions()
+	s.state.propagate(args)
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+// flushFunctions drops every library, along with the interpreter they were
+// loaded in. The caller must hold scriptMu.
+func (st *RedisState) flushFunctions() {
+	st.functions = newFunctionRegistry()
+	if st.functionsVM != nil {
+		st.functionsVM.Close()
+		st.functionsVM = nil
+	}
+}
+
+// functionListCommand replies with the libraries and their functions, with
+// the code of each library if WITHCODE is given.
+func (s *RedisServer) functionListCommand(args []string) CommandResponse {
+	withCode := false
+	pattern := ""
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHCODE":
+			withCode = true
+		case "LIBRARYNAME":
+			if i+1 >= len(args) {
+				return CommandResponse{Error: "-ERR library name argument was not given"}
+			}
+			i++
+			pattern = args[i]
+		default:
+			return CommandResponse{Error: "-ERR Unknown argument " + args[i]}
+		}
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	var libs []string
+	for _, lib := range s.state.functions.sortedLibraries() {
+		if pattern != "" && !globMatch(pattern, lib.name) {
+			continue
+		}
+
+		names := make([]string, 0, len(lib.functions))
+		for name := range lib.functions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		functions := make([]string, len(names))
+		for i, name := range names {
+			fn := lib.functions[name]
+			var flags []string
+			for _, f := range functionFlagNames {
+				if fn.flags&f.flag != 0 {
+					flags = append(flags, f.name)
+				}
+			}
+			description := RESP_NULL_BULK
+			if fn.description != "" {
+				description = toRespStr(fn.description)
+			}
+			functions[i] = "*6\r\n" + toRespStr("name") + toRespStr(fn.name) +
+				toRespStr("description") + description +
+				toRespStr("flags") + toRespStrArr(flags)
+		}
+
+		fields := 6
+		entry := toRespStr("library_name") + toRespStr(lib.name) +
+			toRespStr("engine") + toRespStr("LUA") +
+			toRespStr("functions") + fmt.Sprintf("*%d\r\n", len(functions)) + strings.Join(functions, "")
+		if withCode {
+			fields += 2
+			entry += toRespStr("library_code") + toRespStr(lib.code)
+		}
+		libs = append(libs, fmt.Sprintf("*%d\r\n", fields)+entry)
+	}
+	return CommandResponse{Response: fmt.Sprintf("*%d\r\n", len(libs)) + strings.Join(libs, "")}
+}
+
+// functionStatsCommand reports the running function, if any, and how many
+// libraries and functions are loaded.
+func (s *RedisServer) functionStatsCommand() CommandResponse {
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	running := RESP_NULL_BULK
+	if run := s.state.runningScript; run != nil && run.call.isFunction {
+		running = "*6\r\n" + toRespStr("name") + toRespStr(run.call.name) +
+			toRespStr("command") + toRespStrArr(run.call.command) +
+			toRespStr("duration_ms") + toRespInt(time.Since(run.start).Milliseconds())
+	}
+	engine := "*4\r\n" + toRespStr("libraries_count") + toRespInt(int64(len(s.state.functions.libraries))) +
+		toRespStr("functions_count") + toRespInt(int64(len(s.state.functions.functions)))
+	return CommandResponse{Response: "*4\r\n" + toRespStr("running_script") + running +
+		toRespStr("engines") + "*2\r\n" + toRespStr("LUA") + engine}
+}
+
+// encodeFunctionsPayload serialises the code of libs as FUNCTION DUMP does:
+// RDB function records followed by the RDB version and a checksum.
+func encodeFunctionsPayload(libs []*functionLibrary) []byte {
+	e := &rdbEncoder{}
+	for _, lib := range libs {
+		e.buf.WriteByte(rdbOpcodeFunction2)
+		e.writeString(lib.code)
+	}
+	binary.Write(&e.buf, binary.LittleEndian, uint16(rdbVersion))
+	binary.Write(&e.buf, binary.LittleEndian, rdbChecksum(e.buf.Bytes()))
+	return e.buf.Bytes()
+}
+
+// decodeFunctionsPayload returns the library code in a FUNCTION DUMP
+// payload.
+func decodeFunctionsPayload(payload []byte) ([]string, error) {
+	if len(payload) < 10 {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+	footer := payload[len(payload)-10:]
+	version := binary.LittleEndian.Uint16(footer)
+	if version > rdbVersionHashTTL || binary.LittleEndian.Uint64(footer[2:]) != rdbChecksum(payload[:len(payload)-8]) {
+		return nil, errors.New("payload version or checksum are wrong")
+	}
+
+	d := &rdbDecoder{data: payload[:len(payload)-10]}
+	var codes []string
+	for d.pos < len(d.data) {
+		opcode, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if opcode != rdbOpcodeFunction2 {
+			return nil, errors.New("given type is not a function")
+		}
+		code, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func (s *RedisServer) functionDumpCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("FUNCTION|DUMP")
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	return CommandResponse{Response: toRespStr(string(encodeFunctionsPayload(s.state.functions.sortedLibraries())))}
+}
+
+// functionRestoreCommand loads the libraries of a FUNCTION DUMP payload.
+// With the default APPEND policy a library already loaded is an error;
+// REPLACE replaces it, and FLUSH drops every library first. Either all the
+// libraries are restored or none.
+func (s *RedisServer) functionRestoreCommand(args []string) CommandResponse {
+	if len(args) != 3 && len(args) != 4 {
+		return wrongArgsError("FUNCTION|RESTORE")
+	}
+	policy := "APPEND"
+	if len(args) == 4 {
+		policy = strings.ToUpper(args[3])
+		if policy != "APPEND" && policy != "REPLACE" && policy != "FLUSH" {
+			return CommandResponse{Error: "-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE."}
+		}
+	}
+	codes, err := decodeFunctionsPayload([]byte(args[2]))
+	if err != nil {
+		return CommandResponse{Error: "-ERR " + err.Error()}
+	}
+
+	s.state.scriptMu.Lock()
+	defer s.state.scriptMu.Unlock()
+
+	if err := s.state.restoreFunctions(codes, policy); err != nil {
+		return CommandResponse{Error: "-ERR " + err.Error()}
+	}
+	s.state.propagate(args)
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+// restoreFunctions loads the libraries in codes under a FUNCTION RESTORE
+// policy, installing them only if all of them load. The caller must hold
+// scriptMu.
+func (st *RedisState) restoreFunctions(codes []string, policy string) error {
+	registry := st.functions.clone()
+	if policy == "FLUSH" {
+		registry = newFunctionRegistry()
+	}
+	for _, code := range codes {
+		lib, err := st.loadLibrary(code)
+		if err != nil {
+			return err
+		}
+		if err := registry.add(lib, policy == "REPLACE"); err != nil {
+			return err
+		}
+	}
+	st.functions = registry
+	return nil
+}
+
+// functionCodes returns the code of every library, for RDB snapshots.
+func (st *RedisState) functionCodes() []string {
+	st.scriptMu.Lock()
+	defer st.scriptMu.Unlock()
+
+	libs := st.functions.sortedLibraries()
+	codes := make([]string, len(libs))
+	for i, lib := range libs {
+		codes[i] = lib.code
+	}
+	return codes
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+const (
+	testLibEcho = "#!lua name=echolib\n" +
+		"redis.register_function('echo', function(keys, args) return args[1] end)\n" +
+		"redis.register_function{function_name='shout', callback=function(keys, args) return string.upper(args[1]) end, flags={'no-writes'}, description='louder'}"
+	testLibCount = "#!lua name=countlib\n" +
+		"redis.register_function('count', function(keys, args) return redis.call('INCR', keys[1]) end)"
+)
+
+// dumpFunctions returns the FUNCTION DUMP payload of the loaded libraries.
+func dumpFunctions(c *testClient) string {
+	c.t.Helper()
+	payload, ok := parseBulk(c.do("FUNCTION", "DUMP"))
+	if !ok {
+		c.t.Fatalf("FUNCTION DUMP did not reply with a bulk string")
+	}
+	return payload
+}
+
+func TestFunctionDumpRestore(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(bulk("echolib"), "FUNCTION", "LOAD", testLibEcho)
+	c.expect(bulk("countlib"), "FUNCTION", "LOAD", testLibCount)
+	list := c.do("FUNCTION", "LIST", "WITHCODE")
+	payload := dumpFunctions(c)
+
+	// One function record per library, then the RDB version and checksum.
+	if payload[0] != rdbOpcodeFunction2 {
+		t.Errorf("payload starts with %#x", payload[0])
+	}
+	footer := payload[len(payload)-10:]
+	if v := binary.LittleEndian.Uint16([]byte(footer)); v != rdbVersion {
+		t.Errorf("payload carries RDB version %d", v)
+	}
+	if codes, err := decodeFunctionsPayload([]byte(payload)); err != nil || len(codes) != 2 || codes[0] != testLibCount || codes[1] != testLibEcho {
+		t.Errorf("payload decodes to %q, %v", codes, err)
+	}
+
+	runSteps(t, c, []testStep{
+		{cmd("FUNCTION", "FLUSH"), okReply},
+		{cmd("FCALL", "echo", "0", "hi"), errorReply("-ERR Function not found")},
+		{cmd("FUNCTION", "RESTORE", payload), okReply},
+		{cmd("FUNCTION", "LIST", "WITHCODE"), list},
+		{cmd("FCALL", "echo", "0", "hi"), bulk("hi")},
+		{cmd("FCALL_RO", "shout", "0", "hi"), bulk("HI")},
+		{cmd("FCALL", "count", "1", "n"), integer(1)},
+		// Restoring what is loaded gives back the same payload.
+		{cmd("FUNCTION", "DUMP"), bulk(payload)},
+	})
+
+	// An empty registry dumps to a payload that restores to nothing.
+	c.expect(okReply, "FUNCTION", "FLUSH")
+	empty := dumpFunctions(c)
+	if len(empty) != 10 {
+		t.Errorf("empty payload is %d bytes", len(empty))
+	}
+	c.expect(okReply, "FUNCTION", "RESTORE", empty)
+	c.expect(emptyArrayReply, "FUNCTION", "LIST")
+}
+
+func TestFunctionRestorePolicies(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(bulk("echolib"), "FUNCTION", "LOAD", testLibEcho)
+	c.expect(bulk("countlib"), "FUNCTION", "LOAD", testLibCount)
+	payload := dumpFunctions(c)
+	c.expect(okReply, "FUNCTION", "DELETE", "countlib")
+
+	other := "#!lua name=otherlib\nredis.register_function('other', function() return 1 end)"
+	// A library defining a function the payload also defines, under
+	// another library name.
+	clash := "#!lua name=clashlib\nredis.register_function('count', function() return 2 end)"
+
+	runSteps(t, c, []testStep{
+		// APPEND, the default, refuses libraries already loaded, and
+		// restores nothing when one fails.
+		{cmd("FUNCTION", "RESTORE", payload), errorReply("-ERR Library 'echolib' already exists")},
+		{cmd("FUNCTION", "RESTORE", payload, "append"), errorReply("-ERR Library 'echolib' already exists")},
+		{cmd("FCALL", "count", "1", "n"), errorReply("-ERR Function not found")},
+
+		// REPLACE swaps them, keeping the others.
+		{cmd("FUNCTION", "LOAD", other), bulk("otherlib")},
+		{cmd("FUNCTION", "RESTORE", payload, "REPLACE"), okReply},
+		{cmd("FCALL", "count", "1", "n"), integer(1)},
+		{cmd("FCALL", "other", "0"), integer(1)},
+
+		// Yet it cannot take a function from another library.
+		{cmd("FUNCTION", "DELETE", "countlib"), okReply},
+		{cmd("FUNCTION", "LOAD", clash), bulk("clashlib")},
+		{cmd("FUNCTION", "RESTORE", payload, "REPLACE"), errorReply("-ERR Function count already exists")},
+		{cmd("FCALL", "count", "0"), integer(2)},
+
+		// FLUSH drops every library first.
+		{cmd("FUNCTION", "RESTORE", payload, "FLUSH"), okReply},
+		{cmd("FCALL", "other", "0"), errorReply("-ERR Function not found")},
+		{cmd("FCALL", "count", "1", "n"), integer(2)},
+		{cmd("FUNCTION", "DUMP"), bulk(payload)},
+
+		{cmd("FUNCTION", "RESTORE", payload, "MERGE"), errorReply("-ERR Wrong restore policy given, value should be either FLUSH, APPEND or REPLACE.")},
+		{cmd("FUNCTION", "RESTORE"), errorReply("-ERR wrong number of arguments for 'FUNCTION|RESTORE' command")},
+	})
+}
+
+func TestFunctionRestoreRejectsBadPayloads(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(bulk("echolib"), "FUNCTION", "LOAD", testLibEcho)
+	payload := dumpFunctions(c)
+	c.expect(okReply, "FUNCTION", "FLUSH")
+
+	corrupt := []byte(payload)
+	corrupt[5] ^= 0xff
+	newer := []byte(payload)
+	binary.LittleEndian.PutUint16(newer[len(newer)-10:], rdbVersionHashTTL+1)
+	binary.LittleEndian.PutUint64(newer[len(newer)-8:], rdbChecksum(newer[:len(newer)-8]))
+	// A well-formed payload holding a key rather than a function.
+	e := &rdbEncoder{}
+	e.buf.WriteByte(0)
+	e.writeString("key")
+	binary.Write(&e.buf, binary.LittleEndian, uint16(rdbVersion))
+	binary.Write(&e.buf, binary.LittleEndian, rdbChecksum(e.buf.Bytes()))
+
+	for name, bad := range map[string]string{
+		"corrupt":   string(corrupt),
+		"truncated": payload[:len(payload)-1],
+		"too short": "abc",
+		"newer":     string(newer),
+	} {
+		if got, want := c.do("FUNCTION", "RESTORE", bad), errorReply("-ERR payload version or checksum are wrong"); got != want {
+			t.Errorf("%s payload: got %q, want %q", name, got, want)
+		}
+	}
+	c.expect(errorReply("-ERR given type is not a function"), "FUNCTION", "RESTORE", e.buf.String())
+	c.expect(emptyArrayReply, "FUNCTION", "LIST")
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+const RESP_ERR_GEO_UNIT = "-ERR unsupported unit provided. please use M, KM, FT, MI"
+
+// geoUnitConversion returns how many meters one unit is worth.
+func geoUnitConversion(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
+	case "m":
+		return 1, true
+	case "km":
+		return 1000, true
+	case "ft":
+		return 0.3048, true
+	case "mi":
+		return 1609.34, true
+	}
+	return 0, false
+}
+
+// parseLongLat parses a longitude and latitude pair, rejecting positions
+// geohashes cannot represent.
+func parseLongLat(lonArg, latArg string) (longitude, latitude float64, errResp string) {
+	longitude, ok1 := parseFloatArg(lonArg)
+	latitude, ok2 := parseFloatArg(latArg)
+	if !ok1 || !ok2 {
+		return 0, 0, RESP_ERR_NOT_FLOAT
+	}
+	if longitude < geoLongMin || longitude > geoLongMax || latitude < geoLatMin || latitude > geoLatMax {
+		return 0, 0, fmt.Sprintf("-ERR invalid longitude,latitude pair %f,%f", longitude, latitude)
+	}
+	return longitude, latitude, ""
+}
+
+// formatGeoCoord renders a coordinate the way Redis replies with long
+// doubles in human form: 17 decimals with the trailing zeros trimmed.
+func formatGeoCoord(f float64) string {
+	s := strconv.FormatFloat(f, 'f', 17, 64)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func formatGeoDist(meters, conversion float64) string {
+	return strconv.FormatFloat(meters/conversion, 'f', 4, 64)
+}
+
+func geoCoordReply(longitude, latitude float64) string {
+	return toRespArr(formatGeoCoord(longitude), formatGeoCoord(latitude))
+}
+
+func (s *RedisServer) geoaddCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("GEOADD")
+	}
+
+	var flags zaddFlags
+	i := 2
+parseFlags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "CH":
+			flags.ch = true
+		default:
+			break parseFlags
+		}
+	}
+	triples := args[i:]
+	if len(triples) == 0 || len(triples)%3 != 0 || (flags.nx && flags.xx) {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+
+	// GEOADD is ZADD with the positions turned into geohash scores, and is
+	// propagated as such.
+	zaddArgs := append([]string{"ZADD"}, args[1:i]...)
+	scores := make([]float64, len(triples)/3)
+	for j := range scores {
+		longitude, latitude, errResp := parseLongLat(triples[3*j], triples[3*j+1])
+		if errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		hash, _ := geohashEncodeWGS84(longitude, latitude, geoStepMax)
+		scores[j] = float64(geohashAlign52Bits(hash))
+		zaddArgs = append(zaddArgs, formatScore(scores[j]), triples[3*j+2])
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if flags.xx {
+			return CommandResponse{Response: ":0\r\n"}
+		}
+		zset = sortedset.New()
+	}
+
+	added, updated := 0, 0
+	for j, score := range scores {
+		_, wasAdded, wasUpdated, _, _ := zsetAddMember(zset, triples[3*j+2], score, flags)
+		if wasAdded {
+			added++
+		}
+		if wasUpdated {
+			updated++
+		}
+	}
+
+	if !found && zset.GetCount() > 0 {
+		s.state.storage[args[1]] = newStorageVal(zset, time.Time{})
+	}
+	if added > 0 {
+		s.state.signalKeyReady(args[1])
+	}
+	if added+updated > 0 {
+		s.state.keyModified(notifyZset, "zadd", args[1])
+		s.state.propagate(zaddArgs)
+	}
+
+	if flags.ch {
+		return CommandResponse{Response: toRespInt(int64(added + updated))}
+	}
+	return CommandResponse{Response: toRespInt(int64(added))}
+}
+
+// geoMemberPos returns the decoded position of member, if it is in zset.
+func geoMemberPos(zset *sortedset.SortedSet, member string) (longitude, latitude float64, ok bool) {
+	if zset == nil {
+		return 0, 0, false
+	}
+	node := zset.GetByKey(member)
+	if node == nil {
+		return 0, 0, false
+	}
+	return decodeGeoScore(nodeScore(node))
+}
+
+func (s *RedisServer) geoposCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("GEOPOS")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, _, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)-2) + "\r\n")
+	for _, member := range args[2:] {
+		longitude, latitude, ok := geoMemberPos(zset, member)
+		if !ok {
+			b.WriteString(RESP_NULL_ARRAY)
+			continue
+		}
+		b.WriteString(geoCoordReply(longitude, latitude))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+func (s *RedisServer) geodistCommand(args []string) CommandResponse {
+	if len(args) != 4 && len(args) != 5 {
+		return wrongArgsError("GEODIST")
+	}
+	conversion := 1.0
+	if len(args) == 5 {
+		var ok bool
+		if conversion, ok = geoUnitConversion(args[4]); !ok {
+			return CommandResponse{Error: RESP_ERR_GEO_UNIT}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, _, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	lon1, lat1, ok1 := geoMemberPos(zset, args[2])
+	lon2, lat2, ok2 := geoMemberPos(zset, args[3])
+	if !ok1 || !ok2 {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(formatGeoDist(geoDistance(lon1, lat1, lon2, lat2), conversion))}
+}
+
+func (s *RedisServer) geohashCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("GEOHASH")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, _, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)-2) + "\r\n")
+	for _, member := range args[2:] {
+		longitude, latitude, ok := geoMemberPos(zset, member)
+		if !ok {
+			b.WriteString(RESP_NULL_BULK)
+			continue
+		}
+		b.WriteString(toRespStr(geohashString(longitude, latitude)))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+const (
+	geoSortNone = iota
+	geoSortAsc
+	geoSortDesc
+)
+
+type geoSearchRequest struct {
+	fromMember string
+	hasMember  bool
+	hasLonLat  bool
+	shape      geoShape
+	hasShape   bool
+	sort       int
+	count      int
+	any        bool
+	withCoord  bool
+	withDist   bool
+	withHash   bool
+	storeDist  bool
+}
+
+// parseGeoSearchArgs parses the options of GEOSEARCH and GEOSEARCHSTORE,
+// which follow the source key.
+func parseGeoSearchArgs(cmd string, opts []string, store bool) (geoSearchRequest, string) {
+	var req geoSearchRequest
+	for i := 0; i < len(opts); i++ {
+		remaining := len(opts) - i - 1
+		switch opt := strings.ToUpper(opts[i]); {
+		case opt == "FROMMEMBER" && remaining >= 1:
+			if req.hasLonLat {
+				return req, RESP_ERR_SYNTAX
+			}
+			req.fromMember, req.hasMember = opts[i+1], true
+			i++
+		case opt == "FROMLONLAT" && remaining >= 2:
+			if req.hasMember {
+				return req, RESP_ERR_SYNTAX
+			}
+			longitude, latitude, errResp := parseLongLat(opts[i+1], opts[i+2])
+			if errResp != "" {
+				return req, errResp
+			}
+			req.shape.longitude, req.shape.latitude, req.hasLonLat = longitude, latitude, true
+			i += 2
+		case opt == "BYRADIUS" && remaining >= 2:
+			if req.hasShape {
+				return req, RESP_ERR_SYNTAX
+			}
+			radius, ok := parseFloatArg(opts[i+1])
+			if !ok {
+				return req, RESP_ERR_NOT_FLOAT
+			}
+			if radius < 0 {
+				return req, "-ERR radius cannot be negative"
+			}
+			conversion, ok := geoUnitConversion(opts[i+2])
+			if !ok {
+				return req, RESP_ERR_GEO_UNIT
+			}
+			req.shape.radius, req.shape.conversion, req.hasShape = radius, conversion, true
+			i += 2
+		case opt == "BYBOX" && remaining >= 3:
+			if req.hasShape {
+				return req, RESP_ERR_SYNTAX
+			}
+			width, ok1 := parseFloatArg(opts[i+1])
+			height, ok2 := parseFloatArg(opts[i+2])
+			if !ok1 || !ok2 {
+				return req, RESP_ERR_NOT_FLOAT
+			}
+			if width < 0 || height < 0 {
+				return req, "-ERR height or width cannot be negative"
+			}
+			conversion, ok := geoUnitConversion(opts[i+3])
+			if !ok {
+				return req, RESP_ERR_GEO_UNIT
+			}
+			req.shape.box, req.shape.width, req.shape.height = true, width, height
+			req.shape.conversion, req.hasShape = conversion, true
+			i += 3
+		case opt == "ASC":
+			req.sort = geoSortAsc
+		case opt == "DESC":
+			req.sort = geoSortDesc
+		case opt == "COUNT" && remaining >= 1:
+			count, err := strconv.ParseInt(opts[i+1], 10, 64)
+			if err != nil {
+				return req, RESP_ERR_NOT_INTEGER
+			}
+			if count <= 0 {
+				return req, "-ERR COUNT must be > 0"
+			}
+			req.count = int(min(count, math.MaxInt))
+			i++
+			if i+1 < len(opts) && strings.EqualFold(opts[i+1], "ANY") {
+				req.any = true
+				i++
+			}
+		case opt == "WITHCOORD":
+			req.withCoord = true
+		case opt == "WITHDIST":
+			req.withDist = true
+		case opt == "WITHHASH":
+			req.withHash = true
+		case opt == "STOREDIST" && store:
+			req.storeDist = true
+		default:
+			return req, RESP_ERR_SYNTAX
+		}
+	}
+
+	if !req.hasMember && !req.hasLonLat {
+		return req, "-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for " + cmd
+	}
+	if !req.hasShape {
+		return req, "-ERR exactly one of BYRADIUS and BYBOX can be specified for " + cmd
+	}
+	if req.any && req.count == 0 {
+		return req, "-ERR the ANY argument requires COUNT argument"
+	}
+	if store && (req.withCoord || req.withDist || req.withHash) {
+		return req, "-ERR GEOSEARCHSTORE is not compatible with WITHDIST, WITHHASH and WITHCOORD options"
+	}
+	// The closest N members can only be found by sorting, unless ANY N
+	// members will do.
+	if req.count > 0 && req.sort == geoSortNone && !req.any {
+		req.sort = geoSortAsc
+	}
+	return req, ""
+}
+
+type geoPoint struct {
+	member              string
+	score               float64
+	dist                float64
+	longitude, latitude float64
+}
+
+// geoSearch collects the members of zset within the shape, looking through
+// the geohash cells covering it. With a limit, the search stops as soon as
+// that many members have been found.
+func geoSearch(zset *sortedset.SortedSet, shape geoShape, limit int) []geoPoint {
+	var points []geoPoint
+	areas := shape.searchAreas()
+	lastProcessed := -1
+	for i, area := range areas {
+		if area.isZero() {
+			continue
+		}
+		// Huge radiuses can make neighbouring cells coincide.
+		if lastProcessed >= 0 && area == areas[lastProcessed] {
+			continue
+		}
+		if limit > 0 && len(points) >= limit {
+			break
+		}
+		lastProcessed = i
+
+		lo, hi := geohashScoreRange(area)
+		rank := zsetFirstRank(zset, func(node *sortedset.SortedSetNode) bool {
+			return nodeScore(node) >= lo
+		})
+		for ; rank <= zset.GetCount(); rank++ {
+			node := zset.GetByRank(rank, false)
+			score := nodeScore(node)
+			if score >= hi {
+				break
+			}
+			longitude, latitude, ok := decodeGeoScore(score)
+			if !ok {
+				continue
+			}
+			dist, ok := shape.contains(longitude, latitude)
+			if !ok {
+				continue
+			}
+			points = append(points, geoPoint{node.Key(), score, dist, longitude, latitude})
+			if limit > 0 && len(points) >= limit {
+				break
+			}
+		}
+	}
+	return points
+}
+
+// geoSearchCommand backs GEOSEARCH and GEOSEARCHSTORE.
+func (s *RedisServer) geoSearchCommand(args []string, store bool) CommandResponse {
+	cmd, srcIdx := "GEOSEARCH", 1
+	if store {
+		cmd, srcIdx = "GEOSEARCHSTORE", 2
+	}
+	if len(args) < srcIdx+6 {
+		return wrongArgsError(cmd)
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[srcIdx])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	req, errResp := parseGeoSearchArgs(strings.ToLower(args[0]), args[srcIdx+1:], store)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	if !found {
+		if store {
+			if _, exists := s.state.lookupKey(args[1]); exists {
+				s.state.deleteKey(args[1])
+				s.state.propagate([]string{"DEL", args[1]})
+			}
+			return CommandResponse{Response: ":0\r\n"}
+		}
+		return CommandResponse{Response: "*0\r\n"}
+	}
+	if req.hasMember {
+		var ok bool
+		req.shape.longitude, req.shape.latitude, ok = geoMemberPos(zset, req.fromMember)
+		if !ok {
+			return CommandResponse{Error: "-ERR could not decode requested zset member"}
+		}
+	}
+
+	limit := 0
+	if req.any {
+		limit = req.count
+	}
+	points := geoSearch(zset, req.shape, limit)
+	switch req.sort {
+	case geoSortAsc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist < points[j].dist })
+	case geoSortDesc:
+		sort.SliceStable(points, func(i, j int) bool { return points[i].dist > points[j].dist })
+	}
+	if req.count > 0 && len(points) > req.count {
+		points = points[:req.count]
+	}
+
+	if store {
+		dst := sortedset.New()
+		for _, p := range points {
+			score := p.score
+			if req.storeDist {
+				score = p.dist / req.shape.conversion
+			}
+			dst.AddOrUpdate(p.member, zsetScore(score), nil)
+		}
+		if s.state.storeZset(args[1], dst) > 0 {
+			s.state.keyModified(notifyZset, "geosearchstore", args[1])
+		}
+		s.state.propagate(args)
+		return CommandResponse{Response: toRespInt(int64(len(points)))}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(points)) + "\r\n")
+	options := 0
+	for _, with := range []bool{req.withDist, req.withHash, req.withCoord} {
+		if with {
+			options++
+		}
+	}
+	for _, p := range points {
+		if options == 0 {
+			b.WriteString(toRespStr(p.member))
+			continue
+		}
+		b.WriteString("*" + strconv.Itoa(1+options) + "\r\n")
+		b.WriteString(toRespStr(p.member))
+		if req.withDist {
+			b.WriteString(toRespStr(formatGeoDist(p.dist, req.shape.conversion)))
+		}
+		if req.withHash {
+			b.WriteString(toRespInt(int64(p.score)))
+		}
+		if req.withCoord {
+			b.WriteString(geoCoordReply(p.longitude, p.latitude))
+		}
+	}
+	return CommandResponse{Response: b.String()}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+// The Sicily replies below are the ones the Redis documentation shows for
+// the same commands.
+func addSicily(c *testClient) {
+	c.expect(integer(2), "GEOADD", "Sicily", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	c.expect(integer(2), "GEOADD", "Sicily", "12.758489", "38.788135", "edge1", "17.241510", "38.788135", "edge2")
+}
+
+func TestGeoSicily(t *testing.T) {
+	palermo := bulks("13.36138933897018433", "38.11555639549629859")
+	catania := bulks("15.08726745843887329", "37.50266842333162032")
+	edge1 := bulks("12.7584877610206604", "38.78813451624225195")
+	edge2 := bulks("17.24151045083999634", "38.78813451624225195")
+
+	tests := []struct {
+		name string
+		cmd  []string
+		want string
+	}{
+		{"scores", []string{"ZSCORE", "Sicily", "Palermo"}, bulk("3479099956230698")},
+		{"scores", []string{"ZSCORE", "Sicily", "Catania"}, bulk("3479447370796909")},
+		{"geodist", []string{"GEODIST", "Sicily", "Palermo", "Catania"}, bulk("166274.1516")},
+		{"geodist km", []string{"GEODIST", "Sicily", "Palermo", "Catania", "km"}, bulk("166.2742")},
+		{"geodist mi", []string{"GEODIST", "Sicily", "Palermo", "Catania", "mi"}, bulk("103.3182")},
+		{"geodist missing", []string{"GEODIST", "Sicily", "Foo", "Bar"}, nilBulkReply},
+		{"geohash", []string{"GEOHASH", "Sicily", "Palermo", "Catania"}, bulks("sqc8b49rny0", "sqdtr74hyu0")},
+		{"geopos", []string{"GEOPOS", "Sicily", "Palermo", "Catania", "NonExisting"}, array(palermo, catania, nilArrayReply)},
+		{
+			"byradius",
+			[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "ASC"},
+			bulks("Catania", "Palermo"),
+		},
+		{
+			"byradius withdist",
+			[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYRADIUS", "200", "km", "WITHDIST", "DESC"},
+			array(bulks("Palermo", "190.4424"), bulks("Catania", "56.4413")),
+		},
+		{
+			"frommember byradius",
+			[]string{"GEOSEARCH", "Sicily:west", "FROMMEMBER", "Agrigento", "BYRADIUS", "100", "km", "ASC"},
+			bulks("Agrigento", "Palermo"),
+		},
+		{
+			"bybox withcoord withdist",
+			[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "WITHCOORD", "WITHDIST"},
+			array(
+				array(bulk("Catania"), bulk("56.4413"), catania),
+				array(bulk("Palermo"), bulk("190.4424"), palermo),
+				array(bulk("edge2"), bulk("279.7403"), edge2),
+				array(bulk("edge1"), bulk("279.7405"), edge1),
+			),
+		},
+		{
+			"bybox withhash count",
+			[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3", "WITHHASH"},
+			array(
+				array(bulk("Catania"), integer(3479447370796909)),
+				array(bulk("Palermo"), integer(3479099956230698)),
+				array(bulk("edge2"), integer(3481342659049484)),
+			),
+		},
+		{
+			"narrow box",
+			[]string{"GEOSEARCH", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "200", "400", "km", "ASC"},
+			bulks("Catania"),
+		},
+	}
+
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	addSicily(c)
+	c.expect(integer(3), "GEOADD", "Sicily:west", "13.583333", "37.316667", "Agrigento", "13.361389", "38.115556", "Palermo", "15.087269", "37.502669", "Catania")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.do(tt.cmd...); got != tt.want {
+				t.Errorf("%q:\n got %q\nwant %q", tt.cmd, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGeoSearchStoreDist(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	addSicily(c)
+	c.expect(integer(3), "GEOSEARCHSTORE", "key2", "Sicily", "FROMLONLAT", "15", "37", "BYBOX", "400", "400", "km", "ASC", "COUNT", "3", "STOREDIST")
+
+	// Redis stores 56.441257870158204, 190.44242984775784 and
+	// 279.7403417843143. Go's math.Cos and math.Asin may round the last
+	// bit differently from the C library, so compare within an ulp or so.
+	want := []struct {
+		member string
+		dist   float64
+	}{{"Catania", 56.441257870158204}, {"Palermo", 190.44242984775784}, {"edge2", 279.7403417843143}}
+	for _, w := range want {
+		reply := c.do("ZSCORE", "key2", w.member)
+		score, _ := parseBulk(reply)
+		got, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			t.Fatalf("ZSCORE %s: %q", w.member, reply)
+		}
+		if math.Abs(got-w.dist) > 1e-12*w.dist {
+			t.Errorf("%s stored at %v, want %v", w.member, got, w.dist)
+		}
+	}
+}
+
+// Positions on the edges of what a geohash can represent. Scores, positions
+// and hashes follow from Redis' integer arithmetic in geohash.c: an offset
+// of exactly 1.0 spills into bit 26 of the cell index, decoded positions are
+// clamped to the valid range, and GEOHASH only renders 52 bits.
+func TestGeoEdges(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  []string
+		want string
+	}{
+		{"south-west corner score", []string{"ZSCORE", "edges", "sw"}, bulk("0")},
+		{"north-east corner score", []string{"ZSCORE", "edges", "ne"}, bulk("13510798882111488")},
+		{"antimeridian score", []string{"ZSCORE", "edges", "e"}, bulk("10133099161583616")},
+		{"north-east corner clamped", []string{"GEOPOS", "edges", "ne"}, array(bulks("180", "85.0511287799999991"))},
+		{"antimeridian clamped", []string{"GEOPOS", "edges", "e"}, array(bulks("180", "0.00000126736058093"))},
+		{"south-west corner", []string{"GEOPOS", "edges", "sw"}, array(bulks("-179.99999731779098511", "-85.05112751263942528"))},
+		{"geohash corners", []string{"GEOHASH", "edges", "ne", "sw", "e"}, bulks("bp05b5048p0", "00bh0hbj200", "80000000000")},
+		{"latitude too far north", []string{"GEOADD", "edges", "0", "85.05112879", "x"}, "-ERR invalid longitude,latitude pair 0.000000,85.051129\r\n"},
+		{"latitude too far south", []string{"GEOADD", "edges", "0", "-85.05112879", "x"}, "-ERR invalid longitude,latitude pair 0.000000,-85.051129\r\n"},
+		{"longitude past antimeridian", []string{"GEOADD", "edges", "180.000001", "0", "x"}, "-ERR invalid longitude,latitude pair 180.000001,0.000000\r\n"},
+		{
+			"radius across antimeridian",
+			[]string{"GEOSEARCH", "edges", "FROMLONLAT", "179.99", "0", "BYRADIUS", "10", "km", "ASC", "WITHDIST"},
+			array(bulks("e2", "0.0003"), bulks("w", "2.2247")),
+		},
+		{
+			"box across antimeridian",
+			[]string{"GEOSEARCH", "edges", "FROMLONLAT", "-179.99", "0", "BYBOX", "10", "10", "km", "ASC"},
+			bulks("w", "e2"),
+		},
+		{"distance across antimeridian", []string{"GEODIST", "edges", "w", "e2"}, bulk("2224.9614")},
+		{
+			"radius near the pole",
+			[]string{"GEOSEARCH", "edges", "FROMLONLAT", "0", "85", "BYRADIUS", "200", "km", "ASC"},
+			bulks("pole0", "pole10"),
+		},
+		{
+			"box near the pole",
+			[]string{"GEOSEARCH", "edges", "FROMLONLAT", "0", "85", "BYBOX", "400", "100", "km", "ASC"},
+			bulks("pole0", "pole10"),
+		},
+	}
+
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "GEOADD", "edges", "180", "85.05112878", "ne", "-180", "-85.05112878", "sw", "180", "0", "e", "-179.99", "0", "w", "179.99", "0", "e2")
+	// pole10 is some 97 km from (0, 85), pole83 some 222 km.
+	c.expect(integer(3), "GEOADD", "edges", "0", "85", "pole0", "10", "85", "pole10", "0", "83", "pole83")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := c.do(tt.cmd...); got != tt.want {
+				t.Errorf("%q:\n got %q\nwant %q", tt.cmd, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"math"
+)
+
+// Geo members live in sorted sets, scored by a 52-bit interleaved geohash of
+// their position. The functions below port Redis' geohash.c and
+// geohash_helper.c so that scores, decoded coordinates and search results
+// match a real server.
+const (
+	geoStepMax   = 26
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLongMin   = -180.0
+	geoLongMax   = 180.0
+	earthRadiusM = 6372797.560856
+	// mercatorMax is the half-width of the Web Mercator projection in
+	// meters, used to pick a geohash precision for a search radius.
+	mercatorMax = 20037726.37
+)
+
+// geoHashBits is a geohash of step bits per coordinate, interleaved with
+// latitude in the even bits and longitude in the odd ones.
+type geoHashBits struct {
+	bits uint64
+	step uint
+}
+
+func (h geoHashBits) isZero() bool {
+	return h.bits == 0 && h.step == 0
+}
+
+type geoHashRange struct {
+	min, max float64
+}
+
+type geoHashArea struct {
+	hash                geoHashBits
+	longitude, latitude geoHashRange
+}
+
+type geoHashNeighbors struct {
+	north, east, west, south                   geoHashBits
+	northEast, southEast, northWest, southWest geoHashBits
+}
+
+var (
+	geoLongRange = geoHashRange{geoLongMin, geoLongMax}
+	geoLatRange  = geoHashRange{geoLatMin, geoLatMax}
+)
+
+// interleave64 spreads the bits of x over the even bit positions and those
+// of y over the odd ones.
+func interleave64(x, y uint32) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF}
+	s := [...]uint{1, 2, 4, 8, 16}
+
+	xx, yy := uint64(x), uint64(y)
+	for i := len(s) - 1; i >= 0; i-- {
+		xx = (xx | xx<<s[i]) & b[i]
+		yy = (yy | yy<<s[i]) & b[i]
+	}
+	return xx | yy<<1
+}
+
+// deinterleave64 reverses interleave64, returning x in the low 32 bits and y
+// in the high ones.
+func deinterleave64(interleaved uint64) uint64 {
+	b := [...]uint64{0x5555555555555555, 0x3333333333333333, 0x0F0F0F0F0F0F0F0F, 0x00FF00FF00FF00FF, 0x0000FFFF0000FFFF, 0x00000000FFFFFFFF}
+	s := [...]uint{0, 1, 2, 4, 8, 16}
+
+	x, y := interleaved, interleaved>>1
+	for i := range s {
+		x = (x | x>>s[i]) & b[i]
+		y = (y | y>>s[i]) & b[i]
+	}
+	return x | y<<32
+}
+
+// geohashEncode hashes a position at the given precision. ok is false for
+// positions outside the ranges or the limits of Web Mercator.
+func geohashEncode(longRange, latRange geoHashRange, longitude, latitude float64, step uint) (geoHashBits, bool) {
+	if longitude > geoLongMax || longitude < geoLongMin || latitude > geoLatMax || latitude < geoLatMin {
+		return geoHashBits{}, false
+	}
+	if latitude < latRange.min || latitude > latRange.max || longitude < longRange.min || longitude > longRange.max {
+		return geoHashBits{}, false
+	}
+
+	latOffset := (latitude - latRange.min) / (latRange.max - latRange.min)
+	longOffset := (longitude - longRange.min) / (longRange.max - longRange.min)
+	latOffset *= float64(uint64(1) << step)
+	longOffset *= float64(uint64(1) << step)
+	return geoHashBits{bits: interleave64(uint32(latOffset), uint32(longOffset)), step: step}, true
+}
+
+func geohashEncodeWGS84(longitude, latitude float64, step uint) (geoHashBits, bool) {
+	return geohashEncode(geoLongRange, geoLatRange, longitude, latitude, step)
+}
+
+// geohashDecode returns the cell a hash stands for.
+func geohashDecode(longRange, latRange geoHashRange, hash geoHashBits) (geoHashArea, bool) {
+	if hash.isZero() {
+		return geoHashArea{}, false
+	}
+	sep := deinterleave64(hash.bits)
+	latScale := latRange.max - latRange.min
+	longScale := longRange.max - longRange.min
+	ilato := float64(uint32(sep))
+	ilono := float64(uint32(sep >> 32))
+	cells := float64(uint64(1) << hash.step)
+
+	return geoHashArea{
+		hash: hash,
+		latitude: geoHashRange{
+			min: latRange.min + (ilato*1.0/cells)*latScale,
+			max: latRange.min + ((ilato+1)*1.0/cells)*latScale,
+		},
+		longitude: geoHashRange{
+			min: longRange.min + (ilono*1.0/cells)*longScale,
+			max: longRange.min + ((ilono+1)*1.0/cells)*longScale,
+		},
+	}, true
+}
+
+// decodeGeoScore returns the longitude and latitude at the centre of the cell
+// a sorted set score stands for.
+func decodeGeoScore(score float64) (longitude, latitude float64, ok bool) {
+	area, ok := geohashDecode(geoLongRange, geoLatRange, geoHashBits{bits: uint64(score), step: geoStepMax})
+	if !ok {
+		return 0, 0, false
+	}
+	longitude = (area.longitude.min + area.longitude.max) / 2
+	longitude = min(max(longitude, geoLongMin), geoLongMax)
+	latitude = (area.latitude.min + area.latitude.max) / 2
+	latitude = min(max(latitude, geoLatMin), geoLatMax)
+	return longitude, latitude, true
+}
+
+// geohashAlign52Bits widens a hash to the 52 bits sorted set scores use.
+func geohashAlign52Bits(hash geoHashBits) uint64 {
+	return hash.bits << (52 - hash.step*2)
+}
+
+func geohashMoveX(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0x5555555555555555) >> (64 - hash.step*2)
+	if d > 0 {
+		x += zz + 1
+	} else {
+		x |= zz
+		x -= zz + 1
+	}
+	x &= 0xaaaaaaaaaaaaaaaa >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMoveY(hash *geoHashBits, d int) {
+	if d == 0 {
+		return
+	}
+	x := hash.bits & 0xaaaaaaaaaaaaaaaa
+	y := hash.bits & 0x5555555555555555
+	zz := uint64(0xaaaaaaaaaaaaaaaa) >> (64 - hash.step*2)
+	if d > 0 {
+		y += zz + 1
+	} else {
+		y |= zz
+		y -= zz + 1
+	}
+	y &= 0x5555555555555555 >> (64 - hash.step*2)
+	hash.bits = x | y
+}
+
+func geohashMove(hash geoHashBits, dx, dy int) geoHashBits {
+	geohashMoveX(&hash, dx)
+	geohashMoveY(&hash, dy)
+	return hash
+}
+
+func geohashNeighborsOf(hash geoHashBits) geoHashNeighbors {
+	return geoHashNeighbors{
+		east:      geohashMove(hash, 1, 0),
+		west:      geohashMove(hash, -1, 0),
+		south:     geohashMove(hash, 0, -1),
+		north:     geohashMove(hash, 0, 1),
+		northWest: geohashMove(hash, -1, 1),
+		southWest: geohashMove(hash, -1, -1),
+		northEast: geohashMove(hash, 1, 1),
+		southEast: geohashMove(hash, 1, -1),
+	}
+}
+
+func degRad(ang float64) float64 { return ang * (math.Pi / 180.0) }
+func radDeg(ang float64) float64 { return ang / (math.Pi / 180.0) }
+
+func geoLatDistance(lat1, lat2 float64) float64 {
+	return earthRadiusM * math.Abs(degRad(lat2)-degRad(lat1))
+}
+
+// geoDistance returns the haversine distance in meters between two points.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	lon1r, lon2r := degRad(lon1), degRad(lon2)
+	v := math.Sin((lon2r - lon1r) / 2)
+	// Points on the same meridian only differ in latitude.
+	if v == 0 {
+		return geoLatDistance(lat1, lat2)
+	}
+	lat1r, lat2r := degRad(lat1), degRad(lat2)
+	u := math.Sin((lat2r - lat1r) / 2)
+	a := u*u + math.Cos(lat1r)*math.Cos(lat2r)*v*v
+	return 2.0 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// geoShape is the area a GEOSEARCH covers: a circle of radius, or a box of
+// width by height, centred on (longitude, latitude). Sizes are in the unit
+// the command gave, conversion turning them into meters.
+type geoShape struct {
+	longitude, latitude float64
+	box                 bool
+	radius              float64
+	width, height       float64
+	conversion          float64
+}
+
+// contains reports whether a point lies within the shape, and its distance
+// from the centre in meters.
+func (sh geoShape) contains(longitude, latitude float64) (float64, bool) {
+	if !sh.box {
+		dist := geoDistance(sh.longitude, sh.latitude, longitude, latitude)
+		return dist, dist <= sh.radius*sh.conversion
+	}
+	// The latitude distance is cheaper, so it is checked first.
+	if geoLatDistance(latitude, sh.latitude) > sh.height*sh.conversion/2 {
+		return 0, false
+	}
+	if geoDistance(longitude, latitude, sh.longitude, latitude) > sh.width*sh.conversion/2 {
+		return 0, false
+	}
+	return geoDistance(sh.longitude, sh.latitude, longitude, latitude), true
+}
+
+// boundingBox returns the minimum longitude and latitude, then the maximum
+// ones, of a box enclosing the shape.
+func (sh geoShape) boundingBox() (minLon, minLat, maxLon, maxLat float64) {
+	height, width := sh.radius*sh.conversion, sh.radius*sh.conversion
+	if sh.box {
+		height, width = sh.conversion*sh.height/2, sh.conversion*sh.width/2
+	}
+
+	latDelta := radDeg(height / earthRadiusM)
+	longDeltaTop := radDeg(width / earthRadiusM / math.Cos(degRad(sh.latitude+latDelta)))
+	longDeltaBottom := radDeg(width / earthRadiusM / math.Cos(degRad(sh.latitude-latDelta)))
+	// The hemispheres widen in opposite directions, so the wider edge
+	// bounds the longitude.
+	longDelta := longDeltaTop
+	if sh.latitude < 0 {
+		longDelta = longDeltaBottom
+	}
+	return sh.longitude - longDelta, sh.latitude - latDelta, sh.longitude + longDelta, sh.latitude + latDelta
+}
+
+// geohashEstimateSteps picks the precision whose cells are about as large
+// as the search radius.
+func geohashEstimateSteps(rangeMeters, latitude float64) uint {
+	if rangeMeters == 0 {
+		return geoStepMax
+	}
+	step := 1
+	for rangeMeters < mercatorMax {
+		rangeMeters *= 2
+		step++
+	}
+	step -= 2
+	// Cells shrink towards the poles.
+	if latitude > 66 || latitude < -66 {
+		step--
+		if latitude > 80 || latitude < -80 {
+			step--
+		}
+	}
+	return uint(min(max(step, 1), geoStepMax))
+}
+
+// searchAreas returns the cell holding the centre of the shape and its
+// eight neighbours, at a precision where together they cover the shape.
+// Neighbours lying entirely outside the shape are returned zeroed.
+func (sh geoShape) searchAreas() [9]geoHashBits {
+	minLon, minLat, maxLon, maxLat := sh.boundingBox()
+
+	radiusMeters := sh.radius
+	if sh.box {
+		// The distance from the centre to a corner.
+		radiusMeters = math.Sqrt((sh.width/2)*(sh.width/2) + (sh.height/2)*(sh.height/2))
+	}
+	radiusMeters *= sh.conversion
+
+	steps := geohashEstimateSteps(radiusMeters, sh.latitude)
+	hash, _ := geohashEncodeWGS84(sh.longitude, sh.latitude, steps)
+	neighbors := geohashNeighborsOf(hash)
+	area, _ := geohashDecode(geoLongRange, geoLatRange, hash)
+
+	// Near the edge of a cell the estimated precision may leave part of the
+	// shape uncovered; one step coarser fixes that.
+	north, _ := geohashDecode(geoLongRange, geoLatRange, neighbors.north)
+	south, _ := geohashDecode(geoLongRange, geoLatRange, neighbors.south)
+	east, _ := geohashDecode(geoLongRange, geoLatRange, neighbors.east)
+	west, _ := geohashDecode(geoLongRange, geoLatRange, neighbors.west)
+	decreaseStep := north.latitude.max < maxLat || south.latitude.min > minLat ||
+		east.longitude.max < maxLon || west.longitude.min > minLon
+
+	if steps > 1 && decreaseStep {
+		steps--
+		hash, _ = geohashEncodeWGS84(sh.longitude, sh.latitude, steps)
+		neighbors = geohashNeighborsOf(hash)
+		area, _ = geohashDecode(geoLongRange, geoLatRange, hash)
+	}
+
+	if steps >= 2 {
+		if area.latitude.min < minLat {
+			neighbors.south, neighbors.southWest, neighbors.southEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.latitude.max > maxLat {
+			neighbors.north, neighbors.northEast, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.min < minLon {
+			neighbors.west, neighbors.southWest, neighbors.northWest = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+		if area.longitude.max > maxLon {
+			neighbors.east, neighbors.southEast, neighbors.northEast = geoHashBits{}, geoHashBits{}, geoHashBits{}
+		}
+	}
+
+	return [9]geoHashBits{
+		hash,
+		neighbors.north, neighbors.south, neighbors.east, neighbors.west,
+		neighbors.northEast, neighbors.northWest, neighbors.southEast, neighbors.southWest,
+	}
+}
+
+// geohashScoreRange returns the half-open range of sorted set scores that
+// fall within a cell.
+func geohashScoreRange(hash geoHashBits) (lo, hi float64) {
+	first := geohashAlign52Bits(hash)
+	hash.bits++
+	return float64(first), float64(geohashAlign52Bits(hash))
+}
+
+// geohashString renders a position as the standard 11 character base32
+// geohash, re-encoded against the full -90..90 latitude range.
+func geohashString(longitude, latitude float64) string {
+	const alphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+	hash, _ := geohashEncode(geoHashRange{-180, 180}, geoHashRange{-90, 90}, longitude, latitude, geoStepMax)
+
+	buf := make([]byte, 11)
+	for i := range buf {
+		idx := 0
+		// Only 52 bits are available; the last character is padding.
+		if i < 10 {
+			idx = int(hash.bits>>(52-(i+1)*5)) & 0x1f
+		}
+		buf[i] = alphabet[idx]
+	}
+	return string(buf)
+}
@@ -2,4 +2,7 @@ module github.com/codecrafters-io/redis-starter-go
 
 go 1.24.0
 
-require github.com/wangjia184/sortedset v0.0.0-20220209072355-af6d6d227aa7 // indirect
+require (
+	github.com/wangjia184/sortedset v0.0.0-20220209072355-af6d6d227aa7
+	github.com/yuin/gopher-lua v1.1.1
+)
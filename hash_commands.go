@@ -0,0 +1,845 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thresholds under which Redis keeps a hash in the compact listpack encoding.
+// They only affect what OBJECT ENCODING reports.
+const (
+	hashMaxListpackEntries = 128
+	hashMaxListpackValue   = 64
+)
+
+// hashValue is the hash type. Fields live in a map for O(1) lookups and in a
+// dense slice so HRANDFIELD can pick uniformly and iteration order stays
+// stable between writes. Fields may carry their own expiry (HEXPIRE).
+type hashValue struct {
+	entries map[string]*hashField
+	order   []string
+	// ttlFields counts fields with an expiry; minExpire is a lower bound on
+	// the earliest of them, so expired fields are only searched for when one
+	// may actually be due.
+	ttlFields int
+	minExpire int64
+}
+
+type hashField struct {
+	value string
+	pos   int
+	// expireAt is the field's absolute expiry in unix milliseconds, or 0
+	// when it has none.
+	expireAt int64
+}
+
+func newHashValue() *hashValue {
+	return &hashValue{entries: make(map[string]*hashField)}
+}
+
+func (h *hashValue) Len() int {
+	return len(h.order)
+}
+
+func (h *hashValue) Get(field string) (string, bool) {
+	entry, ok := h.entries[field]
+	if !ok {
+		return "", false
+	}
+	return entry.value, true
+}
+
+// Set stores value under field and reports whether the field is new. An
+// overwritten field loses its TTL, as in Redis.
+func (h *hashValue) Set(field, value string) bool {
+	if entry, ok := h.entries[field]; ok {
+		entry.value = value
+		h.setExpire(entry, 0)
+		return false
+	}
+	h.entries[field] = &hashField{value: value, pos: len(h.order)}
+	h.order = append(h.order, field)
+	return true
+}
+
+// Update is like Set but keeps the TTL of an existing field, which is how
+// the increment commands behave.
+func (h *hashValue) Update(field, value string) {
+	if entry, ok := h.entries[field]; ok {
+		entry.value = value
+		return
+	}
+	h.Set(field, value)
+}
+
+func (h *hashValue) Delete(field string) bool {
+	entry, ok := h.entries[field]
+	if !ok {
+		return false
+	}
+	h.setExpire(entry, 0)
+
+	last := len(h.order) - 1
+	moved := h.order[last]
+	h.order[entry.pos] = moved
+	h.entries[moved].pos = entry.pos
+	h.order = h.order[:last]
+	delete(h.entries, field)
+	return true
+}
+
+func (h *hashValue) setExpire(entry *hashField, expireAt int64) {
+	if entry.expireAt != 0 {
+		h.ttlFields--
+	}
+	if expireAt != 0 {
+		h.ttlFields++
+		if h.ttlFields == 1 || expireAt < h.minExpire {
+			h.minExpire = expireAt
+		}
+	}
+	entry.expireAt = expireAt
+}
+
+// expireFields removes every field whose TTL has elapsed at now (unix ms) and
+// returns their names.
+func (h *hashValue) expireFields(now int64) []string {
+	if !h.fieldsDue(now) {
+		return nil
+	}
+
+	var expired []string
+	next := int64(math.MaxInt64)
+	for _, field := range h.order {
+		entry := h.entries[field]
+		if entry.expireAt == 0 {
+			continue
+		}
+		if entry.expireAt <= now {
+			expired = append(expired, field)
+		} else if entry.expireAt < next {
+			next = entry.expireAt
+		}
+	}
+	for _, field := range expired {
+		h.Delete(field)
+	}
+	h.minExpire = next
+	return expired
+}
+
+// fieldsDue reports whether a field may have expired at now (unix ms).
+func (h *hashValue) fieldsDue(now int64) bool {
+	return h.ttlFields > 0 && now >= h.minExpire
+}
+
+// live returns the hash as readers see it at now (unix ms): h itself, or a
+// copy without the fields whose TTL has elapsed. h is left untouched.
+func (h *hashValue) live(now int64) *hashValue {
+	if !h.fieldsDue(now) {
+		return h
+	}
+	c := newHashValue()
+	for _, field := range h.order {
+		entry := h.entries[field]
+		if entry.expireAt != 0 && entry.expireAt <= now {
+			continue
+		}
+		c.Set(field, entry.value)
+		c.setExpire(c.entries[field], entry.expireAt)
+	}
+	return c
+}
+
+func (h *hashValue) encoding() string {
+	if h.Len() > hashMaxListpackEntries {
+		return "hashtable"
+	}
+	for field, entry := range h.entries {
+		if len(field) > hashMaxListpackValue || len(entry.value) > hashMaxListpackValue {
+			return "hashtable"
+		}
+	}
+	if h.ttlFields > 0 {
+		return "listpackex"
+	}
+	return "listpack"
+}
+
+// hashAt returns the hash stored at key as readers see it, leaving out the
+// fields whose TTL has elapsed without deleting them: that is left to the
+// writes and the active expire cycle. found is false when the key does not
+// exist (or every field expired); wrongType is true when it holds a value of
+// another type. The caller must hold storageMu for writing.
+func (st *RedisState) hashAt(key string) (hash *hashValue, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	hash, ok = value.val.(*hashValue)
+	if !ok {
+		return nil, true, true
+	}
+	hash = hash.live(time.Now().UnixMilli())
+	return hash, hash.Len() > 0, false
+}
+
+// hashToModify is hashAt for the commands writing to the hash, which get the
+// stored hash itself once its expired fields have been deleted.
+func (st *RedisState) hashToModify(key string) (hash *hashValue, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	hash, ok = value.val.(*hashValue)
+	if !ok {
+		return nil, true, true
+	}
+	if st.expireHashFields(key, hash, time.Now().UnixMilli()) && hash.Len() == 0 {
+		return nil, false, false
+	}
+	return hash, true, false
+}
+
+// expireHashFields deletes the fields of the hash at key whose TTL has
+// elapsed at now (unix ms), raising hexpired and propagating an HDEL, and
+// deletes the key if no field is left. It reports whether any field expired.
+// The caller must hold storageMu for writing.
+func (st *RedisState) expireHashFields(key string, hash *hashValue, now int64) bool {
+	expired := hash.expireFields(now)
+	if len(expired) == 0 {
+		return false
+	}
+	st.keyModified(notifyHash, "hexpired", key)
+	st.propagate(append([]string{RESP_COMMAND_HDEL, key}, expired...))
+	if hash.Len() == 0 {
+		st.deleteKey(key)
+	}
+	return true
+}
+
+// hashForWrite returns the hash at key, creating an empty one if the key does
+// not exist. The caller must hold storageMu for writing.
+func (st *RedisState) hashForWrite(key string) (*hashValue, bool) {
+	hash, found, wrongType := st.hashToModify(key)
+	if wrongType {
+		return nil, false
+	}
+	if !found {
+		hash = newHashValue()
+		st.storage[key] = newStorageVal(hash, time.Time{})
+	}
+	return hash, true
+}
+
+func (s *RedisServer) hsetCommand(args []string) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) < 4 || len(args)%2 != 0 {
+		return wrongArgsError(cmd)
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, ok := s.state.hashForWrite(args[1])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	added := 0
+	for i := 2; i < len(args); i += 2 {
+		if hash.Set(args[i], args[i+1]) {
+			added++
+		}
+	}
+	s.state.keyModified(notifyHash, "hset", args[1])
+	s.state.propagate(args)
+
+	if cmd == RESP_COMMAND_HMSET {
+		return CommandResponse{Response: "+OK\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(added))}
+}
+
+func (s *RedisServer) hsetnxCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("HSETNX")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, ok := s.state.hashForWrite(args[1])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if _, exists := hash.Get(args[2]); exists {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	hash.Set(args[2], args[3])
+	s.state.keyModified(notifyHash, "hset", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: ":1\r\n"}
+}
+
+func (s *RedisServer) hgetCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("HGET")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	value, ok := hash.Get(args[2])
+	if !ok {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(value)}
+}
+
+func (s *RedisServer) hmgetCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("HMGET")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)-2) + "\r\n")
+	for _, field := range args[2:] {
+		var value string
+		ok := false
+		if found {
+			value, ok = hash.Get(field)
+		}
+		if !ok {
+			b.WriteString(RESP_NULL_BULK)
+			continue
+		}
+		b.WriteString(toRespStr(value))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+// hashDump replies with the fields and/or values of the hash at key; it backs
+// HGETALL, HKEYS and HVALS.
+func (s *RedisServer) hashDump(args []string, withFields, withValues bool) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+
+	out := make([]string, 0, hash.Len()*2)
+	for _, field := range hash.order {
+		if withFields {
+			out = append(out, field)
+		}
+		if withValues {
+			out = append(out, hash.entries[field].value)
+		}
+	}
+	return CommandResponse{Response: toRespStrArr(out)}
+}
+
+func (s *RedisServer) hdelCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("HDEL")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashToModify(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	deleted := 0
+	for _, field := range args[2:] {
+		if hash.Delete(field) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.state.keyModified(notifyHash, "hdel", args[1])
+		s.state.propagate(args)
+	}
+	if hash.Len() == 0 {
+		s.state.deleteKey(args[1])
+	}
+	return CommandResponse{Response: toRespInt(int64(deleted))}
+}
+
+func (s *RedisServer) hexistsCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("HEXISTS")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if found {
+		if _, ok := hash.Get(args[2]); ok {
+			return CommandResponse{Response: ":1\r\n"}
+		}
+	}
+	return CommandResponse{Response: ":0\r\n"}
+}
+
+func (s *RedisServer) hlenCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("HLEN")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(hash.Len()))}
+}
+
+func (s *RedisServer) hstrlenCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("HSTRLEN")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	value, _ := hash.Get(args[2])
+	return CommandResponse{Response: toRespInt(int64(len(value)))}
+}
+
+func (s *RedisServer) hincrbyCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("HINCRBY")
+	}
+	delta, ok := parseStrictInt(args[3])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, ok := s.state.hashForWrite(args[1])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var current int64
+	if value, exists := hash.Get(args[2]); exists {
+		current, ok = parseStrictInt(value)
+		if !ok {
+			return CommandResponse{Error: "-ERR hash value is not an integer"}
+		}
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return CommandResponse{Error: "-ERR increment or decrement would overflow"}
+	}
+	current += delta
+
+	hash.Update(args[2], strconv.FormatInt(current, 10))
+	s.state.keyModified(notifyHash, "hincrby", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(current)}
+}
+
+func (s *RedisServer) hincrbyfloatCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("HINCRBYFLOAT")
+	}
+	delta, ok := parseFloatArg(args[3])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_NOT_FLOAT}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, ok := s.state.hashForWrite(args[1])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var current float64
+	if value, exists := hash.Get(args[2]); exists {
+		current, ok = parseFloatArg(value)
+		if !ok {
+			return CommandResponse{Error: "-ERR hash value is not a float"}
+		}
+	}
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return CommandResponse{Error: "-ERR increment would produce NaN or Infinity"}
+	}
+
+	result := formatFloat(current)
+	hash.Update(args[2], result)
+	s.state.keyModified(notifyHash, "hincrbyfloat", args[1])
+	// Like INCRBYFLOAT, replicas receive the result rather than the delta.
+	s.state.propagate([]string{RESP_COMMAND_HSET, args[1], args[2], result})
+	if expireAt := hash.entries[args[2]].expireAt; expireAt != 0 {
+		s.state.propagate([]string{RESP_COMMAND_HPEXPIREAT, args[1], strconv.FormatInt(expireAt, 10), "FIELDS", "1", args[2]})
+	}
+
+	return CommandResponse{Response: toRespStr(result)}
+}
+
+func (s *RedisServer) hrandfieldCommand(args []string) CommandResponse {
+	if len(args) < 2 || len(args) > 4 {
+		return wrongArgsError("HRANDFIELD")
+	}
+
+	withCount := len(args) >= 3
+	count := 1
+	if withCount {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = n
+	}
+	withValues := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3]) != "WITHVALUES" {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		withValues = true
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if withCount {
+			return CommandResponse{Response: "*0\r\n"}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	if !withCount {
+		return CommandResponse{Response: toRespStr(hash.order[rand.Intn(hash.Len())])}
+	}
+
+	picks := randomPicks(hash.Len(), count)
+	out := make([]string, 0, len(picks)*2)
+	for _, i := range picks {
+		field := hash.order[i]
+		out = append(out, field)
+		if withValues {
+			out = append(out, hash.entries[field].value)
+		}
+	}
+	return CommandResponse{Response: toRespStrArr(out)}
+}
+
+// randomPicks chooses positions out of size for the HRANDFIELD family: a
+// positive count yields distinct positions (at most size of them), a negative
+// one yields exactly -count positions that may repeat.
+func randomPicks(size, count int) []int {
+	if count < 0 {
+		picks := make([]int, -count)
+		for i := range picks {
+			picks[i] = rand.Intn(size)
+		}
+		return picks
+	}
+	if count >= size {
+		return rand.Perm(size)
+	}
+	return rand.Perm(size)[:count]
+}
+
+func (s *RedisServer) hscanCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("HSCAN")
+	}
+	opts, errResp := parseScanArgs(args[2:], true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: scanReply(0, nil)}
+	}
+
+	next, fields := scanStrings(hash.order, opts)
+	out := make([]string, 0, len(fields)*2)
+	for _, field := range fields {
+		out = append(out, field)
+		if !opts.noValues {
+			out = append(out, hash.entries[field].value)
+		}
+	}
+	return CommandResponse{Response: scanReply(next, out)}
+}
+
+// parseHashFieldsArg parses the trailing "FIELDS numfields field [field ...]"
+// of the per-field TTL commands.
+func parseHashFieldsArg(args []string) ([]string, string) {
+	if len(args) < 2 || strings.ToUpper(args[0]) != "FIELDS" {
+		return nil, "-ERR Mandatory argument FIELDS is missing or not at the right position"
+	}
+	numFields, err := strconv.Atoi(args[1])
+	if err != nil || numFields <= 0 {
+		return nil, "-ERR Parameter `numFields` should be greater than 0"
+	}
+	if numFields != len(args)-2 {
+		return nil, "-ERR The `numfields` parameter must match the number of arguments"
+	}
+	return args[2:], ""
+}
+
+// hexpireCommand implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT.
+func (s *RedisServer) hexpireCommand(args []string) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) < 6 {
+		return wrongArgsError(cmd)
+	}
+
+	n, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+	if n < 0 {
+		return CommandResponse{Error: "-ERR invalid expire time, must be >= 0"}
+	}
+
+	var expireAt int64
+	now := time.Now().UnixMilli()
+	switch cmd {
+	case RESP_COMMAND_HEXPIRE:
+		expireAt = now + n*1000
+	case RESP_COMMAND_HPEXPIRE:
+		expireAt = now + n
+	case RESP_COMMAND_HEXPIREAT:
+		expireAt = n * 1000
+	default:
+		expireAt = n
+	}
+	if n > math.MaxInt64/1000 || expireAt < 0 || expireAt > 1<<48 {
+		return CommandResponse{Error: "-ERR invalid expire time, must be >= 0 and <= 281474976710655"}
+	}
+
+	rest := args[3:]
+	condition := ""
+	switch strings.ToUpper(rest[0]) {
+	case "NX", "XX", "GT", "LT":
+		condition = strings.ToUpper(rest[0])
+		rest = rest[1:]
+	}
+	fields, errResp := parseHashFieldsArg(rest)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashToModify(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	results := make([]int64, len(fields))
+	var updated, deleted []string
+	for i, field := range fields {
+		var entry *hashField
+		if found {
+			entry = hash.entries[field]
+		}
+		if entry == nil {
+			results[i] = -2
+			continue
+		}
+
+		current := entry.expireAt
+		skip := false
+		switch condition {
+		case "NX":
+			skip = current != 0
+		case "XX":
+			skip = current == 0
+		case "GT":
+			// A field without TTL counts as an infinite one.
+			skip = current == 0 || expireAt <= current
+		case "LT":
+			skip = current != 0 && expireAt >= current
+		}
+		if skip {
+			results[i] = 0
+			continue
+		}
+
+		if expireAt <= now {
+			hash.Delete(field)
+			deleted = append(deleted, field)
+			results[i] = 2
+			continue
+		}
+		hash.setExpire(entry, expireAt)
+		updated = append(updated, field)
+		results[i] = 1
+	}
+
+	if len(deleted) > 0 {
+		s.state.keyModified(notifyHash, "hdel", args[1])
+		s.state.propagate(append([]string{RESP_COMMAND_HDEL, args[1]}, deleted...))
+	}
+	if len(updated) > 0 {
+		s.state.keyModified(notifyHash, "hexpire", args[1])
+		propagated := []string{RESP_COMMAND_HPEXPIREAT, args[1], strconv.FormatInt(expireAt, 10), "FIELDS", strconv.Itoa(len(updated))}
+		s.state.propagate(append(propagated, updated...))
+	}
+	if found && hash.Len() == 0 {
+		s.state.deleteKey(args[1])
+	}
+
+	return CommandResponse{Response: toRespIntArr(results)}
+}
+
+// httlCommand implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME.
+func (s *RedisServer) httlCommand(args []string) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) < 5 {
+		return wrongArgsError(cmd)
+	}
+	fields, errResp := parseHashFieldsArg(args[2:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	now := time.Now().UnixMilli()
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		var entry *hashField
+		if found {
+			entry = hash.entries[field]
+		}
+		switch {
+		case entry == nil:
+			results[i] = -2
+		case entry.expireAt == 0:
+			results[i] = -1
+		case cmd == RESP_COMMAND_HTTL:
+			results[i] = (entry.expireAt - now + 500) / 1000
+		case cmd == RESP_COMMAND_HPTTL:
+			results[i] = entry.expireAt - now
+		case cmd == RESP_COMMAND_HEXPIRETIME:
+			results[i] = entry.expireAt / 1000
+		default:
+			results[i] = entry.expireAt
+		}
+	}
+	return CommandResponse{Response: toRespIntArr(results)}
+}
+
+func (s *RedisServer) hpersistCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("HPERSIST")
+	}
+	fields, errResp := parseHashFieldsArg(args[2:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hash, found, wrongType := s.state.hashToModify(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	results := make([]int64, len(fields))
+	persisted := false
+	for i, field := range fields {
+		var entry *hashField
+		if found {
+			entry = hash.entries[field]
+		}
+		switch {
+		case entry == nil:
+			results[i] = -2
+		case entry.expireAt == 0:
+			results[i] = -1
+		default:
+			hash.setExpire(entry, 0)
+			persisted = true
+			results[i] = 1
+		}
+	}
+	if persisted {
+		s.state.keyModified(notifyHash, "hpersist", args[1])
+		s.state.propagate(args)
+	}
+	return CommandResponse{Response: toRespIntArr(results)}
+}
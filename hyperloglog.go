@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+// HyperLogLogs are stored as strings laid out exactly as Redis lays them out,
+// so PFCOUNT estimates and RDB dumps match a real server byte for byte:
+//
+//	+------+----------+-----------+---------------------------+
+//	| HYLL | encoding | 3 unused  | cached cardinality (8 LE) | registers...
+//	+------+----------+-----------+---------------------------+
+//
+// The dense encoding packs 16384 6-bit registers, least significant bits
+// first. The sparse encoding run-length encodes them with three opcodes:
+//
+//	ZERO  00xxxxxx          xxxxxx+1 registers set to 0 (1-64)
+//	XZERO 01xxxxxx yyyyyyyy 14-bit length+1 registers set to 0 (1-16384)
+//	VAL   1vvvvvxx          xx+1 registers set to vvvvv+1 (1-4 of 1-32)
+//
+// A sparse HyperLogLog is promoted to dense once a register exceeds 32 or the
+// string grows past hllSparseMaxBytes.
+const (
+	hllP                 = 14
+	hllQ                 = 64 - hllP
+	hllRegisters         = 1 << hllP
+	hllPMask             = hllRegisters - 1
+	hllBits              = 6
+	hllRegisterMax       = 1<<hllBits - 1
+	hllHeaderSize        = 16
+	hllDenseSize         = hllHeaderSize + (hllRegisters*hllBits+7)/8
+	hllDense             = 0
+	hllSparse            = 1
+	hllAlphaInf          = 0.721347520444481703680
+	hllHashSeed          = 0xadc83b19
+	hllSparseValMaxValue = 32
+	hllSparseValMaxLen   = 4
+	hllSparseZeroMaxLen  = 64
+	// hllSparseMaxBytes mirrors Redis' default hll-sparse-max-bytes.
+	hllSparseMaxBytes = 3000
+)
+
+// newHLL returns an empty sparse HyperLogLog: a single XZERO opcode covering
+// every register.
+func newHLL() []byte {
+	hll := make([]byte, hllHeaderSize, hllHeaderSize+2)
+	copy(hll, "HYLL")
+	hll[4] = hllSparse
+	return hllSparseXZeroSet(hll, hllRegisters)
+}
+
+// isHLL reports whether buf is a well-formed HyperLogLog header.
+func isHLL(buf []byte) bool {
+	if len(buf) < hllHeaderSize || string(buf[:4]) != "HYLL" || buf[4] > hllSparse {
+		return false
+	}
+	return buf[4] != hllDense || len(buf) == hllDenseSize
+}
+
+func hllCachedCard(hll []byte) (uint64, bool) {
+	if hll[15]&0x80 != 0 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(hll[8:16]), true
+}
+
+func hllSetCachedCard(hll []byte, card uint64) {
+	binary.LittleEndian.PutUint64(hll[8:16], card)
+}
+
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 0x80
+}
+
+// murmurHash64A is the hash function Redis feeds its HyperLogLogs with.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ uint64(len(data))*m
+
+	for len(data) >= 8 {
+		k := binary.LittleEndian.Uint64(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * i)
+		}
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatLen returns the register an element maps to and the length of the
+// run of zeros in the rest of its hash, plus one.
+func hllPatLen(element string) (index int, count uint8) {
+	hash := murmurHash64A([]byte(element), hllHashSeed)
+	index = int(hash & hllPMask)
+	hash >>= hllP
+	// Setting bit Q makes sure the loop terminates.
+	hash |= 1 << hllQ
+	return index, uint8(bits.TrailingZeros64(hash) + 1)
+}
+
+func hllDenseGet(registers []byte, index int) uint8 {
+	byteIdx := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	b0 := registers[byteIdx]
+	var b1 byte
+	if byteIdx+1 < len(registers) {
+		b1 = registers[byteIdx+1]
+	}
+	return uint8((uint(b0)>>fb)|(uint(b1)<<(8-fb))) & hllRegisterMax
+}
+
+func hllDenseSetRegister(registers []byte, index int, val uint8) {
+	byteIdx := index * hllBits / 8
+	fb := uint(index * hllBits & 7)
+	registers[byteIdx] &^= hllRegisterMax << fb
+	registers[byteIdx] |= val << fb
+	if byteIdx+1 < len(registers) {
+		registers[byteIdx+1] &^= hllRegisterMax >> (8 - fb)
+		registers[byteIdx+1] |= val >> (8 - fb)
+	}
+}
+
+// hllDenseSet raises register index to count, reporting whether it changed.
+func hllDenseSet(registers []byte, index int, count uint8) bool {
+	if count <= hllDenseGet(registers, index) {
+		return false
+	}
+	hllDenseSetRegister(registers, index, count)
+	return true
+}
+
+// Sparse opcode accessors, named after Redis' HLL_SPARSE_* macros.
+
+func hllSparseIsZero(op byte) bool  { return op&0xc0 == 0 }
+func hllSparseIsXZero(op byte) bool { return op&0xc0 == 0x40 }
+func hllSparseIsVal(op byte) bool   { return op&0x80 != 0 }
+func hllSparseZeroLen(op byte) int  { return int(op&0x3f) + 1 }
+func hllSparseValValue(op byte) int { return int(op>>2&0x1f) + 1 }
+func hllSparseValLen(op byte) int   { return int(op&0x3) + 1 }
+
+func hllSparseXZeroLen(op, next byte) int {
+	return int(op&0x3f)<<8 | int(next) + 1
+}
+
+func hllSparseVal(val, length int) byte {
+	return byte((val-1)<<2|(length-1)) | 0x80
+}
+
+func hllSparseXZeroSet(buf []byte, length int) []byte {
+	l := length - 1
+	return append(buf, byte(l>>8)|0x40, byte(l))
+}
+
+// hllSparseZeroRun appends the shortest opcode for a run of zero registers.
+func hllSparseZeroRun(buf []byte, length int) []byte {
+	if length > hllSparseZeroMaxLen {
+		return hllSparseXZeroSet(buf, length)
+	}
+	return append(buf, byte(length-1))
+}
+
+// hllSparseOps walks the opcodes of a sparse HyperLogLog, calling fn with
+// each run's value and length. ok is false if the opcodes do not cover
+// exactly hllRegisters registers.
+func hllSparseOps(hll []byte, fn func(first, value, runLen int)) bool {
+	ops := hll[hllHeaderSize:]
+	idx := 0
+	for i := 0; i < len(ops); {
+		op := ops[i]
+		switch {
+		case hllSparseIsZero(op):
+			runLen := hllSparseZeroLen(op)
+			fn(idx, 0, runLen)
+			idx += runLen
+			i++
+		case hllSparseIsXZero(op):
+			if i+1 >= len(ops) {
+				return false
+			}
+			runLen := hllSparseXZeroLen(op, ops[i+1])
+			fn(idx, 0, runLen)
+			idx += runLen
+			i += 2
+		default:
+			runLen := hllSparseValLen(op)
+			if idx+runLen > hllRegisters {
+				return false
+			}
+			fn(idx, hllSparseValValue(op), runLen)
+			idx += runLen
+			i++
+		}
+		if idx > hllRegisters {
+			return false
+		}
+	}
+	return idx == hllRegisters
+}
+
+// hllSparseToDense converts a sparse HyperLogLog to the dense encoding,
+// keeping the header, cached cardinality included.
+func hllSparseToDense(hll []byte) ([]byte, bool) {
+	if hll[4] == hllDense {
+		return hll, true
+	}
+	dense := make([]byte, hllDenseSize)
+	copy(dense, hll[:hllHeaderSize])
+	dense[4] = hllDense
+	registers := dense[hllHeaderSize:]
+	ok := hllSparseOps(hll, func(first, value, runLen int) {
+		if value == 0 {
+			return
+		}
+		for i := first; i < first+runLen; i++ {
+			hllDenseSetRegister(registers, i, uint8(value))
+		}
+	})
+	return dense, ok
+}
+
+// hllSparseSet raises register index of a sparse HyperLogLog to count. It is
+// a port of Redis' hllSparseSet, producing the same opcodes, and promotes the
+// HyperLogLog to dense when the value or the resulting size demands it. It
+// returns the possibly reallocated HyperLogLog, whether the register changed,
+// and ok set to false if the encoding is corrupt.
+func hllSparseSet(hll []byte, index int, count uint8) (out []byte, changed, ok bool) {
+	if count > hllSparseValMaxValue {
+		return hllPromoteAndSet(hll, index, count)
+	}
+
+	// Find the opcode covering index, remembering the one before it.
+	ops := hll[hllHeaderSize:]
+	p, prev, first, span := 0, -1, 0, 0
+	for p < len(ops) {
+		opLen := 1
+		switch {
+		case hllSparseIsZero(ops[p]):
+			span = hllSparseZeroLen(ops[p])
+		case hllSparseIsVal(ops[p]):
+			span = hllSparseValLen(ops[p])
+		default:
+			if p+1 >= len(ops) {
+				return hll, false, false
+			}
+			span = hllSparseXZeroLen(ops[p], ops[p+1])
+			opLen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += opLen
+		first += span
+	}
+	if span == 0 || p >= len(ops) {
+		return hll, false, false
+	}
+
+	op := ops[p]
+	isXZero := hllSparseIsXZero(op)
+	var runLen int
+	switch {
+	case hllSparseIsZero(op):
+		runLen = hllSparseZeroLen(op)
+	case isXZero:
+		runLen = hllSparseXZeroLen(op, ops[p+1])
+	default:
+		runLen = hllSparseValLen(op)
+		if hllSparseValValue(op) >= int(count) {
+			return hll, false, true
+		}
+	}
+
+	if runLen == 1 && !isXZero {
+		// A lone register turns into a single VAL opcode in place.
+		ops[p] = hllSparseVal(int(count), 1)
+	} else {
+		// Split the run into up to three opcodes: the registers before
+		// index, index itself, and the registers after it.
+		last := first + span - 1
+		seq := make([]byte, 0, 5)
+		if hllSparseIsVal(op) {
+			curVal := hllSparseValValue(op)
+			if index != first {
+				seq = append(seq, hllSparseVal(curVal, index-first))
+			}
+			seq = append(seq, hllSparseVal(int(count), 1))
+			if index != last {
+				seq = append(seq, hllSparseVal(curVal, last-index))
+			}
+		} else {
+			if index != first {
+				seq = hllSparseZeroRun(seq, index-first)
+			}
+			seq = append(seq, hllSparseVal(int(count), 1))
+			if index != last {
+				seq = hllSparseZeroRun(seq, last-index)
+			}
+		}
+
+		oldLen := 1
+		if isXZero {
+			oldLen = 2
+		}
+		delta := len(seq) - oldLen
+		if delta > 0 && len(hll)+delta > hllSparseMaxBytes {
+			return hllPromoteAndSet(hll, index, count)
+		}
+		rest := append([]byte(nil), ops[p+oldLen:]...)
+		hll = append(append(hll[:hllHeaderSize+p], seq...), rest...)
+		ops = hll[hllHeaderSize:]
+	}
+
+	// Merge adjacent VAL opcodes holding the same value, scanning up to
+	// five opcodes from the one before the change.
+	p = max(prev, 0)
+	for scan := 5; p < len(ops) && scan > 0; scan-- {
+		switch {
+		case hllSparseIsXZero(ops[p]):
+			p += 2
+			continue
+		case hllSparseIsZero(ops[p]):
+			p++
+			continue
+		}
+		if p+1 < len(ops) && hllSparseIsVal(ops[p+1]) {
+			v1, v2 := hllSparseValValue(ops[p]), hllSparseValValue(ops[p+1])
+			length := hllSparseValLen(ops[p]) + hllSparseValLen(ops[p+1])
+			if v1 == v2 && length <= hllSparseValMaxLen {
+				ops[p+1] = hllSparseVal(v1, length)
+				copy(ops[p:], ops[p+1:])
+				hll = hll[:len(hll)-1]
+				ops = ops[:len(ops)-1]
+				// Try merging the result with its right neighbour too.
+				continue
+			}
+		}
+		p++
+	}
+
+	hllInvalidateCache(hll)
+	return hll, true, true
+}
+
+func hllPromoteAndSet(hll []byte, index int, count uint8) ([]byte, bool, bool) {
+	dense, ok := hllSparseToDense(hll)
+	if !ok {
+		return hll, false, false
+	}
+	hllDenseSet(dense[hllHeaderSize:], index, count)
+	hllInvalidateCache(dense)
+	return dense, true, true
+}
+
+// hllAdd adds element to the HyperLogLog, returning the possibly reallocated
+// HyperLogLog and whether any register changed.
+func hllAdd(hll []byte, element string) (out []byte, changed, ok bool) {
+	index, count := hllPatLen(element)
+	return hllSet(hll, index, count)
+}
+
+// hllSet raises a register to count in either encoding.
+func hllSet(hll []byte, index int, count uint8) (out []byte, changed, ok bool) {
+	if hll[4] == hllDense {
+		if !hllDenseSet(hll[hllHeaderSize:], index, count) {
+			return hll, false, true
+		}
+		hllInvalidateCache(hll)
+		return hll, true, true
+	}
+	return hllSparseSet(hll, index, count)
+}
+
+// hllMergeInto raises every register of regs to the matching register of
+// hll. ok is false if the sparse encoding is corrupt.
+func hllMergeInto(regs []uint8, hll []byte) bool {
+	if hll[4] == hllDense {
+		registers := hll[hllHeaderSize:]
+		for i := range regs {
+			if v := hllDenseGet(registers, i); v > regs[i] {
+				regs[i] = v
+			}
+		}
+		return true
+	}
+	return hllSparseOps(hll, func(first, value, runLen int) {
+		if value == 0 {
+			return
+		}
+		for i := first; i < first+runLen; i++ {
+			if uint8(value) > regs[i] {
+				regs[i] = uint8(value)
+			}
+		}
+	})
+}
+
+// hllHistogram counts how many registers hold each value.
+func hllHistogram(hll []byte) (histo [64]int, ok bool) {
+	if hll[4] == hllDense {
+		registers := hll[hllHeaderSize:]
+		for i := 0; i < hllRegisters; i++ {
+			histo[hllDenseGet(registers, i)]++
+		}
+		return histo, true
+	}
+	ok = hllSparseOps(hll, func(first, value, runLen int) {
+		histo[value] += runLen
+	})
+	return histo, ok
+}
+
+func hllRawHistogram(registers []uint8) (histo [64]int) {
+	for _, v := range registers {
+		histo[v]++
+	}
+	return histo
+}
+
+// hllEstimate computes the cardinality from a register histogram with Otmar
+// Ertl's improved estimator, as Redis does.
+func hllEstimate(histo [64]int) uint64 {
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return uint64(math.Round(hllAlphaInf * m * m / z))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
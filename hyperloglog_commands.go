@@ -0,0 +1,183 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	RESP_ERR_INVALID_HLL = "-WRONGTYPE Key is not a valid HyperLogLog string value."
+	RESP_ERR_CORRUPT_HLL = "-INVALIDOBJ Corrupted HLL object detected"
+)
+
+// hllAt returns the HyperLogLog stored at key for reading. errResp is set
+// when the key holds something other than a HyperLogLog string.
+func (st *RedisState) hllAt(key string) (hll []byte, found bool, errResp string) {
+	value, exists := st.lookupKey(key)
+	if !exists {
+		return nil, false, ""
+	}
+	buf, ok := mutableString(value.val)
+	if !ok {
+		return nil, true, RESP_ERR_WRONGTYPE
+	}
+	if !isHLL(buf) {
+		return nil, true, RESP_ERR_INVALID_HLL
+	}
+	return buf, true, ""
+}
+
+// storeHLL writes hll back to key, keeping its TTL. HyperLogLogs are modified
+// in place, but may be reallocated as they grow or switch to dense.
+func (st *RedisState) storeHLL(key string, hll []byte) {
+	value, exists := st.storage[key]
+	if !exists {
+		value = newStorageVal(nil, time.Time{})
+	}
+	value.val = hll
+	st.storage[key] = value
+}
+
+func (s *RedisServer) pfaddCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("PFADD")
+	}
+	key := args[1]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	hll, found, errResp := s.state.hllAt(key)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	updated := !found
+	if !found {
+		hll = newHLL()
+	}
+	for _, element := range args[2:] {
+		var changed, ok bool
+		hll, changed, ok = hllAdd(hll, element)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+		}
+		updated = updated || changed
+	}
+
+	if !updated {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	hllInvalidateCache(hll)
+	s.state.storeHLL(key, hll)
+	s.state.keyModified(notifyString, "pfadd", key)
+	s.state.propagate(args)
+	return CommandResponse{Response: ":1\r\n"}
+}
+
+func (s *RedisServer) pfcountCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("PFCOUNT")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	if len(args) > 2 {
+		// Several keys are merged on the fly into a scratch register set,
+		// leaving the stored HyperLogLogs untouched.
+		registers := make([]uint8, hllRegisters)
+		for _, key := range args[1:] {
+			hll, found, errResp := s.state.hllAt(key)
+			if errResp != "" {
+				return CommandResponse{Error: errResp}
+			}
+			if !found {
+				continue
+			}
+			if !hllMergeInto(registers, hll) {
+				return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+			}
+		}
+		card := hllEstimate(hllRawHistogram(registers))
+		return CommandResponse{Response: toRespInt(int64(card))}
+	}
+
+	key := args[1]
+	hll, found, errResp := s.state.hllAt(key)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	if card, ok := hllCachedCard(hll); ok {
+		return CommandResponse{Response: toRespInt(int64(card))}
+	}
+	histo, ok := hllHistogram(hll)
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+	}
+	card := hllEstimate(histo)
+
+	// Caching the estimate changes the stored bytes, so replicas are told
+	// to do the same.
+	hllSetCachedCard(hll, card)
+	s.state.storeHLL(key, hll)
+	s.state.propagate(args)
+	return CommandResponse{Response: toRespInt(int64(card))}
+}
+
+func (s *RedisServer) pfmergeCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("PFMERGE")
+	}
+	dest := args[1]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	// The destination takes part in the union too.
+	registers := make([]uint8, hllRegisters)
+	useDense := false
+	for _, key := range args[1:] {
+		hll, found, errResp := s.state.hllAt(key)
+		if errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		if !found {
+			continue
+		}
+		if hll[4] == hllDense {
+			useDense = true
+		}
+		if !hllMergeInto(registers, hll) {
+			return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+		}
+	}
+
+	hll, found, _ := s.state.hllAt(dest)
+	if !found {
+		hll = newHLL()
+	}
+	// The result stays sparse unless one of the inputs was dense, so the
+	// bytes match what Redis would store.
+	if useDense {
+		var ok bool
+		if hll, ok = hllSparseToDense(hll); !ok {
+			return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+		}
+	}
+	for i, count := range registers {
+		if count == 0 {
+			continue
+		}
+		var ok bool
+		if hll, _, ok = hllSet(hll, i, count); !ok {
+			return CommandResponse{Error: RESP_ERR_CORRUPT_HLL}
+		}
+	}
+	hllInvalidateCache(hll)
+	s.state.storeHLL(dest, hll)
+	s.state.keyModified(notifyString, "pfadd", dest)
+	s.state.propagate(args)
+	return CommandResponse{Response: "+OK\r\n"}
+}
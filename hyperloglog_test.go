@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+)
+
+// The payloads below are what Redis 7.2 stores for the same commands. They
+// were worked out by replaying the commands through a transcription of
+// hyperloglog.c (hash, sparse opcode splitting and merging, promotion and the
+// estimator) rather than captured from a running server; the counts for 1..5
+// and 1..10 and the cache byte checks are also asserted by Redis' own
+// tests/unit/hyperloglog.tcl.
+
+// getHLL returns the raw string stored at key.
+func getHLL(c *testClient, key string) []byte {
+	c.t.Helper()
+	reply := c.do("GET", key)
+	payload, ok := parseBulk(reply)
+	if !ok {
+		c.t.Fatalf("GET %s: %q", key, reply)
+	}
+	return []byte(payload)
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+func TestHLLSparsePayloads(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+
+	// An empty HyperLogLog is a single XZERO covering all 16384 registers,
+	// its cached cardinality marked stale.
+	c.expect(integer(1), "PFADD", "empty")
+	want := mustDecodeHex(t, "48594c4c0100000000000000000000807fff")
+	if got := getHLL(c, "empty"); !bytes.Equal(got, want) {
+		t.Errorf("empty HLL:\n got %x\nwant %x", got, want)
+	}
+
+	c.expect(integer(1), "PFADD", "abc", "a", "b", "c")
+	want = mustDecodeHex(t, "48594c4c01000000000000000000008060f38050b1844bfb80425a")
+	if got := getHLL(c, "abc"); !bytes.Equal(got, want) {
+		t.Errorf("PFADD a b c:\n got %x\nwant %x", got, want)
+	}
+
+	// PFCOUNT caches the cardinality, little endian, in the header.
+	c.expect(integer(3), "PFCOUNT", "abc")
+	want[15] = 0
+	want[8] = 3
+	if got := getHLL(c, "abc"); !bytes.Equal(got, want) {
+		t.Errorf("after PFCOUNT:\n got %x\nwant %x", got, want)
+	}
+	c.expect(integer(0), "PFADD", "abc", "a", "b", "c")
+	c.expect(bulk("\x00"), "GETRANGE", "abc", "15", "15")
+	c.expect(integer(1), "PFADD", "abc", "1", "2", "3")
+	c.expect(bulk("\x80"), "GETRANGE", "abc", "15", "15")
+}
+
+func TestHLLCountInvalidatesCache(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(1), "PFADD", "hll", "1", "2", "3", "4", "5")
+	c.expect(integer(5), "PFCOUNT", "hll")
+	c.expect(integer(1), "PFADD", "hll", "6", "7", "8", "8", "9", "10")
+	c.expect(integer(10), "PFCOUNT", "hll")
+}
+
+func TestHLLPromotesToDense(t *testing.T) {
+	tests := []struct {
+		elements int
+		encoding byte
+		size     int
+		sha256   string
+		card     int64
+	}{
+		// element:1667 takes the sparse string to exactly hll-sparse-max-bytes.
+		{1668, hllSparse, 3000, "a0de9b7022c663ff773968391af1c90e9a228c89de6cb1de4b3cddc7b0a08185", 1674},
+		// element:1668 would grow it past the limit, so it goes dense, keeping
+		// the header and with it the cardinality the last PFCOUNT cached.
+		{1669, hllDense, hllDenseSize, "2cb94ffbe75f776989d9e0ff19de46697ea243d89fd70abd09797e2c2e0f9202", 1675},
+		{5000, hllDense, hllDenseSize, "7cda47be0945325286e10cdfc68dade81e2cdd435b38604ed96fcc38d72a743b", 5005},
+	}
+
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	added := 0
+	for _, tt := range tests {
+		for ; added < tt.elements; added++ {
+			c.do("PFADD", "hll", "element:"+strconv.Itoa(added))
+		}
+		got := getHLL(c, "hll")
+		if len(got) != tt.size || got[4] != tt.encoding {
+			t.Fatalf("%d elements: %d bytes, encoding %d; want %d bytes, encoding %d",
+				tt.elements, len(got), got[4], tt.size, tt.encoding)
+		}
+		if sum := sha256.Sum256(got); hex.EncodeToString(sum[:]) != tt.sha256 {
+			t.Errorf("%d elements: payload sha256 %x, want %s", tt.elements, sum, tt.sha256)
+		}
+		c.expect(integer(tt.card), "PFCOUNT", "hll")
+	}
+}
+
+func TestHLLCountDensePayload(t *testing.T) {
+	// Dense registers are packed six bits each, least significant bits
+	// first, so three bytes hold four registers and a repeating three-byte
+	// pattern sets every register.
+	tests := []struct {
+		name    string
+		pattern string
+		card    int64
+	}{
+		{"registers 1 2 3 0", "813000", 21922},
+		{"every fourth register 1", "000004", 4630},
+		{"every register 5", "455114", 378194},
+	}
+
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mustDecodeHex(t, "48594c4c000000000000000000000080")
+			payload := append(header, bytes.Repeat(mustDecodeHex(t, tt.pattern), hllRegisters/4)...)
+			c.expect(okReply, "SET", "dense", string(payload))
+			c.expect(integer(tt.card), "PFCOUNT", "dense")
+			c.expect(integer(tt.card), "PFCOUNT", "dense")
+		})
+	}
+
+	// A valid cached cardinality is trusted as is.
+	payload := append(mustDecodeHex(t, "48594c4c000000002a00000000000000"), make([]byte, hllDenseSize-hllHeaderSize)...)
+	c.expect(okReply, "SET", "cached", string(payload))
+	c.expect(integer(42), "PFCOUNT", "cached")
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// embstrSizeLimit is the longest string Redis stores with the embstr
+// encoding.
+const embstrSizeLimit = 44
+
+// encodingOf reports the name OBJECT ENCODING uses for val.
+func encodingOf(val interface{}) string {
+	switch v := val.(type) {
+	case int64:
+		return "int"
+	case string:
+		if len(v) <= embstrSizeLimit {
+			return "embstr"
+		}
+		return "raw"
+	case []byte:
+		return "raw"
+	case *quicklist:
+		if v.head == v.tail {
+			return "listpack"
+		}
+		return "quicklist"
+	case *hashValue:
+		return v.encoding()
+	case *setValue:
+		return v.encoding()
+	case *sortedset.SortedSet:
+		return zsetEncoding(v)
+	case *stream:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// typeName reports the name TYPE uses for val.
+func typeName(val interface{}) string {
+	switch val.(type) {
+	case string, int64, []byte:
+		return "string"
+	case *quicklist:
+		return "list"
+	case *hashValue:
+		return "hash"
+	case *setValue:
+		return "set"
+	case *sortedset.SortedSet:
+		return "zset"
+	case *stream:
+		return "stream"
+	}
+	return "none"
+}
+
+func (s *RedisServer) typeCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("TYPE")
+	}
+
+	s.state.storageMu.RLock()
+	value, ok := s.state.readKey(args[1])
+	s.state.storageMu.RUnlock()
+
+	if !ok {
+		return CommandResponse{Response: "+none"}
+	}
+	return CommandResponse{Response: "+" + typeName(value.val)}
+}
+
+func (s *RedisServer) keysCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("KEYS")
+	}
+
+	now := time.Now()
+	keys := []string{}
+	s.state.storageMu.RLock()
+	for key, value := range s.state.storage {
+		if !value.expired(now) && globMatch(args[1], key) {
+			keys = append(keys, key)
+		}
+	}
+	s.state.storageMu.RUnlock()
+
+	return CommandResponse{Response: toRespStrArr(keys)}
+}
+
+// flushCommand implements FLUSHALL and FLUSHDB, which are the same thing with
+// a single database. ASYNC is accepted but the flush always happens at once.
+func (s *RedisServer) flushCommand(args []string) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) > 2 {
+		return wrongArgsError(cmd)
+	}
+	if len(args) == 2 {
+		if mode := strings.ToUpper(args[1]); mode != "ASYNC" && mode != "SYNC" {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	s.state.replaceStorage(make(map[string]storageVal))
+	s.state.propagate(args)
+	s.state.storageMu.Unlock()
+
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) objectCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("OBJECT")
+	}
+
+	sub := strings.ToUpper(args[1])
+	switch sub {
+	case "ENCODING", "REFCOUNT":
+		if len(args) != 3 {
+			return wrongArgsError("OBJECT|" + strings.ToLower(sub))
+		}
+	default:
+		return CommandResponse{Error: "-ERR unknown subcommand '" + args[1] + "'. Try OBJECT HELP."}
+	}
+
+	s.state.storageMu.RLock()
+	value, ok := s.state.readKey(args[2])
+	s.state.storageMu.RUnlock()
+
+	if !ok {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	if sub == "REFCOUNT" {
+		return CommandResponse{Response: ":1\r\n"}
+	}
+	return CommandResponse{Response: toRespStr(encodingOf(value.val))}
+}
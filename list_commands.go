@@ -0,0 +1,747 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listAt returns the list stored at key. found is false when the key does not
+// exist; wrongType is true when it holds a value of another type. The caller
+// must hold storageMu for writing.
+func (st *RedisState) listAt(key string) (list *quicklist, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	list, ok = value.val.(*quicklist)
+	if !ok {
+		return nil, true, true
+	}
+	return list, true, false
+}
+
+// popList removes up to count elements from the head (left) or the tail of
+// the list at key, deleting the key once it is empty. Elements are returned in
+// the order they were popped. The caller must hold storageMu for writing and
+// have checked the key holds a list.
+func (st *RedisState) popList(key string, left bool, count int) []string {
+	list := st.storage[key].val.(*quicklist)
+	if count > list.Len() {
+		count = list.Len()
+	}
+
+	popped := make([]string, count)
+	for i := range popped {
+		if left {
+			popped[i], _ = list.PopFront()
+		} else {
+			popped[i], _ = list.PopBack()
+		}
+	}
+
+	st.keyModified(notifyList, strings.ToLower(popCommandName(left)), key)
+	if list.Len() == 0 {
+		st.deleteKey(key)
+	}
+	return popped
+}
+
+// pushList adds elems to the head (left) or the tail of the list at key,
+// creating it if needed, and wakes clients blocked on the key. It returns the
+// new length. The caller must hold storageMu for writing and have checked the
+// key does not hold another type.
+func (st *RedisState) pushList(key string, elems []string, left bool) int {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		value = newStorageVal(newQuicklist(), time.Time{})
+		st.storage[key] = value
+	}
+	list := value.val.(*quicklist)
+
+	for _, elem := range elems {
+		if left {
+			list.PushFront(elem)
+		} else {
+			list.PushBack(elem)
+		}
+	}
+
+	event := "rpush"
+	if left {
+		event = "lpush"
+	}
+	st.keyModified(notifyList, event, key)
+	st.signalKeyReady(key)
+	return list.Len()
+}
+
+// pushCommand implements LPUSH, RPUSH and their X variants, which only push
+// onto lists that already exist.
+func (s *RedisServer) pushCommand(args []string, left bool, onlyExisting bool) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	key := args[1]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	_, found, wrongType := s.state.listAt(key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if onlyExisting && !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	listLen := s.state.pushList(key, args[2:], left)
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(listLen))}
+}
+
+// normaliseRange applies Redis' range rules for LRANGE and LTRIM: negative
+// indexes count from the tail and the range is clamped to the list. ok is
+// false when the range selects nothing.
+func normaliseRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	return start, stop, true
+}
+
+func (s *RedisServer) lrangeCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("LRANGE")
+	}
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+
+	start, stop, ok := normaliseRange(start, stop, list.Len())
+	if !ok {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+	return CommandResponse{Response: toRespStrArr(list.Range(start, stop))}
+}
+
+func (s *RedisServer) llenCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("LLEN")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(list.Len()))}
+}
+
+func (s *RedisServer) lindexCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("LINDEX")
+	}
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	elem, ok := list.Index(index)
+	if !ok {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(elem)}
+}
+
+func (s *RedisServer) lsetCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("LSET")
+	}
+	index, err := strconv.Atoi(args[2])
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Error: "-ERR no such key"}
+	}
+	if !list.Set(index, args[3]) {
+		return CommandResponse{Error: "-ERR index out of range"}
+	}
+	s.state.keyModified(notifyList, "lset", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) linsertCommand(args []string) CommandResponse {
+	if len(args) != 5 {
+		return wrongArgsError("LINSERT")
+	}
+	var after bool
+	switch strings.ToUpper(args[2]) {
+	case "BEFORE":
+	case "AFTER":
+		after = true
+	default:
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+	pivot, elem := args[3], args[4]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	position := -1
+	list.Each(false, func(index int, e string) bool {
+		if e == pivot {
+			position = index
+			return false
+		}
+		return true
+	})
+	if position == -1 {
+		return CommandResponse{Response: ":-1\r\n"}
+	}
+	if after {
+		position++
+	}
+
+	list.InsertAt(position, elem)
+	s.state.keyModified(notifyList, "linsert", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(list.Len()))}
+}
+
+func (s *RedisServer) lremCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("LREM")
+	}
+	count, err := strconv.Atoi(args[2])
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+	removed := list.RemoveMatching(args[3], limit, count < 0)
+	if removed > 0 {
+		s.state.keyModified(notifyList, "lrem", args[1])
+		s.state.propagate(args)
+	}
+	if list.Len() == 0 {
+		s.state.deleteKey(args[1])
+	}
+
+	return CommandResponse{Response: toRespInt(int64(removed))}
+}
+
+func (s *RedisServer) ltrimCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("LTRIM")
+	}
+	start, err1 := strconv.Atoi(args[2])
+	stop, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: "+OK\r\n"}
+	}
+
+	start, stop, ok := normaliseRange(start, stop, list.Len())
+	if ok {
+		list.Trim(start, stop)
+	}
+	s.state.keyModified(notifyList, "ltrim", args[1])
+	if !ok {
+		s.state.deleteKey(args[1])
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) lposCommand(args []string) CommandResponse {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return wrongArgsError("LPOS")
+	}
+	elem := args[2]
+
+	rank, count, maxLen := 1, -1, 0
+	for i := 3; i < len(args); i += 2 {
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		switch strings.ToUpper(args[i]) {
+		case "RANK":
+			if n == 0 {
+				return CommandResponse{Error: "-ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list"}
+			}
+			rank = n
+		case "COUNT":
+			if n < 0 {
+				return CommandResponse{Error: "-ERR COUNT can't be negative"}
+			}
+			count = n
+		case "MAXLEN":
+			if n < 0 {
+				return CommandResponse{Error: "-ERR MAXLEN can't be negative"}
+			}
+			maxLen = n
+		default:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	list, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var matches []int
+	if found {
+		skip := rank - 1
+		if rank < 0 {
+			skip = -rank - 1
+		}
+		scanned := 0
+		list.Each(rank < 0, func(index int, e string) bool {
+			if maxLen > 0 && scanned >= maxLen {
+				return false
+			}
+			scanned++
+			if e != elem {
+				return true
+			}
+			if skip > 0 {
+				skip--
+				return true
+			}
+			matches = append(matches, index)
+			// Without COUNT only the first match is wanted; COUNT 0 means
+			// every match.
+			return count != -1 && (count == 0 || len(matches) < count)
+		})
+	}
+
+	if count == -1 {
+		if len(matches) == 0 {
+			return CommandResponse{Response: RESP_NULL_BULK}
+		}
+		return CommandResponse{Response: toRespInt(int64(matches[0]))}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(matches)) + "\r\n")
+	for _, index := range matches {
+		b.WriteString(toRespInt(int64(index)))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+func parseListSide(arg string) (left bool, ok bool) {
+	switch strings.ToUpper(arg) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+func listSideName(left bool) string {
+	if left {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+func popCommandName(left bool) string {
+	if left {
+		return RESP_COMMAND_LPOP
+	}
+	return RESP_COMMAND_RPOP
+}
+
+// popCommand implements LPOP and RPOP. With a count argument the reply is
+// an array, even when a single element is popped.
+func (s *RedisServer) popCommand(args []string, left bool) CommandResponse {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError(popCommandName(left))
+	}
+
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return CommandResponse{Error: "-ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	_, found, wrongType := s.state.listAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if len(args) == 3 {
+			return CommandResponse{Response: RESP_NULL_ARRAY}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	popped := s.state.popList(args[1], left, count)
+	if len(popped) > 0 {
+		s.state.propagate(args)
+	}
+
+	if len(args) == 2 {
+		return CommandResponse{Response: toRespStr(popped[0])}
+	}
+	return CommandResponse{Response: toRespStrArr(popped)}
+}
+
+// moveListElement pops one element from src and pushes it onto dst, which is
+// the shared core of LMOVE, RPOPLPUSH and their blocking forms. The caller
+// must hold storageMu for writing.
+func (s *RedisServer) moveListElement(src, dst string, fromLeft, toLeft bool) CommandResponse {
+	_, found, wrongType := s.state.listAt(src)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	if _, _, wrongType := s.state.listAt(dst); wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	elem := s.state.popList(src, fromLeft, 1)[0]
+	s.state.pushList(dst, []string{elem}, toLeft)
+	s.state.propagate([]string{RESP_COMMAND_LMOVE, src, dst, listSideName(fromLeft), listSideName(toLeft)})
+
+	return CommandResponse{Response: toRespStr(elem)}
+}
+
+func (s *RedisServer) lmoveCommand(args []string) CommandResponse {
+	if len(args) != 5 {
+		return wrongArgsError("LMOVE")
+	}
+	fromLeft, ok1 := parseListSide(args[3])
+	toLeft, ok2 := parseListSide(args[4])
+	if !ok1 || !ok2 {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	return s.moveListElement(args[1], args[2], fromLeft, toLeft)
+}
+
+func (s *RedisServer) rpoplpushCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("RPOPLPUSH")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	return s.moveListElement(args[1], args[2], false, true)
+}
+
+// blockingPop implements BLPOP and BRPOP: pop from the first non-empty list
+// among the keys, or wait for one to be pushed to.
+func (s *RedisServer) blockingPop(args []string, left bool) CommandResponse {
+	cmd := "BRPOP"
+	if left {
+		cmd = "BLPOP"
+	}
+	if len(args) < 3 {
+		return wrongArgsError(cmd)
+	}
+	timeout, errResp := parseBlockTimeout(args[len(args)-1])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys := args[1 : len(args)-1]
+
+	serve := func(key string) (CommandResponse, bool) {
+		if _, found, wrongType := s.state.listAt(key); !found || wrongType {
+			return CommandResponse{}, false
+		}
+		elem := s.state.popList(key, left, 1)[0]
+		s.state.propagate([]string{popCommandName(left), key})
+		return CommandResponse{Response: toRespArr(key, elem)}, true
+	}
+
+	s.state.storageMu.Lock()
+	for _, key := range keys {
+		if _, _, wrongType := s.state.listAt(key); wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := serve(key); served {
+			s.state.storageMu.Unlock()
+			return resp
+		}
+	}
+	// Inside a transaction there is nobody to wait for: behave as if the
+	// timeout had already expired.
+	if s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, timeout, RESP_NULL_ARRAY)
+}
+
+func (s *RedisServer) blmoveCommand(args []string) CommandResponse {
+	if len(args) != 6 {
+		return wrongArgsError("BLMOVE")
+	}
+	fromLeft, ok1 := parseListSide(args[3])
+	toLeft, ok2 := parseListSide(args[4])
+	if !ok1 || !ok2 {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+	timeout, errResp := parseBlockTimeout(args[5])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	return s.blockingMove(args[1], args[2], fromLeft, toLeft, timeout)
+}
+
+func (s *RedisServer) brpoplpushCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("BRPOPLPUSH")
+	}
+	timeout, errResp := parseBlockTimeout(args[3])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	return s.blockingMove(args[1], args[2], false, true, timeout)
+}
+
+// blockingMove implements BLMOVE and BRPOPLPUSH: move an element from src to
+// dst, or wait for src to be pushed to.
+func (s *RedisServer) blockingMove(src, dst string, fromLeft, toLeft bool, timeout time.Duration) CommandResponse {
+	serve := func(key string) (CommandResponse, bool) {
+		if _, found, wrongType := s.state.listAt(src); !found || wrongType {
+			return CommandResponse{}, false
+		}
+		return s.moveListElement(src, dst, fromLeft, toLeft), true
+	}
+
+	s.state.storageMu.Lock()
+	if _, found, wrongType := s.state.listAt(src); found || wrongType {
+		resp := s.moveListElement(src, dst, fromLeft, toLeft)
+		s.state.storageMu.Unlock()
+		return resp
+	}
+	// Inside a transaction there is nobody to wait for: reply as the
+	// timeout would.
+	if s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	client := s.state.blockClient([]string{src}, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, timeout, RESP_NULL_ARRAY)
+}
+
+// parseMPopArgs parses the "numkeys key [key ...] LEFT|RIGHT [COUNT count]"
+// tail shared by LMPOP and BLMPOP.
+func parseMPopArgs(args []string) (keys []string, left bool, count int, errResp string) {
+	if len(args) < 3 {
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, "-ERR numkeys should be greater than 0"
+	}
+	if numKeys > len(args)-2 {
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+	keys = args[1 : 1+numKeys]
+
+	left, ok := parseListSide(args[1+numKeys])
+	if !ok {
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+
+	count = 1
+	if rest := args[2+numKeys:]; len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0]) != "COUNT" {
+			return nil, false, 0, RESP_ERR_SYNTAX
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil || n <= 0 {
+			return nil, false, 0, "-ERR count should be greater than 0"
+		}
+		count = n
+	}
+	return keys, left, count, ""
+}
+
+// mpopFrom pops up to count elements from key when it holds a non-empty list,
+// replying in the "key, elements" shape LMPOP and BLMPOP share. The caller
+// must hold storageMu for writing.
+func (s *RedisServer) mpopFrom(key string, left bool, count int) (CommandResponse, bool) {
+	if _, found, wrongType := s.state.listAt(key); !found || wrongType {
+		return CommandResponse{}, false
+	}
+	popped := s.state.popList(key, left, count)
+	s.state.propagate([]string{popCommandName(left), key, strconv.Itoa(len(popped))})
+	return CommandResponse{Response: "*2\r\n" + toRespStr(key) + toRespStrArr(popped)}, true
+}
+
+func (s *RedisServer) lmpopCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("LMPOP")
+	}
+	keys, left, count, errResp := parseMPopArgs(args[1:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	for _, key := range keys {
+		if _, _, wrongType := s.state.listAt(key); wrongType {
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := s.mpopFrom(key, left, count); served {
+			return resp
+		}
+	}
+	return CommandResponse{Response: RESP_NULL_ARRAY}
+}
+
+func (s *RedisServer) blmpopCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("BLMPOP")
+	}
+	timeout, errResp := parseBlockTimeout(args[1])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys, left, count, errResp := parseMPopArgs(args[2:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	serve := func(key string) (CommandResponse, bool) {
+		return s.mpopFrom(key, left, count)
+	}
+
+	s.state.storageMu.Lock()
+	for _, key := range keys {
+		if _, _, wrongType := s.state.listAt(key); wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := serve(key); served {
+			s.state.storageMu.Unlock()
+			return resp
+		}
+	}
+	if s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, timeout, RESP_NULL_ARRAY)
+}
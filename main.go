@@ -15,9 +15,29 @@ func main() {
 	dbfilename := flag.String("dbfilename", "", "Database file name")
 	port_arg := flag.String("port", "", "Database file name")
 	replicaOf := flag.String("replicaof", "", "The host and port of master server")
+	outputLimit := flag.String("client-output-buffer-limit", "", "Output buffer limit of pubsub clients, e.g. 'pubsub 32mb 8mb 60'")
+	notifyEvents := flag.String("notify-keyspace-events", "", "Keyspace event classes to publish, e.g. 'KEA'")
+	requirePass := flag.String("requirepass", "", "Password clients must AUTH with")
+	masterAuth := flag.String("masterauth", "", "Password to AUTH with to the master")
+	masterUser := flag.String("masteruser", "", "ACL user to AUTH as to the master")
+	aclFile := flag.String("aclfile", "", "File the ACL users are loaded from and saved to")
 
 	flag.Parse()
 
+	pubsubOutputLimit := defaultPubsubOutputLimit
+	if *outputLimit != "" {
+		limit, err := parseOutputBufferLimit(*outputLimit)
+		if err != nil {
+			log.Fatalf("wrong client-output-buffer-limit argument: %v\n", err)
+		}
+		pubsubOutputLimit = limit
+	}
+
+	notifyFlags, ok := parseKeyspaceEvents(*notifyEvents)
+	if !ok {
+		log.Fatalf("wrong notify-keyspace-events argument: %q\n", *notifyEvents)
+	}
+
 	var port string
 
 	if *port_arg == "" {
@@ -26,18 +46,30 @@ func main() {
 		port = *port_arg
 	}
 
-	sharedState := &RedisState{
-		storage: make(map[string]storageVal),
-		config: Config{
-			Directory:  *dir,
-			dbFileName: *dbfilename,
-		},
-		replicaConns: []net.Conn{},
-		channels:     make(map[string]Channel),
+	sharedState := newRedisState()
+	sharedState.config.Directory = *dir
+	sharedState.config.dbFileName = *dbfilename
+	sharedState.config.pubsubOutputLimit = pubsubOutputLimit
+	sharedState.config.aclFile = *aclFile
+	sharedState.config.notifyKeyspaceEvents.Store(int32(notifyFlags))
+	sharedState.config.requirepass.Store(*requirePass)
+	sharedState.config.masterauth.Store(*masterAuth)
+	sharedState.config.masteruser.Store(*masterUser)
+	sharedState.setDefaultUserPassword(*requirePass)
+
+	if *aclFile != "" {
+		if err := sharedState.loadACLFile(*aclFile); err != nil {
+			log.Fatalf("failed to load ACL file: %v\n", err)
+		}
+	}
+
+	if err := sharedState.loadRDBFile(sharedState.config.rdbPath()); err != nil {
+		log.Fatalf("failed to load RDB file: %v\n", err)
 	}
 
 	if *replicaOf == "" {
 		sharedState.serverIsMaster = true
+		go sharedState.activeExpireLoop()
 	} else {
 		sharedState.serverIsMaster = false
 		masterHost, masterPort, err := extractReplicaInfo(replicaOf)
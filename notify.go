@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+)
+
+// Keyspace notification classes, selected with notify-keyspace-events. K and
+// E choose the channels events go to; the other flags select which events are
+// published.
+const (
+	notifyKeyspace = 1 << iota // K: __keyspace@<db>__:<key> receives the event
+	notifyKeyevent             // E: __keyevent@<db>__:<event> receives the key
+	notifyGeneric              // g: type independent commands, such as del
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x: a key was removed because its TTL elapsed
+	notifyEvicted              // e: never raised, as nothing is evicted
+	notifyStream               // t
+	notifyKeyMiss              // m: a read command found no key
+
+	// notifyAll is what the A alias stands for; key misses are left out.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// notifyClassChars maps every flag character but A to its class, in the order
+// keyspaceEventsString renders them.
+var notifyClassChars = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'t', notifyStream},
+	{'m', notifyKeyMiss},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+}
+
+// parseKeyspaceEvents turns a notify-keyspace-events value into its flags.
+func parseKeyspaceEvents(value string) (int, bool) {
+	flags := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		found := false
+		for _, c := range notifyClassChars {
+			if c.char == value[i] {
+				flags |= c.class
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, false
+		}
+	}
+	return flags, true
+}
+
+// keyspaceEventsString renders flags the way CONFIG GET reports them, using A
+// when every class it covers is set.
+func keyspaceEventsString(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	}
+	for _, c := range notifyClassChars {
+		if flags&notifyAll == notifyAll && c.class&notifyAll != 0 {
+			continue
+		}
+		if flags&c.class != 0 {
+			b.WriteByte(c.char)
+		}
+	}
+	return b.String()
+}
+
+// notifyKeyspaceEvent publishes event on key to the keyspace and keyevent
+// channels, if class is enabled. Writers call it with storageMu held, right
+// after the change, so subscribers see events in the order writes happened.
+func (st *RedisState) notifyKeyspaceEvent(class int, event, key string) {
+	flags := int(st.config.notifyKeyspaceEvents.Load())
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		st.publish("__keyspace@0__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		st.publish("__keyevent@0__:"+event, key)
+	}
+}
+
+// deleteKey removes key, raising a del event if it existed. It is how
+// commands drop a key explicitly or once they have emptied it. The caller
+// must hold storageMu for writing.
+func (st *RedisState) deleteKey(key string) bool {
+	if _, ok := st.storage[key]; !ok {
+		return false
+	}
+	delete(st.storage, key)
+	st.notifyKeyspaceEvent(notifyGeneric, "del", key)
+	return true
+}
+
+// readCommandKeys returns the keys a read-only command looks up, for the
+// keymiss events raised by notifyKeyMisses. Commands missing here raise none.
+func readCommandKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	switch strings.ToUpper(args[0]) {
+	case RESP_COMMAND_MGET, RESP_COMMAND_PFCOUNT, RESP_COMMAND_SINTER, RESP_COMMAND_SUNION, RESP_COMMAND_SDIFF:
+		return args[1:]
+	case RESP_COMMAND_LCS:
+		if len(args) < 3 {
+			return nil
+		}
+		return args[1:3]
+	case RESP_COMMAND_GET, RESP_COMMAND_GETRANGE, RESP_COMMAND_STRLEN,
+		RESP_COMMAND_GETBIT, RESP_COMMAND_BITCOUNT, RESP_COMMAND_BITPOS, RESP_COMMAND_BITFIELD_RO,
+		RESP_COMMAND_LRANGE, RESP_COMMAND_LLEN, RESP_COMMAND_LINDEX, RESP_COMMAND_LPOS,
+		RESP_COMMAND_SMEMBERS, RESP_COMMAND_SISMEMBER, RESP_COMMAND_SMISMEMBER, RESP_COMMAND_SCARD, RESP_COMMAND_SRANDMEMBER,
+		RESP_COMMAND_HGET, RESP_COMMAND_HMGET, RESP_COMMAND_HGETALL, RESP_COMMAND_HEXISTS, RESP_COMMAND_HLEN,
+		RESP_COMMAND_HKEYS, RESP_COMMAND_HVALS, RESP_COMMAND_HSTRLEN, RESP_COMMAND_HRANDFIELD, RESP_COMMAND_HSCAN,
+		RESP_COMMAND_ZRANGE, RESP_COMMAND_ZREVRANGE, RESP_COMMAND_ZRANGEBYSCORE, RESP_COMMAND_ZREVRANGEBYSCORE,
+		RESP_COMMAND_ZRANGEBYLEX, RESP_COMMAND_ZREVRANGEBYLEX, RESP_COMMAND_ZSCORE, RESP_COMMAND_ZMSCORE,
+		RESP_COMMAND_ZCARD, RESP_COMMAND_ZCOUNT, RESP_COMMAND_ZRANK, RESP_COMMAND_ZREVRANK, RESP_COMMAND_ZRANDMEMBER,
+		RESP_COMMAND_XRANGE, RESP_COMMAND_XREVRANGE, RESP_COMMAND_XLEN,
+		RESP_COMMAND_GEOPOS, RESP_COMMAND_GEODIST, RESP_COMMAND_GEOHASH, RESP_COMMAND_GEOSEARCH:
+		return args[1:2]
+	}
+	return nil
+}
+
+// notifyKeyMisses raises keymiss for every key a read-only command found
+// missing. It runs once the command has finished and looks the keys up
+// again, which is skipped entirely unless the m class is enabled.
+func (st *RedisState) notifyKeyMisses(args []string) {
+	if st.config.notifyKeyspaceEvents.Load()&notifyKeyMiss == 0 {
+		return
+	}
+	keys := readCommandKeys(args)
+	if len(keys) == 0 {
+		return
+	}
+
+	st.storageMu.Lock()
+	defer st.storageMu.Unlock()
+	for _, key := range keys {
+		if _, ok := st.readKey(key); !ok {
+			st.notifyKeyspaceEvent(notifyKeyMiss, "keymiss", key)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outputBufferLimit is a client-output-buffer-limit class: a client is
+// disconnected once its pending output reaches hard bytes, or stays at or
+// above soft bytes for longer than softSeconds. Zero disables a limit.
+type outputBufferLimit struct {
+	hard, soft  int
+	softSeconds time.Duration
+}
+
+// defaultPubsubOutputLimit mirrors Redis' "client-output-buffer-limit pubsub
+// 32mb 8mb 60".
+var defaultPubsubOutputLimit = outputBufferLimit{hard: 32 << 20, soft: 8 << 20, softSeconds: 60 * time.Second}
+
+// parseOutputBufferLimit parses a limit in redis.conf form, such as
+// "pubsub 32mb 8mb 60". Only the pubsub class applies here.
+func parseOutputBufferLimit(arg string) (outputBufferLimit, error) {
+	fields := strings.Fields(arg)
+	if len(fields) != 4 || strings.ToLower(fields[0]) != "pubsub" {
+		return outputBufferLimit{}, fmt.Errorf("expected 'pubsub <hard> <soft> <soft seconds>'")
+	}
+	hard, err1 := parseMemorySize(fields[1])
+	soft, err2 := parseMemorySize(fields[2])
+	secs, err3 := strconv.Atoi(fields[3])
+	if err1 != nil || err2 != nil || err3 != nil || secs < 0 {
+		return outputBufferLimit{}, fmt.Errorf("invalid limit %q", arg)
+	}
+	return outputBufferLimit{hard: hard, soft: soft, softSeconds: time.Duration(secs) * time.Second}, nil
+}
+
+// exceeded reports whether pending bytes break the limit, tracking in
+// softSince when the soft limit was first reached.
+func (l outputBufferLimit) exceeded(pending int, softSince *time.Time, now time.Time) bool {
+	if l.hard > 0 && pending >= l.hard {
+		return true
+	}
+	if l.soft == 0 || pending < l.soft {
+		*softSince = time.Time{}
+		return false
+	}
+	if softSince.IsZero() {
+		*softSince = now
+		return false
+	}
+	return now.Sub(*softSince) > l.softSeconds
+}
+
+// clientOutput queues the replies and messages bound for one client and
+// writes them to its connection from a goroutine of its own, so publishers
+// never wait on a slow subscriber. A client whose queue outgrows its limit
+// is disconnected.
+type clientOutput struct {
+	conn  net.Conn
+	limit outputBufferLimit
+	wake  chan struct{}
+
+	mu  sync.Mutex
+	buf []byte
+	// pending counts the bytes queued or being written.
+	pending   int
+	softSince time.Time
+	closed    bool
+	// drained is signalled whenever pending drops or the output closes.
+	drained *sync.Cond
+}
+
+func newClientOutput(conn net.Conn, limit outputBufferLimit) *clientOutput {
+	out := &clientOutput{conn: conn, limit: limit, wake: make(chan struct{}, 1)}
+	out.drained = sync.NewCond(&out.mu)
+	go out.writeLoop()
+	return out
+}
+
+// enqueue appends data to the queue, closing the client if that breaks its
+// output buffer limit.
+func (o *clientOutput) enqueue(data string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return
+	}
+	o.buf = append(o.buf, data...)
+	o.pending += len(data)
+	if o.limit.exceeded(o.pending, &o.softSince, time.Now()) {
+		fmt.Printf("Client %s closed for overcoming of output buffer limits.\n", o.conn.RemoteAddr())
+		o.closeLocked()
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *clientOutput) writeLoop() {
+	for range o.wake {
+		o.mu.Lock()
+		data := o.buf
+		o.buf = nil
+		o.mu.Unlock()
+		if len(data) == 0 {
+			continue
+		}
+
+		_, err := o.conn.Write(data)
+
+		o.mu.Lock()
+		o.pending -= len(data)
+		if err != nil {
+			o.closeLocked()
+		}
+		o.drained.Broadcast()
+		o.mu.Unlock()
+	}
+}
+
+// flush waits until everything queued so far has been written, or the
+// output has been closed.
+func (o *clientOutput) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for o.pending > 0 && !o.closed {
+		o.drained.Wait()
+	}
+}
+
+// close stops the writer and closes the connection, which also ends the
+// client's read loop.
+func (o *clientOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closeLocked()
+}
+
+func (o *clientOutput) closeLocked() {
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.buf = nil
+	close(o.wake)
+	o.conn.Close()
+	o.drained.Broadcast()
+}
+
+// pubsubKind selects one of the subscription namespaces: plain channels,
+// glob patterns, and shard channels, which in a single node only differ from
+// plain channels in being published to with SPUBLISH.
+type pubsubKind int
+
+const (
+	pubsubChannel pubsubKind = iota
+	pubsubPattern
+	pubsubShard
+)
+
+var (
+	pubsubSubscribeVerbs   = [...]string{"subscribe", "psubscribe", "ssubscribe"}
+	pubsubUnsubscribeVerbs = [...]string{"unsubscribe", "punsubscribe", "sunsubscribe"}
+)
+
+// verb returns the command name, in lower case as replies carry it.
+func (k pubsubKind) verb(subscribe bool) string {
+	if subscribe {
+		return pubsubSubscribeVerbs[k]
+	}
+	return pubsubUnsubscribeVerbs[k]
+}
+
+// pubsubClient is the registry entry of a connection that subscribed to
+// channels, patterns or shard channels. Its sets are guarded by
+// RedisState.channelsMu.
+type pubsubClient struct {
+	out  *clientOutput
+	subs [3]map[string]struct{}
+}
+
+// count returns the subscription count reported in (un)subscribe replies of
+// the given kind: shard channels are counted apart from the others.
+func (c *pubsubClient) count(kind pubsubKind) int {
+	if kind == pubsubShard {
+		return len(c.subs[pubsubShard])
+	}
+	return len(c.subs[pubsubChannel]) + len(c.subs[pubsubPattern])
+}
+
+// total returns the number of subscriptions of every kind; the connection
+// stays in subscribed mode while it is positive.
+func (c *pubsubClient) total() int {
+	return len(c.subs[pubsubChannel]) + len(c.subs[pubsubPattern]) + len(c.subs[pubsubShard])
+}
+
+// registry returns the subscribers of every name of a kind. The caller must
+// hold channelsMu.
+func (st *RedisState) registry(kind pubsubKind) map[string]map[*pubsubClient]struct{} {
+	switch kind {
+	case pubsubPattern:
+		return st.patterns
+	case pubsubShard:
+		return st.shardChannels
+	}
+	return st.channels
+}
+
+// pubsubClient returns the registry entry of the connection, creating it and
+// routing the connection's output through a queue on its first subscription.
+func (s *RedisServer) pubsubClient() *pubsubClient {
+	if s.pubsub == nil {
+		client := &pubsubClient{out: newClientOutput(s.conn, s.state.config.pubsubOutputLimit)}
+		for i := range client.subs {
+			client.subs[i] = make(map[string]struct{})
+		}
+		s.pubsub = client
+	}
+	return s.pubsub
+}
+
+func pubsubReply(verb, name string, count int) string {
+	return "*3\r\n" + toRespStr(verb) + toRespStr(name) + ":" + strconv.Itoa(count) + "\r\n"
+}
+
+// subscriptionReply hands the (un)subscribe confirmations to the client.
+// They are queued while channelsMu is still held, so no message published
+// after the subscription can overtake them. Inside EXEC, or for a client
+// that never subscribed and so has no queue, they are returned as the
+// command's reply instead.
+func (s *RedisServer) subscriptionReply(resp string) CommandResponse {
+	if s.inExec || s.pubsub == nil {
+		return CommandResponse{Response: resp}
+	}
+	s.pubsub.out.enqueue(resp)
+	return CommandResponse{}
+}
+
+// subscribeCommand backs SUBSCRIBE, PSUBSCRIBE and SSUBSCRIBE.
+func (s *RedisServer) subscribeCommand(args []string, kind pubsubKind) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError(strings.ToUpper(kind.verb(true)))
+	}
+
+	s.state.channelsMu.Lock()
+	defer s.state.channelsMu.Unlock()
+
+	client := s.pubsubClient()
+	registry := s.state.registry(kind)
+
+	var b strings.Builder
+	for _, name := range args[1:] {
+		if _, ok := client.subs[kind][name]; !ok {
+			client.subs[kind][name] = struct{}{}
+			if registry[name] == nil {
+				registry[name] = make(map[*pubsubClient]struct{})
+			}
+			registry[name][client] = struct{}{}
+		}
+		b.WriteString(pubsubReply(kind.verb(true), name, client.count(kind)))
+	}
+	s.SubscribedMode = true
+	return s.subscriptionReply(b.String())
+}
+
+// unsubscribeCommand backs UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE.
+// Without arguments the client leaves every name of that kind it is
+// subscribed to.
+func (s *RedisServer) unsubscribeCommand(args []string, kind pubsubKind) CommandResponse {
+	s.state.channelsMu.Lock()
+	defer s.state.channelsMu.Unlock()
+
+	// A client that never subscribed has nothing to leave, and no reason to
+	// get an output queue and its writer.
+	client := s.pubsub
+	if client == nil {
+		client = &pubsubClient{}
+	}
+	verb := kind.verb(false)
+
+	names := args[1:]
+	if len(names) == 0 {
+		for name := range client.subs[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			resp := "*3\r\n" + toRespStr(verb) + RESP_NULL_BULK + ":" + strconv.Itoa(client.count(kind)) + "\r\n"
+			s.SubscribedMode = client.total() > 0
+			return s.subscriptionReply(resp)
+		}
+	}
+
+	var b strings.Builder
+	for _, name := range names {
+		s.state.unsubscribe(client, name, kind)
+		b.WriteString(pubsubReply(verb, name, client.count(kind)))
+	}
+	s.SubscribedMode = client.total() > 0
+	return s.subscriptionReply(b.String())
+}
+
+// unsubscribe removes client from one name of a kind. The caller must hold
+// channelsMu.
+func (st *RedisState) unsubscribe(client *pubsubClient, name string, kind pubsubKind) {
+	if _, ok := client.subs[kind][name]; !ok {
+		return
+	}
+	delete(client.subs[kind], name)
+	registry := st.registry(kind)
+	delete(registry[name], client)
+	if len(registry[name]) == 0 {
+		delete(registry, name)
+	}
+}
+
+// removePubsubClient drops every subscription of a disconnecting client and
+// stops its writer.
+func (st *RedisState) removePubsubClient(client *pubsubClient) {
+	if client == nil {
+		return
+	}
+	st.unsubscribeAll(client)
+	client.out.close()
+}
+
+// unsubscribeAll drops every subscription of client, keeping its output
+// queue so the connection can go on using it.
+func (st *RedisState) unsubscribeAll(client *pubsubClient) {
+	st.channelsMu.Lock()
+	defer st.channelsMu.Unlock()
+	for kind := range client.subs {
+		for name := range client.subs[kind] {
+			st.unsubscribe(client, name, pubsubKind(kind))
+		}
+	}
+}
+
+// publishCommand backs PUBLISH and, with shard set, SPUBLISH.
+func (s *RedisServer) publishCommand(args []string, shard bool) CommandResponse {
+	if len(args) != 3 {
+		if shard {
+			return wrongArgsError("SPUBLISH")
+		}
+		return wrongArgsError("PUBLISH")
+	}
+	if shard {
+		return CommandResponse{Response: toRespInt(int64(s.state.spublish(args[1], args[2])))}
+	}
+	return CommandResponse{Response: toRespInt(int64(s.state.publish(args[1], args[2])))}
+}
+
+// publish queues message for every subscriber of channel and every client
+// with a matching pattern, returning how many deliveries were made.
+func (st *RedisState) publish(channel, message string) int {
+	st.channelsMu.RLock()
+	defer st.channelsMu.RUnlock()
+
+	count := 0
+	if subscribers := st.channels[channel]; len(subscribers) > 0 {
+		deliver := "*3\r\n" + toRespStr("message") + toRespStr(channel) + toRespStr(message)
+		for client := range subscribers {
+			client.out.enqueue(deliver)
+			count++
+		}
+	}
+	for pattern, subscribers := range st.patterns {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		deliver := "*4\r\n" + toRespStr("pmessage") + toRespStr(pattern) + toRespStr(channel) + toRespStr(message)
+		for client := range subscribers {
+			client.out.enqueue(deliver)
+			count++
+		}
+	}
+	return count
+}
+
+// spublish queues message for the subscribers of a shard channel.
+func (st *RedisState) spublish(channel, message string) int {
+	st.channelsMu.RLock()
+	defer st.channelsMu.RUnlock()
+
+	subscribers := st.shardChannels[channel]
+	deliver := "*3\r\n" + toRespStr("smessage") + toRespStr(channel) + toRespStr(message)
+	for client := range subscribers {
+		client.out.enqueue(deliver)
+	}
+	return len(subscribers)
+}
+
+func (s *RedisServer) pubsubCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("PUBSUB")
+	}
+
+	s.state.channelsMu.RLock()
+	defer s.state.channelsMu.RUnlock()
+
+	sub := strings.ToUpper(args[1])
+	switch {
+	case (sub == "CHANNELS" || sub == "SHARDCHANNELS") && len(args) <= 3:
+		registry := s.state.channels
+		if sub == "SHARDCHANNELS" {
+			registry = s.state.shardChannels
+		}
+		names := []string{}
+		for name := range registry {
+			if len(args) == 2 || globMatch(args[2], name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return CommandResponse{Response: toRespStrArr(names)}
+
+	case sub == "NUMSUB" || sub == "SHARDNUMSUB":
+		registry := s.state.channels
+		if sub == "SHARDNUMSUB" {
+			registry = s.state.shardChannels
+		}
+		var b strings.Builder
+		b.WriteString("*" + strconv.Itoa(2*(len(args)-2)) + "\r\n")
+		for _, name := range args[2:] {
+			b.WriteString(toRespStr(name) + toRespInt(int64(len(registry[name]))))
+		}
+		return CommandResponse{Response: b.String()}
+
+	case sub == "NUMPAT" && len(args) == 2:
+		return CommandResponse{Response: toRespInt(int64(len(s.state.patterns)))}
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try PUBSUB HELP."}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func pubsubMessage(channel, message string) string {
+	return bulks("message", channel, message)
+}
+
+func pubsubPmessage(pattern, channel, message string) string {
+	return bulks("pmessage", pattern, channel, message)
+}
+
+func TestPatternSubscriptions(t *testing.T) {
+	ts := startTestServer(t, nil)
+	sub, c := ts.client(t), ts.client(t)
+	sub.send("PSUBSCRIBE", "news.*", "h?llo")
+	for i, pattern := range []string{"news.*", "h?llo"} {
+		if got, want := sub.read(), array(bulk("psubscribe"), bulk(pattern), integer(int64(i+1))); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+	c.expect(integer(2), "PUBSUB", "NUMPAT")
+
+	c.expect(integer(1), "PUBLISH", "news.tech", "hi")
+	if got, want := sub.read(), pubsubPmessage("news.*", "news.tech", "hi"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c.expect(integer(0), "PUBLISH", "sports", "hi")
+
+	// A client matching a channel both ways gets the message twice.
+	sub.expect(array(bulk("subscribe"), bulk("news.tech"), integer(3)), "SUBSCRIBE", "news.tech")
+	c.expect(integer(2), "PUBLISH", "news.tech", "again")
+	if got, want := sub.read(), pubsubMessage("news.tech", "again"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := sub.read(), pubsubPmessage("news.*", "news.tech", "again"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	sub.expect(array(bulk("punsubscribe"), bulk("news.*"), integer(2)), "PUNSUBSCRIBE", "news.*")
+	c.expect(integer(1), "PUBLISH", "news.tech", "once")
+	if got, want := sub.read(), pubsubMessage("news.tech", "once"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	c.expect(integer(1), "PUBLISH", "hallo", "x")
+	if got, want := sub.read(), pubsubPmessage("h?llo", "hallo", "x"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Without arguments PUNSUBSCRIBE leaves every pattern, but not the
+	// channels.
+	sub.expect(array(bulk("punsubscribe"), bulk("h?llo"), integer(1)), "PUNSUBSCRIBE")
+	c.expect(integer(0), "PUBSUB", "NUMPAT")
+	c.expect(integer(0), "PUBLISH", "hallo", "x")
+	c.expect(array(bulk("news.tech"), integer(1)), "PUBSUB", "NUMSUB", "news.tech")
+}
+
+func TestParseOutputBufferLimit(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want outputBufferLimit
+		ok   bool
+	}{
+		{"pubsub 32mb 8mb 60", defaultPubsubOutputLimit, true},
+		{"PUBSUB 1000 1k 0", outputBufferLimit{hard: 1000, soft: 1000}, true},
+		{"pubsub 0 0 0", outputBufferLimit{}, true},
+		{"normal 0 0 0", outputBufferLimit{}, false},
+		{"pubsub 32mb 8mb", outputBufferLimit{}, false},
+		{"pubsub 32xb 8mb 60", outputBufferLimit{}, false},
+		{"pubsub 32mb 8mb -1", outputBufferLimit{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseOutputBufferLimit(tt.arg)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseOutputBufferLimit(%q) = %+v, %v", tt.arg, got, err)
+		}
+	}
+}
+
+func TestOutputBufferLimitExceeded(t *testing.T) {
+	limit := outputBufferLimit{hard: 100, soft: 50, softSeconds: 10 * time.Second}
+	start := time.Now()
+	var softSince time.Time
+
+	if limit.exceeded(49, &softSince, start) || !softSince.IsZero() {
+		t.Fatalf("49 bytes broke the limit or started the soft timer")
+	}
+	if !limit.exceeded(100, &softSince, start) {
+		t.Errorf("the hard limit was not enforced")
+	}
+	softSince = time.Time{}
+
+	// Over the soft limit, a client has softSeconds to catch up.
+	steps := []struct {
+		pending  int
+		after    time.Duration
+		exceeded bool
+	}{
+		{60, 0, false},
+		{60, 10 * time.Second, false},
+		{40, 11 * time.Second, false}, // dropping under resets the timer
+		{60, 12 * time.Second, false},
+		{60, 22 * time.Second, false},
+		{60, 23 * time.Second, true},
+	}
+	for _, step := range steps {
+		if got := limit.exceeded(step.pending, &softSince, start.Add(step.after)); got != step.exceeded {
+			t.Errorf("%d bytes after %v: exceeded = %v", step.pending, step.after, got)
+		}
+	}
+
+	if (outputBufferLimit{}).exceeded(1<<30, &softSince, start) {
+		t.Errorf("a zero limit was enforced")
+	}
+}
+
+func TestSlowSubscriberIsDisconnected(t *testing.T) {
+	ts := startTestServer(t, func(st *RedisState) {
+		st.config.pubsubOutputLimit = outputBufferLimit{hard: 1 << 20}
+	})
+	slow, fast, c := ts.client(t), ts.client(t), ts.client(t)
+	slow.expect(array(bulk("subscribe"), bulk("ch"), integer(1)), "SUBSCRIBE", "ch")
+	fast.expect(array(bulk("psubscribe"), bulk("c*"), integer(1)), "PSUBSCRIBE", "c*")
+
+	// slow never reads, so once the socket buffers fill its queue grows
+	// until it reaches the hard limit. fast keeps up and stays.
+	message := strings.Repeat("x", 256<<10)
+	for i := 0; ; i++ {
+		if i == 400 {
+			t.Fatalf("the slow subscriber was never disconnected")
+		}
+		if c.do("PUBLISH", "ch", message) == integer(1) {
+			break
+		}
+		if got, want := fast.read(), pubsubPmessage("c*", "ch", message); got != want {
+			t.Fatalf("fast subscriber got %d bytes, want %d", len(got), len(want))
+		}
+	}
+	if got, want := fast.read(), pubsubPmessage("c*", "ch", message); got != want {
+		t.Fatalf("fast subscriber got %d bytes, want %d", len(got), len(want))
+	}
+
+	ok := eventually(t, 5*time.Second, func() bool {
+		return c.do("PUBSUB", "NUMSUB", "ch") == array(bulk("ch"), integer(0))
+	})
+	if !ok {
+		t.Errorf("the disconnected subscriber kept its subscription")
+	}
+	c.expect(integer(1), "PUBLISH", "ch", "small")
+	if got, want := fast.read(), pubsubPmessage("c*", "ch", "small"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// An unsubscribe from a connection that never subscribed is answered
+// directly, without setting up the output queue subscribers get.
+func TestUnsubscribeWithoutSubscriptions(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("UNSUBSCRIBE"), array(bulk("unsubscribe"), nilBulkReply, integer(0))},
+		{cmd("PUNSUBSCRIBE"), array(bulk("punsubscribe"), nilBulkReply, integer(0))},
+		{cmd("SUNSUBSCRIBE", "s"), array(bulk("sunsubscribe"), bulk("s"), integer(0))},
+	})
+	c.send("UNSUBSCRIBE", "a", "b")
+	for _, name := range []string{"a", "b"} {
+		if got, want := c.read(), array(bulk("unsubscribe"), bulk(name), integer(0)); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	// The connection did not enter subscribed mode.
+	c.expect(okReply, "SET", "k", "v")
+
+	hasQueue := func() bool {
+		ts.state.clientsMu.Lock()
+		defer ts.state.clientsMu.Unlock()
+		for s := range ts.state.clients {
+			if s.pubsub != nil {
+				return true
+			}
+		}
+		return false
+	}
+	if hasQueue() {
+		t.Fatalf("unsubscribing set up an output queue")
+	}
+	c.expect(array(bulk("subscribe"), bulk("ch"), integer(1)), "SUBSCRIBE", "ch")
+	if !hasQueue() {
+		t.Errorf("subscribing set up no output queue")
+	}
+}
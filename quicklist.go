@@ -0,0 +1,341 @@
+package main
+
+// quicklistNodeSize caps the number of elements per node. Small enough that
+// shifting inside a node stays cheap, large enough to keep per-node overhead
+// low for lists with millions of elements.
+const quicklistNodeSize = 128
+
+// quicklist is the list representation: a doubly linked list of small
+// element chunks, like Redis' quicklist. Pushes and pops at either end are
+// O(1); positional access walks nodes from the nearer end.
+type quicklist struct {
+	head   *quicklistNode
+	tail   *quicklistNode
+	length int
+}
+
+type quicklistNode struct {
+	prev  *quicklistNode
+	next  *quicklistNode
+	elems []string
+}
+
+func newQuicklist() *quicklist {
+	return &quicklist{}
+}
+
+func (ql *quicklist) Len() int {
+	return ql.length
+}
+
+func (ql *quicklist) PushFront(elem string) {
+	if ql.head == nil || len(ql.head.elems) >= quicklistNodeSize {
+		ql.insertNodeBefore(ql.head, &quicklistNode{elems: make([]string, 0, 8)})
+	}
+	node := ql.head
+	node.elems = append(node.elems, "")
+	copy(node.elems[1:], node.elems)
+	node.elems[0] = elem
+	ql.length++
+}
+
+func (ql *quicklist) PushBack(elem string) {
+	if ql.tail == nil || len(ql.tail.elems) >= quicklistNodeSize {
+		ql.insertNodeAfter(ql.tail, &quicklistNode{elems: make([]string, 0, 8)})
+	}
+	ql.tail.elems = append(ql.tail.elems, elem)
+	ql.length++
+}
+
+func (ql *quicklist) PopFront() (string, bool) {
+	if ql.length == 0 {
+		return "", false
+	}
+	node := ql.head
+	elem := node.elems[0]
+	node.elems[0] = ""
+	node.elems = node.elems[1:]
+	ql.length--
+	if len(node.elems) == 0 {
+		ql.unlinkNode(node)
+	}
+	return elem, true
+}
+
+func (ql *quicklist) PopBack() (string, bool) {
+	if ql.length == 0 {
+		return "", false
+	}
+	node := ql.tail
+	last := len(node.elems) - 1
+	elem := node.elems[last]
+	node.elems[last] = ""
+	node.elems = node.elems[:last]
+	ql.length--
+	if len(node.elems) == 0 {
+		ql.unlinkNode(node)
+	}
+	return elem, true
+}
+
+// locate returns the node holding the element at index (0-based, already
+// normalised) and the element's offset inside that node.
+func (ql *quicklist) locate(index int) (*quicklistNode, int) {
+	if index < ql.length/2 {
+		for node := ql.head; node != nil; node = node.next {
+			if index < len(node.elems) {
+				return node, index
+			}
+			index -= len(node.elems)
+		}
+		return nil, 0
+	}
+	index = ql.length - 1 - index
+	for node := ql.tail; node != nil; node = node.prev {
+		if index < len(node.elems) {
+			return node, len(node.elems) - 1 - index
+		}
+		index -= len(node.elems)
+	}
+	return nil, 0
+}
+
+// normaliseIndex turns a Redis-style index, where negative values count from
+// the tail, into a 0-based one. ok is false when it falls outside the list.
+func (ql *quicklist) normaliseIndex(index int) (int, bool) {
+	if index < 0 {
+		index += ql.length
+	}
+	return index, index >= 0 && index < ql.length
+}
+
+func (ql *quicklist) Index(index int) (string, bool) {
+	index, ok := ql.normaliseIndex(index)
+	if !ok {
+		return "", false
+	}
+	node, offset := ql.locate(index)
+	return node.elems[offset], true
+}
+
+func (ql *quicklist) Set(index int, elem string) bool {
+	index, ok := ql.normaliseIndex(index)
+	if !ok {
+		return false
+	}
+	node, offset := ql.locate(index)
+	node.elems[offset] = elem
+	return true
+}
+
+// InsertAt inserts elem so that it ends up at position index, shifting the
+// element currently there (if any) towards the tail.
+func (ql *quicklist) InsertAt(index int, elem string) {
+	if index <= 0 {
+		ql.PushFront(elem)
+		return
+	}
+	if index >= ql.length {
+		ql.PushBack(elem)
+		return
+	}
+
+	node, offset := ql.locate(index)
+	if len(node.elems) >= quicklistNodeSize {
+		// Split the full node in half and insert into whichever half now
+		// holds the position.
+		half := len(node.elems) / 2
+		right := &quicklistNode{elems: append(make([]string, 0, quicklistNodeSize), node.elems[half:]...)}
+		for i := half; i < len(node.elems); i++ {
+			node.elems[i] = ""
+		}
+		node.elems = node.elems[:half]
+		ql.insertNodeAfter(node, right)
+		if offset >= half {
+			node, offset = right, offset-half
+		}
+	}
+
+	node.elems = append(node.elems, "")
+	copy(node.elems[offset+1:], node.elems[offset:])
+	node.elems[offset] = elem
+	ql.length++
+}
+
+// Range returns the elements between the normalised, in-bounds positions
+// start and stop inclusive.
+func (ql *quicklist) Range(start, stop int) []string {
+	if start > stop {
+		return []string{}
+	}
+	result := make([]string, 0, stop-start+1)
+	node, offset := ql.locate(start)
+	for ; node != nil && len(result) < cap(result); node = node.next {
+		for ; offset < len(node.elems) && len(result) < cap(result); offset++ {
+			result = append(result, node.elems[offset])
+		}
+		offset = 0
+	}
+	return result
+}
+
+// Each calls fn for every element from head to tail (or tail to head when
+// reverse is set) with its 0-based position, stopping early if fn returns
+// false.
+func (ql *quicklist) Each(reverse bool, fn func(index int, elem string) bool) {
+	if !reverse {
+		index := 0
+		for node := ql.head; node != nil; node = node.next {
+			for _, elem := range node.elems {
+				if !fn(index, elem) {
+					return
+				}
+				index++
+			}
+		}
+		return
+	}
+
+	index := ql.length - 1
+	for node := ql.tail; node != nil; node = node.prev {
+		for i := len(node.elems) - 1; i >= 0; i-- {
+			if !fn(index, node.elems[i]) {
+				return
+			}
+			index--
+		}
+	}
+}
+
+// RemoveMatching deletes up to limit elements equal to elem, scanning from the
+// head, or from the tail when fromTail is set. A limit of 0 removes all of
+// them. It returns the number of elements removed.
+func (ql *quicklist) RemoveMatching(elem string, limit int, fromTail bool) int {
+	removed := 0
+	node := ql.head
+	if fromTail {
+		node = ql.tail
+	}
+
+	for node != nil && (limit == 0 || removed < limit) {
+		next := node.next
+		if fromTail {
+			next = node.prev
+		}
+
+		kept := node.elems[:0]
+		if !fromTail {
+			for _, e := range node.elems {
+				if e == elem && (limit == 0 || removed < limit) {
+					removed++
+					continue
+				}
+				kept = append(kept, e)
+			}
+		} else {
+			// Walk the node backwards so a limited removal takes the
+			// occurrences nearest the tail.
+			drop := make([]bool, len(node.elems))
+			for i := len(node.elems) - 1; i >= 0; i-- {
+				if node.elems[i] == elem && (limit == 0 || removed < limit) {
+					drop[i] = true
+					removed++
+				}
+			}
+			for i, e := range node.elems {
+				if !drop[i] {
+					kept = append(kept, e)
+				}
+			}
+		}
+		for i := len(kept); i < len(node.elems); i++ {
+			node.elems[i] = ""
+		}
+		ql.length -= len(node.elems) - len(kept)
+		node.elems = kept
+		if len(node.elems) == 0 {
+			ql.unlinkNode(node)
+		}
+
+		node = next
+	}
+	if removed > 0 {
+		ql.mergeNodes()
+	}
+	return removed
+}
+
+// mergeNodes joins neighbouring nodes whose elements fit in a single node, so
+// removals scattered along a list do not leave it a chain of near-empty
+// nodes.
+func (ql *quicklist) mergeNodes() {
+	for node := ql.head; node != nil && node.next != nil; {
+		next := node.next
+		if len(node.elems)+len(next.elems) > quicklistNodeSize {
+			node = next
+			continue
+		}
+		node.elems = append(node.elems, next.elems...)
+		ql.unlinkNode(next)
+	}
+}
+
+// Trim keeps only the elements between the normalised positions start and
+// stop inclusive; start > stop empties the list.
+func (ql *quicklist) Trim(start, stop int) {
+	if start > stop || start >= ql.length {
+		*ql = quicklist{}
+		return
+	}
+	tailDrop := ql.length - 1 - stop
+	for i := 0; i < start; i++ {
+		ql.PopFront()
+	}
+	for i := 0; i < tailDrop; i++ {
+		ql.PopBack()
+	}
+}
+
+func (ql *quicklist) insertNodeBefore(at, node *quicklistNode) {
+	if at == nil {
+		ql.head, ql.tail = node, node
+		return
+	}
+	node.next = at
+	node.prev = at.prev
+	if at.prev != nil {
+		at.prev.next = node
+	} else {
+		ql.head = node
+	}
+	at.prev = node
+}
+
+func (ql *quicklist) insertNodeAfter(at, node *quicklistNode) {
+	if at == nil {
+		ql.head, ql.tail = node, node
+		return
+	}
+	node.prev = at
+	node.next = at.next
+	if at.next != nil {
+		at.next.prev = node
+	} else {
+		ql.tail = node
+	}
+	at.next = node
+}
+
+func (ql *quicklist) unlinkNode(node *quicklistNode) {
+	if node.prev != nil {
+		node.prev.next = node.next
+	} else {
+		ql.head = node.next
+	}
+	if node.next != nil {
+		node.next.prev = node.prev
+	} else {
+		ql.tail = node.prev
+	}
+	node.prev, node.next = nil, nil
+}
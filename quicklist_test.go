@@ -0,0 +1,239 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// newTestQuicklist returns a list holding "0" to "n-1", pushed from the tail
+// so every node but the last is full.
+func newTestQuicklist(n int) (*quicklist, []string) {
+	ql := newQuicklist()
+	want := make([]string, n)
+	for i := range want {
+		want[i] = strconv.Itoa(i)
+		ql.PushBack(want[i])
+	}
+	return ql, want
+}
+
+// nodeSizes returns the number of elements in each node, head first.
+func nodeSizes(ql *quicklist) []int {
+	var sizes []int
+	for node := ql.head; node != nil; node = node.next {
+		sizes = append(sizes, len(node.elems))
+	}
+	return sizes
+}
+
+// checkQuicklist fails the test unless ql holds exactly want and its nodes
+// are linked both ways, non-empty and within quicklistNodeSize.
+func checkQuicklist(t *testing.T, ql *quicklist, want []string) {
+	t.Helper()
+	if ql.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", ql.Len(), len(want))
+	}
+	var got []string
+	var prev *quicklistNode
+	for node := ql.head; node != nil; node = node.next {
+		if node.prev != prev {
+			t.Fatalf("node after %d elements has a bad prev link", len(got))
+		}
+		if len(node.elems) == 0 || len(node.elems) > quicklistNodeSize {
+			t.Fatalf("node after %d elements holds %d", len(got), len(node.elems))
+		}
+		got = append(got, node.elems...)
+		prev = node
+	}
+	if ql.tail != prev {
+		t.Fatalf("tail is not the last node")
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("list holds %q, want %q", got, want)
+	}
+	var reversed []string
+	ql.Each(true, func(_ int, elem string) bool {
+		reversed = append(reversed, elem)
+		return true
+	})
+	slices.Reverse(reversed)
+	if !slices.Equal(reversed, want) {
+		t.Fatalf("walking from the tail gives %q", reversed)
+	}
+}
+
+func TestQuicklistPushFillsNodes(t *testing.T) {
+	ql, want := newTestQuicklist(2*quicklistNodeSize + 1)
+	checkQuicklist(t, ql, want)
+	if got := nodeSizes(ql); !slices.Equal(got, []int{quicklistNodeSize, quicklistNodeSize, 1}) {
+		t.Fatalf("node sizes %v", got)
+	}
+
+	ql.PushFront("head")
+	want = append([]string{"head"}, want...)
+	checkQuicklist(t, ql, want)
+	if got := nodeSizes(ql); !slices.Equal(got, []int{1, quicklistNodeSize, quicklistNodeSize, 1}) {
+		t.Fatalf("node sizes after PushFront %v", got)
+	}
+
+	// Popping the last element of a node unlinks it.
+	ql.PopFront()
+	ql.PopBack()
+	checkQuicklist(t, ql, want[1:len(want)-1])
+	if got := nodeSizes(ql); !slices.Equal(got, []int{quicklistNodeSize, quicklistNodeSize}) {
+		t.Fatalf("node sizes after pops %v", got)
+	}
+}
+
+func TestQuicklistIndexAndSet(t *testing.T) {
+	ql, want := newTestQuicklist(3 * quicklistNodeSize)
+	for _, index := range []int{
+		0, 1, quicklistNodeSize - 1, quicklistNodeSize, 2*quicklistNodeSize - 1,
+		-1, -2, -quicklistNodeSize, -quicklistNodeSize - 1, -len(want),
+	} {
+		pos := index
+		if pos < 0 {
+			pos += len(want)
+		}
+		if got, ok := ql.Index(index); !ok || got != want[pos] {
+			t.Errorf("Index(%d) = %q, %v; want %q", index, got, ok, want[pos])
+		}
+		want[pos] = "set" + strconv.Itoa(index)
+		if !ql.Set(index, want[pos]) {
+			t.Errorf("Set(%d) failed", index)
+		}
+	}
+	checkQuicklist(t, ql, want)
+
+	for _, index := range []int{len(want), -len(want) - 1} {
+		if _, ok := ql.Index(index); ok {
+			t.Errorf("Index(%d) found an element", index)
+		}
+		if ql.Set(index, "x") {
+			t.Errorf("Set(%d) succeeded", index)
+		}
+	}
+}
+
+func TestQuicklistInsertAtNodeBoundaries(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		sizes []int
+	}{
+		// A full node splits in half; the new element joins whichever half
+		// holds its position.
+		{"start of first node", 1, []int{65, 64, quicklistNodeSize}},
+		{"end of first node", quicklistNodeSize - 1, []int{64, 65, quicklistNodeSize}},
+		{"start of second node", quicklistNodeSize, []int{quicklistNodeSize, 65, 64}},
+		{"middle of second node", quicklistNodeSize + 64, []int{quicklistNodeSize, 64, 65}},
+		{"before the head", 0, []int{1, quicklistNodeSize, quicklistNodeSize}},
+		{"after the tail", 2 * quicklistNodeSize, []int{quicklistNodeSize, quicklistNodeSize, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ql, want := newTestQuicklist(2 * quicklistNodeSize)
+			ql.InsertAt(tt.index, "new")
+			want = slices.Insert(want, tt.index, "new")
+			checkQuicklist(t, ql, want)
+			if got := nodeSizes(ql); !slices.Equal(got, tt.sizes) {
+				t.Errorf("node sizes %v, want %v", got, tt.sizes)
+			}
+		})
+	}
+
+	// Splitting the same node again and again keeps every piece in bounds.
+	ql, want := newTestQuicklist(quicklistNodeSize)
+	for i := 0; i < 4*quicklistNodeSize; i++ {
+		pos := quicklistNodeSize / 2
+		ql.InsertAt(pos, "i"+strconv.Itoa(i))
+		want = slices.Insert(want, pos, "i"+strconv.Itoa(i))
+	}
+	checkQuicklist(t, ql, want)
+}
+
+func TestQuicklistRemoveMergesNodes(t *testing.T) {
+	ql, want := newTestQuicklist(4 * quicklistNodeSize)
+	// Tag all but the first and last few elements of every node, so
+	// removing them leaves four nodes of 8 elements.
+	for i := range want {
+		if offset := i % quicklistNodeSize; offset >= 4 && offset < quicklistNodeSize-4 {
+			ql.Set(i, "x")
+		}
+	}
+	if removed := ql.RemoveMatching("x", 0, false); removed != 4*(quicklistNodeSize-8) {
+		t.Fatalf("removed %d", removed)
+	}
+	want = slices.DeleteFunc(want, func(e string) bool {
+		offset, _ := strconv.Atoi(e)
+		offset %= quicklistNodeSize
+		return offset >= 4 && offset < quicklistNodeSize-4
+	})
+	checkQuicklist(t, ql, want)
+	if got := nodeSizes(ql); !slices.Equal(got, []int{32}) {
+		t.Fatalf("node sizes %v, want the nodes merged into one", got)
+	}
+
+	// Neighbours that would overflow a node stay apart.
+	ql, want = newTestQuicklist(3 * quicklistNodeSize)
+	ql.Set(0, "x")
+	ql.RemoveMatching("x", 0, false)
+	checkQuicklist(t, ql, want[1:])
+	if got := nodeSizes(ql); !slices.Equal(got, []int{quicklistNodeSize - 1, quicklistNodeSize, quicklistNodeSize}) {
+		t.Fatalf("node sizes %v", got)
+	}
+}
+
+func TestQuicklistRemoveFromTailWithLimit(t *testing.T) {
+	ql := newQuicklist()
+	var want []string
+	for i := 0; i < 3*quicklistNodeSize; i++ {
+		elem := strconv.Itoa(i)
+		if i%quicklistNodeSize == quicklistNodeSize-1 || i%quicklistNodeSize == 0 {
+			elem = "x"
+		}
+		ql.PushBack(elem)
+		want = append(want, elem)
+	}
+	// The three "x" nearest the tail straddle the last two node boundaries.
+	if removed := ql.RemoveMatching("x", 3, true); removed != 3 {
+		t.Fatalf("removed %d", removed)
+	}
+	n := quicklistNodeSize
+	want = slices.Delete(want, 3*n-1, 3*n)
+	want = slices.Delete(want, 2*n-1, 2*n+1)
+	checkQuicklist(t, ql, want)
+}
+
+func TestQuicklistRangeAndTrimAcrossNodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		start, stop int
+	}{
+		{"whole list", 0, 3*quicklistNodeSize - 1},
+		{"one element", quicklistNodeSize, quicklistNodeSize},
+		{"node boundaries", quicklistNodeSize - 1, 2 * quicklistNodeSize},
+		{"exact node", quicklistNodeSize, 2*quicklistNodeSize - 1},
+		{"inside last node", 2*quicklistNodeSize + 3, 3*quicklistNodeSize - 2},
+		{"empty", 5, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ql, want := newTestQuicklist(3 * quicklistNodeSize)
+			want = want[tt.start:max(tt.start, tt.stop+1)]
+			if got := ql.Range(tt.start, tt.stop); !slices.Equal(got, want) {
+				t.Errorf("Range(%d, %d) = %q, want %q", tt.start, tt.stop, got, want)
+			}
+			ql.Trim(tt.start, tt.stop)
+			checkQuicklist(t, ql, want)
+		})
+	}
+
+	ql, _ := newTestQuicklist(quicklistNodeSize)
+	ql.Trim(quicklistNodeSize, quicklistNodeSize+10)
+	checkQuicklist(t, ql, nil)
+	if ql.head != nil || ql.tail != nil {
+		t.Errorf("trimmed list still has nodes")
+	}
+}
@@ -0,0 +1,1563 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// RDB opcodes and value types, numbered as in Redis' rdb.h.
+const (
+	rdbOpcodeFunction2    = 0xF5
+	rdbOpcodeModuleAux    = 0xF7
+	rdbOpcodeIdle         = 0xF8
+	rdbOpcodeFreq         = 0xF9
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5
+	rdbTypeSetIntset        = 11
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+	rdbTypeHashMetadata     = 24
+	rdbTypeHashListpackEx   = 25
+
+	// Special string encodings, flagged by the top two bits of a length.
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	// Quicklist node containers.
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	// Flags of an entry in a stream listpack node.
+	streamItemDeleted    = 1
+	streamItemSameFields = 2
+)
+
+// rdbVersion is written to the header of every snapshot; a snapshot holding
+// hash field TTLs needs rdbVersionHashTTL to be readable.
+const (
+	rdbVersion        = 11
+	rdbVersionHashTTL = 12
+)
+
+// crc64Table is the Jones polynomial (reflected) Redis checksums RDB files
+// with.
+var crc64Table = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// rdbChecksum computes Redis' crc64: no initial or final inversion, unlike
+// the ISO/ECMA variants hash/crc64 is built around.
+func rdbChecksum(p []byte) uint64 {
+	return ^crc64.Update(^uint64(0), crc64Table, p)
+}
+
+// rdbPath is where SAVE writes and startup loads the snapshot.
+func (c *Config) rdbPath() string {
+	name := c.dbFileName
+	if name == "" {
+		name = "dump.rdb"
+	}
+	return filepath.Join(c.Directory, name)
+}
+
+type rdbEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *rdbEncoder) writeLen(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.buf.WriteByte(byte(n))
+	case n < 1<<14:
+		e.buf.WriteByte(0x40 | byte(n>>8))
+		e.buf.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(0x80)
+		binary.Write(&e.buf, binary.BigEndian, uint32(n))
+	default:
+		e.buf.WriteByte(0x81)
+		binary.Write(&e.buf, binary.BigEndian, n)
+	}
+}
+
+// writeString writes s, using the compact integer encodings when s is the
+// canonical form of a small integer, as Redis does.
+func (e *rdbEncoder) writeString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && len(s) <= 11 && strconv.FormatInt(n, 10) == s {
+		if e.writeInt(n) {
+			return
+		}
+	}
+	e.writeLen(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *rdbEncoder) writeInt(n int64) bool {
+	switch {
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		e.buf.WriteByte(0xC0 | rdbEncInt8)
+		e.buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		e.buf.WriteByte(0xC0 | rdbEncInt16)
+		binary.Write(&e.buf, binary.LittleEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		e.buf.WriteByte(0xC0 | rdbEncInt32)
+		binary.Write(&e.buf, binary.LittleEndian, int32(n))
+	default:
+		return false
+	}
+	return true
+}
+
+func (e *rdbEncoder) writeAux(key, value string) {
+	e.buf.WriteByte(rdbOpcodeAux)
+	e.writeString(key)
+	e.writeString(value)
+}
+
+// rdbTypeOf returns the type byte val is saved under. ok is false for types
+// the snapshot has no encoding for, which are then left out.
+func rdbTypeOf(val interface{}) (typ byte, ok bool) {
+	switch v := val.(type) {
+	case string, int64, []byte:
+		return rdbTypeString, true
+	case *quicklist:
+		return rdbTypeList, true
+	case *hashValue:
+		if v.ttlFields > 0 {
+			return rdbTypeHashMetadata, true
+		}
+		return rdbTypeHash, true
+	case *setValue:
+		if v.isIntset() {
+			return rdbTypeSetIntset, true
+		}
+		return rdbTypeSet, true
+	case *sortedset.SortedSet:
+		return rdbTypeZset2, true
+	case *stream:
+		return rdbTypeStreamListpacks3, true
+	}
+	return 0, false
+}
+
+// writeValue writes the payload of val in the layout rdbTypeOf chose for it.
+func (e *rdbEncoder) writeValue(val interface{}, now int64) {
+	switch v := val.(type) {
+	case string:
+		e.writeString(v)
+	case []byte:
+		e.writeString(string(v))
+	case int64:
+		if !e.writeInt(v) {
+			e.writeString(strconv.FormatInt(v, 10))
+		}
+	case *quicklist:
+		e.writeLen(uint64(v.Len()))
+		v.Each(false, func(_ int, elem string) bool {
+			e.writeString(elem)
+			return true
+		})
+	case *hashValue:
+		e.writeHash(v, now)
+	case *setValue:
+		if v.isIntset() {
+			e.writeIntset(v.intset)
+			return
+		}
+		e.writeLen(uint64(v.Len()))
+		for _, member := range v.order {
+			e.writeString(member)
+		}
+	case *sortedset.SortedSet:
+		nodes := v.GetByRankRange(1, -1, false)
+		e.writeLen(uint64(len(nodes)))
+		for _, node := range nodes {
+			e.writeString(node.Key())
+			binary.Write(&e.buf, binary.LittleEndian, math.Float64bits(nodeScore(node)))
+		}
+	case *stream:
+		e.writeStream(v)
+	}
+}
+
+// writeIntset writes the members of an intset as the blob Redis keeps it in:
+// the element width, the count, then the sorted members, all little-endian.
+func (e *rdbEncoder) writeIntset(members []int64) {
+	width := 2
+	for _, n := range members {
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			width = 8
+			break
+		}
+		if n < math.MinInt16 || n > math.MaxInt16 {
+			width = 4
+		}
+	}
+
+	blob := make([]byte, 8+width*len(members))
+	binary.LittleEndian.PutUint32(blob, uint32(width))
+	binary.LittleEndian.PutUint32(blob[4:], uint32(len(members)))
+	for i, n := range members {
+		p := blob[8+i*width:]
+		switch width {
+		case 2:
+			binary.LittleEndian.PutUint16(p, uint16(n))
+		case 4:
+			binary.LittleEndian.PutUint32(p, uint32(n))
+		default:
+			binary.LittleEndian.PutUint64(p, uint64(n))
+		}
+	}
+	e.writeLen(uint64(len(blob)))
+	e.buf.Write(blob)
+}
+
+// writeHash writes a hash. With field TTLs they are stored relative to the
+// earliest one, as Redis does; fields already expired are left out.
+func (e *rdbEncoder) writeHash(h *hashValue, now int64) {
+	live := 0
+	minExpire := int64(0)
+	for _, field := range h.order {
+		entry := h.entries[field]
+		if entry.expireAt != 0 && entry.expireAt <= now {
+			continue
+		}
+		live++
+		if entry.expireAt != 0 && (minExpire == 0 || entry.expireAt < minExpire) {
+			minExpire = entry.expireAt
+		}
+	}
+
+	if h.ttlFields == 0 {
+		e.writeLen(uint64(live))
+		for _, field := range h.order {
+			e.writeString(field)
+			e.writeString(h.entries[field].value)
+		}
+		return
+	}
+
+	binary.Write(&e.buf, binary.LittleEndian, minExpire)
+	e.writeLen(uint64(live))
+	for _, field := range h.order {
+		entry := h.entries[field]
+		switch {
+		case entry.expireAt == 0:
+			e.writeLen(0)
+		case entry.expireAt <= now:
+			continue
+		default:
+			e.writeLen(uint64(entry.expireAt - minExpire + 1))
+		}
+		e.writeString(field)
+		e.writeString(entry.value)
+	}
+}
+
+// writeStream writes a stream as Redis does: one listpack per chunk, keyed by
+// the big-endian ID of its first entry, followed by the stream metadata.
+func (e *rdbEncoder) writeStream(s *stream) {
+	e.writeLen(uint64(len(s.chunks)))
+	for _, chunk := range s.chunks {
+		master := chunk.entries[0]
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, master.id.ms)
+		binary.BigEndian.PutUint64(key[8:], master.id.seq)
+		e.writeString(string(key))
+		e.writeString(string(streamChunkListpack(chunk)))
+	}
+	e.writeLen(uint64(s.Len()))
+	e.writeStreamID(s.lastID)
+	e.writeStreamID(s.FirstID())
+	e.writeStreamID(s.maxDeletedID)
+	e.writeLen(s.entriesAdded)
+
+	e.writeLen(uint64(len(s.groups)))
+	for _, name := range s.GroupNames() {
+		g := s.groups[name]
+		e.writeString(name)
+		e.writeStreamID(g.lastID)
+		e.writeLen(uint64(g.entriesRead))
+		e.writeLen(uint64(g.pending.Len()))
+		for _, id := range g.pending.ids {
+			nack := g.pending.Get(id)
+			e.writeRawStreamID(id)
+			binary.Write(&e.buf, binary.LittleEndian, nack.deliveryTime)
+			e.writeLen(nack.deliveryCount)
+		}
+		e.writeLen(uint64(len(g.consumers)))
+		for _, cname := range g.ConsumerNames() {
+			c := g.consumers[cname]
+			e.writeString(cname)
+			binary.Write(&e.buf, binary.LittleEndian, c.seenTime)
+			binary.Write(&e.buf, binary.LittleEndian, c.activeTime)
+			e.writeLen(uint64(c.pending.Len()))
+			for _, id := range c.pending.ids {
+				e.writeRawStreamID(id)
+			}
+		}
+	}
+}
+
+func (e *rdbEncoder) writeStreamID(id streamID) {
+	e.writeLen(id.ms)
+	e.writeLen(id.seq)
+}
+
+// writeRawStreamID writes id as the 128-bit big-endian key pending entries
+// are stored under.
+func (e *rdbEncoder) writeRawStreamID(id streamID) {
+	binary.Write(&e.buf, binary.BigEndian, id.ms)
+	binary.Write(&e.buf, binary.BigEndian, id.seq)
+}
+
+// streamChunkListpack lays a chunk out as a Redis stream node. The "master
+// entry" holds the live and deleted counts and the field names of the first
+// entry; entries with the same field names only store their values. Entry
+// IDs are deltas from the first ID, and each entry ends with its element
+// count so the node can be walked backwards.
+func streamChunkListpack(chunk *streamChunk) []byte {
+	master := chunk.entries[0]
+	numFields := len(master.fields) / 2
+
+	lp := &listpackBuilder{}
+	lp.appendInt(int64(len(chunk.entries)))
+	lp.appendInt(0)
+	lp.appendInt(int64(numFields))
+	for i := 0; i < len(master.fields); i += 2 {
+		lp.appendString(master.fields[i])
+	}
+	lp.appendInt(0)
+
+	for _, entry := range chunk.entries {
+		sameFields := len(entry.fields) == len(master.fields)
+		for i := 0; sameFields && i < len(entry.fields); i += 2 {
+			sameFields = entry.fields[i] == master.fields[i]
+		}
+
+		flags := int64(0)
+		if sameFields {
+			flags = streamItemSameFields
+		}
+		lp.appendInt(flags)
+		lp.appendInt(int64(entry.id.ms - master.id.ms))
+		lp.appendInt(int64(entry.id.seq - master.id.seq))
+		n := len(entry.fields) / 2
+		if sameFields {
+			for i := 1; i < len(entry.fields); i += 2 {
+				lp.appendString(entry.fields[i])
+			}
+			lp.appendInt(int64(n + 3))
+			continue
+		}
+		lp.appendInt(int64(n))
+		for _, s := range entry.fields {
+			lp.appendString(s)
+		}
+		lp.appendInt(int64(2*n + 4))
+	}
+	return lp.bytes()
+}
+
+// encodeRDB serialises storage and the code of the function libraries into
+// an RDB snapshot. Keys already past their TTL are skipped. The caller must
+// hold storageMu.
+func encodeRDB(storage map[string]storageVal, functions []string) []byte {
+	now := time.Now()
+	nowMs := now.UnixMilli()
+
+	body := &rdbEncoder{}
+	expires := 0
+	version := rdbVersion
+	keys := 0
+	for key, value := range storage {
+		if value.expired(now) {
+			continue
+		}
+		if h, ok := value.val.(*hashValue); ok && h.ttlFields > 0 {
+			version = rdbVersionHashTTL
+		}
+
+		typ, ok := rdbTypeOf(value.val)
+		if !ok {
+			continue
+		}
+		if at := value.expireAt(); !at.IsZero() {
+			body.buf.WriteByte(rdbOpcodeExpireTimeMs)
+			binary.Write(&body.buf, binary.LittleEndian, at.UnixMilli())
+			expires++
+		}
+		body.buf.WriteByte(typ)
+		body.writeString(key)
+		body.writeValue(value.val, nowMs)
+		keys++
+	}
+
+	e := &rdbEncoder{}
+	fmt.Fprintf(&e.buf, "REDIS%04d", version)
+	e.writeAux("redis-ver", "7.4.0")
+	e.writeAux("redis-bits", "64")
+	e.writeAux("ctime", strconv.FormatInt(now.Unix(), 10))
+	e.writeAux("aof-base", "0")
+	for _, code := range functions {
+		e.buf.WriteByte(rdbOpcodeFunction2)
+		e.writeString(code)
+	}
+	if keys > 0 {
+		e.buf.WriteByte(rdbOpcodeSelectDB)
+		e.writeLen(0)
+		e.buf.WriteByte(rdbOpcodeResizeDB)
+		e.writeLen(uint64(keys))
+		e.writeLen(uint64(expires))
+		e.buf.Write(body.buf.Bytes())
+	}
+	e.buf.WriteByte(rdbOpcodeEOF)
+	binary.Write(&e.buf, binary.LittleEndian, rdbChecksum(e.buf.Bytes()))
+	return e.buf.Bytes()
+}
+
+var errRDBTruncated = errors.New("unexpected end of RDB data")
+
+type rdbDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *rdbDecoder) readByte() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, errRDBTruncated
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *rdbDecoder) readBytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, errRDBTruncated
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// readLen reads a length. encoded is set when the top bits flag a special
+// string encoding, in which case n holds the encoding type instead.
+func (d *rdbDecoder) readLen() (n uint64, encoded bool, err error) {
+	first, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		next, err := d.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(next), false, nil
+	case 2:
+		switch first {
+		case 0x80:
+			b, err := d.readBytes(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(b)), false, nil
+		case 0x81:
+			b, err := d.readBytes(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(b), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding 0x%02X", first)
+	}
+	return uint64(first & 0x3F), true, nil
+}
+
+func (d *rdbDecoder) readCount() (int, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return 0, err
+	}
+	if encoded || n > uint64(len(d.data)) {
+		return 0, fmt.Errorf("invalid element count")
+	}
+	return int(n), nil
+}
+
+func (d *rdbDecoder) readString() (string, error) {
+	n, encoded, err := d.readLen()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		if n > uint64(len(d.data)) {
+			return "", errRDBTruncated
+		}
+		b, err := d.readBytes(int(n))
+		return string(b), err
+	}
+
+	switch n {
+	case rdbEncInt8:
+		b, err := d.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		b, err := d.readBytes(2)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(b)))), nil
+	case rdbEncInt32:
+		b, err := d.readBytes(4)
+		if err != nil {
+			return "", err
+		}
+		return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(b)))), nil
+	case rdbEncLZF:
+		clen, err := d.readCount()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.readCount()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := d.readBytes(clen)
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(compressed, ulen)
+		return string(out), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+func (d *rdbDecoder) readMillis() (int64, error) {
+	b, err := d.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b)), nil
+}
+
+// readDouble reads the string-encoded double of the old zset type.
+func (d *rdbDecoder) readDouble() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.readBytes(int(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+func (d *rdbDecoder) readBinaryDouble() (float64, error) {
+	b, err := d.readBytes(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+}
+
+// readValue decodes a value of type typ into its in-memory representation.
+// now (unix ms) is used to drop hash fields whose TTL already elapsed.
+func (d *rdbDecoder) readValue(typ byte, now int64) (interface{}, error) {
+	switch typ {
+	case rdbTypeString:
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return encodeString(s), nil
+
+	case rdbTypeList:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		list := newQuicklist()
+		for i := 0; i < n; i++ {
+			elem, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			list.PushBack(elem)
+		}
+		return list, nil
+
+	case rdbTypeListQuicklist2:
+		nodes, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		list := newQuicklist()
+		for i := 0; i < nodes; i++ {
+			container, _, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			blob, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if container == quicklistNodePlain {
+				list.PushBack(blob)
+				continue
+			}
+			elems, err := parseListpack([]byte(blob))
+			if err != nil {
+				return nil, err
+			}
+			for _, elem := range elems {
+				list.PushBack(elem)
+			}
+		}
+		return list, nil
+
+	case rdbTypeSet:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		set := newSetValue()
+		for i := 0; i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			set.Add(member)
+		}
+		return set, nil
+
+	case rdbTypeSetIntset:
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		members, err := parseIntset([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		set := newSetValue()
+		for _, n := range members {
+			set.Add(strconv.FormatInt(n, 10))
+		}
+		return set, nil
+
+	case rdbTypeSetListpack:
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		members, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		set := newSetValue()
+		for _, member := range members {
+			set.Add(member)
+		}
+		return set, nil
+
+	case rdbTypeHash:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		hash := newHashValue()
+		for i := 0; i < n; i++ {
+			field, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(field, value)
+		}
+		return hash, nil
+
+	case rdbTypeHashListpack:
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%2 != 0 {
+			return nil, errors.New("hash listpack with odd number of entries")
+		}
+		hash := newHashValue()
+		for i := 0; i < len(elems); i += 2 {
+			hash.Set(elems[i], elems[i+1])
+		}
+		return hash, nil
+
+	case rdbTypeHashMetadata:
+		minExpire, err := d.readMillis()
+		if err != nil {
+			return nil, err
+		}
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		hash := newHashValue()
+		for i := 0; i < n; i++ {
+			ttl, _, err := d.readLen()
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			expireAt := int64(0)
+			if ttl != 0 {
+				expireAt = minExpire + int64(ttl) - 1
+			}
+			loadHashField(hash, field, value, expireAt, now)
+		}
+		return hash, nil
+
+	case rdbTypeHashListpackEx:
+		// The leading minimum expiry is only a hint; the listpack holds
+		// field, value, absolute TTL triplets.
+		if _, err := d.readMillis(); err != nil {
+			return nil, err
+		}
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%3 != 0 {
+			return nil, errors.New("hash listpack with malformed TTL triplets")
+		}
+		hash := newHashValue()
+		for i := 0; i < len(elems); i += 3 {
+			expireAt, err := strconv.ParseInt(elems[i+2], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			loadHashField(hash, elems[i], elems[i+1], expireAt, now)
+		}
+		return hash, nil
+
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := d.readCount()
+		if err != nil {
+			return nil, err
+		}
+		zset := sortedset.New()
+		for i := 0; i < n; i++ {
+			member, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if typ == rdbTypeZset2 {
+				score, err = d.readBinaryDouble()
+			} else {
+				score, err = d.readDouble()
+			}
+			if err != nil {
+				return nil, err
+			}
+			zset.AddOrUpdate(member, zsetScore(score), nil)
+		}
+		return zset, nil
+
+	case rdbTypeZsetListpack:
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		if len(elems)%2 != 0 {
+			return nil, errors.New("zset listpack with odd number of entries")
+		}
+		zset := sortedset.New()
+		for i := 0; i < len(elems); i += 2 {
+			score, err := strconv.ParseFloat(elems[i+1], 64)
+			if err != nil {
+				return nil, err
+			}
+			zset.AddOrUpdate(elems[i], zsetScore(score), nil)
+		}
+		return zset, nil
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return d.readStream(typ)
+	}
+	return nil, fmt.Errorf("unsupported RDB value type %d", typ)
+}
+
+// readStream decodes any of the stream types. Older types lack the first ID,
+// max deleted ID and entries-added metadata.
+func (d *rdbDecoder) readStream(typ byte) (*stream, error) {
+	nodes, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	s := newStream()
+	for i := 0; i < nodes; i++ {
+		key, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		if len(key) != 16 {
+			return nil, errors.New("stream node key is not a 128 bit ID")
+		}
+		master := streamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		blob, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseListpack([]byte(blob))
+		if err != nil {
+			return nil, err
+		}
+		if err := loadStreamNode(s, master, elems); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, _, err = d.readLen(); err != nil {
+		return nil, err
+	}
+	if s.lastID, err = d.readStreamID(); err != nil {
+		return nil, err
+	}
+	s.entriesAdded = uint64(s.Len())
+	if typ >= rdbTypeStreamListpacks2 {
+		if _, err = d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.maxDeletedID, err = d.readStreamID(); err != nil {
+			return nil, err
+		}
+		if s.entriesAdded, _, err = d.readLen(); err != nil {
+			return nil, err
+		}
+	}
+
+	groups, err := d.readCount()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < groups; i++ {
+		if err := d.readStreamGroup(s, typ); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// readStreamGroup decodes a consumer group with its pending entries and
+// consumers. Consumers list the IDs they own; the delivery metadata lives in
+// the group's list.
+func (d *rdbDecoder) readStreamGroup(s *stream, typ byte) error {
+	name, err := d.readString()
+	if err != nil {
+		return err
+	}
+	lastID, err := d.readStreamID()
+	if err != nil {
+		return err
+	}
+	entriesRead := s.entriesUpTo(lastID)
+	if typ >= rdbTypeStreamListpacks2 {
+		n, _, err := d.readLen()
+		if err != nil {
+			return err
+		}
+		entriesRead = int64(n)
+	}
+	g, ok := s.CreateGroup(name, lastID, entriesRead)
+	if !ok {
+		return fmt.Errorf("duplicated consumer group name %q", name)
+	}
+
+	pending, err := d.readCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < pending; i++ {
+		id, err := d.readRawStreamID()
+		if err != nil {
+			return err
+		}
+		nack := &pendingEntry{id: id}
+		if nack.deliveryTime, err = d.readMillis(); err != nil {
+			return err
+		}
+		if nack.deliveryCount, _, err = d.readLen(); err != nil {
+			return err
+		}
+		g.pending.Add(nack)
+	}
+
+	consumers, err := d.readCount()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < consumers; i++ {
+		cname, err := d.readString()
+		if err != nil {
+			return err
+		}
+		seenTime, err := d.readMillis()
+		if err != nil {
+			return err
+		}
+		c, _ := g.CreateConsumer(cname, seenTime)
+		c.activeTime = seenTime
+		if typ >= rdbTypeStreamListpacks3 {
+			if c.activeTime, err = d.readMillis(); err != nil {
+				return err
+			}
+		}
+
+		owned, err := d.readCount()
+		if err != nil {
+			return err
+		}
+		for j := 0; j < owned; j++ {
+			id, err := d.readRawStreamID()
+			if err != nil {
+				return err
+			}
+			nack := g.pending.Get(id)
+			if nack == nil {
+				return errors.New("consumer pending entry not found in the group's pending entries list")
+			}
+			nack.consumer = c
+			c.pending.Add(nack)
+		}
+	}
+
+	for _, id := range g.pending.ids {
+		if g.pending.Get(id).consumer == nil {
+			return errors.New("pending entry without a consumer")
+		}
+	}
+	return nil
+}
+
+func (d *rdbDecoder) readRawStreamID() (streamID, error) {
+	b, err := d.readBytes(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{binary.BigEndian.Uint64(b), binary.BigEndian.Uint64(b[8:])}, nil
+}
+
+func (d *rdbDecoder) readStreamID() (streamID, error) {
+	ms, _, err := d.readLen()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, _, err := d.readLen()
+	return streamID{ms, seq}, err
+}
+
+// loadStreamNode appends the live entries of a stream listpack node, the
+// layout streamChunkListpack writes.
+func loadStreamNode(s *stream, master streamID, elems []string) error {
+	errCorrupt := errors.New("corrupt stream node")
+	pos := 0
+	next := func() (int64, bool) {
+		if pos >= len(elems) {
+			return 0, false
+		}
+		n, err := strconv.ParseInt(elems[pos], 10, 64)
+		pos++
+		return n, err == nil
+	}
+
+	// Master entry: live count, deleted count, field names, terminator.
+	next()
+	next()
+	numFields, ok := next()
+	if !ok || numFields < 0 || pos+int(numFields)+1 > len(elems) {
+		return errCorrupt
+	}
+	masterFields := elems[pos : pos+int(numFields)]
+	pos += int(numFields) + 1
+
+	for pos < len(elems) {
+		flags, ok1 := next()
+		msDelta, ok2 := next()
+		seqDelta, ok3 := next()
+		if !ok1 || !ok2 || !ok3 {
+			return errCorrupt
+		}
+		id := streamID{master.ms + uint64(msDelta), master.seq + uint64(seqDelta)}
+
+		var fields []string
+		if flags&streamItemSameFields != 0 {
+			if pos+len(masterFields) > len(elems) {
+				return errCorrupt
+			}
+			fields = make([]string, 0, 2*len(masterFields))
+			for i, field := range masterFields {
+				fields = append(fields, field, elems[pos+i])
+			}
+			pos += len(masterFields)
+		} else {
+			n, ok := next()
+			if !ok || n < 0 || pos+2*int(n) > len(elems) {
+				return errCorrupt
+			}
+			fields = append([]string(nil), elems[pos:pos+2*int(n)]...)
+			pos += 2 * int(n)
+		}
+		if _, ok := next(); !ok {
+			return errCorrupt
+		}
+
+		if flags&streamItemDeleted != 0 {
+			continue
+		}
+		if s.Len() > 0 && !s.lastID.Less(id) {
+			return errors.New("stream entries out of order")
+		}
+		s.Append(id, fields)
+	}
+	return nil
+}
+
+func loadHashField(hash *hashValue, field, value string, expireAt, now int64) {
+	if expireAt != 0 && expireAt <= now {
+		return
+	}
+	hash.Set(field, value)
+	if expireAt != 0 {
+		hash.setExpire(hash.entries[field], expireAt)
+	}
+}
+
+// decodeRDB parses an RDB snapshot and returns the keys of database 0 that
+// have not expired yet, and the code of the function libraries. Other
+// databases are parsed and skipped, since the server only has one.
+func decodeRDB(data []byte) (map[string]storageVal, []string, error) {
+	if len(data) < 9 || string(data[:5]) != "REDIS" {
+		return nil, nil, errors.New("wrong signature trying to load DB from file")
+	}
+	version, err := strconv.Atoi(string(data[5:9]))
+	if err != nil || version < 1 || version > rdbVersionHashTTL {
+		return nil, nil, fmt.Errorf("can't handle RDB format version %s", data[5:9])
+	}
+
+	d := &rdbDecoder{data: data, pos: 9}
+	storage := make(map[string]storageVal)
+	var functions []string
+	now := time.Now()
+	db := uint64(0)
+	var expireAt time.Time
+
+	for {
+		opcode, err := d.readByte()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version >= 5 && len(data)-d.pos >= 8 {
+				stored := binary.LittleEndian.Uint64(data[d.pos:])
+				// A zero checksum means the writer had checksums disabled.
+				if stored != 0 && stored != rdbChecksum(data[:d.pos]) {
+					return nil, nil, errors.New("wrong RDB checksum")
+				}
+			}
+			return storage, functions, nil
+
+		case rdbOpcodeSelectDB:
+			if db, _, err = d.readLen(); err != nil {
+				return nil, nil, err
+			}
+			continue
+
+		case rdbOpcodeResizeDB:
+			if _, _, err = d.readLen(); err != nil {
+				return nil, nil, err
+			}
+			if _, _, err = d.readLen(); err != nil {
+				return nil, nil, err
+			}
+			continue
+
+		case rdbOpcodeAux:
+			if _, err = d.readString(); err != nil {
+				return nil, nil, err
+			}
+			if _, err = d.readString(); err != nil {
+				return nil, nil, err
+			}
+			continue
+
+		case rdbOpcodeExpireTimeMs:
+			ms, err := d.readMillis()
+			if err != nil {
+				return nil, nil, err
+			}
+			expireAt = time.UnixMilli(ms)
+			continue
+
+		case rdbOpcodeExpireTime:
+			b, err := d.readBytes(4)
+			if err != nil {
+				return nil, nil, err
+			}
+			expireAt = time.Unix(int64(binary.LittleEndian.Uint32(b)), 0)
+			continue
+
+		case rdbOpcodeIdle:
+			if _, _, err = d.readLen(); err != nil {
+				return nil, nil, err
+			}
+			continue
+
+		case rdbOpcodeFreq:
+			if _, err = d.readByte(); err != nil {
+				return nil, nil, err
+			}
+			continue
+
+		case rdbOpcodeFunction2:
+			code, err := d.readString()
+			if err != nil {
+				return nil, nil, err
+			}
+			functions = append(functions, code)
+			continue
+
+		case rdbOpcodeModuleAux:
+			return nil, nil, fmt.Errorf("unsupported RDB opcode 0x%02X", opcode)
+		}
+
+		key, err := d.readString()
+		if err != nil {
+			return nil, nil, err
+		}
+		val, err := d.readValue(opcode, now.UnixMilli())
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %q: %w", key, err)
+		}
+
+		keyExpire := expireAt
+		expireAt = time.Time{}
+		if db != 0 || (!keyExpire.IsZero() && !keyExpire.After(now)) {
+			continue
+		}
+		if h, ok := val.(*hashValue); ok && h.Len() == 0 {
+			continue
+		}
+		storage[key] = newStorageVal(val, keyExpire)
+	}
+}
+
+// loadRDBFile replaces the dataset with the snapshot at path. A missing file
+// leaves the dataset empty, as on a fresh server.
+func (st *RedisState) loadRDBFile(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	storage, functions, err := decodeRDB(data)
+	if err != nil {
+		return err
+	}
+
+	st.scriptMu.Lock()
+	err = st.restoreFunctions(functions, "FLUSH")
+	st.scriptMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("loading function libraries: %w", err)
+	}
+
+	st.storageMu.Lock()
+	st.storage = storage
+	st.storageMu.Unlock()
+	return nil
+}
+
+// writeRDBFile writes snapshot to path atomically.
+func writeRDBFile(path string, snapshot []byte) error {
+	return replaceFile(path, fmt.Sprintf("%s.temp-%d.rdb", path, os.Getpid()), snapshot, 0o644)
+}
+
+// replaceFile writes data to path atomically, through the temporary file tmp
+// renamed into place once it is fully on disk. The file gets mode perm.
+func replaceFile(path, tmp string, data []byte, perm os.FileMode) error {
+	os.Remove(tmp)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *RedisServer) saveCommand(args []string) CommandResponse {
+	if len(args) != 1 {
+		return wrongArgsError("SAVE")
+	}
+	if s.state.bgsaveInProgress.Load() {
+		return CommandResponse{Error: "-ERR Background save already in progress"}
+	}
+
+	functions := s.state.functionCodes()
+	s.state.storageMu.RLock()
+	snapshot := encodeRDB(s.state.storage, functions)
+	s.state.storageMu.RUnlock()
+
+	if err := writeRDBFile(s.state.config.rdbPath(), snapshot); err != nil {
+		fmt.Printf("Failed saving the DB: %v\n", err)
+		return CommandResponse{Error: "-ERR " + err.Error()}
+	}
+	return CommandResponse{Response: "+OK"}
+}
+
+// bgsaveCommand takes the snapshot right away, which is what fixes its
+// point in time, and writes it to disk in the background.
+func (s *RedisServer) bgsaveCommand(args []string) CommandResponse {
+	if len(args) > 2 || (len(args) == 2 && strings.ToUpper(args[1]) != "SCHEDULE") {
+		return CommandResponse{Error: "-ERR syntax error"}
+	}
+	if !s.state.bgsaveInProgress.CompareAndSwap(false, true) {
+		return CommandResponse{Error: "-ERR Background save already in progress"}
+	}
+
+	functions := s.state.functionCodes()
+	s.state.storageMu.RLock()
+	snapshot := encodeRDB(s.state.storage, functions)
+	s.state.storageMu.RUnlock()
+
+	path := s.state.config.rdbPath()
+	go func() {
+		defer s.state.bgsaveInProgress.Store(false)
+		if err := writeRDBFile(path, snapshot); err != nil {
+			fmt.Printf("Background saving error: %v\n", err)
+			return
+		}
+		fmt.Println("Background saving terminated with success")
+	}()
+	return CommandResponse{Response: "+Background saving started"}
+}
+
+// lzfDecompress expands LZF-compressed data, the compression Redis applies
+// to long strings in snapshots.
+func lzfDecompress(in []byte, outLen int) ([]byte, error) {
+	out := make([]byte, 0, outLen)
+	for ip := 0; ip < len(in); {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 1<<5 {
+			// Literal run of ctrl+1 bytes.
+			n := ctrl + 1
+			if ip+n > len(in) || len(out)+n > outLen {
+				return nil, errors.New("corrupt LZF data")
+			}
+			out = append(out, in[ip:ip+n]...)
+			ip += n
+			continue
+		}
+
+		// Back reference: length in the top three bits (7 means another
+		// length byte follows), offset in the rest plus the next byte.
+		n := ctrl >> 5
+		if n == 7 {
+			if ip >= len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			n += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return nil, errors.New("corrupt LZF data")
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[ip]) - 1
+		ip++
+		n += 2
+		if ref < 0 || len(out)+n > outLen {
+			return nil, errors.New("corrupt LZF data")
+		}
+		// Byte by byte: the reference may overlap what is being written.
+		for i := 0; i < n; i++ {
+			out = append(out, out[ref+i])
+		}
+	}
+	if len(out) != outLen {
+		return nil, errors.New("corrupt LZF data")
+	}
+	return out, nil
+}
+
+// parseListpack returns the entries of a listpack blob as strings.
+func parseListpack(lp []byte) ([]string, error) {
+	if len(lp) < 7 {
+		return nil, errors.New("listpack too short")
+	}
+	errCorrupt := errors.New("corrupt listpack")
+
+	var elems []string
+	pos := 6
+	for {
+		if pos >= len(lp) {
+			return nil, errCorrupt
+		}
+		b := lp[pos]
+		if b == 0xFF {
+			return elems, nil
+		}
+
+		var entryLen int
+		switch {
+		case b&0x80 == 0:
+			elems = append(elems, strconv.Itoa(int(b&0x7F)))
+			entryLen = 1
+		case b&0xC0 == 0x80:
+			n := int(b & 0x3F)
+			if pos+1+n > len(lp) {
+				return nil, errCorrupt
+			}
+			elems = append(elems, string(lp[pos+1:pos+1+n]))
+			entryLen = 1 + n
+		case b&0xE0 == 0xC0:
+			if pos+2 > len(lp) {
+				return nil, errCorrupt
+			}
+			// 13-bit two's complement integer.
+			v := int(b&0x1F)<<8 | int(lp[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			elems = append(elems, strconv.Itoa(v))
+			entryLen = 2
+		case b&0xF0 == 0xE0:
+			if pos+2 > len(lp) {
+				return nil, errCorrupt
+			}
+			n := int(b&0x0F)<<8 | int(lp[pos+1])
+			if pos+2+n > len(lp) {
+				return nil, errCorrupt
+			}
+			elems = append(elems, string(lp[pos+2:pos+2+n]))
+			entryLen = 2 + n
+		case b == 0xF0:
+			if pos+5 > len(lp) {
+				return nil, errCorrupt
+			}
+			n := int(binary.LittleEndian.Uint32(lp[pos+1:]))
+			if n < 0 || pos+5+n > len(lp) {
+				return nil, errCorrupt
+			}
+			elems = append(elems, string(lp[pos+5:pos+5+n]))
+			entryLen = 5 + n
+		case b >= 0xF1 && b <= 0xF4:
+			size := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}[b]
+			if pos+1+size > len(lp) {
+				return nil, errCorrupt
+			}
+			var u uint64
+			for i := size - 1; i >= 0; i-- {
+				u = u<<8 | uint64(lp[pos+1+i])
+			}
+			// Sign-extend from size bytes.
+			shift := 64 - 8*uint(size)
+			elems = append(elems, strconv.FormatInt(int64(u<<shift)>>shift, 10))
+			entryLen = 1 + size
+		default:
+			return nil, errCorrupt
+		}
+
+		pos += entryLen + listpackBacklenSize(entryLen)
+	}
+}
+
+// listpackBacklenSize is the number of bytes the trailing back-length of an
+// entry of entryLen bytes takes. The bounds are Redis' lpEncodeBacklen ones,
+// which stop one short of each power of two.
+func listpackBacklenSize(entryLen int) int {
+	switch {
+	case entryLen <= 127:
+		return 1
+	case entryLen < 16383:
+		return 2
+	case entryLen < 2097151:
+		return 3
+	case entryLen < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// listpackBuilder assembles a listpack blob element by element.
+type listpackBuilder struct {
+	body  []byte
+	count int
+}
+
+// appendString adds s, stored as an integer when it is the canonical form of
+// one, as Redis' lpAppend does.
+func (lp *listpackBuilder) appendString(s string) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && strconv.FormatInt(n, 10) == s {
+		lp.appendInt(n)
+		return
+	}
+
+	start := len(lp.body)
+	switch n := len(s); {
+	case n < 1<<6:
+		lp.body = append(lp.body, 0x80|byte(n))
+	case n < 1<<12:
+		lp.body = append(lp.body, 0xE0|byte(n>>8), byte(n))
+	default:
+		lp.body = append(lp.body, 0xF0)
+		lp.body = binary.LittleEndian.AppendUint32(lp.body, uint32(n))
+	}
+	lp.body = append(lp.body, s...)
+	lp.finishEntry(start)
+}
+
+func (lp *listpackBuilder) appendInt(n int64) {
+	start := len(lp.body)
+	switch {
+	case n >= 0 && n <= 127:
+		lp.body = append(lp.body, byte(n))
+	case n >= -4096 && n <= 4095:
+		v := uint16(n) & 0x1FFF
+		lp.body = append(lp.body, 0xC0|byte(v>>8), byte(v))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		lp.body = append(lp.body, 0xF1)
+		lp.body = binary.LittleEndian.AppendUint16(lp.body, uint16(n))
+	case n >= -1<<23 && n < 1<<23:
+		lp.body = append(lp.body, 0xF2, byte(n), byte(n>>8), byte(n>>16))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		lp.body = append(lp.body, 0xF3)
+		lp.body = binary.LittleEndian.AppendUint32(lp.body, uint32(n))
+	default:
+		lp.body = append(lp.body, 0xF4)
+		lp.body = binary.LittleEndian.AppendUint64(lp.body, uint64(n))
+	}
+	lp.finishEntry(start)
+}
+
+// finishEntry appends the back-length of the entry that begins at start.
+func (lp *listpackBuilder) finishEntry(start int) {
+	l := uint64(len(lp.body) - start)
+	size := listpackBacklenSize(int(l))
+	for i := size - 1; i >= 0; i-- {
+		b := byte(l>>(7*uint(i))) & 0x7F
+		if i < size-1 {
+			b |= 0x80
+		}
+		lp.body = append(lp.body, b)
+	}
+	lp.count++
+}
+
+// bytes returns the finished blob: the total size and element count header,
+// the entries and the terminator.
+func (lp *listpackBuilder) bytes() []byte {
+	out := make([]byte, 6, 6+len(lp.body)+1)
+	binary.LittleEndian.PutUint32(out, uint32(len(out)+len(lp.body)+1))
+	binary.LittleEndian.PutUint16(out[4:], uint16(min(lp.count, math.MaxUint16)))
+	out = append(out, lp.body...)
+	return append(out, 0xFF)
+}
+
+// parseIntset returns the members of an intset blob.
+func parseIntset(blob []byte) ([]int64, error) {
+	if len(blob) < 8 {
+		return nil, errors.New("intset too short")
+	}
+	width := int(binary.LittleEndian.Uint32(blob))
+	n := int(binary.LittleEndian.Uint32(blob[4:]))
+	if (width != 2 && width != 4 && width != 8) || len(blob) != 8+width*n {
+		return nil, errors.New("corrupt intset")
+	}
+	members := make([]int64, n)
+	for i := range members {
+		p := blob[8+i*width:]
+		switch width {
+		case 2:
+			members[i] = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			members[i] = int64(int32(binary.LittleEndian.Uint32(p)))
+		default:
+			members[i] = int64(binary.LittleEndian.Uint64(p))
+		}
+	}
+	return members, nil
+}
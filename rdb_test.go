@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// dumpValue renders a stored value in a form that can be compared after a
+// round trip, independently of pointers and internal layout.
+func dumpValue(val interface{}) string {
+	if str, ok := valueString(val); ok {
+		// Every string encoding is the same value to clients.
+		return fmt.Sprintf("string %q", str)
+	}
+	var b strings.Builder
+	switch v := val.(type) {
+	case *quicklist:
+		b.WriteString("list")
+		v.Each(false, func(_ int, elem string) bool {
+			fmt.Fprintf(&b, " %q", elem)
+			return true
+		})
+	case *hashValue:
+		fields := make([]string, 0, len(v.entries))
+		for field, entry := range v.entries {
+			fields = append(fields, fmt.Sprintf("%q=%q@%d", field, entry.value, entry.expireAt))
+		}
+		sort.Strings(fields)
+		fmt.Fprintf(&b, "hash ttl=%d %s", v.ttlFields, strings.Join(fields, " "))
+	case *setValue:
+		members := v.Members()
+		sort.Strings(members)
+		fmt.Fprintf(&b, "set intset=%t %q", v.isIntset(), members)
+	case *sortedset.SortedSet:
+		b.WriteString("zset")
+		for _, node := range v.GetByRankRange(1, -1, false) {
+			fmt.Fprintf(&b, " %q:%v", node.Key(), nodeScore(node))
+		}
+	case *stream:
+		fmt.Fprintf(&b, "stream last=%v len=%d", v.lastID, v.length)
+		for _, entry := range v.Range(streamID{}, streamID{ms: ^uint64(0), seq: ^uint64(0)}, 0, false) {
+			fmt.Fprintf(&b, " %v%q", entry.id, entry.fields)
+		}
+		for _, name := range v.GroupNames() {
+			g := v.Group(name)
+			fmt.Fprintf(&b, " group %s last=%v read=%d", name, g.lastID, g.entriesRead)
+			for _, nack := range g.pending.Range(streamID{}, streamID{ms: ^uint64(0), seq: ^uint64(0)}, 0) {
+				fmt.Fprintf(&b, " pel %v->%s@%d#%d", nack.id, nack.consumer.name, nack.deliveryTime, nack.deliveryCount)
+			}
+			for _, cname := range g.ConsumerNames() {
+				c := g.Consumer(cname)
+				fmt.Fprintf(&b, " consumer %s seen=%d pending=%d", c.name, c.seenTime, c.pending.Len())
+			}
+		}
+	default:
+		fmt.Fprintf(&b, "unknown %T", v)
+	}
+	return b.String()
+}
+
+func TestRDBRoundTrip(t *testing.T) {
+	now := time.Now()
+	nowMs := now.UnixMilli()
+
+	list := newQuicklist()
+	for _, elem := range []string{"a", "", "12345", strings.Repeat("x", 1000)} {
+		list.PushBack(elem)
+	}
+
+	hash := newHashValue()
+	hash.Set("f1", "v1")
+	hash.Set("n", "42")
+
+	hashTTL := newHashValue()
+	hashTTL.Set("keep", "forever")
+	hashTTL.Set("soon", "later")
+	hashTTL.setExpire(hashTTL.entries["soon"], nowMs+60_000)
+	hashTTL.Set("later", "much later")
+	hashTTL.setExpire(hashTTL.entries["later"], nowMs+3_600_000)
+
+	intset := newSetValue()
+	for _, m := range []string{"3", "-7", "100000"} {
+		intset.Add(m)
+	}
+	set := newSetValue()
+	for _, m := range []string{"a", "b", "7"} {
+		set.Add(m)
+	}
+
+	zset := sortedset.New()
+	zset.AddOrUpdate("one", zsetScore(1), nil)
+	zset.AddOrUpdate("half", zsetScore(0.5), nil)
+	zset.AddOrUpdate("neg", zsetScore(-2.25), nil)
+
+	st := newStream()
+	st.Append(streamID{ms: 1, seq: 0}, []string{"temp", "20"})
+	st.Append(streamID{ms: 1, seq: 1}, []string{"temp", "21", "hum", "50"})
+	st.Append(streamID{ms: 5, seq: 0}, []string{"temp", "22"})
+	group, _ := st.CreateGroup("g", streamID{ms: 1, seq: 1}, 2)
+	alice, _ := group.CreateConsumer("alice", nowMs)
+	group.CreateConsumer("bob", nowMs)
+	for _, id := range []streamID{{ms: 1, seq: 0}, {ms: 1, seq: 1}} {
+		nack := group.Assign(id, alice)
+		nack.deliveryTime = nowMs
+		nack.deliveryCount = 1
+	}
+
+	storage := map[string]storageVal{
+		"str":      newStorageVal(encodeString("hello"), time.Time{}),
+		"int":      newStorageVal(encodeString("-12345"), time.Time{}),
+		"binary":   newStorageVal("\x00\r\n\xff", time.Time{}),
+		"hll":      newStorageVal(newHLL(), time.Time{}),
+		"list":     newStorageVal(list, time.Time{}),
+		"hash":     newStorageVal(hash, time.Time{}),
+		"hashttl":  newStorageVal(hashTTL, time.Time{}),
+		"intset":   newStorageVal(intset, time.Time{}),
+		"set":      newStorageVal(set, time.Time{}),
+		"zset":     newStorageVal(zset, time.Time{}),
+		"stream":   newStorageVal(st, time.Time{}),
+		"volatile": newStorageVal("bye", now.Add(time.Hour)),
+	}
+	functions := []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"}
+
+	got, gotFunctions, err := decodeRDB(encodeRDB(storage, functions))
+	if err != nil {
+		t.Fatalf("decodeRDB: %v", err)
+	}
+	if !reflect.DeepEqual(gotFunctions, functions) {
+		t.Errorf("functions = %q, want %q", gotFunctions, functions)
+	}
+	if len(got) != len(storage) {
+		t.Errorf("decoded %d keys, want %d", len(got), len(storage))
+	}
+	for key, want := range storage {
+		val, ok := got[key]
+		if !ok {
+			t.Errorf("key %q missing", key)
+			continue
+		}
+		if g, w := dumpValue(val.val), dumpValue(want.val); g != w {
+			t.Errorf("key %q:\n got %s\nwant %s", key, g, w)
+		}
+		if g, w := val.expireAt().UnixMilli(), want.expireAt().UnixMilli(); want.px != -1 && (g < w-1 || g > w+1) {
+			t.Errorf("key %q expires at %d, want %d", key, g, w)
+		}
+		if want.px == -1 && val.px != -1 {
+			t.Errorf("key %q gained a TTL", key)
+		}
+	}
+}
+
+func TestRDBDropsExpiredHashFields(t *testing.T) {
+	nowMs := time.Now().UnixMilli()
+	hash := newHashValue()
+	hash.Set("live", "1")
+	hash.setExpire(hash.entries["live"], nowMs+60_000)
+	hash.Set("dead", "2")
+	hash.setExpire(hash.entries["dead"], nowMs+1)
+
+	snapshot := encodeRDB(map[string]storageVal{"h": newStorageVal(hash, time.Time{})}, nil)
+	time.Sleep(5 * time.Millisecond)
+	got, _, err := decodeRDB(snapshot)
+	if err != nil {
+		t.Fatalf("decodeRDB: %v", err)
+	}
+	h, ok := got["h"].val.(*hashValue)
+	if !ok {
+		t.Fatalf("key h decoded as %T", got["h"].val)
+	}
+	if _, ok := h.Get("dead"); ok {
+		t.Errorf("expired field survived the round trip")
+	}
+	if v, ok := h.Get("live"); !ok || v != "1" || h.entries["live"].expireAt != nowMs+60_000 || h.ttlFields != 1 {
+		t.Errorf("live field lost its value or TTL")
+	}
+}
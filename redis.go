@@ -1,12 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	lua "github.com/yuin/gopher-lua"
 )
 
 type storageVal struct {
@@ -22,15 +27,64 @@ type storageVal struct {
 // 	t   time.Time
 // }
 
-type Channel struct {
-	name        string
-	connections []*net.Conn
-	mu          sync.RWMutex
+// newStorageVal wraps val in a storageVal that expires at expireAt. A zero
+// expireAt means the key never expires.
+func newStorageVal(val interface{}, expireAt time.Time) storageVal {
+	now := time.Now()
+	if expireAt.IsZero() {
+		return storageVal{val: val, px: -1, t: now}
+	}
+	return storageVal{val: val, px: int(expireAt.Sub(now) / time.Millisecond), t: now}
+}
+
+// expireAt returns the absolute expiry time of the value, or the zero time
+// when it has no TTL.
+func (v storageVal) expireAt() time.Time {
+	if v.px == -1 {
+		return time.Time{}
+	}
+	return v.t.Add(time.Millisecond * time.Duration(v.px))
+}
+
+func (v storageVal) expired(now time.Time) bool {
+	return v.px != -1 && now.After(v.t.Add(time.Millisecond*time.Duration(v.px)))
 }
 
 type Config struct {
-	Directory  string
-	dbFileName string
+	Directory         string
+	dbFileName        string
+	pubsubOutputLimit outputBufferLimit
+	// notifyKeyspaceEvents holds the notify* classes to publish, as set by
+	// CONFIG SET notify-keyspace-events.
+	notifyKeyspaceEvents atomic.Int32
+	// busyReplyThreshold is how long, in milliseconds, a script may run
+	// before other clients are answered -BUSY.
+	busyReplyThreshold atomic.Int64
+	// requirepass is the password clients must AUTH with, and masterauth
+	// the one a replica sends to its master. Both hold strings; unset or
+	// empty means none.
+	requirepass atomic.Value
+	masterauth  atomic.Value
+	// masteruser is the ACL user a replica authenticates to its master as,
+	// "default" when unset.
+	masteruser atomic.Value
+	// aclFile is where ACL SAVE and ACL LOAD store the users, if anywhere.
+	aclFile string
+}
+
+func (c *Config) requirePass() string {
+	pass, _ := c.requirepass.Load().(string)
+	return pass
+}
+
+func (c *Config) masterAuth() string {
+	pass, _ := c.masterauth.Load().(string)
+	return pass
+}
+
+func (c *Config) masterUser() string {
+	user, _ := c.masteruser.Load().(string)
+	return user
 }
 
 // Global Redis server state
@@ -38,121 +92,277 @@ type RedisState struct {
 	storage        map[string]storageVal
 	config         Config
 	serverIsMaster bool
-	replicaConns   []net.Conn
-	channels       map[string]Channel
-	storageMu      sync.RWMutex
-	replicaMu      sync.RWMutex
-	channelsMu     sync.RWMutex
+	replicas       []*replicaLink
+	// channels, patterns and shardChannels map each channel name and glob
+	// pattern to its subscribers. They are guarded by channelsMu, along
+	// with the subscription sets of every pubsubClient.
+	channels      map[string]map[*pubsubClient]struct{}
+	patterns      map[string]map[*pubsubClient]struct{}
+	shardChannels map[string]map[*pubsubClient]struct{}
+	// clients holds every connected client for CLIENT LIST and INFO. It is
+	// guarded by clientsMu.
+	clients      map[*RedisServer]struct{}
+	nextClientID atomic.Int64
+	// keyVersions holds the modification version of every watched key,
+	// drawn from versionSeq, and watchers counts the connections watching
+	// each key. All three are guarded by storageMu.
+	keyVersions map[string]uint64
+	versionSeq  uint64
+	watchers    map[string]int
+	// blocked holds, per key, the clients parked in blocking commands in
+	// the order they blocked. readyKeys lists keys that received data since
+	// the waiters were last served. Both are guarded by storageMu.
+	blocked      map[string][]*blockedClient
+	readyKeys    []string
+	hasReadyKeys atomic.Bool
+	// bgsaveInProgress is set while a BGSAVE is writing its snapshot.
+	bgsaveInProgress atomic.Bool
+	// txPropagation tracks how far the running EXEC has got in wrapping its
+	// writes in MULTI/EXEC for replicas. It is guarded by txMu, which every
+	// command runs under for reading and EXEC holds for writing, so that a
+	// transaction runs without other clients interleaving.
+	txPropagation txPropagationState
+	// scripts caches compiled scripts by SHA1 digest. It is guarded by
+	// scriptMu, along with the interpreter and the running script.
+	scripts       map[string]*lua.FunctionProto
+	luaVM         *lua.LState
+	runningScript *scriptRun
+	// functions holds the libraries loaded with FUNCTION LOAD, which run in
+	// functionsVM. Both are guarded by scriptMu as well.
+	functions   *functionRegistry
+	functionsVM *lua.LState
+	// users holds the ACL users by name, and aclLog the entries of ACL LOG,
+	// most recent first. Both are guarded by aclMu.
+	users        map[string]*aclUser
+	aclLog       []*aclLogEntry
+	aclLogNextID int64
+	aclMu        sync.RWMutex
+	scriptMu     sync.Mutex
+	txMu         sync.RWMutex
+	storageMu    sync.RWMutex
+	replicaMu    sync.RWMutex
+	channelsMu   sync.RWMutex
+	clientsMu    sync.Mutex
+}
+
+// newRedisState returns the state of a server with an empty keyspace, the
+// default user and the default configuration.
+func newRedisState() *RedisState {
+	st := &RedisState{
+		storage:       make(map[string]storageVal),
+		channels:      make(map[string]map[*pubsubClient]struct{}),
+		patterns:      make(map[string]map[*pubsubClient]struct{}),
+		shardChannels: make(map[string]map[*pubsubClient]struct{}),
+		clients:       make(map[*RedisServer]struct{}),
+		blocked:       make(map[string][]*blockedClient),
+		keyVersions:   make(map[string]uint64),
+		watchers:      make(map[string]int),
+		scripts:       make(map[string]*lua.FunctionProto),
+		functions:     newFunctionRegistry(),
+		users:         map[string]*aclUser{"default": newDefaultUser()},
+	}
+	st.config.pubsubOutputLimit = defaultPubsubOutputLimit
+	st.config.busyReplyThreshold.Store(defaultBusyReplyThreshold)
+	return st
+}
+
+// lookupKey returns the live value stored at key, evicting it first when its
+// TTL has elapsed. The caller must hold storageMu for writing.
+func (st *RedisState) lookupKey(key string) (storageVal, bool) {
+	value, ok := st.storage[key]
+	if !ok {
+		return storageVal{}, false
+	}
+	if value.expired(time.Now()) {
+		st.expireKey(key)
+		return storageVal{}, false
+	}
+	return value, true
+}
+
+// readKey is the read-only counterpart of lookupKey: expired values are
+// reported as missing but left in place. The caller must hold storageMu.
+func (st *RedisState) readKey(key string) (storageVal, bool) {
+	value, ok := st.storage[key]
+	if !ok || value.expired(time.Now()) {
+		return storageVal{}, false
+	}
+	return value, true
+}
+
+// propagate forwards a write command to every connected replica.
+func (st *RedisState) propagate(args []string) {
+	if st.txPropagation == txPropagationPending {
+		st.txPropagation = txPropagationOpen
+		st.propagate([]string{RESP_COMMAND_MULTI})
+	}
+
+	payload := encodeBulkArray(args)
+	st.replicaMu.RLock()
+	for _, replica := range st.replicas {
+		replica.write(payload)
+	}
+	st.replicaMu.RUnlock()
 }
 
 type RedisServer struct {
-	state          *RedisState
-	conn           net.Conn
-	ReplOffset     int
-	MultiOn        bool
-	multiQueue     [][]string
+	state      *RedisState
+	conn       net.Conn
+	reader     *bufio.Reader
+	ReplOffset int
+	MultiOn    bool
+	inExec     bool
+	// inScript is set while the connection runs a script, whose calls run
+	// with inExec set too.
+	inScript   bool
+	multiQueue [][]string
+	// multiFailed is set when a command was rejected while queueing, so
+	// that EXEC discards the transaction.
+	multiFailed bool
+	// authenticated is set once the client has passed AUTH, or from the
+	// start when the default user needs no password.
+	authenticated  bool
 	SubscribedMode bool
+	// pubsub is set once the connection subscribes to anything. From then
+	// on its output goes through pubsub.out.
+	pubsub *pubsubClient
+	// client is what CLIENT LIST reports about the connection.
+	client *clientInfo
+	// watched holds the keys passed to WATCH, until EXEC, DISCARD or
+	// UNWATCH.
+	watched map[string]watchedKey
+}
+
+// write sends a reply to the client, through its output queue if it has one.
+func (s *RedisServer) write(resp string) {
+	if s.pubsub != nil {
+		s.pubsub.out.enqueue(resp)
+		return
+	}
+	s.conn.Write([]byte(resp))
 }
 
 func (s *RedisServer) handleConnection() {
 	defer s.conn.Close()
+	s.state.registerClient(s)
+	defer s.closeClient()
 
-	buffer := make([]byte, 1024)
+	if s.reader == nil {
+		s.reader = bufio.NewReader(s.conn)
+	}
+	s.authenticated = !s.state.defaultUserNeedsAuth()
 
 	for {
-		n, err := s.conn.Read(buffer)
+		tempArr, _, err := readRESPCommand(s.reader)
 
 		if err != nil {
-			if err == io.EOF {
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				s.write("-ERR " + protoErr.Error() + "\r\n")
+				fmt.Printf("Closing %s: %v\n", s.conn.RemoteAddr(), err)
+			} else if err == io.EOF {
 				fmt.Printf("Client %s disconnected.\n", s.conn.RemoteAddr())
 			} else {
 				fmt.Printf("Error reading from %s: %v\n", s.conn.RemoteAddr(), err)
 			}
 			return
 		}
-
-		tempArr, err := RESPToArray(string(buffer[:n]))
-		if err != nil {
-			s.conn.Write([]byte("-ERR invalid RESP format\r\n"))
-			continue
-		}
 		if len(tempArr) == 0 {
-			s.conn.Write([]byte("-ERR empty command\r\n"))
 			continue
 		}
 
 		cmd := strings.ToUpper(tempArr[0])
+		s.touchClient(tempArr)
+
+		// QUIT and RESET act on the connection itself, so they run at once
+		// even inside MULTI or in subscribed mode.
+		if cmd == RESP_COMMAND_QUIT {
+			s.write("+OK\r\n")
+			if s.pubsub != nil {
+				s.pubsub.out.flush()
+			}
+			return
+		}
+
+		// Until the client authenticates, only the commands that let it do
+		// so are served.
+		if !s.authenticated && !allowedBeforeAuth(cmd) {
+			s.write(RESP_ERR_NOAUTH + "\r\n")
+			continue
+		}
+
+		// The commands acting on the connection never reach
+		// executeCommand, so their permissions are checked here.
+		switch cmd {
+		case RESP_COMMAND_RESET, RESP_COMMAND_MULTI, RESP_COMMAND_DISCARD, RESP_COMMAND_EXEC:
+			if errMsg := s.checkPermissions(tempArr); errMsg != "" {
+				s.write(errMsg + "\r\n")
+				continue
+			}
+		}
+
+		if cmd == RESP_COMMAND_RESET {
+			s.resetClient()
+			s.write("+RESET\r\n")
+			continue
+		}
 
 		// Handle transaction commands
 		if cmd == RESP_COMMAND_MULTI {
-			s.MultiOn = true
-			s.conn.Write([]byte("+OK\r\n"))
+			if s.MultiOn {
+				s.write("-ERR MULTI calls can not be nested\r\n")
+			} else {
+				s.MultiOn = true
+				s.write("+OK\r\n")
+			}
 			continue
 		}
 
 		if cmd == RESP_COMMAND_DISCARD {
 			if !s.MultiOn {
-				s.conn.Write([]byte("-ERR DISCARD without MULTI\r\n"))
+				s.write("-ERR DISCARD without MULTI\r\n")
 			} else {
-				s.MultiOn = false
-				s.conn.Write([]byte("+OK\r\n"))
-				s.multiQueue = nil
+				s.discardTransaction()
+				s.unwatchAll()
+				s.write("+OK\r\n")
 			}
 			continue
 		}
 
 		if cmd == RESP_COMMAND_EXEC {
 			if !s.MultiOn {
-				s.conn.Write([]byte("-ERR EXEC without MULTI\r\n"))
+				s.write("-ERR EXEC without MULTI\r\n")
 			} else {
-				s.MultiOn = false
-
-				responses := make([]string, len(s.multiQueue))
-
-				for i, queuedCmd := range s.multiQueue {
-					cmdResponse := s.executeCommand(queuedCmd)
-					if cmdResponse.Error != "" {
-						responses[i] = cmdResponse.Error
-					} else {
-						responses[i] = cmdResponse.Response
-					}
-				}
-
-				response := fmt.Sprintf("*%d\r\n", len(responses))
-				for _, resp := range responses {
-					if !strings.HasSuffix(resp, "\r\n") {
-						resp += "\r\n"
-					}
-					response += resp
-				}
-
-				s.conn.Write([]byte(response))
-
-				s.multiQueue = nil
+				s.write(s.execTransaction())
 			}
 			continue
 		}
 
 		if s.MultiOn {
-			if cmd == "MULTI" {
-				s.conn.Write([]byte("-ERR MULTI calls can not be nested\r\n"))
-				continue
-			}
-			s.multiQueue = append(s.multiQueue, tempArr)
-			s.conn.Write([]byte("+QUEUED\r\n"))
+			s.write(s.queueCommand(tempArr))
 			continue
 		}
 
-		cmdResponse := s.executeCommand(tempArr)
+		var cmdResponse CommandResponse
+		if busy := s.state.lockTx(false); busy == nil {
+			cmdResponse = s.executeCommand(tempArr)
+			s.state.notifyKeyMisses(tempArr)
+			s.state.serveBlockedClients()
+			s.state.txMu.RUnlock()
+		} else if allowedWhenBusy(tempArr) {
+			cmdResponse = s.executeCommand(tempArr)
+		} else {
+			cmdResponse = CommandResponse{Error: busy.busyError()}
+		}
 
 		if cmdResponse.Error != "" {
-			s.conn.Write([]byte(cmdResponse.Error + "\r\n"))
+			s.write(cmdResponse.Error + "\r\n")
 		} else if cmdResponse.Response != "" {
 			if s.state.serverIsMaster || cmd != RESP_COMMAND_SET {
 				if !strings.HasSuffix(cmdResponse.Response, "\r\n") {
 					cmdResponse.Response += "\r\n"
 				}
-				s.conn.Write([]byte(cmdResponse.Response))
+				s.write(cmdResponse.Response)
 			}
 		}
 	}
@@ -1,82 +1,209 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 )
 
 func initHandShake(conn net.Conn, port string, sharedState *RedisState) {
+	// Every reply is read through the same buffered reader as the stream that
+	// follows, so bytes the master sends back to back are never lost.
+	reader := bufio.NewReader(conn)
+
 	// Send PING
 	conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
-	waitForSimpleResponse(conn) // Wait for +PONG
+	waitForSimpleResponse(reader) // Wait for +PONG, or -NOAUTH
+
+	// Authenticate to a protected master
+	if masterAuth := sharedState.config.masterAuth(); masterAuth != "" {
+		auth := []string{RESP_COMMAND_AUTH, masterAuth}
+		if masterUser := sharedState.config.masterUser(); masterUser != "" {
+			auth = []string{RESP_COMMAND_AUTH, masterUser, masterAuth}
+		}
+		conn.Write(encodeBulkArray(auth))
+		waitForSimpleResponse(reader)
+	}
 
 	// Send REPLCONF listening-port-
 	conn.Write([]byte(fmt.Sprintf("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$%d\r\n%s\r\n", len(port), port)))
-	waitForSimpleResponse(conn)
+	waitForSimpleResponse(reader)
 
 	// Send REPLCONF capa psync2
 	conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"))
-	waitForSimpleResponse(conn)
+	waitForSimpleResponse(reader)
 
 	// Send PSYNC
 	conn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"))
 
 	// Handle FULLRESYNC response only
-	waitForFullResyncResponse(conn)
+	waitForFullResyncResponse(reader)
 
 	// Create replica server to handle the master stream including RDB and commands
 	redisServer := RedisServer{
 		state:      sharedState,
 		conn:       conn,
+		reader:     reader,
 		ReplOffset: 0,
 	}
 	go redisServer.handleMasterStream()
 }
 
-func waitForSimpleResponse(conn net.Conn) {
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
+// replicaBacklogLimit bounds the writes buffered for a replica while its
+// snapshot is being sent, like Redis' client-output-buffer-limit for
+// replicas. A replica that falls further behind is disconnected.
+const replicaBacklogLimit = 256 * 1024 * 1024
+
+// replicaLink is a replica connected to this master. Until its snapshot has
+// been sent, propagated writes are kept in backlog and sent after it, as
+// Redis does with its replication backlog.
+type replicaLink struct {
+	conn    net.Conn
+	mu      sync.Mutex
+	syncing bool
+	backlog []byte
+	dropped bool
+}
+
+// write sends p to the replica, or buffers it while the snapshot is still
+// being sent.
+func (r *replicaLink) write(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.dropped {
+		return
+	}
+	if !r.syncing {
+		r.conn.Write(p)
+		return
+	}
+	if len(r.backlog)+len(p) > replicaBacklogLimit {
+		fmt.Println("Replica backlog limit reached, disconnecting replica")
+		r.dropped = true
+		r.backlog = nil
+		r.conn.Close()
+		return
+	}
+	r.backlog = append(r.backlog, p...)
+}
+
+// sendSnapshot writes the full resynchronisation reply and snapshot, then
+// drains the writes buffered meanwhile. The link only leaves the syncing
+// state once the backlog is empty, so the stream stays in order.
+func (r *replicaLink) sendSnapshot(snapshot []byte) {
+	r.conn.Write([]byte("+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n"))
+	r.conn.Write([]byte(fmt.Sprintf("$%d\r\n", len(snapshot))))
+	r.conn.Write(snapshot)
+
+	for {
+		r.mu.Lock()
+		pending := r.backlog
+		r.backlog = nil
+		if len(pending) == 0 || r.dropped {
+			r.syncing = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+		r.conn.Write(pending)
+	}
+}
+
+// syncReplica performs a full resynchronisation with a replica. The snapshot
+// is taken and the replica registered under the storage read lock, so no
+// write can slip in between the snapshot and the first propagated command;
+// the snapshot itself is sent in the background once the lock is released,
+// with writes propagated in the meantime buffered on the link.
+func (st *RedisState) syncReplica(conn net.Conn) {
+	link := &replicaLink{conn: conn, syncing: true}
+
+	st.storageMu.RLock()
+	snapshot := encodeRDB(st.storage, st.functionCodes())
+	st.replicaMu.Lock()
+	st.replicas = append(st.replicas, link)
+	st.replicaMu.Unlock()
+	st.storageMu.RUnlock()
+
+	go link.sendSnapshot(snapshot)
+}
+
+func waitForSimpleResponse(reader *bufio.Reader) {
+	line, err := readRESPLine(reader)
 	if err != nil {
 		fmt.Println("Error reading from master:", err)
 		return
 	}
-	response := string(buf[:n])
-	lines := strings.Split(response, "\r\n")
-	if len(lines) > 0 && (strings.HasPrefix(lines[0], "+") || strings.HasPrefix(lines[0], "-")) {
-		fmt.Println("Received from master:", lines[0])
+	if strings.HasPrefix(line, "+") || strings.HasPrefix(line, "-") {
+		fmt.Println("Received from master:", line)
 	}
 }
 
-func waitForFullResyncResponse(conn net.Conn) {
-	buf := make([]byte, 256)
-	n, err := conn.Read(buf)
+func waitForFullResyncResponse(reader *bufio.Reader) {
+	line, err := readRESPLine(reader)
 	if err != nil {
 		fmt.Println("Error reading FULLRESYNC response:", err)
 		return
 	}
-	response := string(buf[:n])
-	lines := strings.Split(response, "\r\n")
-	if len(lines) > 0 && strings.HasPrefix(lines[0], "+FULLRESYNC") {
-		fmt.Println("Received from master:", lines[0])
+	if strings.HasPrefix(line, "+FULLRESYNC") {
+		fmt.Println("Received from master:", line)
 	}
 }
 
+// readRDBPayload reads the snapshot the master sends after FULLRESYNC. It is
+// framed like a bulk string but without the trailing CRLF.
+func readRDBPayload(reader *bufio.Reader) ([]byte, error) {
+	header, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(header, "$") {
+		return nil, fmt.Errorf("expected RDB payload, got %q", header)
+	}
+	length, err := strconv.Atoi(header[1:])
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid RDB length %q", header[1:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
 func (s *RedisServer) handleMasterStream() {
 	defer s.conn.Close()
 	fmt.Println("Starting to listen for replication commands...")
 
-	buffer := make([]byte, 4096)
-	accumulated := ""
-	rdbConsumed := false
-	rdbLength := -1
-	rdbBytesConsumed := 0
+	rdb, err := readRDBPayload(s.reader)
+	if err != nil {
+		fmt.Printf("Error reading RDB from master: %v\n", err)
+		return
+	}
+	storage, functions, err := decodeRDB(rdb)
+	if err != nil {
+		fmt.Printf("Error loading RDB from master: %v\n", err)
+		return
+	}
+	s.state.txMu.Lock()
+	s.state.scriptMu.Lock()
+	err = s.state.restoreFunctions(functions, "FLUSH")
+	s.state.scriptMu.Unlock()
+	s.state.storageMu.Lock()
+	s.state.replaceStorage(storage)
+	s.state.storageMu.Unlock()
+	s.state.txMu.Unlock()
+	if err != nil {
+		fmt.Printf("Error loading function libraries from master: %v\n", err)
+		return
+	}
+	fmt.Printf("RDB data received and loaded (%d bytes, %d keys)\n", len(rdb), len(storage))
 
 	for {
-		n, err := s.conn.Read(buffer)
+		cmd, n, err := readRESPCommand(s.reader)
 		if err != nil {
 			if err == io.EOF {
 				fmt.Printf("Master connection closed\n")
@@ -86,117 +213,10 @@ func (s *RedisServer) handleMasterStream() {
 			return
 		}
 
-		accumulated += string(buffer[:n])
-
-		// First consume RDB data if not done yet
-		if !rdbConsumed {
-			// Parse RDB header $<length>\r\n
-			if rdbLength == -1 && strings.HasPrefix(accumulated, "$") {
-				endPos := strings.Index(accumulated, "\r\n")
-				if endPos != -1 {
-					lengthStr := accumulated[1:endPos]
-					var err error
-					rdbLength, err = strconv.Atoi(lengthStr)
-					if err == nil {
-						// Remove RDB header
-						accumulated = accumulated[endPos+2:]
-						rdbBytesConsumed = 0
-					}
-				}
-			}
-
-			// Consume RDB data bytes
-			if rdbLength > 0 {
-				bytesNeeded := rdbLength - rdbBytesConsumed
-				if len(accumulated) >= bytesNeeded {
-					// Have all RDB data, consume it
-					accumulated = accumulated[bytesNeeded:]
-					rdbBytesConsumed = rdbLength
-					rdbConsumed = true
-					fmt.Printf("RDB data received and consumed (%d bytes)\n", rdbLength)
-				} else {
-					// Consume all available and continue
-					rdbBytesConsumed += len(accumulated)
-					accumulated = ""
-					continue
-				}
-			}
-		}
-
-		// Process RESP commands after RDB is consumed
-		if rdbConsumed {
-			for len(accumulated) > 0 {
-				// Parse RESP array
-				if !strings.HasPrefix(accumulated, "*") {
-					// Find next RESP command
-					starPos := strings.Index(accumulated[1:], "*")
-					if starPos == -1 {
-						accumulated = ""
-						break
-					}
-					accumulated = accumulated[starPos+1:]
-					continue
-				}
-
-				// Get array length
-				crlfPos := strings.Index(accumulated, "\r\n")
-				if crlfPos == -1 {
-					break // Need more data
-				}
-
-				arrayLenStr := accumulated[1:crlfPos]
-				arrayLen, err := strconv.Atoi(arrayLenStr)
-				if err != nil {
-					accumulated = accumulated[crlfPos+2:]
-					continue
-				}
-
-				// Parse array elements
-				pos := crlfPos + 2
-				elements := make([]string, 0, arrayLen)
-
-				for i := 0; i < arrayLen; i++ {
-					if pos >= len(accumulated) || accumulated[pos] != '$' {
-						goto needMoreData
-					}
-
-					// Get bulk string length
-					bulkCrlfPos := strings.Index(accumulated[pos:], "\r\n")
-					if bulkCrlfPos == -1 {
-						goto needMoreData
-					}
-					bulkCrlfPos += pos
-
-					bulkLenStr := accumulated[pos+1 : bulkCrlfPos]
-					bulkLen, err := strconv.Atoi(bulkLenStr)
-					if err != nil {
-						goto skipCommand
-					}
-
-					pos = bulkCrlfPos + 2
-
-					// Get bulk string data
-					if pos+bulkLen+2 > len(accumulated) {
-						goto needMoreData
-					}
-
-					element := accumulated[pos : pos+bulkLen]
-					elements = append(elements, element)
-					pos += bulkLen + 2
-				}
-
-				// Process complete command
-				s.processReplicationCommand(elements)
-				accumulated = accumulated[pos:]
-				continue
-
-			needMoreData:
-				break
-			skipCommand:
-				accumulated = accumulated[pos:]
-				break
-			}
-		}
+		// The offset acknowledged to the master covers every byte processed
+		// before the current command, so count it only once it has run.
+		s.processReplicationCommand(cmd)
+		s.ReplOffset += n
 	}
 }
 
@@ -211,52 +231,69 @@ func (s *RedisServer) processReplicationCommand(cmd []string) {
 	switch command {
 	case "REPLCONF":
 		if len(cmd) >= 3 && strings.ToUpper(cmd[1]) == "GETACK" && cmd[2] == "*" {
-			// Send REPLCONF ACK 0
-			// fmt.Println(s.ReplOffset)
-			ack := "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$1\r\n0\r\n"
+			ack := toRespArr("REPLCONF", "ACK", strconv.Itoa(s.ReplOffset))
 			_, err := s.conn.Write([]byte(ack))
 
-			// fmt.Println(toRespArr("REPLCONF", "ACK", strconv.Itoa(s.ReplOffset)))
-			// _, err := s.conn.Write([]byte(toRespArr("REPLCONF", "ACK", strconv.Itoa(s.ReplOffset))))
-
-			// ack := strconv.FormatInt(int64(s.ReplOffset), 10)
-			// _, err := fmt.Fprintf(s.conn, "*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(ack), ack)
-
 			if err != nil {
 				fmt.Println("Error sending REPLCONF ACK:", err)
 			} else {
 				fmt.Println("Sent REPLCONF ACK " + strconv.Itoa(s.ReplOffset))
 			}
 		}
-	case "SET":
-		if len(cmd) < 3 {
-			return
+	case "PING":
+		fmt.Println("Received PING from master")
+
+	case RESP_COMMAND_MULTI:
+		s.MultiOn = true
+
+	case RESP_COMMAND_EXEC:
+		// The master's transaction is applied as a whole, so clients of
+		// the replica never see it half done either.
+		queue := s.multiQueue
+		s.discardTransaction()
+
+		s.state.txMu.Lock()
+		defer s.state.txMu.Unlock()
+		s.state.beginTxPropagation()
+		for _, queued := range queue {
+			s.applyReplicatedWrite(queued)
 		}
+		s.state.endTxPropagation()
+		s.state.serveBlockedClients()
 
-		var val storageVal
-		if len(cmd) > 4 && strings.ToUpper(cmd[3]) == "PX" {
-			px, err := strconv.Atoi(cmd[4])
-			if err != nil {
-				px = -1
-			}
-			val = storageVal{val: cmd[2], px: px, t: time.Now()}
-		} else {
-			val = storageVal{val: cmd[2], px: -1, t: time.Now()}
+	default:
+		if s.MultiOn {
+			s.multiQueue = append(s.multiQueue, cmd)
+			return
 		}
 
-		s.state.storage[cmd[1]] = val
-		fmt.Printf("Replica SET: %s = %s\n", cmd[1], cmd[2])
+		s.state.txMu.RLock()
+		defer s.state.txMu.RUnlock()
+		s.applyReplicatedWrite(cmd)
+		s.state.serveBlockedClients()
+	}
+}
 
-	case "DEL":
+// applyReplicatedWrite applies a write received from the master. The caller
+// must hold txMu.
+func (s *RedisServer) applyReplicatedWrite(cmd []string) {
+	command := strings.ToUpper(cmd[0])
+	if command == "DEL" {
 		if len(cmd) >= 2 {
-			delete(s.state.storage, cmd[1])
-			fmt.Printf("Replica DEL: %s\n", cmd[1])
+			s.state.storageMu.Lock()
+			for _, key := range cmd[1:] {
+				s.state.deleteKey(key)
+			}
+			s.state.storageMu.Unlock()
+			s.state.propagate(cmd)
+			fmt.Printf("Replica DEL: %v\n", cmd[1:])
 		}
+		return
+	}
 
-	case "PING":
-		fmt.Println("Received PING from master")
-
-	default:
-		fmt.Printf("Unhandled replication command: %s\n", command)
+	// Writes are applied through the regular command path; the reply is
+	// discarded since the master does not read it.
+	if resp := s.executeCommand(cmd); resp.Error != "" {
+		fmt.Printf("Replication command %s failed: %s\n", command, resp.Error)
 	}
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scanOptions holds the arguments shared by the SCAN family.
+type scanOptions struct {
+	cursor   uint64
+	match    string
+	count    int
+	noValues bool
+}
+
+// parseScanArgs parses "cursor [MATCH pattern] [COUNT count]", plus NOVALUES
+// when allowNoValues is set (HSCAN only).
+func parseScanArgs(args []string, allowNoValues bool) (scanOptions, string) {
+	opts := scanOptions{count: 10}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return opts, "-ERR invalid cursor"
+	}
+	opts.cursor = cursor
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			if i+1 >= len(args) {
+				return opts, RESP_ERR_SYNTAX
+			}
+			i++
+			opts.match = args[i]
+		case "COUNT":
+			if i+1 >= len(args) {
+				return opts, RESP_ERR_SYNTAX
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return opts, RESP_ERR_NOT_INTEGER
+			}
+			if n < 1 {
+				return opts, RESP_ERR_SYNTAX
+			}
+			opts.count = n
+		case "NOVALUES":
+			if !allowNoValues {
+				return opts, RESP_ERR_SYNTAX
+			}
+			opts.noValues = true
+		default:
+			return opts, RESP_ERR_SYNTAX
+		}
+	}
+	return opts, ""
+}
+
+// scanHash orders elements for cursor based iteration. It keeps the top two
+// bits clear so that "last hash + 1" can never wrap around to the terminal
+// cursor 0.
+func scanHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return h.Sum64() >> 2
+}
+
+// scanStrings runs one SCAN step over items. Elements are visited in the
+// order of their hash and the cursor is the hash to resume from, so every
+// element present for the whole iteration is returned at least once no
+// matter how the collection changes in between calls.
+func scanStrings(items []string, opts scanOptions) (uint64, []string) {
+	type hashed struct {
+		hash uint64
+		item string
+	}
+	pending := make([]hashed, 0, len(items))
+	for _, item := range items {
+		if h := scanHash(item); h >= opts.cursor {
+			pending = append(pending, hashed{h, item})
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].hash < pending[j].hash })
+
+	end := opts.count
+	if end > len(pending) {
+		end = len(pending)
+	}
+	// Never split elements sharing a hash across two calls.
+	for end > 0 && end < len(pending) && pending[end].hash == pending[end-1].hash {
+		end++
+	}
+
+	next := uint64(0)
+	if end < len(pending) {
+		next = pending[end-1].hash + 1
+	}
+
+	out := make([]string, 0, end)
+	for _, p := range pending[:end] {
+		if opts.match == "" || globMatch(opts.match, p.item) {
+			out = append(out, p.item)
+		}
+	}
+	return next, out
+}
+
+func scanReply(cursor uint64, items []string) string {
+	return "*2\r\n" + toRespStr(strconv.FormatUint(cursor, 10)) + toRespStrArr(items)
+}
+
+// globMatch reports whether str matches the glob-style pattern, following
+// the rules of Redis' stringmatchlen: '*', '?', '[...]' classes with ranges
+// and '^' negation, and '\' escapes.
+func globMatch(pattern, str string) bool {
+	p, s := 0, 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := s; i <= len(str); i++ {
+				if globMatch(pattern[p+1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s >= len(str) {
+				return false
+			}
+			s++
+		case '[':
+			if s >= len(str) {
+				return false
+			}
+			p++
+			not := p < len(pattern) && pattern[p] == '^'
+			if not {
+				p++
+			}
+			matched := false
+			for {
+				if p >= len(pattern) {
+					p--
+					break
+				}
+				if pattern[p] == '\\' && p+2 < len(pattern) {
+					p++
+					if pattern[p] == str[s] {
+						matched = true
+					}
+				} else if pattern[p] == ']' {
+					break
+				} else if p+2 < len(pattern) && pattern[p+1] == '-' {
+					lo, hi := pattern[p], pattern[p+2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if str[s] >= lo && str[s] <= hi {
+						matched = true
+					}
+					p += 2
+				} else if pattern[p] == str[s] {
+					matched = true
+				}
+				p++
+			}
+			if not {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s++
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			fallthrough
+		default:
+			if s >= len(str) || pattern[p] != str[s] {
+				return false
+			}
+			s++
+		}
+		p++
+	}
+	return s == len(str)
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+const defaultBusyReplyThreshold = 5000 // milliseconds
+
+// scriptRun is the script currently executing.
+type scriptRun struct {
+	server *RedisServer
+	call   *scriptCall
+	start  time.Time
+	// wrote is set once the script ran a write command, from which point
+	// SCRIPT KILL refuses to stop it.
+	wrote  atomic.Bool
+	killed atomic.Bool
+	cancel context.CancelFunc
+	// busy is closed once the script outlives busy-reply-threshold, and
+	// done once it returns.
+	busy chan struct{}
+	done chan struct{}
+}
+
+// scriptRunKey keys the running script in the context of its interpreter,
+// where redis.call finds it.
+type scriptRunKey struct{}
+
+// luaState returns the interpreter scripts run in, creating it on first use.
+// The caller must hold scriptMu.
+func (st *RedisState) luaState() *lua.LState {
+	if st.luaVM == nil {
+		st.luaVM = newLuaVM(nil)
+	}
+	return st.luaVM
+}
+
+// newLuaVM creates an interpreter with the libraries scripts may use and the
+// redis table, extended with extra. Like Redis 7, the globals, the libraries
+// and the redis table are read-only once it is set up, so no script can
+// change what later scripts see.
+func newLuaVM(extra map[string]lua.LGFunction) *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts must not reach the file system, nor swap or edit the
+	// environment of running code.
+	for _, name := range []string{"dofile", "loadfile", "module", "require", "_printregs", "getfenv", "setfenv"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("rawset", L.NewFunction(luaRawSet))
+
+	redis := L.NewTable()
+	L.SetFuncs(redis, map[string]lua.LGFunction{
+		"call":         func(L *lua.LState) int { return luaRedisCall(L, true) },
+		"pcall":        func(L *lua.LState) int { return luaRedisCall(L, false) },
+		"status_reply": luaStatusReply,
+		"error_reply":  luaErrorReply,
+		"sha1hex":      luaSha1Hex,
+		"log":          luaLog,
+	})
+	L.SetFuncs(redis, extra)
+	for i, level := range []string{"LOG_DEBUG", "LOG_VERBOSE", "LOG_NOTICE", "LOG_WARNING"} {
+		redis.RawSetString(level, lua.LNumber(i))
+	}
+	L.SetGlobal("redis", redis)
+
+	protectGlobals(L)
+	return L
+}
+
+// luaReadOnlyError is raised by writes to a read-only table.
+const luaReadOnlyError = "Attempt to modify a readonly table"
+
+// readOnlyMetatable returns the metatable of a read-only proxy for t: reads
+// go to t, writes fail, and the metatable itself can be neither read nor
+// replaced. The __readonly marker lets rawset refuse the proxy too.
+func readOnlyMetatable(L *lua.LState, t *lua.LTable) *lua.LTable {
+	mt := L.NewTable()
+	mt.RawSetString("__index", t)
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		L.RaiseError("%s: %s", luaReadOnlyError, L.CheckAny(2).String())
+		return 0
+	}))
+	mt.RawSetString("__metatable", lua.LFalse)
+	mt.RawSetString("__readonly", lua.LTrue)
+	return mt
+}
+
+// protectGlobals makes the global table and every table in it read-only.
+// Each table global is replaced by an empty proxy reading through to it,
+// and the entries of the global table itself move to a backing table the
+// global table reads through to. Code compiled by loadstring, whose
+// environment is the global table, is held to the same rules.
+func protectGlobals(L *lua.LState) {
+	globals := L.G.Global
+
+	// Strings index the string library through their metatable, which
+	// scripts can get hold of with getmetatable(""); give them a protected
+	// one, and drop the library's reference to itself.
+	if lib, ok := globals.RawGetString(lua.StringLibName).(*lua.LTable); ok {
+		lib.RawSetString("__index", lua.LNil)
+		L.SetMetatable(lua.LString(""), readOnlyMetatable(L, lib))
+	}
+
+	backing := L.NewTable()
+	var names []lua.LValue
+	globals.ForEach(func(name, value lua.LValue) {
+		if t, ok := value.(*lua.LTable); ok && t != globals {
+			proxy := L.NewTable()
+			L.SetMetatable(proxy, readOnlyMetatable(L, t))
+			value = proxy
+		}
+		backing.RawSet(name, value)
+		names = append(names, name)
+	})
+	for _, name := range names {
+		globals.RawSet(name, lua.LNil)
+	}
+	L.SetMetatable(globals, readOnlyMetatable(L, backing))
+}
+
+// luaRawSet is rawset, refusing read-only tables.
+func luaRawSet(L *lua.LState) int {
+	t := L.CheckTable(1)
+	if mt, ok := t.Metatable.(*lua.LTable); ok && mt.RawGetString("__readonly") == lua.LTrue {
+		L.RaiseError(luaReadOnlyError)
+	}
+	L.RawSet(t, L.CheckAny(2), L.CheckAny(3))
+	L.SetTop(1)
+	return 1
+}
+
+// scriptEnv returns a fresh global environment for one script run. Reads
+// fall through to the interpreter's globals, but scripts may neither create
+// globals, change existing ones nor read ones that do not exist, so nothing
+// leaks between runs.
+func scriptEnv(L *lua.LState) *lua.LTable {
+	globals := L.G.Global.Metatable.(*lua.LTable).RawGetString("__index").(*lua.LTable)
+	env := L.NewTable()
+	mt := L.NewTable()
+	mt.RawSetString("__index", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		value := globals.RawGetString(name)
+		if value == lua.LNil {
+			L.RaiseError("Script attempted to access nonexistent global variable '%s'", name)
+		}
+		L.Push(value)
+		return 1
+	}))
+	mt.RawSetString("__newindex", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckAny(2)
+		if globals.RawGet(name) != lua.LNil {
+			L.RaiseError("%s: %s", luaReadOnlyError, name.String())
+		}
+		L.RaiseError("Script attempted to create global variable '%s'", name.String())
+		return 0
+	}))
+	L.SetMetatable(env, mt)
+	return env
+}
+
+// compileScript compiles body into a function prototype.
+func compileScript(body, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(strings.NewReader(body), name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(chunk, name)
+}
+
+func scriptSha(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadScript compiles body and adds it to the script cache, returning its
+// SHA1 digest.
+func (st *RedisState) loadScript(body string) (string, CommandResponse) {
+	sha := scriptSha(body)
+
+	st.scriptMu.Lock()
+	defer st.scriptMu.Unlock()
+	if _, ok := st.scripts[sha]; ok {
+		return sha, CommandResponse{}
+	}
+	proto, err := compileScript(body, "user_script")
+	if err != nil {
+		return "", CommandResponse{Error: "-ERR Error compiling script (new function): " + firstLine(err.Error())}
+	}
+	st.scripts[sha] = proto
+	return sha, CommandResponse{}
+}
+
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i]
+	}
+	return s
+}
+
+func (s *RedisServer) evalCommand(args []string, readOnly bool) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	sha, errResp := s.state.loadScript(args[1])
+	if errResp.Error != "" {
+		return errResp
+	}
+	return s.evalScript(sha, args[2:], readOnly)
+}
+
+func (s *RedisServer) evalShaCommand(args []string, readOnly bool) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	return s.evalScript(strings.ToLower(args[1]), args[2:], readOnly)
+}
+
+// splitScriptKeys splits the arguments of EVAL and FCALL following the
+// script or function name, which start with numkeys, into keys and args.
+func splitScriptKeys(args []string) (keys, argv []string, errResp CommandResponse) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, nil, CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+	if numKeys < 0 {
+		return nil, nil, CommandResponse{Error: "-ERR Number of keys can't be negative"}
+	}
+	if numKeys > len(args)-1 {
+		return nil, nil, CommandResponse{Error: "-ERR Number of keys can't be greater than number of args"}
+	}
+	return args[1 : 1+numKeys], args[1+numKeys:], CommandResponse{}
+}
+
+// evalScript runs a cached script; args starts with numkeys.
+func (s *RedisServer) evalScript(sha string, args []string, readOnly bool) CommandResponse {
+	keys, argv, errResp := splitScriptKeys(args)
+	if errResp.Error != "" {
+		return errResp
+	}
+
+	return s.runScript(func(st *RedisState) (*scriptCall, CommandResponse) {
+		proto, ok := st.scripts[sha]
+		if !ok {
+			return nil, CommandResponse{Error: "-NOSCRIPT No matching script. Please use EVAL."}
+		}
+		L := st.luaState()
+		fn := L.NewFunctionFromProto(proto)
+		fn.Env = scriptEnv(L)
+		fn.Env.RawSetString("KEYS", luaStringArray(L, keys))
+		fn.Env.RawSetString("ARGV", luaStringArray(L, argv))
+		return &scriptCall{L: L, fn: fn, name: sha, command: args, readOnly: readOnly}, CommandResponse{}
+	})
+}
+
+// scriptCall is a script or function for runScript to call.
+type scriptCall struct {
+	L    *lua.LState
+	fn   *lua.LFunction
+	args []lua.LValue
+	// name is the SHA1 digest of a script, or the name of a function.
+	name string
+	// command is the EVAL or FCALL command that runs it.
+	command    []string
+	isFunction bool
+	readOnly   bool
+}
+
+// runScript runs the script prepare returns; prepare is called once the
+// script may run, with scriptMu held. Scripts run atomically: txMu is held
+// for writing throughout, and their writes reach replicas wrapped in
+// MULTI/EXEC, as the effects they had rather than the script itself.
+func (s *RedisServer) runScript(prepare func(st *RedisState) (*scriptCall, CommandResponse)) CommandResponse {
+	st := s.state
+	if !s.inExec {
+		// The command runs under txMu for reading; trade it for the write
+		// lock, and begin propagating a transaction, as EXEC would.
+		st.txMu.RUnlock()
+		st.txMu.Lock()
+		st.beginTxPropagation()
+		defer func() {
+			st.endTxPropagation()
+			st.txMu.Unlock()
+			st.txMu.RLock()
+		}()
+	}
+
+	st.scriptMu.Lock()
+	call, errResp := prepare(st)
+	if errResp.Error != "" {
+		st.scriptMu.Unlock()
+		return errResp
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := &scriptRun{
+		server: s,
+		call:   call,
+		start:  time.Now(),
+		cancel: cancel,
+		busy:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	st.runningScript = run
+	st.scriptMu.Unlock()
+
+	busyTimer := time.AfterFunc(time.Duration(st.config.busyReplyThreshold.Load())*time.Millisecond, func() {
+		close(run.busy)
+	})
+	defer busyTimer.Stop()
+	defer func() {
+		st.scriptMu.Lock()
+		st.runningScript = nil
+		st.scriptMu.Unlock()
+		close(run.done)
+	}()
+
+	inExec, inScript := s.inExec, s.inScript
+	s.inExec, s.inScript = true, true
+	defer func() { s.inExec, s.inScript = inExec, inScript }()
+
+	L := call.L
+	L.SetContext(context.WithValue(ctx, scriptRunKey{}, run))
+	defer L.RemoveContext()
+
+	L.Push(call.fn)
+	for _, arg := range call.args {
+		L.Push(arg)
+	}
+	if err := L.PCall(len(call.args), 1, nil); err != nil {
+		if run.killed.Load() {
+			if call.isFunction {
+				return CommandResponse{Error: "-ERR Script killed by user with FUNCTION KILL..."}
+			}
+			return CommandResponse{Error: "-ERR Script killed by user with SCRIPT KILL..."}
+		}
+		if apiErr, ok := err.(*lua.ApiError); ok {
+			if tbl, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := tbl.RawGetString("err").(lua.LString); ok {
+					return CommandResponse{Error: "-" + string(msg)}
+				}
+			}
+			return CommandResponse{Error: "-ERR " + apiErr.Object.String() + " script: " + call.name}
+		}
+		return CommandResponse{Error: "-ERR " + err.Error() + " script: " + call.name}
+	}
+	result := L.Get(-1)
+	L.Pop(1)
+
+	resp := luaToResp(result)
+	if strings.HasPrefix(resp, "-") {
+		return CommandResponse{Error: strings.TrimSuffix(resp, "\r\n")}
+	}
+	return CommandResponse{Response: resp}
+}
+
+func luaStringArray(L *lua.LState, strs []string) *lua.LTable {
+	tbl := L.CreateTable(len(strs), 0)
+	for i, str := range strs {
+		tbl.RawSetInt(i+1, lua.LString(str))
+	}
+	return tbl
+}
+
+// luaRedisCall implements redis.call and redis.pcall: the arguments are run
+// as a command on behalf of the script's client. A failing command raises a
+// Lua error from redis.call, while redis.pcall returns it as an error table.
+func luaRedisCall(L *lua.LState, raise bool) int {
+	var run *scriptRun
+	if ctx := L.Context(); ctx != nil {
+		run, _ = ctx.Value(scriptRunKey{}).(*scriptRun)
+	}
+	if run == nil {
+		L.RaiseError("redis.call and redis.pcall can only be called inside a script invocation")
+		return 0
+	}
+
+	resp := run.runCommand(L)
+	if resp.Error != "" {
+		errTable := L.NewTable()
+		errTable.RawSetString("err", lua.LString(strings.TrimPrefix(resp.Error, "-")))
+		if raise {
+			L.Error(errTable, 1)
+			return 0
+		}
+		L.Push(errTable)
+		return 1
+	}
+	L.Push(respToLua(L, resp.Response))
+	return 1
+}
+
+// runCommand runs the command passed to redis.call or redis.pcall.
+func (run *scriptRun) runCommand(L *lua.LState) CommandResponse {
+	n := L.GetTop()
+	if n == 0 {
+		return CommandResponse{Error: "-ERR Please specify at least one argument for this redis lib call"}
+	}
+	args := make([]string, n)
+	for i := 1; i <= n; i++ {
+		switch arg := L.Get(i).(type) {
+		case lua.LString:
+			args[i-1] = string(arg)
+		case lua.LNumber:
+			args[i-1] = arg.String()
+		default:
+			return CommandResponse{Error: "-ERR Lua redis lib command arguments must be strings or integers"}
+		}
+	}
+
+	spec, ok := commandTable[strings.ToUpper(args[0])]
+	switch {
+	case !ok:
+		return CommandResponse{Error: "-ERR Unknown Redis command called from script"}
+	case checkCommand(args) != "":
+		return CommandResponse{Error: "-ERR Wrong number of args calling Redis command from script"}
+	case spec.flags&cmdNoScript != 0:
+		return CommandResponse{Error: "-ERR This Redis command is not allowed from script"}
+	case spec.flags&cmdWrite != 0 && run.call.readOnly:
+		return CommandResponse{Error: "-ERR Write commands are not allowed from read-only scripts."}
+	}
+	if spec.flags&cmdWrite != 0 {
+		run.wrote.Store(true)
+	}
+
+	s := run.server
+	resp := s.executeCommand(args)
+	s.state.notifyKeyMisses(args)
+	return resp
+}
+
+func luaStatusReply(L *lua.LState) int {
+	tbl := L.NewTable()
+	tbl.RawSetString("ok", lua.LString(L.CheckString(1)))
+	L.Push(tbl)
+	return 1
+}
+
+func luaErrorReply(L *lua.LState) int {
+	tbl := L.NewTable()
+	tbl.RawSetString("err", lua.LString(L.CheckString(1)))
+	L.Push(tbl)
+	return 1
+}
+
+func luaSha1Hex(L *lua.LState) int {
+	L.Push(lua.LString(scriptSha(L.CheckString(1))))
+	return 1
+}
+
+func luaLog(L *lua.LState) int {
+	level := L.CheckInt(1)
+	parts := make([]string, 0, L.GetTop()-1)
+	for i := 2; i <= L.GetTop(); i++ {
+		parts = append(parts, L.ToStringMeta(L.Get(i)).String())
+	}
+	fmt.Printf("Script log (level %d): %s\n", level, strings.Join(parts, " "))
+	return 0
+}
+
+// respToLua converts a command reply to the value redis.call returns, the
+// way Redis does: integers become numbers, bulk strings strings, arrays
+// tables, nil replies false, and status and error replies tables with an
+// ok or err field.
+func respToLua(L *lua.LState, resp string) lua.LValue {
+	value, _ := parseRespToLua(L, resp)
+	return value
+}
+
+// parseRespToLua converts the first reply in resp, returning what follows.
+func parseRespToLua(L *lua.LState, resp string) (lua.LValue, string) {
+	end := strings.Index(resp, "\r\n")
+	if end < 1 {
+		return lua.LFalse, ""
+	}
+	line, rest := resp[1:end], resp[end+2:]
+
+	switch resp[0] {
+	case '+':
+		tbl := L.NewTable()
+		tbl.RawSetString("ok", lua.LString(line))
+		return tbl, rest
+	case '-':
+		tbl := L.NewTable()
+		tbl.RawSetString("err", lua.LString(line))
+		return tbl, rest
+	case ':':
+		n, _ := strconv.ParseInt(line, 10, 64)
+		return lua.LNumber(n), rest
+	case ',':
+		return lua.LString(line), rest
+	case '#':
+		if line == "t" {
+			return lua.LNumber(1), rest
+		}
+		return lua.LFalse, rest
+	case '$':
+		n, _ := strconv.Atoi(line)
+		if n < 0 || len(rest) < n+2 {
+			return lua.LFalse, rest
+		}
+		return lua.LString(rest[:n]), rest[n+2:]
+	case '*', '~', '%', '>':
+		n, _ := strconv.Atoi(line)
+		if n < 0 {
+			return lua.LFalse, rest
+		}
+		if resp[0] == '%' {
+			n *= 2
+		}
+		tbl := L.CreateTable(n, 0)
+		for i := 1; i <= n; i++ {
+			var elem lua.LValue
+			elem, rest = parseRespToLua(L, rest)
+			tbl.RawSetInt(i, elem)
+		}
+		return tbl, rest
+	}
+	return lua.LFalse, rest
+}
+
+// luaToResp converts a script's return value to a reply: numbers are
+// truncated to integers, true becomes 1 and false or nil a nil reply, and a
+// table is an error or status reply if it has an err or ok field, or else an
+// array of its elements up to the first nil.
+func luaToResp(value lua.LValue) string {
+	switch v := value.(type) {
+	case lua.LNumber:
+		return toRespInt(int64(v))
+	case lua.LString:
+		return toRespStr(string(v))
+	case lua.LBool:
+		if v {
+			return toRespInt(1)
+		}
+		return RESP_NULL_BULK
+	case *lua.LTable:
+		if msg, ok := v.RawGetString("err").(lua.LString); ok {
+			return "-" + string(msg) + "\r\n"
+		}
+		if msg, ok := v.RawGetString("ok").(lua.LString); ok {
+			return "+" + string(msg) + "\r\n"
+		}
+		var elems []string
+		for i := 1; ; i++ {
+			elem := v.RawGetInt(i)
+			if elem == lua.LNil {
+				break
+			}
+			elems = append(elems, luaToResp(elem))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(elems), strings.Join(elems, ""))
+	}
+	return RESP_NULL_BULK
+}
+
+func (s *RedisServer) scriptCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("SCRIPT")
+	}
+
+	switch sub := strings.ToUpper(args[1]); {
+	case sub == "LOAD" && len(args) == 3:
+		sha, errResp := s.state.loadScript(args[2])
+		if errResp.Error != "" {
+			return errResp
+		}
+		return CommandResponse{Response: toRespStr(sha)}
+
+	case sub == "EXISTS" && len(args) >= 3:
+		s.state.scriptMu.Lock()
+		defer s.state.scriptMu.Unlock()
+		exists := make([]int64, len(args)-2)
+		for i, sha := range args[2:] {
+			if _, ok := s.state.scripts[strings.ToLower(sha)]; ok {
+				exists[i] = 1
+			}
+		}
+		return CommandResponse{Response: toRespIntArr(exists)}
+
+	case sub == "FLUSH" && len(args) <= 3:
+		if len(args) == 3 {
+			if mode := strings.ToUpper(args[2]); mode != "ASYNC" && mode != "SYNC" {
+				return CommandResponse{Error: "-ERR SCRIPT FLUSH only support SYNC|ASYNC option"}
+			}
+		}
+		s.state.scriptMu.Lock()
+		defer s.state.scriptMu.Unlock()
+		s.state.scripts = make(map[string]*lua.FunctionProto)
+		if s.state.luaVM != nil {
+			s.state.luaVM.Close()
+			s.state.luaVM = nil
+		}
+		return CommandResponse{Response: "+OK\r\n"}
+
+	case sub == "KILL" && len(args) == 2:
+		return s.state.killScript(false)
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try SCRIPT HELP."}
+}
+
+// killScript stops the running script, or function if function is set,
+// unless it already wrote to the dataset: stopping it then would leave the
+// write half done.
+func (st *RedisState) killScript(function bool) CommandResponse {
+	st.scriptMu.Lock()
+	defer st.scriptMu.Unlock()
+
+	run := st.runningScript
+	if run == nil || run.call.isFunction != function {
+		return CommandResponse{Error: "-NOTBUSY No scripts in execution right now."}
+	}
+	if run.wrote.Load() {
+		return CommandResponse{Error: "-UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command."}
+	}
+	run.killed.Store(true)
+	run.cancel()
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+// lockTx takes txMu, for writing if exclusive is set. If a script holding it
+// outlives busy-reply-threshold, lockTx gives up and returns that script, so
+// the caller can reply -BUSY instead of waiting for the script to end.
+func (st *RedisState) lockTx(exclusive bool) *scriptRun {
+	tryLock, lock := st.txMu.TryRLock, st.txMu.RLock
+	if exclusive {
+		tryLock, lock = st.txMu.TryLock, st.txMu.Lock
+	}
+
+	for !tryLock() {
+		st.scriptMu.Lock()
+		run := st.runningScript
+		st.scriptMu.Unlock()
+		if run == nil {
+			lock()
+			return nil
+		}
+		select {
+		case <-run.busy:
+			return run
+		case <-run.done:
+		}
+	}
+	return nil
+}
+
+// busyError is the reply to commands arriving while run is busy.
+func (run *scriptRun) busyError() string {
+	if run.call.isFunction {
+		return "-BUSY Redis is busy running a script. You can only call FUNCTION KILL or SHUTDOWN NOSAVE."
+	}
+	return "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE."
+}
+
+// allowedWhenBusy reports whether args is a command that may run while a
+// script is busy.
+func allowedWhenBusy(args []string) bool {
+	switch strings.ToUpper(args[0]) {
+	case RESP_COMMAND_AUTH, RESP_COMMAND_HELLO:
+		return true
+	}
+	if len(args) != 2 {
+		return false
+	}
+	switch sub := strings.ToUpper(args[1]); strings.ToUpper(args[0]) {
+	case RESP_COMMAND_SCRIPT:
+		return sub == "KILL"
+	case RESP_COMMAND_FUNCTION:
+		return sub == "KILL" || sub == "STATS"
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// runLua runs body the way EVAL does, in a fresh environment of L.
+func runLua(t *testing.T, L *lua.LState, body string) (lua.LValue, error) {
+	t.Helper()
+	proto, err := compileScript(body, "user_script")
+	if err != nil {
+		t.Fatalf("compile %q: %v", body, err)
+	}
+	fn := L.NewFunctionFromProto(proto)
+	fn.Env = scriptEnv(L)
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	return ret, nil
+}
+
+func TestScriptGlobalsAreReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		wantErr string
+	}{
+		{"replace redis.call", "redis.call = function() return 1 end", luaReadOnlyError},
+		{"replace library function", "string.rep = function() return 'x' end", luaReadOnlyError},
+		{"add library field", "math.answer = 42", luaReadOnlyError},
+		{"replace global", "tostring = nil", luaReadOnlyError},
+		{"create global", "x = 1", "Script attempted to create global variable 'x'"},
+		{"read missing global", "return y", "Script attempted to access nonexistent global variable 'y'"},
+		{"through _G", "_G.string = {}", luaReadOnlyError},
+		{"rawset on _G", "rawset(_G, 'tostring', nil)", luaReadOnlyError},
+		{"rawset on library", "rawset(table, 'insert', nil)", luaReadOnlyError},
+		{"string metatable", "getmetatable('').__index.rep = nil", "attempt to index a non-table object"},
+		{"replace library metatable", "setmetatable(string, {})", "cannot change a protected metatable"},
+		{"loadstring global", "loadstring('tostring = nil')()", luaReadOnlyError},
+		{"getfenv", "return getfenv(0)", "nonexistent global variable 'getfenv'"},
+		{"setfenv", "setfenv(1, {})", "nonexistent global variable 'setfenv'"},
+	}
+
+	L := newLuaVM(nil)
+	defer L.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := runLua(t, L, tt.body)
+			if err == nil {
+				t.Fatalf("script ran without error")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %q, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Whatever the scripts above tried, later scripts see the libraries
+	// they started with.
+	ret, err := runLua(t, L, "return type(redis.call) .. string.rep('a', 3) .. ('b'):rep(2) .. table.concat({math.max(1, 2)})")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := lua.LVAsString(ret), "functionaaabb2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestScriptLocalsStillWork(t *testing.T) {
+	L := newLuaVM(nil)
+	defer L.Close()
+	ret, err := runLua(t, L, "local t = {} rawset(t, 'k', 'v') setmetatable(t, {}) return rawget(t, 'k')")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lua.LVAsString(ret) != "v" {
+		t.Errorf("got %v, want v", ret)
+	}
+}
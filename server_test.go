@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer is a master serving connections on a loopback port, the way
+// main does.
+type testServer struct {
+	state *RedisState
+	addr  string
+}
+
+// startTestServer starts a master with a fresh state, running the active
+// expire cycle. configure, if not nil, adjusts the state before the first
+// connection is accepted.
+func startTestServer(t *testing.T, configure func(st *RedisState)) *testServer {
+	t.Helper()
+	st := newRedisState()
+	st.serverIsMaster = true
+	if configure != nil {
+		configure(st)
+	}
+	go st.activeExpireLoop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s := &RedisServer{state: st, conn: conn, multiQueue: [][]string{}}
+			go s.handleConnection()
+		}
+	}()
+	return &testServer{state: st, addr: l.Addr().String()}
+}
+
+// testClient speaks RESP to a testServer.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (ts *testServer) client(t *testing.T) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", ts.addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send writes a command without waiting for its reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(encodeBulkArray(args)); err != nil {
+		c.t.Fatalf("write %q: %v", args, err)
+	}
+}
+
+// do sends a command and returns its raw reply.
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+// read returns the next raw reply, failing the test if none arrives within
+// a few seconds.
+func (c *testClient) read() string {
+	c.t.Helper()
+	reply, err := c.readWithin(5 * time.Second)
+	if err != nil {
+		c.t.Fatalf("read reply: %v", err)
+	}
+	return reply
+}
+
+func (c *testClient) readWithin(timeout time.Duration) (string, error) {
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	var b strings.Builder
+	err := readTestReply(c.reader, &b)
+	return b.String(), err
+}
+
+// readTestReply copies one reply, nested arrays included, from r to b.
+func readTestReply(r *bufio.Reader, b *strings.Builder) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	b.WriteString(line)
+	if len(line) < 3 {
+		return fmt.Errorf("malformed reply %q", line)
+	}
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1 : len(line)-2])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		b.Write(buf)
+	case '*':
+		n, _ := strconv.Atoi(line[1 : len(line)-2])
+		for i := 0; i < n; i++ {
+			if err := readTestReply(r, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reply builders, for comparing against raw replies.
+
+func bulk(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+
+func integer(n int64) string { return ":" + strconv.FormatInt(n, 10) + "\r\n" }
+
+// errorReply is the raw reply for an error string as commands return it.
+func errorReply(err string) string { return err + "\r\n" }
+
+func array(elems ...string) string {
+	return "*" + strconv.Itoa(len(elems)) + "\r\n" + strings.Join(elems, "")
+}
+
+func bulks(elems ...string) string {
+	for i, e := range elems {
+		elems[i] = bulk(e)
+	}
+	return array(elems...)
+}
+
+// parseBulk returns the string a bulk string reply holds.
+func parseBulk(reply string) (string, bool) {
+	header, rest, ok := strings.Cut(reply, "\r\n")
+	if !ok || !strings.HasPrefix(header, "$") || !strings.HasSuffix(rest, "\r\n") {
+		return "", false
+	}
+	return strings.TrimSuffix(rest, "\r\n"), true
+}
+
+// parseBulks returns the strings a flat array of bulk strings holds.
+func parseBulks(reply string) ([]string, bool) {
+	header, rest, ok := strings.Cut(reply, "\r\n")
+	if !ok || !strings.HasPrefix(header, "*") {
+		return nil, false
+	}
+	n, err := strconv.Atoi(header[1:])
+	if err != nil || n < 0 {
+		return nil, false
+	}
+	elems := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, rest, ok = strings.Cut(rest, "\r\n")
+		size, err := strconv.Atoi(strings.TrimPrefix(header, "$"))
+		if !ok || !strings.HasPrefix(header, "$") || err != nil || size < 0 || len(rest) < size+2 {
+			return nil, false
+		}
+		elems = append(elems, rest[:size])
+		rest = rest[size+2:]
+	}
+	return elems, rest == ""
+}
+
+const (
+	okReply         = "+OK\r\n"
+	nilBulkReply    = "$-1\r\n"
+	nilArrayReply   = "*-1\r\n"
+	queuedReply     = "+QUEUED\r\n"
+	emptyArrayReply = "*0\r\n"
+)
+
+// expect runs a command and fails the test unless it replies want.
+func (c *testClient) expect(want string, args ...string) {
+	c.t.Helper()
+	if got := c.do(args...); got != want {
+		c.t.Fatalf("%q: got %q, want %q", args, got, want)
+	}
+}
+
+// eventually polls cond until it holds or the timeout passes.
+func eventually(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+// testStep is a command and the raw reply it must get.
+type testStep struct {
+	cmd  []string
+	want string
+}
+
+// runSteps runs steps in order on c, reporting every reply that differs.
+func runSteps(t *testing.T, c *testClient, steps []testStep) {
+	t.Helper()
+	for _, step := range steps {
+		if got := c.do(step.cmd...); got != step.want {
+			t.Errorf("%q:\n got %q\nwant %q", step.cmd, got, step.want)
+		}
+	}
+}
+
+// cmd builds a command line for a testStep.
+func cmd(args ...string) []string { return args }
+
+// ttl returns what TTL would for key: its remaining time to live in
+// seconds, rounded, -1 when it has none and -2 when the key does not exist.
+func (ts *testServer) ttl(key string) int64 {
+	ts.state.storageMu.RLock()
+	defer ts.state.storageMu.RUnlock()
+	value, ok := ts.state.readKey(key)
+	if !ok {
+		return -2
+	}
+	if value.px == -1 {
+		return -1
+	}
+	return (time.Until(value.expireAt()).Milliseconds() + 500) / 1000
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thresholds of Redis' compact set encodings. An all-integer set is stored
+// as a sorted intset up to setMaxIntsetEntries members; the listpack limits
+// only affect what OBJECT ENCODING reports.
+const (
+	setMaxIntsetEntries   = 512
+	setMaxListpackEntries = 128
+	setMaxListpackValue   = 64
+)
+
+// setValue is the set type. While every member is an integer it is kept as a
+// sorted []int64, like Redis' intset; the first non-integer member (or
+// growing past setMaxIntsetEntries) converts it to a map plus a dense slice
+// of members, which keeps random picks uniform.
+type setValue struct {
+	intset  []int64
+	members map[string]int
+	order   []string
+	// hashtable records that the set outgrew the listpack limits. As in
+	// Redis, a set never converts back to a more compact encoding.
+	hashtable bool
+}
+
+func newSetValue() *setValue {
+	return &setValue{}
+}
+
+func (set *setValue) isIntset() bool {
+	return set.members == nil
+}
+
+func (set *setValue) Len() int {
+	if set.isIntset() {
+		return len(set.intset)
+	}
+	return len(set.order)
+}
+
+// searchInt returns the position of n in the intset, or where it would be
+// inserted.
+func (set *setValue) searchInt(n int64) (int, bool) {
+	i := sort.Search(len(set.intset), func(i int) bool { return set.intset[i] >= n })
+	return i, i < len(set.intset) && set.intset[i] == n
+}
+
+func (set *setValue) Has(member string) bool {
+	if set.isIntset() {
+		n, ok := parseStrictInt(member)
+		if !ok {
+			return false
+		}
+		_, found := set.searchInt(n)
+		return found
+	}
+	_, ok := set.members[member]
+	return ok
+}
+
+// Add inserts member and reports whether it was not already present.
+func (set *setValue) Add(member string) bool {
+	if set.isIntset() {
+		if n, ok := parseStrictInt(member); ok {
+			i, found := set.searchInt(n)
+			if found {
+				return false
+			}
+			if len(set.intset) < setMaxIntsetEntries {
+				set.intset = append(set.intset, 0)
+				copy(set.intset[i+1:], set.intset[i:])
+				set.intset[i] = n
+				return true
+			}
+		}
+		set.convert()
+	}
+
+	if _, ok := set.members[member]; ok {
+		return false
+	}
+	set.members[member] = len(set.order)
+	set.order = append(set.order, member)
+	if len(set.order) > setMaxListpackEntries || len(member) > setMaxListpackValue {
+		set.hashtable = true
+	}
+	return true
+}
+
+func (set *setValue) Remove(member string) bool {
+	if set.isIntset() {
+		n, ok := parseStrictInt(member)
+		if !ok {
+			return false
+		}
+		i, found := set.searchInt(n)
+		if !found {
+			return false
+		}
+		set.intset = append(set.intset[:i], set.intset[i+1:]...)
+		return true
+	}
+
+	pos, ok := set.members[member]
+	if !ok {
+		return false
+	}
+	last := len(set.order) - 1
+	moved := set.order[last]
+	set.order[pos] = moved
+	set.members[moved] = pos
+	set.order = set.order[:last]
+	delete(set.members, member)
+	return true
+}
+
+// At returns the member at position i, for uniform random picks.
+func (set *setValue) At(i int) string {
+	if set.isIntset() {
+		return strconv.FormatInt(set.intset[i], 10)
+	}
+	return set.order[i]
+}
+
+// Members returns every member; an intset yields them in ascending order.
+func (set *setValue) Members() []string {
+	members := make([]string, set.Len())
+	for i := range members {
+		members[i] = set.At(i)
+	}
+	return members
+}
+
+// convert moves an intset to the general representation.
+func (set *setValue) convert() {
+	set.members = make(map[string]int, len(set.intset)+1)
+	set.order = make([]string, 0, len(set.intset)+1)
+	for _, n := range set.intset {
+		member := strconv.FormatInt(n, 10)
+		set.members[member] = len(set.order)
+		set.order = append(set.order, member)
+	}
+	set.hashtable = len(set.order) > setMaxListpackEntries
+	set.intset = nil
+}
+
+func (set *setValue) encoding() string {
+	switch {
+	case set.isIntset():
+		return "intset"
+	case set.hashtable:
+		return "hashtable"
+	}
+	return "listpack"
+}
+
+// setAt returns the set stored at key. found is false when the key does not
+// exist; wrongType is true when it holds a value of another type. The caller
+// must hold storageMu for writing.
+func (st *RedisState) setAt(key string) (set *setValue, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	set, ok = value.val.(*setValue)
+	if !ok {
+		return nil, true, true
+	}
+	return set, true, false
+}
+
+// storeSet replaces the value at key with set, deleting the key when the set
+// is empty, and returns the resulting cardinality.
+func (st *RedisState) storeSet(key string, set *setValue) int {
+	if set.Len() == 0 {
+		st.deleteKey(key)
+		return 0
+	}
+	st.storage[key] = newStorageVal(set, time.Time{})
+	return set.Len()
+}
+
+func (s *RedisServer) saddCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("SADD")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		set = newSetValue()
+	}
+
+	added := 0
+	for _, member := range args[2:] {
+		if set.Add(member) {
+			added++
+		}
+	}
+	if !found {
+		s.state.storage[args[1]] = newStorageVal(set, time.Time{})
+	}
+	if added > 0 {
+		s.state.keyModified(notifySet, "sadd", args[1])
+		s.state.propagate(args)
+	}
+	return CommandResponse{Response: toRespInt(int64(added))}
+}
+
+func (s *RedisServer) sremCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("SREM")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	removed := 0
+	for _, member := range args[2:] {
+		if set.Remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.state.keyModified(notifySet, "srem", args[1])
+		s.state.propagate(args)
+	}
+	if set.Len() == 0 {
+		s.state.deleteKey(args[1])
+	}
+	return CommandResponse{Response: toRespInt(int64(removed))}
+}
+
+func (s *RedisServer) sismemberCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("SISMEMBER")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if found && set.Has(args[2]) {
+		return CommandResponse{Response: ":1\r\n"}
+	}
+	return CommandResponse{Response: ":0\r\n"}
+}
+
+func (s *RedisServer) smismemberCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("SMISMEMBER")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	replies := make([]int64, len(args)-2)
+	for i, member := range args[2:] {
+		if found && set.Has(member) {
+			replies[i] = 1
+		}
+	}
+	return CommandResponse{Response: toRespIntArr(replies)}
+}
+
+func (s *RedisServer) smembersCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("SMEMBERS")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+	return CommandResponse{Response: toRespStrArr(set.Members())}
+}
+
+func (s *RedisServer) scardCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("SCARD")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(set.Len()))}
+}
+
+// spopCommand removes random members. Replicas receive the removal as SREM,
+// so they drop the same members rather than picking their own.
+func (s *RedisServer) spopCommand(args []string) CommandResponse {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("SPOP")
+	}
+	withCount := len(args) == 3
+	count := 1
+	if withCount {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		if n < 0 {
+			return CommandResponse{Error: "-ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if withCount {
+			return CommandResponse{Response: "*0\r\n"}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	var popped []string
+	if count >= set.Len() {
+		popped = set.Members()
+		s.state.keyModified(notifySet, "spop", args[1])
+		s.state.deleteKey(args[1])
+		s.state.propagate([]string{"DEL", args[1]})
+	} else {
+		popped = make([]string, count)
+		for i := range popped {
+			popped[i] = set.At(rand.Intn(set.Len()))
+			set.Remove(popped[i])
+		}
+		if count > 0 {
+			s.state.keyModified(notifySet, "spop", args[1])
+			s.state.propagate(append([]string{RESP_COMMAND_SREM, args[1]}, popped...))
+		}
+	}
+
+	if !withCount {
+		return CommandResponse{Response: toRespStr(popped[0])}
+	}
+	return CommandResponse{Response: toRespStrArr(popped)}
+}
+
+func (s *RedisServer) srandmemberCommand(args []string) CommandResponse {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError("SRANDMEMBER")
+	}
+	withCount := len(args) == 3
+	count := 1
+	if withCount {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = n
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	set, found, wrongType := s.state.setAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if withCount {
+			return CommandResponse{Response: "*0\r\n"}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	if !withCount {
+		return CommandResponse{Response: toRespStr(set.At(rand.Intn(set.Len())))}
+	}
+	picks := randomPicks(set.Len(), count)
+	out := make([]string, len(picks))
+	for i, pos := range picks {
+		out[i] = set.At(pos)
+	}
+	return CommandResponse{Response: toRespStrArr(out)}
+}
+
+func (s *RedisServer) smoveCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("SMOVE")
+	}
+	srcKey, dstKey, member := args[1], args[2], args[3]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	src, srcFound, wrongType := s.state.setAt(srcKey)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	dst, dstFound, wrongType := s.state.setAt(dstKey)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !srcFound || !src.Has(member) {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	if srcKey == dstKey {
+		return CommandResponse{Response: ":1\r\n"}
+	}
+
+	src.Remove(member)
+	s.state.keyModified(notifySet, "srem", srcKey)
+	if src.Len() == 0 {
+		s.state.deleteKey(srcKey)
+	}
+	if !dstFound {
+		dst = newSetValue()
+		s.state.storage[dstKey] = newStorageVal(dst, time.Time{})
+	}
+	if dst.Add(member) {
+		s.state.keyModified(notifySet, "sadd", dstKey)
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: ":1\r\n"}
+}
+
+// Set algebra operations.
+const (
+	setOpUnion = iota
+	setOpInter
+	setOpDiff
+)
+
+// setAlgebra computes the union, intersection or difference of the sets at
+// keys. Missing keys count as empty sets. errResp is set when a key holds
+// another type. The caller must hold storageMu for writing.
+func (st *RedisState) setAlgebra(keys []string, op int) (*setValue, string) {
+	sets := make([]*setValue, len(keys))
+	for i, key := range keys {
+		set, _, wrongType := st.setAt(key)
+		if wrongType {
+			return nil, RESP_ERR_WRONGTYPE
+		}
+		sets[i] = set
+	}
+
+	result := newSetValue()
+	// An empty operand empties an intersection, and a difference when it is
+	// the first one.
+	if op == setOpDiff && sets[0] == nil {
+		return result, ""
+	}
+	if op == setOpInter {
+		for _, set := range sets {
+			if set == nil {
+				return result, ""
+			}
+		}
+	}
+	switch op {
+	case setOpUnion:
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			for i := 0; i < set.Len(); i++ {
+				result.Add(set.At(i))
+			}
+		}
+
+	case setOpInter:
+		// Probe the other sets with the members of the smallest one.
+		sort.SliceStable(sets, func(i, j int) bool { return sets[i].Len() < sets[j].Len() })
+		for i := 0; i < sets[0].Len(); i++ {
+			member := sets[0].At(i)
+			if inAll(sets[1:], member) {
+				result.Add(member)
+			}
+		}
+
+	case setOpDiff:
+		for i := 0; i < sets[0].Len(); i++ {
+			member := sets[0].At(i)
+			if !inAny(sets[1:], member) {
+				result.Add(member)
+			}
+		}
+	}
+	return result, ""
+}
+
+func inAll(sets []*setValue, member string) bool {
+	for _, set := range sets {
+		if !set.Has(member) {
+			return false
+		}
+	}
+	return true
+}
+
+func inAny(sets []*setValue, member string) bool {
+	for _, set := range sets {
+		if set != nil && set.Has(member) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAlgebraCommand backs SUNION, SINTER and SDIFF.
+func (s *RedisServer) setAlgebraCommand(args []string, op int) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	result, errResp := s.state.setAlgebra(args[1:], op)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	return CommandResponse{Response: toRespStrArr(result.Members())}
+}
+
+// setAlgebraStoreCommand backs SUNIONSTORE, SINTERSTORE and SDIFFSTORE.
+func (s *RedisServer) setAlgebraStoreCommand(args []string, op int) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	result, errResp := s.state.setAlgebra(args[2:], op)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	size := s.state.storeSet(args[1], result)
+	if size > 0 {
+		s.state.keyModified(notifySet, strings.ToLower(args[0]), args[1])
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(size))}
+}
+
+func (s *RedisServer) sintercardCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("SINTERCARD")
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys <= 0 {
+		return CommandResponse{Error: "-ERR numkeys should be greater than 0"}
+	}
+	if numKeys > len(args)-2 {
+		return CommandResponse{Error: "-ERR Number of keys can't be greater than number of args"}
+	}
+	keys := args[2 : 2+numKeys]
+
+	limit := 0
+	for rest := args[2+numKeys:]; len(rest) > 0; rest = rest[2:] {
+		if strings.ToUpper(rest[0]) != "LIMIT" || len(rest) < 2 {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		if n < 0 {
+			return CommandResponse{Error: "-ERR LIMIT can't be negative"}
+		}
+		limit = n
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	sets := make([]*setValue, 0, len(keys))
+	empty := false
+	for _, key := range keys {
+		set, found, wrongType := s.state.setAt(key)
+		if wrongType {
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if !found {
+			empty = true
+			continue
+		}
+		sets = append(sets, set)
+	}
+	if empty {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	// Count without building the intersection, stopping at the limit.
+	sort.SliceStable(sets, func(i, j int) bool { return sets[i].Len() < sets[j].Len() })
+	count := 0
+	for i := 0; i < sets[0].Len() && (limit == 0 || count < limit); i++ {
+		if inAll(sets[1:], sets[0].At(i)) {
+			count++
+		}
+	}
+	return CommandResponse{Response: toRespInt(int64(count))}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSetEncodings(t *testing.T) {
+	ints := func(n int) []string {
+		members := make([]string, n)
+		for i := range members {
+			members[i] = strconv.Itoa(n - i)
+		}
+		return members
+	}
+	words := func(n int) []string {
+		members := make([]string, n)
+		for i := range members {
+			members[i] = "m" + strconv.Itoa(i)
+		}
+		return members
+	}
+
+	tests := []struct {
+		name     string
+		members  []string
+		encoding string
+	}{
+		{"integers", []string{"3", "-1", "9223372036854775807"}, "intset"},
+		{"intset at its limit", ints(setMaxIntsetEntries), "intset"},
+		{"intset past its limit", ints(setMaxIntsetEntries + 1), "hashtable"},
+		{"one string", []string{"1", "2", "x"}, "listpack"},
+		{"non-canonical integer", []string{"1", "01"}, "listpack"},
+		{"integer out of range", []string{"1", "9223372036854775808"}, "listpack"},
+		{"listpack at its limit", words(setMaxListpackEntries), "listpack"},
+		{"listpack past its limit", words(setMaxListpackEntries + 1), "hashtable"},
+		{"long member", []string{"1", strings.Repeat("x", setMaxListpackValue+1)}, "hashtable"},
+		{"intset of a listpack's size", append(ints(setMaxListpackEntries), "x"), "hashtable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set := newSetValue()
+			for _, m := range tt.members {
+				if !set.Add(m) {
+					t.Fatalf("Add(%q) reported a duplicate", m)
+				}
+			}
+			if got := set.encoding(); got != tt.encoding {
+				t.Errorf("encoding %s, want %s", got, tt.encoding)
+			}
+			if set.Len() != len(tt.members) {
+				t.Errorf("Len() = %d, want %d", set.Len(), len(tt.members))
+			}
+			for _, m := range tt.members {
+				if !set.Has(m) || set.Add(m) {
+					t.Errorf("%q missing after conversion", m)
+				}
+			}
+		})
+	}
+}
+
+func TestIntsetLookups(t *testing.T) {
+	set := newSetValue()
+	for _, m := range []string{"5", "-3", "10", "5"} {
+		set.Add(m)
+	}
+	if got, want := set.Members(), []string{"-3", "5", "10"}; !slices.Equal(got, want) {
+		t.Errorf("members %q, want %q in ascending order", got, want)
+	}
+	// Only the canonical spelling of an integer is a member.
+	for _, m := range []string{"05", "+5", " 5", "5.0", "x"} {
+		if set.Has(m) || set.Remove(m) {
+			t.Errorf("%q matched the member 5", m)
+		}
+	}
+	if !set.Remove("5") || set.Has("5") || set.encoding() != "intset" {
+		t.Errorf("removing 5 failed or converted the set")
+	}
+}
+
+func TestSetNeverShrinksEncoding(t *testing.T) {
+	set := newSetValue()
+	for i := 0; i <= setMaxListpackEntries; i++ {
+		set.Add("m" + strconv.Itoa(i))
+	}
+	for i := 1; i <= setMaxListpackEntries; i++ {
+		set.Remove("m" + strconv.Itoa(i))
+	}
+	if set.encoding() != "hashtable" || set.Len() != 1 {
+		t.Errorf("encoding %s with %d members, want hashtable with 1", set.encoding(), set.Len())
+	}
+
+	set = newSetValue()
+	set.Add("1")
+	set.Add("x")
+	set.Remove("x")
+	if set.encoding() != "listpack" {
+		t.Errorf("encoding %s, want listpack", set.encoding())
+	}
+}
+
+// sortedMembers runs a command replying with set members and returns them
+// sorted, as only intsets have a defined order.
+func sortedMembers(c *testClient, args ...string) []string {
+	c.t.Helper()
+	reply := c.do(args...)
+	members, ok := parseBulks(reply)
+	if !ok {
+		c.t.Fatalf("%q: %q", args, reply)
+	}
+	slices.Sort(members)
+	return members
+}
+
+func TestSetCommands(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("SADD", "nums", "3", "1", "2", "1"), integer(3)},
+		{cmd("SMEMBERS", "nums"), bulks("1", "2", "3")},
+		{cmd("OBJECT", "ENCODING", "nums"), bulk("intset")},
+		{cmd("SADD", "nums", "a"), integer(1)},
+		{cmd("OBJECT", "ENCODING", "nums"), bulk("listpack")},
+		{cmd("SCARD", "nums"), integer(4)},
+		{cmd("SISMEMBER", "nums", "a"), integer(1)},
+		{cmd("SISMEMBER", "nums", "b"), integer(0)},
+		{cmd("SMISMEMBER", "nums", "1", "b", "a"), array(integer(1), integer(0), integer(1))},
+		{cmd("SMISMEMBER", "missing", "1"), array(integer(0))},
+		{cmd("SREM", "nums", "a", "b"), integer(1)},
+		{cmd("SREM", "nums", "1", "2", "3"), integer(3)},
+		{cmd("TYPE", "nums"), "+none\r\n"},
+
+		{cmd("SADD", "src", "x", "y"), integer(2)},
+		{cmd("SMOVE", "src", "dst", "x"), integer(1)},
+		{cmd("SMOVE", "src", "dst", "x"), integer(0)},
+		{cmd("SMOVE", "src", "dst", "y"), integer(1)},
+		{cmd("TYPE", "src"), "+none\r\n"},
+		{cmd("SCARD", "dst"), integer(2)},
+		{cmd("SET", "str", "v"), okReply},
+		{cmd("SMOVE", "dst", "str", "x"), errorReply(RESP_ERR_WRONGTYPE)},
+		{cmd("SADD", "str", "x"), errorReply(RESP_ERR_WRONGTYPE)},
+
+		{cmd("SPOP", "missing"), nilBulkReply},
+		{cmd("SPOP", "missing", "2"), emptyArrayReply},
+		{cmd("SPOP", "dst", "-1"), errorReply("-ERR value is out of range, must be positive")},
+		{cmd("SRANDMEMBER", "missing", "3"), emptyArrayReply},
+		{cmd("SINTERCARD", "0", "dst"), errorReply("-ERR numkeys should be greater than 0")},
+		{cmd("SINTERCARD", "2", "dst"), errorReply("-ERR Number of keys can't be greater than number of args")},
+		{cmd("SINTERCARD", "1", "dst", "LIMIT", "-1"), errorReply("-ERR LIMIT can't be negative")},
+	})
+}
+
+func TestSetRandomMembers(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "SADD", "s", "a", "b", "c", "d", "e")
+	all := []string{"a", "b", "c", "d", "e"}
+
+	// A positive count returns distinct members, at most all of them.
+	if got := sortedMembers(c, "SRANDMEMBER", "s", "10"); !slices.Equal(got, all) {
+		t.Errorf("SRANDMEMBER 10 = %q", got)
+	}
+	if got := slices.Compact(sortedMembers(c, "SRANDMEMBER", "s", "3")); len(got) != 3 {
+		t.Errorf("SRANDMEMBER 3 = %q, want 3 distinct members", got)
+	}
+	// A negative one may repeat members.
+	got := sortedMembers(c, "SRANDMEMBER", "s", "-20")
+	if len(got) != 20 {
+		t.Errorf("SRANDMEMBER -20 returned %d members", len(got))
+	}
+	for _, m := range got {
+		if !slices.Contains(all, m) {
+			t.Errorf("SRANDMEMBER returned %q", m)
+		}
+	}
+
+	popped := sortedMembers(c, "SPOP", "s", "2")
+	if len(slices.Compact(popped)) != 2 {
+		t.Fatalf("SPOP 2 = %q", popped)
+	}
+	left := sortedMembers(c, "SMEMBERS", "s")
+	if merged := slices.Sorted(slices.Values(append(left, popped...))); !slices.Equal(merged, all) {
+		t.Errorf("SPOP left %q after popping %q", left, popped)
+	}
+	if got := sortedMembers(c, "SPOP", "s", "10"); !slices.Equal(got, left) {
+		t.Errorf("SPOP 10 = %q, want %q", got, left)
+	}
+	c.expect("+none\r\n", "TYPE", "s")
+}
+
+func TestSetAlgebra(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(4), "SADD", "a", "1", "2", "3", "4")
+	c.expect(integer(3), "SADD", "b", "3", "4", "x")
+	c.expect(integer(3), "SADD", "c", "4", "x", "y")
+	c.expect(okReply, "SET", "str", "v")
+
+	tests := []struct {
+		cmd  []string
+		want []string
+	}{
+		{cmd("SINTER", "a", "b"), []string{"3", "4"}},
+		{cmd("SINTER", "a", "b", "c"), []string{"4"}},
+		{cmd("SINTER", "a", "missing"), []string{}},
+		{cmd("SUNION", "a", "b", "missing"), []string{"1", "2", "3", "4", "x"}},
+		{cmd("SDIFF", "a", "b"), []string{"1", "2"}},
+		{cmd("SDIFF", "b", "a", "c"), []string{}},
+		{cmd("SDIFF", "missing", "a"), []string{}},
+		{cmd("SDIFF", "c", "missing"), []string{"4", "x", "y"}},
+	}
+	for _, tt := range tests {
+		if got := sortedMembers(c, tt.cmd...); !slices.Equal(got, tt.want) {
+			t.Errorf("%q = %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+
+	runSteps(t, c, []testStep{
+		{cmd("SINTER", "a", "str"), errorReply(RESP_ERR_WRONGTYPE)},
+		{cmd("SUNION", "missing", "str"), errorReply(RESP_ERR_WRONGTYPE)},
+
+		// Results are encoded afresh, so integer results become intsets.
+		{cmd("SINTERSTORE", "dst", "a", "b"), integer(2)},
+		{cmd("OBJECT", "ENCODING", "dst"), bulk("intset")},
+		{cmd("SMEMBERS", "dst"), bulks("3", "4")},
+		{cmd("SUNIONSTORE", "dst", "b", "c"), integer(4)},
+		{cmd("OBJECT", "ENCODING", "dst"), bulk("listpack")},
+		{cmd("SDIFFSTORE", "dst", "a", "b", "c"), integer(2)},
+		{cmd("SMEMBERS", "dst"), bulks("1", "2")},
+		// An empty result deletes the destination, whatever it held.
+		{cmd("SET", "str2", "v"), okReply},
+		{cmd("SINTERSTORE", "str2", "a", "missing"), integer(0)},
+		{cmd("TYPE", "str2"), "+none\r\n"},
+		{cmd("SDIFFSTORE", "dst", "a", "a"), integer(0)},
+		{cmd("TYPE", "dst"), "+none\r\n"},
+
+		{cmd("SINTERCARD", "2", "a", "b"), integer(2)},
+		{cmd("SINTERCARD", "2", "a", "b", "LIMIT", "1"), integer(1)},
+		{cmd("SINTERCARD", "2", "a", "b", "LIMIT", "0"), integer(2)},
+		{cmd("SINTERCARD", "2", "a", "missing"), integer(0)},
+		{cmd("SINTERCARD", "2", "a", "str"), errorReply(RESP_ERR_WRONGTYPE)},
+	})
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// streamChunkSize caps the entries per chunk, like Redis'
+// stream-node-max-entries. Approximate (~) trimming only ever drops whole
+// chunks.
+const streamChunkSize = 100
+
+// streamID identifies a stream entry: a millisecond timestamp and a sequence
+// number within it.
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) Less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+func (id streamID) IsZero() bool {
+	return id.ms == 0 && id.seq == 0
+}
+
+// next returns the smallest ID greater than id; ok is false at the maximum.
+func (id streamID) next() (streamID, bool) {
+	switch {
+	case id.seq < math.MaxUint64:
+		return streamID{id.ms, id.seq + 1}, true
+	case id.ms < math.MaxUint64:
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the largest ID smaller than id; ok is false at 0-0.
+func (id streamID) prev() (streamID, bool) {
+	switch {
+	case id.seq > 0:
+		return streamID{id.ms, id.seq - 1}, true
+	case id.ms > 0:
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses "ms-seq" or "ms". When the sequence is omitted it is
+// missingSeq, and seqGiven reports false.
+func parseStreamID(s string, missingSeq uint64) (id streamID, seqGiven bool, ok bool) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false, false
+	}
+	if !hasSeq {
+		return streamID{ms, missingSeq}, false, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, false, false
+	}
+	return streamID{ms, seq}, true, true
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string // field, value, field, value, ...
+}
+
+type streamChunk struct {
+	entries []streamEntry
+}
+
+// stream is the stream type: entries in ID order, split over fixed-size
+// chunks so appends, deletions and trimming from the head stay cheap, and a
+// lookup is a binary search over chunks followed by one inside a chunk.
+type stream struct {
+	chunks []*streamChunk
+	length int
+	lastID streamID
+	// maxDeletedID is the largest ID removed by XDEL or trimming, and
+	// entriesAdded counts every entry ever appended; XINFO reports both.
+	maxDeletedID streamID
+	entriesAdded uint64
+	groups       map[string]*streamGroup
+}
+
+func newStream() *stream {
+	return &stream{}
+}
+
+func (s *stream) Len() int {
+	return s.length
+}
+
+// FirstID returns the ID of the oldest entry, or 0-0 for an empty stream.
+func (s *stream) FirstID() streamID {
+	if s.length == 0 {
+		return streamID{}
+	}
+	return s.chunks[0].entries[0].id
+}
+
+func (s *stream) First() (streamEntry, bool) {
+	if s.length == 0 {
+		return streamEntry{}, false
+	}
+	return s.chunks[0].entries[0], true
+}
+
+func (s *stream) Last() (streamEntry, bool) {
+	if s.length == 0 {
+		return streamEntry{}, false
+	}
+	chunk := s.chunks[len(s.chunks)-1]
+	return chunk.entries[len(chunk.entries)-1], true
+}
+
+// Append adds an entry; id must be greater than lastID.
+func (s *stream) Append(id streamID, fields []string) {
+	if len(s.chunks) == 0 || len(s.chunks[len(s.chunks)-1].entries) >= streamChunkSize {
+		s.chunks = append(s.chunks, &streamChunk{entries: make([]streamEntry, 0, 8)})
+	}
+	chunk := s.chunks[len(s.chunks)-1]
+	chunk.entries = append(chunk.entries, streamEntry{id: id, fields: fields})
+	s.length++
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// seek returns the position of the first entry with an ID >= id, as a chunk
+// index and an offset inside it. The chunk index equals len(chunks) when
+// there is no such entry.
+func (s *stream) seek(id streamID) (int, int) {
+	c := sort.Search(len(s.chunks), func(i int) bool {
+		entries := s.chunks[i].entries
+		return !entries[len(entries)-1].id.Less(id)
+	})
+	if c == len(s.chunks) {
+		return c, 0
+	}
+	entries := s.chunks[c].entries
+	return c, sort.Search(len(entries), func(i int) bool { return !entries[i].id.Less(id) })
+}
+
+// Range returns up to count entries (0 means all) with IDs between start and
+// end inclusive, in descending order when rev is set.
+func (s *stream) Range(start, end streamID, count int, rev bool) []streamEntry {
+	var result []streamEntry
+	if end.Less(start) {
+		return result
+	}
+
+	if !rev {
+		c, i := s.seek(start)
+		for ; c < len(s.chunks); c, i = c+1, 0 {
+			for _, entry := range s.chunks[c].entries[i:] {
+				if end.Less(entry.id) || (count > 0 && len(result) == count) {
+					return result
+				}
+				result = append(result, entry)
+			}
+		}
+		return result
+	}
+
+	// Walk backwards from the last entry <= end.
+	c, i := len(s.chunks), 0
+	if after, ok := end.next(); ok {
+		c, i = s.seek(after)
+	}
+	for {
+		if i == 0 {
+			if c == 0 {
+				return result
+			}
+			c--
+			i = len(s.chunks[c].entries)
+		}
+		i--
+		entry := s.chunks[c].entries[i]
+		if entry.id.Less(start) || (count > 0 && len(result) == count) {
+			return result
+		}
+		result = append(result, entry)
+	}
+}
+
+// Get returns the entry with the given ID.
+func (s *stream) Get(id streamID) (streamEntry, bool) {
+	c, i := s.seek(id)
+	if c == len(s.chunks) || s.chunks[c].entries[i].id != id {
+		return streamEntry{}, false
+	}
+	return s.chunks[c].entries[i], true
+}
+
+// Delete removes the entry with the given ID and reports whether it existed.
+func (s *stream) Delete(id streamID) bool {
+	c, i := s.seek(id)
+	if c == len(s.chunks) || s.chunks[c].entries[i].id != id {
+		return false
+	}
+	chunk := s.chunks[c]
+	chunk.entries = append(chunk.entries[:i], chunk.entries[i+1:]...)
+	if len(chunk.entries) == 0 {
+		s.chunks = append(s.chunks[:c], s.chunks[c+1:]...)
+	}
+	s.length--
+	if s.maxDeletedID.Less(id) {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// Trim removes entries from the head: while there are more than maxLen of
+// them, or while they are older than minID. With approx set only whole
+// chunks go, and no more than limit entries (0 for no limit) are removed. It
+// returns the number of entries removed.
+func (s *stream) Trim(byMinID bool, maxLen int, minID streamID, approx bool, limit int) int {
+	removed := 0
+	excess := func(entry streamEntry) bool {
+		if byMinID {
+			return entry.id.Less(minID)
+		}
+		return s.length > maxLen
+	}
+
+	for len(s.chunks) > 0 {
+		chunk := s.chunks[0]
+		last := chunk.entries[len(chunk.entries)-1]
+		wholeChunk := byMinID && last.id.Less(minID) || !byMinID && s.length-len(chunk.entries) >= maxLen
+		if wholeChunk {
+			if approx && limit > 0 && removed+len(chunk.entries) > limit {
+				break
+			}
+			s.noteDeleted(last.id)
+			removed += len(chunk.entries)
+			s.length -= len(chunk.entries)
+			s.chunks[0] = nil
+			s.chunks = s.chunks[1:]
+			continue
+		}
+		if approx {
+			break
+		}
+
+		n := 0
+		for n < len(chunk.entries) && excess(chunk.entries[n]) {
+			s.noteDeleted(chunk.entries[n].id)
+			n++
+			s.length--
+		}
+		chunk.entries = append(chunk.entries[:0], chunk.entries[n:]...)
+		removed += n
+		break
+	}
+	return removed
+}
+
+func (s *stream) noteDeleted(id streamID) {
+	if s.maxDeletedID.Less(id) {
+		s.maxDeletedID = id
+	}
+}
+
+// invalidEntriesRead marks a group whose entries-read counter is unknown,
+// e.g. because it was created at an arbitrary ID.
+const invalidEntriesRead = -1
+
+// streamGroup is a consumer group: the last ID delivered to it, how many
+// entries it has read, and the entries delivered but not yet acknowledged.
+type streamGroup struct {
+	lastID      streamID
+	entriesRead int64
+	pending     *pendingEntries
+	consumers   map[string]*streamConsumer
+}
+
+type streamConsumer struct {
+	name     string
+	seenTime int64
+	// activeTime is when the consumer last read or claimed entries, or -1
+	// if it never did.
+	activeTime int64
+	pending    *pendingEntries
+}
+
+// pendingEntry records the delivery of an entry to a consumer, shared by the
+// group's and the consumer's pending entries lists.
+type pendingEntry struct {
+	id            streamID
+	consumer      *streamConsumer
+	deliveryTime  int64
+	deliveryCount uint64
+}
+
+// pendingEntries is a pending entries list, sorted by ID.
+type pendingEntries struct {
+	ids     []streamID
+	entries map[streamID]*pendingEntry
+}
+
+func newPendingEntries() *pendingEntries {
+	return &pendingEntries{entries: make(map[streamID]*pendingEntry)}
+}
+
+func (p *pendingEntries) Len() int {
+	return len(p.ids)
+}
+
+func (p *pendingEntries) Get(id streamID) *pendingEntry {
+	return p.entries[id]
+}
+
+// search returns the index of the first ID >= id.
+func (p *pendingEntries) search(id streamID) int {
+	return sort.Search(len(p.ids), func(i int) bool { return !p.ids[i].Less(id) })
+}
+
+func (p *pendingEntries) Add(nack *pendingEntry) {
+	if _, ok := p.entries[nack.id]; ok {
+		p.entries[nack.id] = nack
+		return
+	}
+	// Deliveries mostly arrive in ID order, so this is usually an append.
+	i := len(p.ids)
+	if i > 0 && nack.id.Less(p.ids[i-1]) {
+		i = p.search(nack.id)
+	}
+	p.ids = append(p.ids, streamID{})
+	copy(p.ids[i+1:], p.ids[i:])
+	p.ids[i] = nack.id
+	p.entries[nack.id] = nack
+}
+
+func (p *pendingEntries) Remove(id streamID) bool {
+	if _, ok := p.entries[id]; !ok {
+		return false
+	}
+	i := p.search(id)
+	p.ids = append(p.ids[:i], p.ids[i+1:]...)
+	delete(p.entries, id)
+	return true
+}
+
+// Range returns the pending entries with IDs between start and end
+// inclusive, up to count of them (0 means all).
+func (p *pendingEntries) Range(start, end streamID, count int) []*pendingEntry {
+	var result []*pendingEntry
+	for i := p.search(start); i < len(p.ids) && !end.Less(p.ids[i]); i++ {
+		if count > 0 && len(result) == count {
+			break
+		}
+		result = append(result, p.entries[p.ids[i]])
+	}
+	return result
+}
+
+// Group returns the consumer group with the given name, or nil.
+func (s *stream) Group(name string) *streamGroup {
+	return s.groups[name]
+}
+
+// CreateGroup adds a consumer group and reports false if it already exists.
+func (s *stream) CreateGroup(name string, lastID streamID, entriesRead int64) (*streamGroup, bool) {
+	if _, ok := s.groups[name]; ok {
+		return nil, false
+	}
+	if s.groups == nil {
+		s.groups = make(map[string]*streamGroup)
+	}
+	g := &streamGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     newPendingEntries(),
+		consumers:   make(map[string]*streamConsumer),
+	}
+	s.groups[name] = g
+	return g, true
+}
+
+// GroupNames returns the names of the consumer groups, sorted as Redis lists
+// them.
+func (s *stream) GroupNames() []string {
+	names := make([]string, 0, len(s.groups))
+	for name := range s.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Consumer returns the named consumer, or nil.
+func (g *streamGroup) Consumer(name string) *streamConsumer {
+	return g.consumers[name]
+}
+
+// CreateConsumer adds a consumer and reports false if it already exists.
+func (g *streamGroup) CreateConsumer(name string, now int64) (*streamConsumer, bool) {
+	if c, ok := g.consumers[name]; ok {
+		return c, false
+	}
+	c := &streamConsumer{name: name, seenTime: now, activeTime: -1, pending: newPendingEntries()}
+	g.consumers[name] = c
+	return c, true
+}
+
+// DeleteConsumer removes a consumer along with its pending entries and
+// returns how many it had.
+func (g *streamGroup) DeleteConsumer(c *streamConsumer) int {
+	for _, id := range c.pending.ids {
+		g.pending.Remove(id)
+	}
+	delete(g.consumers, c.name)
+	return c.pending.Len()
+}
+
+// ConsumerNames returns the names of the consumers, sorted.
+func (g *streamGroup) ConsumerNames() []string {
+	names := make([]string, 0, len(g.consumers))
+	for name := range g.consumers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Assign makes c the owner of the pending entry for id, creating it if there
+// is none, and returns it.
+func (g *streamGroup) Assign(id streamID, c *streamConsumer) *pendingEntry {
+	nack := g.pending.Get(id)
+	if nack == nil {
+		nack = &pendingEntry{id: id}
+		g.pending.Add(nack)
+	} else if nack.consumer != c {
+		nack.consumer.pending.Remove(id)
+	}
+	nack.consumer = c
+	c.pending.Add(nack)
+	return nack
+}
+
+// Ack drops id from the pending entries lists.
+func (g *streamGroup) Ack(id streamID) bool {
+	nack := g.pending.Get(id)
+	if nack == nil {
+		return false
+	}
+	g.pending.Remove(id)
+	nack.consumer.pending.Remove(id)
+	return true
+}
+
+// Advance moves the group's last delivered ID forward to id, keeping the
+// entries-read counter in step while it can be tracked exactly.
+func (g *streamGroup) Advance(s *stream, id streamID) {
+	if !g.lastID.Less(id) {
+		return
+	}
+	if g.entriesRead != invalidEntriesRead && !s.hasTombstonesFrom(id) {
+		g.entriesRead++
+	} else if s.entriesAdded > 0 {
+		g.entriesRead = s.entriesUpTo(id)
+	}
+	g.lastID = id
+}
+
+// Lag returns how many entries the group has yet to read, and false when
+// deletions make that impossible to tell.
+func (g *streamGroup) Lag(s *stream) (int64, bool) {
+	if s.entriesAdded == 0 {
+		return 0, true
+	}
+	if g.entriesRead != invalidEntriesRead && !s.hasTombstonesFrom(g.lastID) {
+		return int64(s.entriesAdded) - g.entriesRead, true
+	}
+	if read := s.entriesUpTo(g.lastID); read != invalidEntriesRead {
+		return int64(s.entriesAdded) - read, true
+	}
+	return 0, false
+}
+
+// hasTombstonesFrom reports whether an entry at or after id may have been
+// deleted.
+func (s *stream) hasTombstonesFrom(id streamID) bool {
+	if s.length == 0 || s.maxDeletedID.IsZero() {
+		return false
+	}
+	return !s.maxDeletedID.Less(id)
+}
+
+// entriesUpTo works out how many entries were ever added up to and including
+// id, or returns invalidEntriesRead when deletions hide it.
+func (s *stream) entriesUpTo(id streamID) int64 {
+	added := int64(s.entriesAdded)
+	if added == 0 {
+		return 0
+	}
+	if s.length == 0 && !s.lastID.Less(id) {
+		return added
+	}
+	switch {
+	case id == s.lastID:
+		return added
+	case s.lastID.Less(id):
+		return invalidEntriesRead
+	}
+
+	first := s.FirstID()
+	if s.maxDeletedID.IsZero() || s.maxDeletedID.Less(first) {
+		// Nothing was deleted from the live part of the stream.
+		if id.Less(first) {
+			return added - int64(s.length)
+		}
+		if id == first {
+			return added - int64(s.length) + 1
+		}
+	}
+	return invalidEntriesRead
+}
@@ -0,0 +1,663 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RESP_ERR_INVALID_STREAM_ID string = "-ERR Invalid stream ID specified as stream command argument"
+	RESP_ERR_XADD_ID_TOO_SMALL string = "-ERR The ID specified in XADD is equal or smaller than the target stream top item"
+)
+
+// streamAt returns the stream stored at key.
+func (st *RedisState) streamAt(key string) (s *stream, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	s, ok = value.val.(*stream)
+	if !ok {
+		return nil, true, true
+	}
+	return s, true, false
+}
+
+// streamEntryReply encodes an entry as a two element array of its ID and its
+// field-value pairs.
+func streamEntryReply(entry streamEntry) string {
+	return "*2\r\n" + toRespStr(entry.id.String()) + toRespStrArr(entry.fields)
+}
+
+func streamEntriesReply(entries []streamEntry) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(entries)) + "\r\n")
+	for _, entry := range entries {
+		b.WriteString(streamEntryReply(entry))
+	}
+	return b.String()
+}
+
+// streamTrim is the MAXLEN/MINID clause of XADD and XTRIM.
+type streamTrim struct {
+	given   bool
+	byMinID bool
+	maxLen  int
+	minID   streamID
+	approx  bool
+	limit   int
+}
+
+func (t streamTrim) apply(s *stream) int {
+	return s.Trim(t.byMinID, t.maxLen, t.minID, t.approx, t.limit)
+}
+
+// parseStreamTrimArgs consumes the options of XADD (when xadd is set) or
+// XTRIM starting at args[0]. For XADD it stops at the first argument that is
+// not an option, the entry ID, and returns its index.
+func parseStreamTrimArgs(args []string, xadd bool) (trim streamTrim, noMkStream bool, next int, errResp string) {
+	limitGiven := false
+	i := 0
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		moreArgs := len(args) - i - 1
+		switch {
+		case xadd && opt == "NOMKSTREAM":
+			noMkStream = true
+		case (opt == "MAXLEN" || opt == "MINID") && moreArgs >= 1:
+			if trim.given {
+				return trim, false, 0, "-ERR syntax error, MAXLEN and MINID options at the same time are not compatible"
+			}
+			trim.given = true
+			trim.byMinID = opt == "MINID"
+			if (args[i+1] == "~" || args[i+1] == "=") && moreArgs >= 2 {
+				trim.approx = args[i+1] == "~"
+				i++
+			}
+			i++
+			if trim.byMinID {
+				id, _, ok := parseStreamID(args[i], 0)
+				if !ok {
+					return trim, false, 0, RESP_ERR_INVALID_STREAM_ID
+				}
+				trim.minID = id
+			} else {
+				n, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return trim, false, 0, RESP_ERR_NOT_INTEGER
+				}
+				if n < 0 {
+					return trim, false, 0, "-ERR The MAXLEN argument must be >= 0."
+				}
+				trim.maxLen = int(min(n, math.MaxInt))
+			}
+		case opt == "LIMIT" && moreArgs >= 1:
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return trim, false, 0, RESP_ERR_NOT_INTEGER
+			}
+			if n < 0 {
+				return trim, false, 0, "-ERR The LIMIT argument must be >= 0."
+			}
+			trim.limit = int(min(n, math.MaxInt))
+			limitGiven = true
+			i++
+		case xadd:
+			// The entry ID: the remaining arguments are the entry itself.
+			return finishStreamTrim(trim, limitGiven, noMkStream, i)
+		default:
+			return trim, false, 0, RESP_ERR_SYNTAX
+		}
+	}
+	return finishStreamTrim(trim, limitGiven, noMkStream, i)
+}
+
+func finishStreamTrim(trim streamTrim, limitGiven, noMkStream bool, next int) (streamTrim, bool, int, string) {
+	if limitGiven && !trim.approx {
+		return trim, false, 0, "-ERR syntax error, LIMIT cannot be used without the special ~ option"
+	}
+	if trim.approx && !limitGiven {
+		// Like Redis, approximate trimming is bounded by default.
+		trim.limit = 100 * streamChunkSize
+	}
+	return trim, noMkStream, next, ""
+}
+
+// nextStreamID works out the ID XADD assigns after lastID: arg is "*", an
+// explicit "ms-seq" (or "ms") ID, or "ms-*" to pick the sequence only.
+func nextStreamID(arg string, lastID streamID) (streamID, string) {
+	if arg == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if ms > lastID.ms {
+			return streamID{ms, 0}, ""
+		}
+		id, ok := lastID.next()
+		if !ok {
+			return id, "-ERR The stream has exhausted the last possible ID, unable to add more items"
+		}
+		return id, ""
+	}
+
+	if msPart, ok := strings.CutSuffix(arg, "-*"); ok {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return streamID{}, RESP_ERR_INVALID_STREAM_ID
+		}
+		switch {
+		case ms > lastID.ms:
+			return streamID{ms, 0}, ""
+		case ms == lastID.ms && lastID.seq < math.MaxUint64:
+			return streamID{ms, lastID.seq + 1}, ""
+		}
+		return streamID{}, RESP_ERR_XADD_ID_TOO_SMALL
+	}
+
+	id, _, ok := parseStreamID(arg, 0)
+	if !ok {
+		return id, RESP_ERR_INVALID_STREAM_ID
+	}
+	if id.IsZero() {
+		return id, "-ERR The ID specified in XADD must be greater than 0-0"
+	}
+	if !lastID.Less(id) {
+		return id, RESP_ERR_XADD_ID_TOO_SMALL
+	}
+	return id, ""
+}
+
+func (s *RedisServer) xaddCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("XADD")
+	}
+	key := args[1]
+	trim, noMkStream, idx, errResp := parseStreamTrimArgs(args[2:], true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	idx += 2
+	if idx+1 >= len(args) || (len(args)-idx-1)%2 != 0 {
+		return wrongArgsError("XADD")
+	}
+	fields := args[idx+1:]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if noMkStream {
+			return CommandResponse{Response: RESP_NULL_BULK}
+		}
+		str = newStream()
+	}
+
+	id, errResp := nextStreamID(args[idx], str.lastID)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	str.Append(id, append([]string(nil), fields...))
+	trimmed := 0
+	if trim.given {
+		trimmed = trim.apply(str)
+	}
+	if !found {
+		s.state.storage[key] = newStorageVal(str, time.Time{})
+	}
+	s.state.keyModified(notifyStream, "xadd", key)
+	if trimmed > 0 {
+		s.state.keyModified(notifyStream, "xtrim", key)
+	}
+	s.state.signalKeyReady(key)
+
+	// Replicas get the ID that was actually assigned, and an exact trim
+	// down to the length the stream ended up with.
+	propagated := []string{RESP_COMMAND_XADD, key}
+	if trim.given {
+		propagated = append(propagated, "MAXLEN", "=", strconv.Itoa(str.Len()))
+	}
+	propagated = append(propagated, id.String())
+	s.state.propagate(append(propagated, fields...))
+
+	return CommandResponse{Response: toRespStr(id.String())}
+}
+
+func (s *RedisServer) xlenCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("XLEN")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(str.Len()))}
+}
+
+// parseStreamBound parses an XRANGE interval end. "-" and "+" stand for the
+// smallest and largest IDs, a missing sequence is filled in so the bound
+// covers the whole millisecond, and a "(" prefix makes the bound exclusive.
+func parseStreamBound(arg string, isStart bool) (streamID, string) {
+	if exclusive, ok := strings.CutPrefix(arg, "("); ok && len(arg) > 1 {
+		id, ok := parseStreamBoundID(exclusive, isStart, true)
+		if !ok {
+			return id, RESP_ERR_INVALID_STREAM_ID
+		}
+		if isStart {
+			if id, ok = id.next(); !ok {
+				return id, "-ERR invalid start ID for the interval"
+			}
+		} else if id, ok = id.prev(); !ok {
+			return id, "-ERR invalid end ID for the interval"
+		}
+		return id, ""
+	}
+
+	id, ok := parseStreamBoundID(arg, isStart, false)
+	if !ok {
+		return id, RESP_ERR_INVALID_STREAM_ID
+	}
+	return id, ""
+}
+
+func parseStreamBoundID(arg string, isStart bool, strict bool) (streamID, bool) {
+	if !strict {
+		switch arg {
+		case "-":
+			return streamID{}, true
+		case "+":
+			return maxStreamID, true
+		}
+	}
+	missingSeq := uint64(0)
+	if !isStart {
+		missingSeq = math.MaxUint64
+	}
+	id, _, ok := parseStreamID(arg, missingSeq)
+	return id, ok
+}
+
+// xrangeCommand backs XRANGE and, with rev set, XREVRANGE, which takes its
+// bounds the other way round.
+func (s *RedisServer) xrangeCommand(args []string, rev bool) CommandResponse {
+	name := RESP_COMMAND_XRANGE
+	if rev {
+		name = RESP_COMMAND_XREVRANGE
+	}
+	if len(args) < 4 {
+		return wrongArgsError(name)
+	}
+
+	startArg, endArg := args[2], args[3]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, errResp := parseStreamBound(startArg, true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	end, errResp := parseStreamBound(endArg, false)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	count := -1
+	for i := 4; i < len(args); i += 2 {
+		if strings.ToUpper(args[i]) != "COUNT" || i+1 >= len(args) {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = int(max(min(n, math.MaxInt), 0))
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+	if count == 0 {
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	return CommandResponse{Response: streamEntriesReply(str.Range(start, end, max(count, 0), rev))}
+}
+
+func (s *RedisServer) xdelCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("XDEL")
+	}
+	ids := make([]streamID, 0, len(args)-2)
+	for _, arg := range args[2:] {
+		id, _, ok := parseStreamID(arg, 0)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+		}
+		ids = append(ids, id)
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		if str.Delete(id) {
+			deleted++
+		}
+	}
+	if deleted > 0 {
+		s.state.keyModified(notifyStream, "xdel", args[1])
+		s.state.propagate(args)
+	}
+	return CommandResponse{Response: toRespInt(int64(deleted))}
+}
+
+func (s *RedisServer) xtrimCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("XTRIM")
+	}
+	trim, _, _, errResp := parseStreamTrimArgs(args[2:], false)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	if !trim.given {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	removed := trim.apply(str)
+	if removed > 0 {
+		s.state.keyModified(notifyStream, "xtrim", args[1])
+		s.state.propagate([]string{RESP_COMMAND_XTRIM, args[1], "MAXLEN", "=", strconv.Itoa(str.Len())})
+	}
+	return CommandResponse{Response: toRespInt(int64(removed))}
+}
+
+// xreadEntries returns the entries of key's stream after id, or nil when
+// there are none or key holds no stream.
+func (st *RedisState) xreadEntries(key string, after streamID, count int) []streamEntry {
+	str, found, wrongType := st.streamAt(key)
+	if !found || wrongType {
+		return nil
+	}
+	start, ok := after.next()
+	if !ok {
+		return nil
+	}
+	return str.Range(start, maxStreamID, count, false)
+}
+
+// xreadReply encodes the per-stream results of XREAD and XREADGROUP: an
+// array of [key, entries] pairs, each results element an encoded entry array.
+func xreadReply(keys []string, results []string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(keys)) + "\r\n")
+	for i, key := range keys {
+		b.WriteString("*2\r\n" + toRespStr(key) + results[i])
+	}
+	return b.String()
+}
+
+// xreadRequest holds the arguments of XREAD and XREADGROUP.
+type xreadRequest struct {
+	count    int
+	block    bool
+	timeout  time.Duration
+	noAck    bool
+	group    string
+	consumer string
+	keys     []string
+	ids      []string
+}
+
+func parseXReadArgs(args []string, xreadgroup bool) (req xreadRequest, errResp string) {
+	name := strings.ToLower(args[0])
+	streamsIdx := -1
+	for i := 1; i < len(args) && streamsIdx < 0; i++ {
+		opt := strings.ToUpper(args[i])
+		moreArgs := len(args) - i - 1
+		switch {
+		case opt == "COUNT" && moreArgs >= 1:
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return req, RESP_ERR_NOT_INTEGER
+			}
+			req.count = int(max(min(n, math.MaxInt), 0))
+			i++
+		case opt == "BLOCK" && moreArgs >= 1:
+			if req.timeout, errResp = parseBlockMillis(args[i+1]); errResp != "" {
+				return req, errResp
+			}
+			req.block = true
+			i++
+		case opt == "STREAMS" && moreArgs >= 1:
+			streamsIdx = i + 1
+		case opt == "GROUP" && moreArgs >= 2:
+			if !xreadgroup {
+				return req, "-ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead."
+			}
+			req.group, req.consumer = args[i+1], args[i+2]
+			i += 2
+		case opt == "NOACK":
+			if !xreadgroup {
+				return req, "-ERR The NOACK option is only supported by XREADGROUP. You called XREAD instead."
+			}
+			req.noAck = true
+		default:
+			return req, RESP_ERR_SYNTAX
+		}
+	}
+	if streamsIdx < 0 {
+		return req, RESP_ERR_SYNTAX
+	}
+	if xreadgroup && req.group == "" {
+		return req, "-ERR Missing GROUP option for XREADGROUP"
+	}
+	rest := args[streamsIdx:]
+	if len(rest)%2 != 0 {
+		return req, "-ERR Unbalanced '" + name + "' list of streams: for each stream key an ID or '$' must be specified."
+	}
+	req.keys, req.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+	return req, ""
+}
+
+func (s *RedisServer) xreadCommand(args []string) CommandResponse {
+	req, errResp := parseXReadArgs(args, false)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys, count := req.keys, req.count
+
+	s.state.storageMu.Lock()
+
+	// Resolve the IDs first: "$" means whatever arrives after now, and "+"
+	// the current last entry.
+	ids := make([]streamID, len(keys))
+	for i, key := range keys {
+		str, found, wrongType := s.state.streamAt(key)
+		if wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		switch req.ids[i] {
+		case "$":
+			if found {
+				ids[i] = str.lastID
+			}
+		case "+":
+			if found {
+				ids[i] = str.lastID
+				if last, ok := str.Last(); ok {
+					ids[i], _ = last.id.prev()
+				}
+			}
+		default:
+			id, _, ok := parseStreamID(req.ids[i], 0)
+			if !ok {
+				s.state.storageMu.Unlock()
+				return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+			}
+			ids[i] = id
+		}
+	}
+
+	var readyKeys, results []string
+	for i, key := range keys {
+		if entries := s.state.xreadEntries(key, ids[i], count); len(entries) > 0 {
+			readyKeys = append(readyKeys, key)
+			results = append(results, streamEntriesReply(entries))
+		}
+	}
+	if len(readyKeys) > 0 {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: xreadReply(readyKeys, results)}
+	}
+	if !req.block || s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+
+	serve := func(key string) (CommandResponse, bool) {
+		for i, k := range keys {
+			if k != key {
+				continue
+			}
+			if entries := s.state.xreadEntries(key, ids[i], count); len(entries) > 0 {
+				return CommandResponse{Response: xreadReply([]string{key}, []string{streamEntriesReply(entries)})}, true
+			}
+		}
+		return CommandResponse{}, false
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, req.timeout, RESP_NULL_ARRAY)
+}
+
+func (s *RedisServer) xinfoCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("XINFO")
+	}
+
+	sub := strings.ToUpper(args[1])
+	switch sub {
+	case "STREAM":
+		if len(args) < 3 {
+			return wrongArgsError("XINFO|stream")
+		}
+		return s.xinfoStreamCommand(args)
+	case "GROUPS":
+		if len(args) != 3 {
+			return wrongArgsError("XINFO|groups")
+		}
+		return s.xinfoGroupsCommand(args)
+	case "CONSUMERS":
+		if len(args) != 4 {
+			return wrongArgsError("XINFO|consumers")
+		}
+		return s.xinfoConsumersCommand(args)
+	}
+	return CommandResponse{Error: "-ERR unknown subcommand '" + args[1] + "'. Try XINFO HELP."}
+}
+
+// xinfoStreamCommand implements XINFO STREAM key [FULL [COUNT count]].
+func (s *RedisServer) xinfoStreamCommand(args []string) CommandResponse {
+	full := false
+	count := 10
+	if opts := args[3:]; len(opts) > 0 {
+		if strings.ToUpper(opts[0]) != "FULL" {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		full = true
+		switch {
+		case len(opts) == 3 && strings.ToUpper(opts[1]) == "COUNT":
+			n, err := strconv.ParseInt(opts[2], 10, 64)
+			if err != nil {
+				return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+			}
+			count = int(max(min(n, math.MaxInt), 0))
+		case len(opts) != 1:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[2])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Error: "-ERR no such key"}
+	}
+
+	var b strings.Builder
+	fields := 10
+	if full {
+		fields = 9
+	}
+	b.WriteString("*" + strconv.Itoa(2*fields) + "\r\n")
+	b.WriteString(toRespStr("length") + toRespInt(int64(str.Len())))
+	// Each chunk stands in for a radix tree key, hanging off a single root.
+	b.WriteString(toRespStr("radix-tree-keys") + toRespInt(int64(len(str.chunks))))
+	b.WriteString(toRespStr("radix-tree-nodes") + toRespInt(int64(len(str.chunks)+1)))
+	b.WriteString(toRespStr("last-generated-id") + toRespStr(str.lastID.String()))
+	b.WriteString(toRespStr("max-deleted-entry-id") + toRespStr(str.maxDeletedID.String()))
+	b.WriteString(toRespStr("entries-added") + toRespInt(int64(str.entriesAdded)))
+	b.WriteString(toRespStr("recorded-first-entry-id") + toRespStr(str.FirstID().String()))
+
+	if full {
+		b.WriteString(toRespStr("entries") + streamEntriesReply(str.Range(streamID{}, maxStreamID, count, false)))
+		b.WriteString(toRespStr("groups") + streamGroupsFullReply(str, count, time.Now().UnixMilli()))
+		return CommandResponse{Response: b.String()}
+	}
+
+	b.WriteString(toRespStr("groups") + toRespInt(int64(len(str.groups))))
+	first, _ := str.First()
+	last, _ := str.Last()
+	b.WriteString(toRespStr("first-entry") + optionalStreamEntryReply(first, str.Len() > 0))
+	b.WriteString(toRespStr("last-entry") + optionalStreamEntryReply(last, str.Len() > 0))
+	return CommandResponse{Response: b.String()}
+}
+
+func optionalStreamEntryReply(entry streamEntry, ok bool) string {
+	if !ok {
+		return RESP_NULL_BULK
+	}
+	return streamEntryReply(entry)
+}
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamGroupAt returns the stream at key and its consumer group named
+// group; either is nil when missing.
+func (st *RedisState) streamGroupAt(key, group string) (str *stream, g *streamGroup, wrongType bool) {
+	str, found, wrongType := st.streamAt(key)
+	if !found || wrongType {
+		return nil, nil, wrongType
+	}
+	return str, str.Group(group), false
+}
+
+func noSuchKeyOrGroup(key, group string) CommandResponse {
+	return CommandResponse{Error: "-NOGROUP No such key '" + key + "' or consumer group '" + group + "'"}
+}
+
+func noSuchGroup(key, group string) CommandResponse {
+	return CommandResponse{Error: "-NOGROUP No such consumer group '" + group + "' for key name '" + key + "'"}
+}
+
+// groupConsumer returns the named consumer of g, creating it when needed,
+// and marks it as just seen.
+func (st *RedisState) groupConsumer(key, group string, g *streamGroup, name string, now int64) *streamConsumer {
+	c, created := g.CreateConsumer(name, now)
+	if created {
+		st.keyModified(notifyStream, "xgroup-createconsumer", key)
+		st.propagate([]string{RESP_COMMAND_XGROUP, "CREATECONSUMER", key, group, name})
+	}
+	c.seenTime = now
+	return c
+}
+
+// propagateClaim replicates the owner and delivery metadata of a pending
+// entry. Like Redis, it uses an XCLAIM that sets everything explicitly.
+func (st *RedisState) propagateClaim(key, group string, nack *pendingEntry) {
+	st.propagate([]string{
+		RESP_COMMAND_XCLAIM, key, group, nack.consumer.name, "0", nack.id.String(),
+		"TIME", strconv.FormatInt(nack.deliveryTime, 10),
+		"RETRYCOUNT", strconv.FormatUint(nack.deliveryCount, 10),
+		"FORCE", "JUSTID",
+	})
+}
+
+// propagateGroupID replicates the last delivered ID and entries-read counter
+// of a group.
+func (st *RedisState) propagateGroupID(key, group string, g *streamGroup) {
+	st.propagate([]string{
+		RESP_COMMAND_XGROUP, "SETID", key, group, g.lastID.String(),
+		"ENTRIESREAD", strconv.FormatInt(g.entriesRead, 10),
+	})
+}
+
+// parseGroupID parses the ID argument of XGROUP CREATE and SETID, where "$"
+// stands for the last ID of the stream.
+func parseGroupID(arg string, str *stream) (streamID, bool) {
+	if arg == "$" {
+		if str == nil {
+			return streamID{}, true
+		}
+		return str.lastID, true
+	}
+	id, _, ok := parseStreamID(arg, 0)
+	return id, ok
+}
+
+func (s *RedisServer) xgroupCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("XGROUP")
+	}
+
+	sub := strings.ToUpper(args[1])
+	minArgs, maxArgs := 0, 0
+	switch sub {
+	case "CREATE":
+		minArgs, maxArgs = 5, 8
+	case "SETID":
+		minArgs, maxArgs = 5, 7
+	case "DESTROY":
+		minArgs, maxArgs = 4, 4
+	case "CREATECONSUMER", "DELCONSUMER":
+		minArgs, maxArgs = 5, 5
+	default:
+		return CommandResponse{Error: "-ERR unknown subcommand '" + args[1] + "'. Try XGROUP HELP."}
+	}
+	if len(args) < minArgs || len(args) > maxArgs {
+		return wrongArgsError("XGROUP|" + strings.ToLower(sub))
+	}
+	key, group := args[2], args[3]
+
+	mkStream := false
+	entriesRead := int64(invalidEntriesRead)
+	if sub == "CREATE" || sub == "SETID" {
+		for i := 5; i < len(args); i++ {
+			switch opt := strings.ToUpper(args[i]); {
+			case opt == "MKSTREAM" && sub == "CREATE":
+				mkStream = true
+			case opt == "ENTRIESREAD" && i+1 < len(args):
+				n, err := strconv.ParseInt(args[i+1], 10, 64)
+				if err != nil {
+					return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+				}
+				if n < invalidEntriesRead {
+					return CommandResponse{Error: "-ERR value for ENTRIESREAD must be positive or -1"}
+				}
+				entriesRead = n
+				i++
+			default:
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found && !mkStream {
+		return CommandResponse{Error: "-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically."}
+	}
+
+	if sub == "CREATE" {
+		id, ok := parseGroupID(args[4], str)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+		}
+		if !found {
+			str = newStream()
+		}
+		if _, created := str.CreateGroup(group, id, entriesRead); !created {
+			return CommandResponse{Error: "-BUSYGROUP Consumer Group name already exists"}
+		}
+		if !found {
+			s.state.storage[key] = newStorageVal(str, time.Time{})
+		}
+		s.state.keyModified(notifyStream, "xgroup-create", key)
+		s.state.propagate(args)
+		return CommandResponse{Response: "+OK\r\n"}
+	}
+
+	g := str.Group(group)
+	if sub == "DESTROY" {
+		if g == nil {
+			return CommandResponse{Response: ":0\r\n"}
+		}
+		delete(str.groups, group)
+		s.state.keyModified(notifyStream, "xgroup-destroy", key)
+		// Clients blocked reading through the group get an error.
+		s.state.signalKeyReady(key)
+		s.state.propagate(args)
+		return CommandResponse{Response: ":1\r\n"}
+	}
+	if g == nil {
+		return noSuchGroup(key, group)
+	}
+
+	switch sub {
+	case "SETID":
+		id, ok := parseGroupID(args[4], str)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+		}
+		g.lastID = id
+		g.entriesRead = entriesRead
+		s.state.keyModified(notifyStream, "xgroup-setid", key)
+		s.state.propagate(args)
+		return CommandResponse{Response: "+OK\r\n"}
+
+	case "CREATECONSUMER":
+		if _, created := g.CreateConsumer(args[4], time.Now().UnixMilli()); !created {
+			return CommandResponse{Response: ":0\r\n"}
+		}
+		s.state.keyModified(notifyStream, "xgroup-createconsumer", key)
+		s.state.propagate(args)
+		return CommandResponse{Response: ":1\r\n"}
+	}
+
+	// DELCONSUMER
+	c := g.Consumer(args[4])
+	if c == nil {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	pending := g.DeleteConsumer(c)
+	s.state.keyModified(notifyStream, "xgroup-delconsumer", key)
+	s.state.propagate(args)
+	return CommandResponse{Response: toRespInt(int64(pending))}
+}
+
+// deliverNew hands consumer c up to count entries group g has not seen yet,
+// adding them to the pending entries lists unless noAck is set.
+func (st *RedisState) deliverNew(key string, str *stream, group string, g *streamGroup, c *streamConsumer, count int, noAck bool, now int64) []streamEntry {
+	start, ok := g.lastID.next()
+	if !ok {
+		return nil
+	}
+	entries := str.Range(start, maxStreamID, count, false)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	for _, entry := range entries {
+		g.Advance(str, entry.id)
+		if noAck {
+			continue
+		}
+		nack := g.Assign(entry.id, c)
+		nack.deliveryTime = now
+		nack.deliveryCount = 1
+		st.propagateClaim(key, group, nack)
+	}
+	c.activeTime = now
+	st.propagateGroupID(key, group, g)
+	return entries
+}
+
+// deliverHistory returns the encoded entries pending for consumer c after
+// id, counting each as delivered again. Entries deleted from the stream
+// since come back with no fields.
+func (st *RedisState) deliverHistory(key string, str *stream, group string, c *streamConsumer, after streamID, count int, now int64) string {
+	var nacks []*pendingEntry
+	if start, ok := after.next(); ok {
+		nacks = c.pending.Range(start, maxStreamID, count)
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(nacks)) + "\r\n")
+	for _, nack := range nacks {
+		entry, ok := str.Get(nack.id)
+		if !ok {
+			b.WriteString("*2\r\n" + toRespStr(nack.id.String()) + RESP_NULL_ARRAY)
+			continue
+		}
+		nack.deliveryTime = now
+		nack.deliveryCount++
+		st.propagateClaim(key, group, nack)
+		b.WriteString(streamEntryReply(entry))
+	}
+	return b.String()
+}
+
+func (s *RedisServer) xreadgroupCommand(args []string) CommandResponse {
+	req, errResp := parseXReadArgs(args, true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys := req.keys
+	now := time.Now().UnixMilli()
+
+	s.state.storageMu.Lock()
+
+	// Check every stream, group and ID before delivering anything.
+	ids := make([]streamID, len(keys))
+	for i, key := range keys {
+		_, g, wrongType := s.state.streamGroupAt(key, req.group)
+		if wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if g == nil {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: "-NOGROUP No such key '" + key + "' or consumer group '" + req.group + "' in XREADGROUP with GROUP option"}
+		}
+		switch req.ids[i] {
+		case ">":
+		case "$":
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: "-ERR The $ ID is meaningless in the context of XREADGROUP"}
+		default:
+			id, _, ok := parseStreamID(req.ids[i], 0)
+			if !ok {
+				s.state.storageMu.Unlock()
+				return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+			}
+			ids[i] = id
+		}
+	}
+
+	// ">" reads entries never delivered to the group; any other ID reads
+	// the consumer's own pending entries after it, which always answers,
+	// even with nothing.
+	var readyKeys, results []string
+	for i, key := range keys {
+		str, g, _ := s.state.streamGroupAt(key, req.group)
+		c := s.state.groupConsumer(key, req.group, g, req.consumer, now)
+		if req.ids[i] != ">" {
+			readyKeys = append(readyKeys, key)
+			results = append(results, s.state.deliverHistory(key, str, req.group, c, ids[i], req.count, now))
+			continue
+		}
+		if entries := s.state.deliverNew(key, str, req.group, g, c, req.count, req.noAck, now); len(entries) > 0 {
+			readyKeys = append(readyKeys, key)
+			results = append(results, streamEntriesReply(entries))
+		}
+	}
+	if len(readyKeys) > 0 {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: xreadReply(readyKeys, results)}
+	}
+	if !req.block || s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+
+	serve := func(key string) (CommandResponse, bool) {
+		str, g, wrongType := s.state.streamGroupAt(key, req.group)
+		if str == nil || wrongType {
+			return CommandResponse{}, false
+		}
+		if g == nil {
+			return CommandResponse{Error: "-NOGROUP the consumer group this client was blocked on no longer exists"}, true
+		}
+		now := time.Now().UnixMilli()
+		c := s.state.groupConsumer(key, req.group, g, req.consumer, now)
+		entries := s.state.deliverNew(key, str, req.group, g, c, req.count, req.noAck, now)
+		if len(entries) == 0 {
+			return CommandResponse{}, false
+		}
+		return CommandResponse{Response: xreadReply([]string{key}, []string{streamEntriesReply(entries)})}, true
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, req.timeout, RESP_NULL_ARRAY)
+}
+
+func (s *RedisServer) xackCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("XACK")
+	}
+	ids := make([]streamID, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		id, _, ok := parseStreamID(arg, 0)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+		}
+		ids = append(ids, id)
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	_, g, wrongType := s.state.streamGroupAt(args[1], args[2])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if g == nil {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	acked := 0
+	for _, id := range ids {
+		if g.Ack(id) {
+			acked++
+		}
+	}
+	if acked > 0 {
+		s.state.propagate(args)
+	}
+	return CommandResponse{Response: toRespInt(int64(acked))}
+}
+
+// xpendingCommand implements both forms of XPENDING: the summary
+// "XPENDING key group" and the extended
+// "XPENDING key group [IDLE min-idle-time] start end count [consumer]".
+func (s *RedisServer) xpendingCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("XPENDING")
+	}
+	key, group := args[1], args[2]
+
+	extended := len(args) > 3
+	minIdle := int64(0)
+	var start, end streamID
+	count := 0
+	consumer := ""
+	if extended {
+		rest := args[3:]
+		if strings.ToUpper(rest[0]) == "IDLE" && len(rest) >= 2 {
+			n, err := strconv.ParseInt(rest[1], 10, 64)
+			if err != nil {
+				return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+			}
+			minIdle = n
+			rest = rest[2:]
+		}
+		if len(rest) != 3 && len(rest) != 4 {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		var errResp string
+		if start, errResp = parseStreamBound(rest[0], true); errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		if end, errResp = parseStreamBound(rest[1], false); errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		n, err := strconv.ParseInt(rest[2], 10, 64)
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = int(max(min(n, math.MaxInt), 0))
+		if len(rest) == 4 {
+			consumer = rest[3]
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	_, g, wrongType := s.state.streamGroupAt(key, group)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if g == nil {
+		return noSuchKeyOrGroup(key, group)
+	}
+
+	if !extended {
+		if g.pending.Len() == 0 {
+			return CommandResponse{Response: "*4\r\n:0\r\n" + RESP_NULL_BULK + RESP_NULL_BULK + RESP_NULL_ARRAY}
+		}
+		var b strings.Builder
+		b.WriteString("*4\r\n" + toRespInt(int64(g.pending.Len())))
+		b.WriteString(toRespStr(g.pending.ids[0].String()))
+		b.WriteString(toRespStr(g.pending.ids[g.pending.Len()-1].String()))
+		var owners []string
+		for _, name := range g.ConsumerNames() {
+			if n := g.consumers[name].pending.Len(); n > 0 {
+				owners = append(owners, toRespArr(name, strconv.Itoa(n)))
+			}
+		}
+		b.WriteString("*" + strconv.Itoa(len(owners)) + "\r\n" + strings.Join(owners, ""))
+		return CommandResponse{Response: b.String()}
+	}
+
+	if count == 0 {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+	pel := g.pending
+	if consumer != "" {
+		c := g.Consumer(consumer)
+		if c == nil {
+			return CommandResponse{Response: "*0\r\n"}
+		}
+		pel = c.pending
+	}
+
+	now := time.Now().UnixMilli()
+	var rows []string
+	for _, nack := range pel.Range(start, end, 0) {
+		if len(rows) == count {
+			break
+		}
+		idle := now - nack.deliveryTime
+		if idle < minIdle {
+			continue
+		}
+		rows = append(rows, "*4\r\n"+toRespStr(nack.id.String())+toRespStr(nack.consumer.name)+
+			toRespInt(idle)+toRespInt(int64(nack.deliveryCount)))
+	}
+	return CommandResponse{Response: "*" + strconv.Itoa(len(rows)) + "\r\n" + strings.Join(rows, "")}
+}
+
+// claimPending makes c the owner of nack and records the new delivery.
+func claimPending(g *streamGroup, c *streamConsumer, nack *pendingEntry, deliveryTime int64, countDelivery bool, now int64) {
+	g.Assign(nack.id, c)
+	nack.deliveryTime = deliveryTime
+	if countDelivery {
+		nack.deliveryCount++
+	}
+	c.activeTime = now
+}
+
+// dropDeleted removes a pending entry whose stream entry was deleted, and
+// replicates that as the equivalent XACK.
+func (st *RedisState) dropDeleted(key, group string, g *streamGroup, id streamID) {
+	g.Ack(id)
+	st.propagate([]string{RESP_COMMAND_XACK, key, group, id.String()})
+}
+
+func (s *RedisServer) xclaimCommand(args []string) CommandResponse {
+	if len(args) < 6 {
+		return wrongArgsError("XCLAIM")
+	}
+	key, group, consumer := args[1], args[2], args[3]
+	minIdle, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return CommandResponse{Error: "-ERR Invalid min-idle-time argument for XCLAIM"}
+	}
+	minIdle = max(minIdle, 0)
+
+	// The IDs run up to the first argument that is not one.
+	var ids []streamID
+	i := 5
+	for ; i < len(args); i++ {
+		id, _, ok := parseStreamID(args[i], 0)
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+	}
+
+	now := time.Now().UnixMilli()
+	deliveryTime := now
+	retryCount := int64(-1)
+	force, justID := false, false
+	var lastID *streamID
+	for ; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		moreArgs := len(args) - i - 1
+		switch {
+		case opt == "FORCE":
+			force = true
+		case opt == "JUSTID":
+			justID = true
+		case opt == "IDLE" && moreArgs >= 1:
+			idle, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return CommandResponse{Error: "-ERR Invalid IDLE option argument for XCLAIM"}
+			}
+			deliveryTime = now - idle
+			i++
+		case opt == "TIME" && moreArgs >= 1:
+			t, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return CommandResponse{Error: "-ERR Invalid TIME option argument for XCLAIM"}
+			}
+			deliveryTime = t
+			i++
+		case opt == "RETRYCOUNT" && moreArgs >= 1:
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n < 0 {
+				return CommandResponse{Error: "-ERR Invalid RETRYCOUNT option argument for XCLAIM"}
+			}
+			retryCount = n
+			i++
+		case opt == "LASTID" && moreArgs >= 1:
+			id, _, ok := parseStreamID(args[i+1], 0)
+			if !ok {
+				return CommandResponse{Error: RESP_ERR_INVALID_STREAM_ID}
+			}
+			lastID = &id
+			i++
+		default:
+			return CommandResponse{Error: "-ERR Unrecognized XCLAIM option '" + args[i] + "'"}
+		}
+	}
+	if deliveryTime < 0 || deliveryTime > now {
+		deliveryTime = now
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, g, wrongType := s.state.streamGroupAt(key, group)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if g == nil {
+		return noSuchKeyOrGroup(key, group)
+	}
+	if lastID != nil && g.lastID.Less(*lastID) {
+		g.lastID = *lastID
+		s.state.propagateGroupID(key, group, g)
+	}
+	c := s.state.groupConsumer(key, group, g, consumer, now)
+
+	var claimed []string
+	for _, id := range ids {
+		entry, exists := str.Get(id)
+		nack := g.pending.Get(id)
+		if nack == nil {
+			// FORCE creates the pending entry, as long as the stream still
+			// has the entry.
+			if !force || !exists {
+				continue
+			}
+			nack = g.Assign(id, c)
+			nack.deliveryCount = 1
+		} else if !exists {
+			s.state.dropDeleted(key, group, g, id)
+			continue
+		} else if minIdle > 0 && now-nack.deliveryTime < minIdle {
+			continue
+		}
+
+		claimPending(g, c, nack, deliveryTime, retryCount < 0 && !justID, now)
+		if retryCount >= 0 {
+			nack.deliveryCount = uint64(retryCount)
+		}
+		s.state.propagateClaim(key, group, nack)
+		if justID {
+			claimed = append(claimed, toRespStr(id.String()))
+		} else {
+			claimed = append(claimed, streamEntryReply(entry))
+		}
+	}
+	return CommandResponse{Response: "*" + strconv.Itoa(len(claimed)) + "\r\n" + strings.Join(claimed, "")}
+}
+
+func (s *RedisServer) xautoclaimCommand(args []string) CommandResponse {
+	if len(args) < 6 {
+		return wrongArgsError("XAUTOCLAIM")
+	}
+	key, group, consumer := args[1], args[2], args[3]
+	minIdle, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return CommandResponse{Error: "-ERR Invalid min-idle-time argument for XAUTOCLAIM"}
+	}
+	minIdle = max(minIdle, 0)
+	start, errResp := parseStreamBound(args[5], true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	count := 100
+	justID := false
+	for i := 6; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "COUNT" && i+1 < len(args):
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+			}
+			if n < 1 || n > math.MaxInt64/10 {
+				return CommandResponse{Error: "-ERR COUNT must be > 0"}
+			}
+			count = int(n)
+			i++
+		case opt == "JUSTID":
+			justID = true
+		default:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, g, wrongType := s.state.streamGroupAt(key, group)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if g == nil {
+		return noSuchKeyOrGroup(key, group)
+	}
+	now := time.Now().UnixMilli()
+	c := s.state.groupConsumer(key, group, g, consumer, now)
+
+	// Scan the group's pending entries from start, looking at no more than
+	// ten per entry asked for.
+	var claimed, deleted []string
+	attempts := count * 10
+	i := g.pending.search(start)
+	for ; i < g.pending.Len() && attempts > 0 && len(claimed) < count; attempts-- {
+		nack := g.pending.Get(g.pending.ids[i])
+		entry, exists := str.Get(nack.id)
+		if !exists {
+			deleted = append(deleted, nack.id.String())
+			s.state.dropDeleted(key, group, g, nack.id)
+			continue
+		}
+		i++
+		if now-nack.deliveryTime < minIdle {
+			continue
+		}
+		claimPending(g, c, nack, now, !justID, now)
+		s.state.propagateClaim(key, group, nack)
+		if justID {
+			claimed = append(claimed, toRespStr(nack.id.String()))
+		} else {
+			claimed = append(claimed, streamEntryReply(entry))
+		}
+	}
+
+	cursor := streamID{}
+	if i < g.pending.Len() {
+		cursor = g.pending.ids[i]
+	}
+	return CommandResponse{Response: "*3\r\n" + toRespStr(cursor.String()) +
+		"*" + strconv.Itoa(len(claimed)) + "\r\n" + strings.Join(claimed, "") +
+		toRespStrArr(deleted)}
+}
+
+// entriesReadReply encodes a group's entries-read counter, null when unknown.
+func entriesReadReply(g *streamGroup) string {
+	if g.entriesRead == invalidEntriesRead {
+		return RESP_NULL_BULK
+	}
+	return toRespInt(g.entriesRead)
+}
+
+func lagReply(str *stream, g *streamGroup) string {
+	lag, ok := g.Lag(str)
+	if !ok {
+		return RESP_NULL_BULK
+	}
+	return toRespInt(lag)
+}
+
+func (s *RedisServer) xinfoGroupsCommand(args []string) CommandResponse {
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(args[2])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Error: "-ERR no such key"}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(str.groups)) + "\r\n")
+	for _, name := range str.GroupNames() {
+		g := str.groups[name]
+		b.WriteString("*12\r\n")
+		b.WriteString(toRespStr("name") + toRespStr(name))
+		b.WriteString(toRespStr("consumers") + toRespInt(int64(len(g.consumers))))
+		b.WriteString(toRespStr("pending") + toRespInt(int64(g.pending.Len())))
+		b.WriteString(toRespStr("last-delivered-id") + toRespStr(g.lastID.String()))
+		b.WriteString(toRespStr("entries-read") + entriesReadReply(g))
+		b.WriteString(toRespStr("lag") + lagReply(str, g))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+func (s *RedisServer) xinfoConsumersCommand(args []string) CommandResponse {
+	key, group := args[2], args[3]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.streamAt(key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Error: "-ERR no such key"}
+	}
+	g := str.Group(group)
+	if g == nil {
+		return noSuchGroup(key, group)
+	}
+
+	now := time.Now().UnixMilli()
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(g.consumers)) + "\r\n")
+	for _, name := range g.ConsumerNames() {
+		c := g.consumers[name]
+		inactive := int64(-1)
+		if c.activeTime != -1 {
+			inactive = now - c.activeTime
+		}
+		b.WriteString("*8\r\n")
+		b.WriteString(toRespStr("name") + toRespStr(name))
+		b.WriteString(toRespStr("pending") + toRespInt(int64(c.pending.Len())))
+		b.WriteString(toRespStr("idle") + toRespInt(now-c.seenTime))
+		b.WriteString(toRespStr("inactive") + toRespInt(inactive))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+// streamGroupsFullReply encodes the groups section of XINFO STREAM FULL,
+// listing up to count pending entries (0 for all) per group and consumer.
+func streamGroupsFullReply(str *stream, count int, now int64) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(str.groups)) + "\r\n")
+	for _, name := range str.GroupNames() {
+		g := str.groups[name]
+		b.WriteString("*14\r\n")
+		b.WriteString(toRespStr("name") + toRespStr(name))
+		b.WriteString(toRespStr("last-delivered-id") + toRespStr(g.lastID.String()))
+		b.WriteString(toRespStr("entries-read") + entriesReadReply(g))
+		b.WriteString(toRespStr("lag") + lagReply(str, g))
+		b.WriteString(toRespStr("pel-count") + toRespInt(int64(g.pending.Len())))
+
+		nacks := g.pending.Range(streamID{}, maxStreamID, count)
+		b.WriteString(toRespStr("pending") + "*" + strconv.Itoa(len(nacks)) + "\r\n")
+		for _, nack := range nacks {
+			b.WriteString("*4\r\n" + toRespStr(nack.id.String()) + toRespStr(nack.consumer.name) +
+				toRespInt(nack.deliveryTime) + toRespInt(int64(nack.deliveryCount)))
+		}
+
+		b.WriteString(toRespStr("consumers") + "*" + strconv.Itoa(len(g.consumers)) + "\r\n")
+		for _, cname := range g.ConsumerNames() {
+			c := g.consumers[cname]
+			b.WriteString("*10\r\n")
+			b.WriteString(toRespStr("name") + toRespStr(cname))
+			b.WriteString(toRespStr("seen-time") + toRespInt(c.seenTime))
+			b.WriteString(toRespStr("active-time") + toRespInt(c.activeTime))
+			b.WriteString(toRespStr("pel-count") + toRespInt(int64(c.pending.Len())))
+			nacks := c.pending.Range(streamID{}, maxStreamID, count)
+			b.WriteString(toRespStr("pending") + "*" + strconv.Itoa(len(nacks)) + "\r\n")
+			for _, nack := range nacks {
+				b.WriteString("*3\r\n" + toRespStr(nack.id.String()) +
+					toRespInt(nack.deliveryTime) + toRespInt(int64(nack.deliveryCount)))
+			}
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStringLength mirrors Redis' default proto-max-bulk-len.
+const maxStringLength = 512 * 1024 * 1024
+
+// stringAt returns the string stored at key. found is false when the key does
+// not exist; wrongType is true when it holds a value of another type. The
+// caller must hold storageMu for writing.
+func (st *RedisState) stringAt(key string) (str string, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return "", false, false
+	}
+	str, ok = valueString(value.val)
+	if !ok {
+		return "", true, true
+	}
+	return str, true, false
+}
+
+// encodeString picks the internal representation of a string value. Strings
+// that round-trip through int64 are kept as integers, like Redis' "int"
+// encoding, so counters never have to be re-parsed.
+func encodeString(str string) interface{} {
+	if len(str) <= 20 {
+		if n, ok := parseStrictInt(str); ok {
+			return n
+		}
+	}
+	return str
+}
+
+// valueString returns the string form of a string value in any encoding. ok
+// is false when val is not a string at all.
+func valueString(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// mutableString returns the bytes of a string value for in-place editing.
+// Values already held as a []byte (Redis' "raw" encoding, which APPEND,
+// SETRANGE and the bit commands leave behind) are returned as is; the other
+// encodings are copied. ok is false when val is not a string.
+func mutableString(val interface{}) ([]byte, bool) {
+	switch v := val.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	case int64:
+		return strconv.AppendInt(nil, v, 10), true
+	}
+	return nil, false
+}
+
+// parseExpireArg converts the argument of an EX/PX/EXAT/PXAT style option into
+// an absolute expiry time. The returned error string is empty on success.
+func parseExpireArg(unit string, arg string, cmd string) (time.Time, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, RESP_ERR_NOT_INTEGER
+	}
+	if n <= 0 {
+		return time.Time{}, "-ERR invalid expire time in '" + strings.ToLower(cmd) + "' command"
+	}
+
+	var ms int64
+	switch unit {
+	case "EX", "EXAT":
+		if n > math.MaxInt64/1000 {
+			return time.Time{}, "-ERR invalid expire time in '" + strings.ToLower(cmd) + "' command"
+		}
+		ms = n * 1000
+	default:
+		ms = n
+	}
+
+	if unit == "EXAT" || unit == "PXAT" {
+		return time.UnixMilli(ms), ""
+	}
+	if ms > (math.MaxInt64-time.Now().UnixNano())/int64(time.Millisecond) {
+		return time.Time{}, "-ERR invalid expire time in '" + strings.ToLower(cmd) + "' command"
+	}
+	return time.Now().Add(time.Duration(ms) * time.Millisecond), ""
+}
+
+// storeString writes str at key with the given expiry and propagates the
+// write to replicas as an absolute-time SET so that they converge on the same
+// deadline. A deadline already in the past deletes the key instead, and false
+// is returned.
+func (s *RedisServer) storeString(key string, str string, expireAt time.Time) bool {
+	if !expireAt.IsZero() && !expireAt.After(time.Now()) {
+		s.state.deleteKey(key)
+		s.state.propagate([]string{"DEL", key})
+		return false
+	}
+	s.state.storage[key] = newStorageVal(encodeString(str), expireAt)
+	if expireAt.IsZero() {
+		s.state.propagate([]string{"SET", key, str})
+	} else {
+		s.state.propagate([]string{"SET", key, str, "PXAT", strconv.FormatInt(expireAt.UnixMilli(), 10)})
+	}
+	return true
+}
+
+// notifySet raises the events of a SET-like write of key, which also set a
+// TTL when expires is true.
+func (st *RedisState) notifySet(key string, expires bool) {
+	st.keyModified(notifyString, "set", key)
+	if expires {
+		st.keyModified(notifyGeneric, "expire", key)
+	}
+}
+
+func (s *RedisServer) setCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("SET")
+	}
+	key, str := args[1], args[2]
+
+	var nx, xx, get, keepTTL bool
+	var expireAt time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "NX":
+			if xx {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			nx = true
+		case "XX":
+			if nx {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			xx = true
+		case "GET":
+			get = true
+		case "KEEPTTL":
+			if !expireAt.IsZero() {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || !expireAt.IsZero() || i+1 >= len(args) {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			i++
+			var errResp string
+			expireAt, errResp = parseExpireArg(opt, args[i], "SET")
+			if errResp != "" {
+				return CommandResponse{Error: errResp}
+			}
+		default:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	old, exists := s.state.lookupKey(key)
+	oldStr, isStr := valueString(old.val)
+	if get && exists && !isStr {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	reply := "+OK\r\n"
+	if get {
+		reply = RESP_NULL_BULK
+		if exists {
+			reply = toRespStr(oldStr)
+		}
+	}
+
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			return CommandResponse{Response: reply}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	expires := !expireAt.IsZero()
+	if keepTTL && exists {
+		expireAt = old.expireAt()
+	}
+	if s.storeString(key, str, expireAt) {
+		s.state.notifySet(key, expires)
+	}
+
+	return CommandResponse{Response: reply}
+}
+
+func (s *RedisServer) getCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("GET")
+	}
+
+	s.state.storageMu.Lock()
+	str, found, wrongType := s.state.stringAt(args[1])
+	s.state.storageMu.Unlock()
+
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(str)}
+}
+
+func (s *RedisServer) setnxCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("SETNX")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	if _, exists := s.state.lookupKey(args[1]); exists {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	s.storeString(args[1], args[2], time.Time{})
+	s.state.notifySet(args[1], false)
+	return CommandResponse{Response: ":1\r\n"}
+}
+
+// setexCommand implements both SETEX (seconds) and PSETEX (milliseconds).
+func (s *RedisServer) setexCommand(args []string, unit string) CommandResponse {
+	cmd := "SETEX"
+	if unit == "PX" {
+		cmd = "PSETEX"
+	}
+	if len(args) != 4 {
+		return wrongArgsError(cmd)
+	}
+
+	expireAt, errResp := parseExpireArg(unit, args[2], cmd)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	if s.storeString(args[1], args[3], expireAt) {
+		s.state.notifySet(args[1], true)
+	}
+	s.state.storageMu.Unlock()
+
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) getsetCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("GETSET")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	old, found, wrongType := s.state.stringAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	s.storeString(args[1], args[2], time.Time{})
+	s.state.notifySet(args[1], false)
+
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(old)}
+}
+
+func (s *RedisServer) getdelCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("GETDEL")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.stringAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	s.state.deleteKey(args[1])
+	s.state.propagate([]string{"DEL", args[1]})
+
+	return CommandResponse{Response: toRespStr(str)}
+}
+
+func (s *RedisServer) getexCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("GETEX")
+	}
+
+	var expireAt time.Time
+	persist := false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		switch opt {
+		case "PERSIST":
+			if !expireAt.IsZero() {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			persist = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if persist || !expireAt.IsZero() || i+1 >= len(args) {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			i++
+			var errResp string
+			expireAt, errResp = parseExpireArg(opt, args[i], "GETEX")
+			if errResp != "" {
+				return CommandResponse{Error: errResp}
+			}
+		default:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	str, found, wrongType := s.state.stringAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	if persist || !expireAt.IsZero() {
+		if s.storeString(args[1], str, expireAt) {
+			if persist {
+				s.state.keyModified(notifyGeneric, "persist", args[1])
+			} else {
+				s.state.keyModified(notifyGeneric, "expire", args[1])
+			}
+		}
+	}
+
+	return CommandResponse{Response: toRespStr(str)}
+}
+
+func (s *RedisServer) mgetCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("MGET")
+	}
+
+	s.state.storageMu.RLock()
+	defer s.state.storageMu.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)-1) + "\r\n")
+	for _, key := range args[1:] {
+		value, ok := s.state.readKey(key)
+		str, isStr := valueString(value.val)
+		if !ok || !isStr {
+			b.WriteString(RESP_NULL_BULK)
+			continue
+		}
+		b.WriteString(toRespStr(str))
+	}
+
+	return CommandResponse{Response: b.String()}
+}
+
+func (s *RedisServer) msetCommand(args []string) CommandResponse {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return wrongArgsError("MSET")
+	}
+
+	s.state.storageMu.Lock()
+	for i := 1; i < len(args); i += 2 {
+		s.state.storage[args[i]] = newStorageVal(encodeString(args[i+1]), time.Time{})
+		s.state.notifySet(args[i], false)
+	}
+	s.state.propagate(args)
+	s.state.storageMu.Unlock()
+
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) msetnxCommand(args []string) CommandResponse {
+	if len(args) < 3 || len(args)%2 == 0 {
+		return wrongArgsError("MSETNX")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	for i := 1; i < len(args); i += 2 {
+		if _, exists := s.state.lookupKey(args[i]); exists {
+			return CommandResponse{Response: ":0\r\n"}
+		}
+	}
+	for i := 1; i < len(args); i += 2 {
+		s.state.storage[args[i]] = newStorageVal(encodeString(args[i+1]), time.Time{})
+		s.state.notifySet(args[i], false)
+	}
+
+	propagated := append([]string{"MSET"}, args[1:]...)
+	s.state.propagate(propagated)
+	return CommandResponse{Response: ":1\r\n"}
+}
+
+func (s *RedisServer) appendCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("APPEND")
+	}
+	key := args[1]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	value, exists := s.state.lookupKey(key)
+	if !exists {
+		value = newStorageVal([]byte(nil), time.Time{})
+	}
+	buf, ok := mutableString(value.val)
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if len(buf)+len(args[2]) > maxStringLength {
+		return CommandResponse{Error: "-ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	buf = append(buf, args[2]...)
+	value.val = buf
+	s.state.storage[key] = value
+	s.state.keyModified(notifyString, "append", key)
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(len(buf)))}
+}
+
+func (s *RedisServer) strlenCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("STRLEN")
+	}
+
+	s.state.storageMu.Lock()
+	str, _, wrongType := s.state.stringAt(args[1])
+	s.state.storageMu.Unlock()
+
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	return CommandResponse{Response: toRespInt(int64(len(str)))}
+}
+
+func (s *RedisServer) getrangeCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("GETRANGE")
+	}
+	start, err1 := strconv.Atoi(args[2])
+	end, err2 := strconv.Atoi(args[3])
+	if err1 != nil || err2 != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+
+	s.state.storageMu.Lock()
+	str, _, wrongType := s.state.stringAt(args[1])
+	s.state.storageMu.Unlock()
+
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	strLen := len(str)
+	if start < 0 && end < 0 && start > end {
+		return CommandResponse{Response: toRespStr("")}
+	}
+	if start < 0 {
+		start = strLen + start
+	}
+	if end < 0 {
+		end = strLen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strLen {
+		end = strLen - 1
+	}
+	if start > end || strLen == 0 {
+		return CommandResponse{Response: toRespStr("")}
+	}
+
+	return CommandResponse{Response: toRespStr(str[start : end+1])}
+}
+
+func (s *RedisServer) setrangeCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("SETRANGE")
+	}
+	key, patch := args[1], args[3]
+	offset, err := strconv.Atoi(args[2])
+	if err != nil {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+	if offset < 0 {
+		return CommandResponse{Error: "-ERR offset is out of range"}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	value, exists := s.state.lookupKey(key)
+	if !exists {
+		value = newStorageVal([]byte(nil), time.Time{})
+	}
+	buf, ok := mutableString(value.val)
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if len(patch) == 0 {
+		return CommandResponse{Response: toRespInt(int64(len(buf)))}
+	}
+	if offset+len(patch) > maxStringLength {
+		return CommandResponse{Error: "-ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	buf = growString(buf, offset+len(patch))
+	copy(buf[offset:], patch)
+
+	value.val = buf
+	s.state.storage[key] = value
+	s.state.keyModified(notifyString, "setrange", key)
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(len(buf)))}
+}
+
+// growString zero-pads buf to at least size bytes.
+func growString(buf []byte, size int) []byte {
+	if size > len(buf) {
+		buf = append(buf, make([]byte, size-len(buf))...)
+	}
+	return buf
+}
+
+// parseStrictInt parses s the way Redis' string2ll does: only the canonical
+// decimal form is accepted, so "+1", " 1" and "01" are all rejected.
+func parseStrictInt(s string) (int64, bool) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// incrBy adds delta to the integer stored at key and backs INCR, DECR, INCRBY
+// and DECRBY. The key's TTL is preserved.
+func (s *RedisServer) incrBy(args []string, delta int64) CommandResponse {
+	key := args[1]
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	value, exists := s.state.lookupKey(key)
+	var current int64
+	if exists {
+		if n, isInt := value.val.(int64); isInt {
+			current = n
+		} else {
+			str, isStr := valueString(value.val)
+			if !isStr {
+				return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+			}
+			n, ok := parseStrictInt(str)
+			if !ok {
+				return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+			}
+			current = n
+		}
+	} else {
+		value = newStorageVal(nil, time.Time{})
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return CommandResponse{Error: "-ERR increment or decrement would overflow"}
+	}
+	current += delta
+
+	value.val = current
+	s.state.storage[key] = value
+	s.state.keyModified(notifyString, "incrby", key)
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(current)}
+}
+
+func (s *RedisServer) incrbyCommand(args []string, cmd string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError(cmd)
+	}
+	delta, ok := parseStrictInt(args[2])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+	}
+	if cmd == "DECRBY" {
+		if delta == math.MinInt64 {
+			return CommandResponse{Error: "-ERR decrement would overflow"}
+		}
+		delta = -delta
+	}
+	return s.incrBy(args, delta)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseFloatArg parses a float argument, accepting the inf/-inf spellings
+// Redis understands and rejecting NaN.
+func parseFloatArg(s string) (float64, bool) {
+	if s == "" || strings.TrimSpace(s) != s {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, false
+	}
+	return f, true
+}
+
+func (s *RedisServer) incrbyfloatCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("INCRBYFLOAT")
+	}
+	key := args[1]
+	delta, ok := parseFloatArg(args[2])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_NOT_FLOAT}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	value, exists := s.state.lookupKey(key)
+	var current float64
+	if exists {
+		str, isStr := valueString(value.val)
+		if !isStr {
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		current, ok = parseFloatArg(str)
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_NOT_FLOAT}
+		}
+	} else {
+		value = newStorageVal(nil, time.Time{})
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return CommandResponse{Error: "-ERR increment would produce NaN or Infinity"}
+	}
+
+	result := formatFloat(current)
+	value.val = encodeString(result)
+	s.state.storage[key] = value
+	s.state.keyModified(notifyString, "incrbyfloat", key)
+	// Replicas must not re-run the float arithmetic, so ship the result.
+	s.state.propagate([]string{"SET", key, result, "KEEPTTL"})
+
+	return CommandResponse{Response: toRespStr(result)}
+}
+
+func (s *RedisServer) lcsCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("LCS")
+	}
+
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := 0
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 >= len(args) {
+				return CommandResponse{Error: RESP_ERR_SYNTAX}
+			}
+			i++
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+		default:
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+	}
+	if getLen && getIdx {
+		return CommandResponse{Error: "-ERR If you want both the length and indexes, please just use IDX."}
+	}
+
+	s.state.storageMu.Lock()
+	a, _, wrongA := s.state.stringAt(args[1])
+	b, _, wrongB := s.state.stringAt(args[2])
+	s.state.storageMu.Unlock()
+
+	if wrongA || wrongB {
+		return CommandResponse{Error: "-ERR The specified keys must contain string values"}
+	}
+
+	// table[i][j] holds the LCS length of a[:i] and b[:j].
+	cols := len(b) + 1
+	table := make([]uint32, (len(a)+1)*cols)
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			if a[i-1] == b[j-1] {
+				table[i*cols+j] = table[(i-1)*cols+j-1] + 1
+			} else if table[(i-1)*cols+j] > table[i*cols+j-1] {
+				table[i*cols+j] = table[(i-1)*cols+j]
+			} else {
+				table[i*cols+j] = table[i*cols+j-1]
+			}
+		}
+	}
+	lcsLen := int(table[len(a)*cols+len(b)])
+
+	if getLen {
+		return CommandResponse{Response: toRespInt(int64(lcsLen))}
+	}
+
+	// Walk the table backwards, collecting the LCS and, for IDX, the
+	// matching ranges in the same order Redis reports them.
+	result := make([]byte, lcsLen)
+	var matches strings.Builder
+	matchCount := 0
+
+	i, j, idx := len(a), len(b), lcsLen
+	aStart, aEnd, bStart, bEnd := len(a), 0, 0, 0
+	for i > 0 && j > 0 {
+		emit := false
+		if a[i-1] == b[j-1] {
+			result[idx-1] = a[i-1]
+			if aStart == len(a) {
+				aStart, aEnd = i-1, i-1
+				bStart, bEnd = j-1, j-1
+			} else if aStart == i && bStart == j {
+				aStart--
+				bStart--
+			} else {
+				emit = true
+			}
+			if aStart == 0 || bStart == 0 {
+				emit = true
+			}
+			idx--
+			i--
+			j--
+		} else {
+			if table[(i-1)*cols+j] > table[i*cols+j-1] {
+				i--
+			} else {
+				j--
+			}
+			if aStart != len(a) {
+				emit = true
+			}
+		}
+
+		if emit {
+			matchLen := aEnd - aStart + 1
+			if minMatchLen == 0 || matchLen >= minMatchLen {
+				if withMatchLen {
+					matches.WriteString("*3\r\n")
+				} else {
+					matches.WriteString("*2\r\n")
+				}
+				matches.WriteString("*2\r\n" + toRespInt(int64(aStart)) + toRespInt(int64(aEnd)))
+				matches.WriteString("*2\r\n" + toRespInt(int64(bStart)) + toRespInt(int64(bEnd)))
+				if withMatchLen {
+					matches.WriteString(toRespInt(int64(matchLen)))
+				}
+				matchCount++
+			}
+			aStart = len(a)
+		}
+	}
+
+	if !getIdx {
+		return CommandResponse{Response: toRespStr(string(result))}
+	}
+
+	resp := "*4\r\n" + toRespStr("matches") +
+		"*" + strconv.Itoa(matchCount) + "\r\n" + matches.String() +
+		toRespStr("len") + toRespInt(int64(lcsLen))
+	return CommandResponse{Response: resp}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSetOptions(t *testing.T) {
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)
+
+	tests := []struct {
+		name  string
+		steps []testStep
+		ttl   int64 // of k, once the steps have run
+	}{
+		{"plain", []testStep{
+			{cmd("SET", "k", "v", "EX", "100"), okReply},
+			{cmd("SET", "k", "v"), okReply},
+			{cmd("GET", "k"), bulk("v")},
+		}, -1},
+		{"NX", []testStep{
+			{cmd("SET", "k", "v1", "NX"), okReply},
+			{cmd("SET", "k", "v2", "NX"), nilBulkReply},
+			{cmd("GET", "k"), bulk("v1")},
+		}, -1},
+		{"XX", []testStep{
+			{cmd("SET", "k", "v1", "XX"), nilBulkReply},
+			{cmd("TYPE", "k"), "+none\r\n"},
+			{cmd("SET", "k", "v1"), okReply},
+			{cmd("SET", "k", "v2", "xx"), okReply},
+			{cmd("GET", "k"), bulk("v2")},
+		}, -1},
+		{"GET", []testStep{
+			{cmd("SET", "k", "v1", "GET"), nilBulkReply},
+			{cmd("SET", "k", "v2", "GET"), bulk("v1")},
+			{cmd("GET", "k"), bulk("v2")},
+		}, -1},
+		{"NX GET", []testStep{
+			{cmd("SET", "k", "v1"), okReply},
+			{cmd("SET", "k", "v2", "NX", "GET"), bulk("v1")},
+			{cmd("GET", "k"), bulk("v1")},
+		}, -1},
+		{"XX GET on a missing key", []testStep{
+			{cmd("SET", "k", "v", "XX", "GET"), nilBulkReply},
+		}, -2},
+		{"GET on the wrong type", []testStep{
+			{cmd("RPUSH", "k", "a"), integer(1)},
+			{cmd("SET", "k", "v", "GET"), errorReply(RESP_ERR_WRONGTYPE)},
+			{cmd("TYPE", "k"), "+list\r\n"},
+			{cmd("SET", "k", "v"), okReply},
+			{cmd("TYPE", "k"), "+string\r\n"},
+		}, -1},
+		{"EX", []testStep{{cmd("SET", "k", "v", "EX", "100"), okReply}}, 100},
+		{"PX", []testStep{{cmd("SET", "k", "v", "px", "100000"), okReply}}, 100},
+		{"PXAT", []testStep{{cmd("SET", "k", "v", "PXAT", future), okReply}}, 3600},
+		{"EXAT in the past deletes", []testStep{
+			{cmd("SET", "k", "v"), okReply},
+			{cmd("SET", "k", "v", "EXAT", past), okReply},
+		}, -2},
+		{"KEEPTTL", []testStep{
+			{cmd("SET", "k", "v1", "EX", "100"), okReply},
+			{cmd("SET", "k", "v2", "KEEPTTL"), okReply},
+			{cmd("SET", "k", "v3", "KEEPTTL", "XX", "GET"), bulk("v2")},
+			{cmd("GET", "k"), bulk("v3")},
+		}, 100},
+		{"KEEPTTL on a new key", []testStep{{cmd("SET", "k", "v", "KEEPTTL"), okReply}}, -1},
+		{"conflicting options", []testStep{
+			{cmd("SET", "k", "v", "NX", "XX"), errorReply(RESP_ERR_SYNTAX)},
+			{cmd("SET", "k", "v", "EX", "10", "PX", "10"), errorReply(RESP_ERR_SYNTAX)},
+			{cmd("SET", "k", "v", "EX", "10", "KEEPTTL"), errorReply(RESP_ERR_SYNTAX)},
+			{cmd("SET", "k", "v", "KEEPTTL", "PXAT", future), errorReply(RESP_ERR_SYNTAX)},
+		}, -2},
+		{"bad expire", []testStep{
+			{cmd("SET", "k", "v", "EX"), errorReply(RESP_ERR_SYNTAX)},
+			{cmd("SET", "k", "v", "EX", "ten"), errorReply(RESP_ERR_NOT_INTEGER)},
+			{cmd("SET", "k", "v", "EX", "0"), errorReply("-ERR invalid expire time in 'set' command")},
+			{cmd("SET", "k", "v", "PX", "-5"), errorReply("-ERR invalid expire time in 'set' command")},
+			{cmd("SET", "k", "v", "EX", "9223372036854775807"), errorReply("-ERR invalid expire time in 'set' command")},
+			{cmd("SET", "k", "v", "BOGUS"), errorReply(RESP_ERR_SYNTAX)},
+			{cmd("SET", "k"), errorReply("-ERR wrong number of arguments for 'SET' command")},
+		}, -2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startTestServer(t, nil)
+			runSteps(t, ts.client(t), tt.steps)
+			if got := ts.ttl("k"); got != tt.ttl {
+				t.Errorf("TTL of k is %d, want %d", got, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestStringCommands(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("APPEND", "s", "Hello"), integer(5)},
+		{cmd("APPEND", "s", " World"), integer(11)},
+		{cmd("STRLEN", "s"), integer(11)},
+		{cmd("STRLEN", "missing"), integer(0)},
+		{cmd("GETRANGE", "s", "0", "4"), bulk("Hello")},
+		{cmd("GETRANGE", "s", "-5", "-1"), bulk("World")},
+		{cmd("GETRANGE", "s", "-1", "-5"), bulk("")},
+		{cmd("GETRANGE", "s", "6", "100"), bulk("World")},
+		{cmd("SETRANGE", "s", "6", "Redis"), integer(11)},
+		{cmd("GET", "s"), bulk("Hello Redis")},
+		{cmd("SETRANGE", "pad", "3", "x"), integer(4)},
+		{cmd("GET", "pad"), bulk("\x00\x00\x00x")},
+		{cmd("SETRANGE", "pad", "-1", "x"), errorReply("-ERR offset is out of range")},
+
+		{cmd("GETSET", "s", "new"), bulk("Hello Redis")},
+		{cmd("GETDEL", "s"), bulk("new")},
+		{cmd("GETDEL", "s"), nilBulkReply},
+
+		{cmd("SET", "e", "v"), okReply},
+		{cmd("GETEX", "e", "EX", "100"), bulk("v")},
+		{cmd("GETEX", "e", "PERSIST"), bulk("v")},
+		{cmd("GETEX", "g", "PX", "100000"), nilBulkReply},
+		{cmd("GETEX", "e", "PERSIST", "EX", "1"), errorReply(RESP_ERR_SYNTAX)},
+
+		{cmd("MSET", "a", "1", "b", "2"), okReply},
+		{cmd("MGET", "a", "b", "missing"), array(bulk("1"), bulk("2"), nilBulkReply)},
+		{cmd("MSETNX", "b", "3", "c", "4"), integer(0)},
+		{cmd("TYPE", "c"), "+none\r\n"},
+		{cmd("MSETNX", "c", "3", "d", "4"), integer(1)},
+		{cmd("SETNX", "c", "x"), integer(0)},
+		{cmd("SETNX", "f", "x"), integer(1)},
+		{cmd("SETEX", "g", "100", "x"), okReply},
+		{cmd("PSETEX", "h", "200000", "y"), okReply},
+		{cmd("SETEX", "g", "0", "x"), errorReply("-ERR invalid expire time in 'setex' command")},
+
+		{cmd("INCR", "n"), integer(1)},
+		{cmd("INCRBY", "n", "10"), integer(11)},
+		{cmd("DECR", "n"), integer(10)},
+		{cmd("DECRBY", "n", "20"), integer(-10)},
+		{cmd("SET", "n", "9223372036854775807"), okReply},
+		{cmd("INCR", "n"), errorReply("-ERR increment or decrement would overflow")},
+		{cmd("SET", "n", "01"), okReply},
+		{cmd("INCR", "n"), errorReply(RESP_ERR_NOT_INTEGER)},
+		{cmd("DECRBY", "n", "-9223372036854775808"), errorReply("-ERR decrement would overflow")},
+
+		{cmd("SET", "f", "10.50"), okReply},
+		{cmd("INCRBYFLOAT", "f", "0.1"), bulk("10.6")},
+		{cmd("INCRBYFLOAT", "f", "-5"), bulk("5.6")},
+		{cmd("INCRBYFLOAT", "f", "5.0e3"), bulk("5005.6")},
+		{cmd("INCRBYFLOAT", "f", "abc"), errorReply(RESP_ERR_NOT_FLOAT)},
+		{cmd("INCRBYFLOAT", "f", "inf"), errorReply("-ERR increment would produce NaN or Infinity")},
+	})
+
+	for key, want := range map[string]int64{"e": -1, "g": 100, "h": 200, "s": -2} {
+		if got := ts.ttl(key); got != want {
+			t.Errorf("TTL of %s is %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestLCS(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	// The examples from the LCS documentation.
+	runSteps(t, c, []testStep{
+		{cmd("MSET", "key1", "ohmytext", "key2", "mynewtext"), okReply},
+		{cmd("LCS", "key1", "key2"), bulk("mytext")},
+		{cmd("LCS", "key1", "key2", "LEN"), integer(6)},
+		{cmd("LCS", "key1", "key2", "IDX"), array(
+			bulk("matches"),
+			array(
+				array(array(integer(4), integer(7)), array(integer(5), integer(8))),
+				array(array(integer(2), integer(3)), array(integer(0), integer(1))),
+			),
+			bulk("len"), integer(6),
+		)},
+		{cmd("LCS", "key1", "key2", "IDX", "MINMATCHLEN", "4", "WITHMATCHLEN"), array(
+			bulk("matches"),
+			array(array(array(integer(4), integer(7)), array(integer(5), integer(8)), integer(4))),
+			bulk("len"), integer(6),
+		)},
+		{cmd("LCS", "key1", "key2", "LEN", "IDX"), errorReply("-ERR If you want both the length and indexes, please just use IDX.")},
+		{cmd("LCS", "key1", "missing"), bulk("")},
+	})
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// txPropagationState is how far EXEC has got in replicating a transaction.
+type txPropagationState int
+
+const (
+	txPropagationNone    txPropagationState = iota
+	txPropagationPending                    // EXEC is running; MULTI goes out with the first write
+	txPropagationOpen                       // MULTI was sent; EXEC must follow
+)
+
+// queueCommand queues args for EXEC, or rejects it when it could never run,
+// flagging the transaction so that EXEC aborts it. It returns the reply.
+// WATCH is refused without flagging, as Redis runs it rather than queue it.
+func (s *RedisServer) queueCommand(args []string) string {
+	errMsg := checkCommand(args)
+	if errMsg == "" {
+		errMsg = s.checkPermissions(args)
+	}
+	if errMsg == "" && strings.ToUpper(args[0]) == RESP_COMMAND_WATCH {
+		return "-ERR WATCH inside MULTI is not allowed\r\n"
+	}
+	if errMsg != "" {
+		s.multiFailed = true
+		return errMsg + "\r\n"
+	}
+
+	s.multiQueue = append(s.multiQueue, args)
+	return "+QUEUED\r\n"
+}
+
+// execTransaction runs the queued commands and returns the reply to EXEC.
+// It holds txMu for writing throughout, so no other client runs a command
+// between the WATCH check and the last queued command. Writes reach
+// replicas wrapped in MULTI/EXEC, unless the transaction wrote nothing.
+func (s *RedisServer) execTransaction() string {
+	queue, failed := s.multiQueue, s.multiFailed
+	s.discardTransaction()
+	if failed {
+		s.unwatchAll()
+		return "-EXECABORT Transaction discarded because of previous errors.\r\n"
+	}
+
+	if busy := s.state.lockTx(true); busy != nil {
+		return busy.busyError() + "\r\n"
+	}
+	defer s.state.txMu.Unlock()
+
+	s.state.storageMu.Lock()
+	aborted := s.watchedKeysChanged()
+	s.state.storageMu.Unlock()
+	s.unwatchAll()
+	if aborted {
+		return RESP_NULL_ARRAY
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(queue))
+
+	s.inExec = true
+	s.state.beginTxPropagation()
+	for _, args := range queue {
+		cmdResponse := s.executeCommand(args)
+		s.state.notifyKeyMisses(args)
+		resp := cmdResponse.Response
+		if cmdResponse.Error != "" {
+			resp = cmdResponse.Error
+		}
+		if !strings.HasSuffix(resp, "\r\n") {
+			resp += "\r\n"
+		}
+		b.WriteString(resp)
+	}
+	s.state.endTxPropagation()
+	s.inExec = false
+
+	s.state.serveBlockedClients()
+	return b.String()
+}
+
+// beginTxPropagation makes the next write propagated open a MULTI for
+// replicas. The caller must hold txMu for writing until endTxPropagation.
+func (st *RedisState) beginTxPropagation() {
+	st.txPropagation = txPropagationPending
+}
+
+// endTxPropagation sends EXEC to replicas if the transaction wrote anything.
+func (st *RedisState) endTxPropagation() {
+	open := st.txPropagation == txPropagationOpen
+	st.txPropagation = txPropagationNone
+	if open {
+		st.propagate([]string{RESP_COMMAND_EXEC})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestExecAbort(t *testing.T) {
+	tests := []struct {
+		name   string
+		queued testStep
+	}{
+		{"unknown command", testStep{cmd("BOGUS", "x"), errorReply("-ERR unknown command 'BOGUS', with args beginning with: 'x' ")}},
+		{"too few arguments", testStep{cmd("GET"), errorReply("-ERR wrong number of arguments for 'GET' command")}},
+		{"too many arguments", testStep{cmd("INCR", "a", "b"), errorReply("-ERR wrong number of arguments for 'INCR' command")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := startTestServer(t, nil)
+			c := ts.client(t)
+			runSteps(t, c, []testStep{
+				{cmd("MULTI"), okReply},
+				{cmd("SET", "a", "1"), queuedReply},
+				tt.queued,
+				{cmd("SET", "b", "2"), queuedReply},
+				{cmd("EXEC"), errorReply("-EXECABORT Transaction discarded because of previous errors.")},
+				// Nothing ran, and the transaction is over.
+				{cmd("MGET", "a", "b"), array(nilBulkReply, nilBulkReply)},
+				{cmd("EXEC"), errorReply("-ERR EXEC without MULTI")},
+				// The next one starts clean.
+				{cmd("MULTI"), okReply},
+				{cmd("SET", "a", "1"), queuedReply},
+				{cmd("EXEC"), array(okReply)},
+			})
+		})
+	}
+}
+
+func TestExecRunsPastRuntimeErrors(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	// Errors only found while running a command do not abort the rest.
+	runSteps(t, c, []testStep{
+		{cmd("MULTI"), okReply},
+		{cmd("SET", "s", "v"), queuedReply},
+		{cmd("INCR", "s"), queuedReply},
+		{cmd("LPUSH", "s", "x"), queuedReply},
+		{cmd("SET", "t", "1"), queuedReply},
+		{cmd("EXEC"), array(okReply, errorReply(RESP_ERR_NOT_INTEGER), errorReply(RESP_ERR_WRONGTYPE), okReply)},
+		{cmd("MGET", "s", "t"), array(bulk("v"), bulk("1"))},
+	})
+}
+
+func TestTransactionControlErrors(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	// MULTI and WATCH are refused inside a transaction without aborting it.
+	runSteps(t, c, []testStep{
+		{cmd("DISCARD"), errorReply("-ERR DISCARD without MULTI")},
+		{cmd("MULTI"), okReply},
+		{cmd("INCR", "n"), queuedReply},
+		{cmd("MULTI"), errorReply("-ERR MULTI calls can not be nested")},
+		{cmd("WATCH", "n"), errorReply("-ERR WATCH inside MULTI is not allowed")},
+		{cmd("INCR", "n"), queuedReply},
+		{cmd("EXEC"), array(integer(1), integer(2))},
+
+		{cmd("MULTI"), okReply},
+		{cmd("INCR", "n"), queuedReply},
+		{cmd("BOGUS"), errorReply("-ERR unknown command 'BOGUS', with args beginning with: ")},
+		{cmd("DISCARD"), okReply},
+		{cmd("GET", "n"), bulk("2")},
+		{cmd("MULTI"), okReply},
+		{cmd("EXEC"), emptyArrayReply},
+	})
+}
+
+// No other client sees a transaction half done.
+func TestExecIsAtomic(t *testing.T) {
+	ts := startTestServer(t, nil)
+	writer := ts.client(t)
+	writer.expect(okReply, "MSET", "a", "0", "b", "0")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			var batch []byte
+			for _, args := range [][]string{{"MULTI"}, {"INCR", "a"}, {"INCR", "b"}, {"EXEC"}} {
+				batch = append(batch, encodeBulkArray(args)...)
+			}
+			if _, err := writer.conn.Write(batch); err != nil {
+				t.Errorf("write: %v", err)
+				return
+			}
+			for j := 0; j < 4; j++ {
+				if _, err := writer.readWithin(5 * time.Second); err != nil {
+					t.Errorf("read: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	c := ts.client(t)
+	for {
+		select {
+		case <-done:
+			c.expect(array(bulk("200"), bulk("200")), "MGET", "a", "b")
+			return
+		default:
+		}
+		reply, ok := parseBulks(c.do("MGET", "a", "b"))
+		if !ok || len(reply) != 2 || reply[0] != reply[1] {
+			t.Errorf("MGET saw the transaction half done: %q", reply)
+			<-done
+			return
+		}
+	}
+}
+
+func TestExecPropagatesAsTransaction(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+
+	replica, master := net.Pipe()
+	t.Cleanup(func() { replica.Close(); master.Close() })
+	ts.state.replicaMu.Lock()
+	ts.state.replicas = append(ts.state.replicas, &replicaLink{conn: master})
+	ts.state.replicaMu.Unlock()
+
+	received := make(chan []string, 16)
+	go func() {
+		r := bufio.NewReader(replica)
+		for {
+			args, _, err := readRESPCommand(r)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- args
+		}
+	}()
+
+	runSteps(t, c, []testStep{
+		// A transaction writing nothing reaches replicas as nothing.
+		{cmd("MULTI"), okReply},
+		{cmd("GET", "a"), queuedReply},
+		{cmd("EXEC"), array(nilBulkReply)},
+		{cmd("MULTI"), okReply},
+		{cmd("SET", "a", "1"), queuedReply},
+		{cmd("GET", "a"), queuedReply},
+		{cmd("INCR", "n"), queuedReply},
+		{cmd("EXEC"), array(okReply, bulk("1"), integer(1))},
+		{cmd("SET", "after", "x"), okReply},
+	})
+
+	want := [][]string{{"MULTI"}, {"SET", "a", "1"}, {"INCR", "n"}, {"EXEC"}, {"SET", "after", "x"}}
+	for i, w := range want {
+		select {
+		case got := <-received:
+			if !slices.Equal(got, w) {
+				t.Fatalf("command %d propagated as %q, want %q", i, got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("command %d (%q) never propagated", i, w)
+		}
+	}
+}
@@ -1,16 +1,14 @@
 package main
 
 import (
-	"encoding/binary"
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
-	"os"
+	"slices"
 	"strconv"
 	"strings"
-	"time"
-
-	"github.com/wangjia184/sortedset"
 )
 
 func extractReplicaInfo(replicaOf *string) (string, string, error) {
@@ -37,87 +35,6 @@ func extractReplicaInfo(replicaOf *string) (string, string, error) {
 	return masterHost, masterPort, nil
 }
 
-func readRDB(filePath string) (map[string]string, map[string]time.Time, error) {
-	dataMap := make(map[string]string)
-	dataMapTime := make(map[string]time.Time)
-
-	data, err := os.ReadFile(filePath)
-	fmt.Println(data)
-	fmt.Println(string(data))
-
-	if err != nil {
-		return dataMap, dataMapTime, nil
-	}
-	if len(data) < 9 {
-		return dataMap, dataMapTime, nil
-	}
-
-	if string(data[:9]) != "REDIS0011" {
-		return dataMap, dataMapTime, nil
-	}
-
-	index := 9
-
-	for index < len(data) && data[index] != 0xFB {
-		index++
-	}
-	fmt.Printf("we here → index=%d, byte=0x%X\n", index, data[index]) // at 0xFB
-	index += 4
-
-	key, err := readString(data, &index)
-	if err != nil {
-		return dataMap, dataMapTime, nil
-	}
-	value, err := readString(data, &index)
-	if err != nil {
-		return dataMap, dataMapTime, nil
-	}
-	dataMap[key] = value
-	fmt.Print("Loaded key: '%s', value: '%s'\n", key, value)
-	return dataMap, dataMapTime, nil
-
-}
-
-func readString(data []byte, index *int) (string, error) {
-	firstByte := data[*index]
-	*index += 1
-
-	prefix := firstByte & 0xC0 //mask the first two bits
-	var length int
-	var str string
-
-	switch prefix {
-
-	case 0x00: //6 bit
-		length = int(firstByte & 0x3F)
-
-	case 0x40: //14 bit
-		if *index >= len(data) {
-			return "", fmt.Errorf("Error end of data(14 bit)")
-		}
-		secondByte := data[*index]
-		*index += 1
-		length = int(firstByte&0x3f)<<8 | int(secondByte)
-
-	case 0x80: // 32 bit
-		if *index+4 > len(data) {
-			return "", fmt.Errorf("not enough bytes")
-		}
-		length = int(binary.BigEndian.Uint32(data[*index : *index+4]))
-		*index += 4
-
-	case 0xC0: //special case
-		return "", fmt.Errorf("unsupported string encoding")
-	}
-
-	if *index+length > len(data) {
-		return "", fmt.Errorf("not enough data to read string of %d", length)
-	}
-	str = string(data[*index : *index+length])
-	*index += length
-	return str, nil
-}
-
 func RESPToArray(resp string) ([]string, error) {
 	if !strings.HasPrefix(resp, "*") {
 		return nil, errors.New("invalid RESP: missing '*' for array")
@@ -166,13 +83,124 @@ func RESPToArray(resp string) ([]string, error) {
 
 	return elements, nil
 }
+
+const (
+	maxBulkLength      = 512 * 1024 * 1024
+	maxMultibulkLength = 1024 * 1024
+	maxInlineLength    = 64 * 1024
+	// bulkReadChunk is how much of a bulk string is read, and allocated, at
+	// a time.
+	bulkReadChunk = 64 * 1024
+)
+
+// protocolError marks malformed client input. After one the stream can no
+// longer be framed, so the connection is answered with the error and closed.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// readRESPLine reads a CRLF terminated header line, returning it without the
+// terminator. A line is never buffered past maxInlineLength: longer ones are
+// a protocol error as soon as that much has arrived.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line)+len(chunk) > maxInlineLength {
+			return "", protocolError("too big inline request")
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", protocolError("expected CRLF")
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+// readBulk reads a bulk string payload of length bytes followed by its CRLF.
+// The buffer grows as the data arrives, so a client cannot make the server
+// allocate a length it never sends.
+func readBulk(r *bufio.Reader, length int) ([]byte, error) {
+	total := length + 2
+	data := make([]byte, 0, min(total, bulkReadChunk))
+	for len(data) < total {
+		n := min(total-len(data), bulkReadChunk)
+		data = slices.Grow(data, n)
+		if _, err := io.ReadFull(r, data[len(data):len(data)+n]); err != nil {
+			return nil, err
+		}
+		data = data[:len(data)+n]
+	}
+	if data[length] != '\r' || data[length+1] != '\n' {
+		return nil, protocolError("expected CRLF after bulk string")
+	}
+	return data[:length], nil
+}
+
+// readRESPCommand reads the next command from r along with the number of
+// bytes it occupied on the wire. Bulk strings are read by length, so values
+// may carry CRLF, NUL or any other bytes. Inline commands (plain
+// space-separated text, as typed into telnet) are accepted too.
+func readRESPCommand(r *bufio.Reader) ([]string, int, error) {
+	header, err := readRESPLine(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	consumed := len(header) + 2
+
+	if !strings.HasPrefix(header, "*") {
+		return strings.Fields(header), consumed, nil
+	}
+
+	count, err := strconv.Atoi(header[1:])
+	if err != nil || count > maxMultibulkLength {
+		return nil, consumed, protocolError("invalid multibulk length")
+	}
+	if count <= 0 {
+		return []string{}, consumed, nil
+	}
+
+	elements := make([]string, count)
+	for i := range elements {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, consumed, err
+		}
+		consumed += len(line) + 2
+		if !strings.HasPrefix(line, "$") {
+			return nil, consumed, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > maxBulkLength {
+			return nil, consumed, protocolError("invalid bulk length")
+		}
+
+		data, err := readBulk(r, length)
+		consumed += length + 2
+		if err != nil {
+			return nil, consumed, err
+		}
+		elements[i] = string(data)
+	}
+
+	return elements, consumed, nil
+}
+
 func WriteBulkString(conn net.Conn, s string) {
 	response := fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
 	_, err := conn.Write([]byte(response))
 	if err != nil {
-		fmt.Println("Failed to write bulk string '%s': %v", s, err)
+		fmt.Printf("Failed to write bulk string '%s': %v\n", s, err)
 	} else {
-		fmt.Println("Wrote bulk string (%d bytes): %s", len(s), s)
+		fmt.Printf("Wrote bulk string (%d bytes): %s\n", len(s), s)
 	}
 }
 
@@ -180,9 +208,9 @@ func WriteSimpleString(conn net.Conn, s string) {
 	response := fmt.Sprintf("+%s\r\n", s)
 	_, err := conn.Write([]byte(response))
 	if err != nil {
-		fmt.Println("Failed to write simple string '%s': %v", s, err)
+		fmt.Printf("Failed to write simple string '%s': %v\n", s, err)
 	} else {
-		fmt.Println("Wrote simple string: +%s", s)
+		fmt.Printf("Wrote simple string: +%s\n", s)
 	}
 }
 
@@ -305,31 +333,53 @@ func toRespArr(strs ...string) string {
 	return respArr
 }
 
-func convertIndexes(zset *sortedset.SortedSet, startIdx, stopIdx int) (int, int) {
-	length := zset.GetCount()
+func toRespInt(n int64) string {
+	return ":" + strconv.FormatInt(n, 10) + "\r\n"
+}
 
-	if startIdx < 0 {
-		startIdx = length + startIdx
-	}
-	if stopIdx < 0 {
-		stopIdx = length + stopIdx
+// toRespStrArr encodes strs as an array of bulk strings.
+func toRespStrArr(strs []string) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(strs)) + "\r\n")
+	for _, str := range strs {
+		b.WriteString(toRespStr(str))
 	}
+	return b.String()
+}
 
-	if startIdx < 0 {
-		startIdx = 0
-	}
-	if stopIdx < 0 {
-		stopIdx = 0
-	}
-	if startIdx >= length {
-		startIdx = length
-	}
-	if stopIdx >= length {
-		stopIdx = length - 1
+func toRespIntArr(nums []int64) string {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(nums)) + "\r\n")
+	for _, n := range nums {
+		b.WriteString(toRespInt(n))
 	}
+	return b.String()
+}
 
-	start := startIdx + 1
-	stop := stopIdx + 1
+func wrongArgsError(cmd string) CommandResponse {
+	return CommandResponse{Error: fmt.Sprintf("-ERR wrong number of arguments for '%s' command", cmd)}
+}
 
-	return start, stop
+// parseMemorySize parses a size in redis.conf notation: a plain number of
+// bytes, or one followed by k, kb, m, mb, g or gb, where the "b" forms are
+// powers of 1024 and the others powers of 1000.
+func parseMemorySize(s string) (int, error) {
+	units := []struct {
+		suffix string
+		mul    int
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}, {"b", 1}}
+
+	lower := strings.ToLower(s)
+	mul := 1
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower, mul = strings.TrimSuffix(lower, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.Atoi(lower)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * mul, nil
 }
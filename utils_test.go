@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// endlessReader yields the same byte forever, counting how many were read.
+type endlessReader struct {
+	b    byte
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func isProtocolError(err error, msg string) bool {
+	var protoErr protocolError
+	return errors.As(err, &protoErr) && string(protoErr) == msg
+}
+
+func TestReadRESPCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []string
+	}{
+		{"array", "*2\r\n$4\r\nECHO\r\n$3\r\nhey\r\n", []string{"ECHO", "hey"}},
+		{"inline", "SET k v\r\n", []string{"SET", "k", "v"}},
+		{"empty bulk", "*2\r\n$3\r\nGET\r\n$0\r\n\r\n", []string{"GET", ""}},
+		{"binary", "*2\r\n$4\r\nECHO\r\n$6\r\na\r\n\x00\xffb\r\n", []string{"ECHO", "a\r\n\x00\xffb"}},
+		{"empty array", "*0\r\n", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, consumed, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.in)))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if consumed != len(tt.in) {
+				t.Errorf("consumed %d bytes, want %d", consumed, len(tt.in))
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommandLargeBulk(t *testing.T) {
+	value := strings.Repeat("x\r\n\x00", 100*1024)
+	in := "*2\r\n$4\r\nECHO\r\n$409600\r\n" + value + "\r\n"
+	got, _, err := readRESPCommand(bufio.NewReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 2 || got[1] != value {
+		t.Fatalf("bulk string not read back intact")
+	}
+}
+
+func TestReadRESPCommandErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		wantErr string
+	}{
+		{"negative bulk length", "*1\r\n$-5\r\n", "invalid bulk length"},
+		{"non-numeric bulk length", "*1\r\n$abc\r\n", "invalid bulk length"},
+		{"bulk length over limit", "*1\r\n$536870913\r\n", "invalid bulk length"},
+		{"bad multibulk length", "*x\r\n", "invalid multibulk length"},
+		{"missing '$'", "*1\r\n:3\r\n", "expected '$', got ':'"},
+		{"missing CRLF after bulk", "*1\r\n$3\r\nfooXX", "expected CRLF after bulk string"},
+		{"LF without CR", "*1\n", "expected CRLF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readRESPCommand(bufio.NewReader(strings.NewReader(tt.in)))
+			if !isProtocolError(err, tt.wantErr) {
+				t.Fatalf("got error %v, want protocol error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadRESPCommandTruncatedBulk(t *testing.T) {
+	// A header announcing a huge value that never arrives fails once the
+	// stream ends, without the value ever having been allocated.
+	_, _, err := readRESPCommand(bufio.NewReader(strings.NewReader("*1\r\n$500000000\r\nabc")))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReadRESPLineTooBig(t *testing.T) {
+	src := &endlessReader{b: 'a'}
+	_, err := readRESPLine(bufio.NewReader(src))
+	if !isProtocolError(err, "too big inline request") {
+		t.Fatalf("got error %v, want too big inline request", err)
+	}
+	if src.read > 2*maxInlineLength {
+		t.Errorf("read %d bytes before giving up, want at most %d", src.read, 2*maxInlineLength)
+	}
+
+	// A line just under the limit is still accepted.
+	line := strings.Repeat("a", maxInlineLength-2)
+	got, err := readRESPLine(bufio.NewReader(strings.NewReader(line + "\r\n")))
+	if err != nil || got != line {
+		t.Fatalf("line of %d bytes rejected: %v", len(line)+2, err)
+	}
+}
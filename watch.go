@@ -0,0 +1,103 @@
+package main
+
+// watchedKey is what WATCH recorded about a key: its version, and whether it
+// held a value, so that EXEC can tell when it has changed or expired since.
+type watchedKey struct {
+	version uint64
+	existed bool
+}
+
+// keyModified records a write to key: its version is bumped and event is
+// published to keyspace notification subscribers. Every command that
+// changes a key calls it, with storageMu held for writing.
+func (st *RedisState) keyModified(class int, event, key string) {
+	st.touchKey(key)
+	st.notifyKeyspaceEvent(class, event, key)
+}
+
+// touchKey bumps the version of key. Versions are only kept for keys some
+// connection watches, since nothing else compares them; for other keys the
+// bump is a no-op. The caller must hold storageMu for writing.
+func (st *RedisState) touchKey(key string) {
+	if st.watchers[key] == 0 {
+		return
+	}
+	st.versionSeq++
+	st.keyVersions[key] = st.versionSeq
+}
+
+// replaceStorage swaps the whole keyspace for storage, as FLUSHALL and a
+// full resync from the master do. Watched keys present before or after the
+// swap count as modified. The caller must hold storageMu for writing.
+func (st *RedisState) replaceStorage(storage map[string]storageVal) {
+	for key := range st.watchers {
+		_, before := st.storage[key]
+		_, after := storage[key]
+		if before || after {
+			st.touchKey(key)
+		}
+	}
+	st.storage = storage
+}
+
+func (s *RedisServer) watchCommand(args []string) CommandResponse {
+	if len(args) < 2 {
+		return wrongArgsError("WATCH")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	if s.watched == nil {
+		s.watched = make(map[string]watchedKey)
+	}
+	for _, key := range args[1:] {
+		if _, ok := s.watched[key]; ok {
+			continue
+		}
+		_, exists := s.state.readKey(key)
+		s.watched[key] = watchedKey{version: s.state.keyVersions[key], existed: exists}
+		s.state.watchers[key]++
+	}
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+func (s *RedisServer) unwatchCommand(args []string) CommandResponse {
+	if len(args) != 1 {
+		return wrongArgsError("UNWATCH")
+	}
+	s.unwatchAll()
+	return CommandResponse{Response: "+OK\r\n"}
+}
+
+// unwatchAll forgets every key the connection watches.
+func (s *RedisServer) unwatchAll() {
+	if len(s.watched) == 0 {
+		return
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	for key := range s.watched {
+		if s.state.watchers[key]--; s.state.watchers[key] == 0 {
+			delete(s.state.watchers, key)
+			delete(s.state.keyVersions, key)
+		}
+	}
+	s.watched = nil
+}
+
+// watchedKeysChanged reports whether a watched key was written, or expired,
+// since WATCH. The caller must hold storageMu.
+func (s *RedisServer) watchedKeysChanged() bool {
+	for key, w := range s.watched {
+		if s.state.keyVersions[key] != w.version {
+			return true
+		}
+		if _, exists := s.state.readKey(key); w.existed && !exists {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchedKeyExpiringAbortsExec(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(okReply, "SET", "lock", "owner", "PX", "100")
+	c.expect(okReply, "WATCH", "lock")
+
+	ts.state.storageMu.RLock()
+	watchedAt := ts.state.keyVersions["lock"]
+	ts.state.storageMu.RUnlock()
+
+	// Wait for the active expire cycle to remove the key, without any
+	// command looking it up.
+	removed := eventually(t, 2*time.Second, func() bool {
+		ts.state.storageMu.RLock()
+		defer ts.state.storageMu.RUnlock()
+		_, ok := ts.state.storage["lock"]
+		return !ok
+	})
+	if !removed {
+		t.Fatalf("watched key was not expired in the background")
+	}
+	ts.state.storageMu.RLock()
+	version := ts.state.keyVersions["lock"]
+	ts.state.storageMu.RUnlock()
+	if version == watchedAt {
+		t.Errorf("background expiry did not bump the watched key's version")
+	}
+
+	c.expect(okReply, "MULTI")
+	c.expect(queuedReply, "SET", "lock", "other")
+	c.expect(nilArrayReply, "EXEC")
+	c.expect(nilBulkReply, "GET", "lock")
+}
+
+func TestWatchedKeyUnchangedRunsExec(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(okReply, "SET", "lock", "owner", "PX", "60000")
+	c.expect(okReply, "WATCH", "lock")
+	c.expect(okReply, "MULTI")
+	c.expect(queuedReply, "SET", "lock", "other")
+	c.expect(array(okReply), "EXEC")
+	c.expect(bulk("other"), "GET", "lock")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestZsetAlgebra(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(2), "ZADD", "zset1", "1", "one", "2", "two")
+	c.expect(integer(3), "ZADD", "zset2", "1", "one", "2", "two", "3", "three")
+	// The documentation's examples first.
+	runSteps(t, c, []testStep{
+		{cmd("ZUNIONSTORE", "out", "2", "zset1", "zset2", "WEIGHTS", "2", "3"), integer(3)},
+		{cmd("ZRANGE", "out", "0", "-1", "WITHSCORES"), bulks("one", "5", "three", "9", "two", "10")},
+		{cmd("ZINTERSTORE", "out", "2", "zset1", "zset2", "WEIGHTS", "2", "3"), integer(2)},
+		{cmd("ZRANGE", "out", "0", "-1", "WITHSCORES"), bulks("one", "5", "two", "10")},
+		{cmd("ZUNION", "2", "zset1", "zset2"), bulks("one", "three", "two")},
+		{cmd("ZUNION", "2", "zset1", "zset2", "WITHSCORES"), bulks("one", "2", "three", "3", "two", "4")},
+		{cmd("ZINTER", "2", "zset1", "zset2", "WITHSCORES"), bulks("one", "2", "two", "4")},
+		{cmd("ZDIFF", "2", "zset2", "zset1", "WITHSCORES"), bulks("three", "3")},
+		{cmd("ZDIFFSTORE", "out", "2", "zset2", "zset1"), integer(1)},
+		{cmd("ZRANGE", "out", "0", "-1", "WITHSCORES"), bulks("three", "3")},
+
+		{cmd("ZUNION", "2", "zset1", "zset2", "AGGREGATE", "MIN", "WITHSCORES"), bulks("one", "1", "two", "2", "three", "3")},
+		{cmd("ZUNION", "2", "zset1", "zset2", "WEIGHTS", "5", "1", "AGGREGATE", "MAX", "WITHSCORES"), bulks("three", "3", "one", "5", "two", "10")},
+		{cmd("ZINTER", "2", "zset1", "zset2", "WEIGHTS", "1", "-1", "AGGREGATE", "SUM", "WITHSCORES"), bulks("one", "0", "two", "0")},
+		{cmd("ZINTER", "2", "zset1", "missing"), emptyArrayReply},
+		{cmd("ZUNION", "2", "zset1", "missing", "WITHSCORES"), bulks("one", "1", "two", "2")},
+		{cmd("ZDIFF", "2", "missing", "zset1"), emptyArrayReply},
+		{cmd("ZDIFF", "1", "zset1"), bulks("one", "two")},
+
+		// An empty result deletes the destination, even a source.
+		{cmd("ZINTERSTORE", "zset1", "2", "zset1", "missing"), integer(0)},
+		{cmd("TYPE", "zset1"), "+none\r\n"},
+		// The destination may be one of the inputs.
+		{cmd("ZUNIONSTORE", "zset2", "1", "zset2", "WEIGHTS", "2"), integer(3)},
+		{cmd("ZRANGE", "zset2", "0", "-1", "WITHSCORES"), bulks("one", "2", "two", "4", "three", "6")},
+	})
+}
+
+func TestZsetAlgebraTies(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(3), "ZADD", "a", "1", "c", "2", "b", "3", "a")
+	c.expect(integer(3), "ZADD", "b", "3", "c", "2", "b", "1", "a")
+	// Every member sums to 4: members with equal scores come out in
+	// lexicographic order, whatever order the inputs held them in.
+	runSteps(t, c, []testStep{
+		{cmd("ZUNION", "2", "a", "b", "WITHSCORES"), bulks("a", "4", "b", "4", "c", "4")},
+		{cmd("ZINTER", "2", "b", "a", "WITHSCORES"), bulks("a", "4", "b", "4", "c", "4")},
+		{cmd("ZUNION", "2", "a", "b", "AGGREGATE", "MAX", "WITHSCORES"), bulks("b", "2", "a", "3", "c", "3")},
+		{cmd("ZUNIONSTORE", "out", "2", "b", "a", "AGGREGATE", "MIN"), integer(3)},
+		{cmd("ZRANGE", "out", "0", "-1", "WITHSCORES"), bulks("a", "1", "c", "1", "b", "2")},
+		{cmd("ZRANGE", "out", "0", "-1", "REV"), bulks("b", "c", "a")},
+	})
+}
+
+func TestZsetAlgebraOverSetsAndInfinities(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(2), "SADD", "s", "a", "b")
+	c.expect(integer(2), "ZADD", "z", "5", "a", "7", "c")
+	c.expect(integer(2), "ZADD", "inf", "+inf", "a", "-inf", "b")
+	c.expect(integer(2), "ZADD", "ninf", "-inf", "a", "+inf", "b")
+	c.expect(okReply, "SET", "str", "v")
+	runSteps(t, c, []testStep{
+		// Plain set members score 1.
+		{cmd("ZUNION", "2", "s", "z", "WITHSCORES"), bulks("b", "1", "a", "6", "c", "7")},
+		{cmd("ZINTER", "2", "s", "z", "WEIGHTS", "3", "1", "WITHSCORES"), bulks("a", "8")},
+		{cmd("ZDIFF", "2", "z", "s", "WITHSCORES"), bulks("c", "7")},
+		{cmd("ZINTERSTORE", "out", "1", "s"), integer(2)},
+		{cmd("ZRANGE", "out", "0", "-1", "WITHSCORES"), bulks("a", "1", "b", "1")},
+
+		// inf + -inf and 0 * inf are NaN, which count as 0.
+		{cmd("ZUNION", "2", "inf", "ninf", "WITHSCORES"), bulks("a", "0", "b", "0")},
+		{cmd("ZUNION", "1", "inf", "WEIGHTS", "0", "WITHSCORES"), bulks("a", "0", "b", "0")},
+		{cmd("ZUNION", "2", "inf", "ninf", "AGGREGATE", "MAX", "WITHSCORES"), bulks("a", "inf", "b", "inf")},
+		{cmd("ZINTER", "2", "inf", "ninf", "AGGREGATE", "MIN", "WITHSCORES"), bulks("a", "-inf", "b", "-inf")},
+
+		{cmd("ZUNION", "2", "z", "str"), errorReply(RESP_ERR_WRONGTYPE)},
+		{cmd("ZINTERSTORE", "out", "2", "missing", "str"), errorReply(RESP_ERR_WRONGTYPE)},
+		{cmd("ZUNION", "0", "z"), errorReply("-ERR at least 1 input key is needed for 'zunion' command")},
+		{cmd("ZUNIONSTORE", "out", "0", "z"), errorReply("-ERR at least 1 input key is needed for 'zunionstore' command")},
+		{cmd("ZUNION", "3", "z", "s"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZUNION", "x", "z"), errorReply(RESP_ERR_NOT_INTEGER)},
+		{cmd("ZUNION", "2", "z", "s", "WEIGHTS", "1"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZUNION", "2", "z", "s", "WEIGHTS", "1", "x"), errorReply("-ERR weight value is not a float")},
+		{cmd("ZUNION", "1", "z", "AGGREGATE", "AVG"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZDIFF", "2", "z", "s", "WEIGHTS", "1", "1"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZDIFF", "2", "z", "s", "AGGREGATE", "MIN"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZUNIONSTORE", "out", "1", "z", "WITHSCORES"), errorReply(RESP_ERR_SYNTAX)},
+	})
+}
+
+// An aggregation reads all of its inputs at one point in time, even while
+// other clients write to them.
+func TestZsetAlgebraIsAtomic(t *testing.T) {
+	ts := startTestServer(t, nil)
+	writer := ts.client(t)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			score := strconv.Itoa(i)
+			var batch []byte
+			batch = append(batch, encodeBulkArray([]string{"MULTI"})...)
+			batch = append(batch, encodeBulkArray([]string{"ZADD", "a", score, "m"})...)
+			batch = append(batch, encodeBulkArray([]string{"ZADD", "b", score, "m"})...)
+			batch = append(batch, encodeBulkArray([]string{"EXEC"})...)
+			if _, err := writer.conn.Write(batch); err != nil {
+				t.Errorf("write: %v", err)
+				return
+			}
+			for j := 0; j < 4; j++ {
+				if _, err := writer.readWithin(5 * time.Second); err != nil {
+					t.Errorf("read: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	c := ts.client(t)
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		// a and b always hold the same score, so the difference is 0.
+		reply := c.do("ZINTER", "2", "a", "b", "WEIGHTS", "1", "-1", "WITHSCORES")
+		if reply != emptyArrayReply && reply != bulks("m", "0") {
+			t.Errorf("ZINTER saw the inputs half-updated: %q", reply)
+			<-done
+			return
+		}
+	}
+}
@@ -0,0 +1,1398 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangjia184/sortedset"
+)
+
+// Thresholds under which Redis keeps a sorted set in the compact listpack
+// encoding. They only affect what OBJECT ENCODING reports.
+const (
+	zsetMaxListpackEntries = 128
+	zsetMaxListpackValue   = 64
+)
+
+// The sortedset package orders nodes by an int64 score and then by key. Redis
+// scores are doubles, so they are mapped onto int64 in an order-preserving
+// way: flipping the sign bit of positive doubles and every bit of negative
+// ones makes their bit patterns sort like the values, and the mapping is
+// exact both ways. -0 is folded into 0, which Redis treats as equal.
+func zsetScore(f float64) sortedset.SCORE {
+	if f == 0 {
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return sortedset.SCORE(bits ^ 1<<63)
+}
+
+// nodeScore recovers the double score of a node stored through zsetScore.
+func nodeScore(node *sortedset.SortedSetNode) float64 {
+	bits := uint64(node.Score()) ^ 1<<63
+	if bits>>63 != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+// formatScore renders a score the way Redis replies with doubles: the
+// shortest representation that round-trips, written as a plain number unless
+// the exponent makes that unreasonably long.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case f == 0:
+		return "0"
+	}
+
+	sci := strconv.FormatFloat(f, 'e', -1, 64)
+	neg := sci[0] == '-'
+	if neg {
+		sci = sci[1:]
+	}
+	mantissa, expPart, _ := strings.Cut(sci, "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	exp10, _ := strconv.Atoi(expPart)
+
+	// K is the power of ten of the last digit, as in fpconv's emit_digits.
+	ndigits := len(digits)
+	k := exp10 - ndigits + 1
+	absExp := exp10
+	if absExp < 0 {
+		absExp = -absExp
+	}
+
+	var out string
+	switch {
+	case k >= 0 && absExp < ndigits+7:
+		out = digits + strings.Repeat("0", k)
+	case k < 0 && (k > -7 || absExp < 4):
+		if offset := ndigits + k; offset <= 0 {
+			out = "0." + strings.Repeat("0", -offset) + digits
+		} else {
+			out = digits[:offset] + "." + digits[offset:]
+		}
+	default:
+		out = digits[:1]
+		if ndigits > 1 {
+			out += "." + digits[1:]
+		}
+		if exp10 < 0 {
+			out += "e-" + strconv.Itoa(-exp10)
+		} else {
+			out += "e+" + strconv.Itoa(exp10)
+		}
+	}
+	if neg {
+		return "-" + out
+	}
+	return out
+}
+
+// zsetEncoding reports listpack for sorted sets small enough that Redis would
+// keep them compact.
+func zsetEncoding(z *sortedset.SortedSet) string {
+	if z.GetCount() > zsetMaxListpackEntries {
+		return "skiplist"
+	}
+	for _, node := range z.GetByRankRange(1, -1, false) {
+		if len(node.Key()) > zsetMaxListpackValue {
+			return "skiplist"
+		}
+	}
+	return "listpack"
+}
+
+// zsetAt returns the sorted set stored at key. found is false when the key
+// does not exist; wrongType is true when it holds a value of another type.
+// The caller must hold storageMu for writing.
+func (st *RedisState) zsetAt(key string) (zset *sortedset.SortedSet, found bool, wrongType bool) {
+	value, ok := st.lookupKey(key)
+	if !ok {
+		return nil, false, false
+	}
+	zset, ok = value.val.(*sortedset.SortedSet)
+	if !ok {
+		return nil, true, true
+	}
+	return zset, true, false
+}
+
+// storeZset replaces the value at key with zset, deleting the key when the
+// set is empty, and returns the resulting cardinality.
+func (st *RedisState) storeZset(key string, zset *sortedset.SortedSet) int {
+	if zset.GetCount() == 0 {
+		st.deleteKey(key)
+		return 0
+	}
+	st.storage[key] = newStorageVal(zset, time.Time{})
+	st.signalKeyReady(key)
+	return zset.GetCount()
+}
+
+// zsetFirstRank returns the 1-based rank of the first node for which pred
+// holds, or count+1 if there is none. pred must be false for a prefix of the
+// set and true for the rest of it.
+func zsetFirstRank(zset *sortedset.SortedSet, pred func(node *sortedset.SortedSetNode) bool) int {
+	lo, hi := 1, zset.GetCount()+1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if pred(zset.GetByRank(mid, false)) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return lo
+}
+
+// zsetRangeSpec is a score or lexicographic interval. Its methods tell
+// whether a node lies beyond each end, which is monotonic over the set and so
+// locates the interval by binary search.
+type zsetRangeSpec interface {
+	pastMin(node *sortedset.SortedSetNode) bool
+	pastMax(node *sortedset.SortedSetNode) bool
+}
+
+// zsetRanks returns the 1-based ranks of the first and last nodes inside r;
+// first > last when there are none.
+func zsetRanks(zset *sortedset.SortedSet, r zsetRangeSpec) (int, int) {
+	return zsetFirstRank(zset, r.pastMin), zsetFirstRank(zset, r.pastMax) - 1
+}
+
+type scoreRange struct {
+	min, max     float64
+	minEx, maxEx bool
+}
+
+func (r scoreRange) pastMin(node *sortedset.SortedSetNode) bool {
+	if r.minEx {
+		return nodeScore(node) > r.min
+	}
+	return nodeScore(node) >= r.min
+}
+
+func (r scoreRange) pastMax(node *sortedset.SortedSetNode) bool {
+	if r.maxEx {
+		return nodeScore(node) >= r.max
+	}
+	return nodeScore(node) > r.max
+}
+
+func parseScoreBound(arg string) (float64, bool, bool) {
+	exclusive := strings.HasPrefix(arg, "(")
+	if exclusive {
+		arg = arg[1:]
+	}
+	f, ok := parseFloatArg(arg)
+	return f, exclusive, ok
+}
+
+func parseScoreRange(minArg, maxArg string) (scoreRange, string) {
+	var r scoreRange
+	var okMin, okMax bool
+	r.min, r.minEx, okMin = parseScoreBound(minArg)
+	r.max, r.maxEx, okMax = parseScoreBound(maxArg)
+	if !okMin || !okMax {
+		return r, "-ERR min or max is not a float"
+	}
+	return r, ""
+}
+
+// lexBound is one end of a ZRANGEBYLEX interval; inf is -1 for "-" and 1 for
+// "+", which lie below and above every member.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int
+}
+
+type lexRange struct {
+	min, max lexBound
+}
+
+func (r lexRange) pastMin(node *sortedset.SortedSetNode) bool {
+	switch r.min.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.min.exclusive {
+		return node.Key() > r.min.value
+	}
+	return node.Key() >= r.min.value
+}
+
+func (r lexRange) pastMax(node *sortedset.SortedSetNode) bool {
+	switch r.max.inf {
+	case -1:
+		return true
+	case 1:
+		return false
+	}
+	if r.max.exclusive {
+		return node.Key() >= r.max.value
+	}
+	return node.Key() > r.max.value
+}
+
+func parseLexBound(arg string) (lexBound, bool) {
+	switch {
+	case arg == "-":
+		return lexBound{inf: -1}, true
+	case arg == "+":
+		return lexBound{inf: 1}, true
+	case strings.HasPrefix(arg, "("):
+		return lexBound{value: arg[1:], exclusive: true}, true
+	case strings.HasPrefix(arg, "["):
+		return lexBound{value: arg[1:]}, true
+	}
+	return lexBound{}, false
+}
+
+func parseLexRange(minArg, maxArg string) (lexRange, string) {
+	min, okMin := parseLexBound(minArg)
+	max, okMax := parseLexBound(maxArg)
+	if !okMin || !okMax {
+		return lexRange{}, "-ERR min or max not valid string range item"
+	}
+	return lexRange{min: min, max: max}, ""
+}
+
+// zaddFlags are the options of ZADD.
+type zaddFlags struct {
+	nx, xx, gt, lt, ch, incr bool
+}
+
+// zsetAddMember applies one ZADD/ZINCRBY element. It returns the member's
+// resulting score, whether it was added or had its score changed, and
+// whether the flags let the operation happen at all. errResp is set when an
+// increment produces NaN.
+func zsetAddMember(zset *sortedset.SortedSet, member string, score float64, flags zaddFlags) (newScore float64, added, updated, applied bool, errResp string) {
+	node := zset.GetByKey(member)
+	if node == nil {
+		if flags.xx {
+			return 0, false, false, false, ""
+		}
+		zset.AddOrUpdate(member, zsetScore(score), nil)
+		return score, true, false, true, ""
+	}
+	if flags.nx {
+		return 0, false, false, false, ""
+	}
+
+	current := nodeScore(node)
+	if flags.incr {
+		score += current
+		if math.IsNaN(score) {
+			return 0, false, false, false, "-ERR resulting score is not a number (NaN)"
+		}
+	}
+	if (flags.gt && score <= current) || (flags.lt && score >= current) {
+		return 0, false, false, false, ""
+	}
+	if score != current {
+		zset.AddOrUpdate(member, zsetScore(score), nil)
+		return score, false, true, true, ""
+	}
+	return score, false, false, true, ""
+}
+
+func (s *RedisServer) zaddCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("ZADD")
+	}
+
+	var flags zaddFlags
+	i := 2
+parseFlags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			flags.nx = true
+		case "XX":
+			flags.xx = true
+		case "GT":
+			flags.gt = true
+		case "LT":
+			flags.lt = true
+		case "CH":
+			flags.ch = true
+		case "INCR":
+			flags.incr = true
+		default:
+			break parseFlags
+		}
+	}
+
+	pairs := args[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+	if flags.nx && flags.xx {
+		return CommandResponse{Error: "-ERR XX and NX options at the same time are not compatible"}
+	}
+	if (flags.gt && flags.nx) || (flags.lt && flags.nx) || (flags.gt && flags.lt) {
+		return CommandResponse{Error: "-ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if flags.incr && len(pairs) > 2 {
+		return CommandResponse{Error: "-ERR INCR option supports a single increment-element pair"}
+	}
+
+	scores := make([]float64, len(pairs)/2)
+	for j := range scores {
+		score, ok := parseFloatArg(pairs[2*j])
+		if !ok {
+			return CommandResponse{Error: RESP_ERR_NOT_FLOAT}
+		}
+		scores[j] = score
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if flags.xx {
+			if flags.incr {
+				return CommandResponse{Response: RESP_NULL_BULK}
+			}
+			return CommandResponse{Response: ":0\r\n"}
+		}
+		zset = sortedset.New()
+	}
+
+	added, updated := 0, 0
+	var lastScore float64
+	lastApplied := false
+	for j, score := range scores {
+		newScore, wasAdded, wasUpdated, applied, errResp := zsetAddMember(zset, pairs[2*j+1], score, flags)
+		if errResp != "" {
+			return CommandResponse{Error: errResp}
+		}
+		if wasAdded {
+			added++
+		}
+		if wasUpdated {
+			updated++
+		}
+		lastScore, lastApplied = newScore, applied
+	}
+
+	if !found && zset.GetCount() > 0 {
+		s.state.storage[args[1]] = newStorageVal(zset, time.Time{})
+	}
+	if added > 0 {
+		s.state.signalKeyReady(args[1])
+	}
+	if added+updated > 0 {
+		event := "zadd"
+		if flags.incr {
+			event = "zincr"
+		}
+		s.state.keyModified(notifyZset, event, args[1])
+		s.state.propagate(args)
+	}
+
+	if flags.incr {
+		if !lastApplied {
+			return CommandResponse{Response: RESP_NULL_BULK}
+		}
+		return CommandResponse{Response: toRespStr(formatScore(lastScore))}
+	}
+	if flags.ch {
+		return CommandResponse{Response: toRespInt(int64(added + updated))}
+	}
+	return CommandResponse{Response: toRespInt(int64(added))}
+}
+
+func (s *RedisServer) zincrbyCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("ZINCRBY")
+	}
+	delta, ok := parseFloatArg(args[2])
+	if !ok {
+		return CommandResponse{Error: RESP_ERR_NOT_FLOAT}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		zset = sortedset.New()
+	}
+
+	score, _, _, _, errResp := zsetAddMember(zset, args[3], delta, zaddFlags{incr: true})
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	if !found {
+		s.state.storage[args[1]] = newStorageVal(zset, time.Time{})
+		s.state.signalKeyReady(args[1])
+	}
+	s.state.keyModified(notifyZset, "zincr", args[1])
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespStr(formatScore(score))}
+}
+
+func (s *RedisServer) zscoreCommand(args []string) CommandResponse {
+	if len(args) != 3 {
+		return wrongArgsError("ZSCORE")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	node := zset.GetByKey(args[2])
+	if node == nil {
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+	return CommandResponse{Response: toRespStr(formatScore(nodeScore(node)))}
+}
+
+func (s *RedisServer) zmscoreCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("ZMSCORE")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)-2) + "\r\n")
+	for _, member := range args[2:] {
+		var node *sortedset.SortedSetNode
+		if found {
+			node = zset.GetByKey(member)
+		}
+		if node == nil {
+			b.WriteString(RESP_NULL_BULK)
+			continue
+		}
+		b.WriteString(toRespStr(formatScore(nodeScore(node))))
+	}
+	return CommandResponse{Response: b.String()}
+}
+
+func (s *RedisServer) zcardCommand(args []string) CommandResponse {
+	if len(args) != 2 {
+		return wrongArgsError("ZCARD")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	return CommandResponse{Response: toRespInt(int64(zset.GetCount()))}
+}
+
+func (s *RedisServer) zcountCommand(args []string) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError("ZCOUNT")
+	}
+	r, errResp := parseScoreRange(args[2], args[3])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+	first, last := zsetRanks(zset, r)
+	return CommandResponse{Response: toRespInt(int64(max(last-first+1, 0)))}
+}
+
+// zrankCommand backs ZRANK and ZREVRANK.
+func (s *RedisServer) zrankCommand(args []string, reverse bool) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) != 3 && len(args) != 4 {
+		return wrongArgsError(cmd)
+	}
+	withScore := len(args) == 4
+	if withScore && strings.ToUpper(args[3]) != "WITHSCORE" {
+		return CommandResponse{Error: RESP_ERR_SYNTAX}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	var rank int
+	if found {
+		rank = zset.FindRank(args[2])
+	}
+	if rank == 0 {
+		if withScore {
+			return CommandResponse{Response: RESP_NULL_ARRAY}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	rank--
+	if reverse {
+		rank = zset.GetCount() - 1 - rank
+	}
+	if !withScore {
+		return CommandResponse{Response: toRespInt(int64(rank))}
+	}
+	score := formatScore(nodeScore(zset.GetByKey(args[2])))
+	return CommandResponse{Response: "*2\r\n" + toRespInt(int64(rank)) + toRespStr(score)}
+}
+
+func (s *RedisServer) zremCommand(args []string) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError("ZREM")
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	removed := 0
+	for _, member := range args[2:] {
+		if zset.Remove(member) != nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		s.state.keyModified(notifyZset, "zrem", args[1])
+		s.state.propagate(args)
+	}
+	if zset.GetCount() == 0 {
+		s.state.deleteKey(args[1])
+	}
+	return CommandResponse{Response: toRespInt(int64(removed))}
+}
+
+// How a range command selects its elements.
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeRequest is a parsed range query, common to ZRANGE, ZRANGESTORE and
+// the older ZREVRANGE/ZRANGEBYSCORE/ZRANGEBYLEX forms.
+type zrangeRequest struct {
+	key        string
+	start      string
+	stop       string
+	by         int
+	rev        bool
+	withScores bool
+	limit      bool
+	offset     int
+	count      int
+}
+
+// parseZrangeOptions parses the optional arguments following the range.
+// allowed lists the keywords the calling command accepts.
+func parseZrangeOptions(req *zrangeRequest, opts []string, allowed string) string {
+	for i := 0; i < len(opts); i++ {
+		opt := strings.ToUpper(opts[i])
+		if !strings.Contains(" "+allowed+" ", " "+opt+" ") {
+			return RESP_ERR_SYNTAX
+		}
+		switch opt {
+		case "BYSCORE":
+			req.by = zrangeByScore
+		case "BYLEX":
+			req.by = zrangeByLex
+		case "REV":
+			req.rev = true
+		case "WITHSCORES":
+			req.withScores = true
+		case "LIMIT":
+			if i+2 >= len(opts) {
+				return RESP_ERR_SYNTAX
+			}
+			offset, err1 := strconv.Atoi(opts[i+1])
+			count, err2 := strconv.Atoi(opts[i+2])
+			if err1 != nil || err2 != nil {
+				return RESP_ERR_NOT_INTEGER
+			}
+			req.limit, req.offset, req.count = true, offset, count
+			i += 2
+		}
+	}
+
+	if req.limit && req.by == zrangeByRank {
+		return "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX"
+	}
+	if req.withScores && req.by == zrangeByLex {
+		return "-ERR syntax error, WITHSCORES not supported in combination with BYLEX"
+	}
+	return ""
+}
+
+// zrangeNodes returns the nodes req selects, in reply order. The caller must
+// hold storageMu.
+func zrangeNodes(zset *sortedset.SortedSet, req zrangeRequest) ([]*sortedset.SortedSetNode, string) {
+	length := zset.GetCount()
+
+	if req.by == zrangeByRank {
+		start, err1 := strconv.Atoi(req.start)
+		stop, err2 := strconv.Atoi(req.stop)
+		if err1 != nil || err2 != nil {
+			return nil, RESP_ERR_NOT_INTEGER
+		}
+		start, stop, ok := normaliseRange(start, stop, length)
+		if !ok {
+			return nil, ""
+		}
+		if !req.rev {
+			return zset.GetByRankRange(start+1, stop+1, false), ""
+		}
+		// Reverse ranks count from the highest score; asking for the higher
+		// rank first makes the package return them in descending order.
+		return zset.GetByRankRange(length-start, length-stop, false), ""
+	}
+
+	// In the reversed forms the range is given from max to min.
+	minArg, maxArg := req.start, req.stop
+	if req.rev {
+		minArg, maxArg = maxArg, minArg
+	}
+	var spec zsetRangeSpec
+	if req.by == zrangeByScore {
+		r, errResp := parseScoreRange(minArg, maxArg)
+		if errResp != "" {
+			return nil, errResp
+		}
+		spec = r
+	} else {
+		r, errResp := parseLexRange(minArg, maxArg)
+		if errResp != "" {
+			return nil, errResp
+		}
+		spec = r
+	}
+
+	first, last := zsetRanks(zset, spec)
+	if first > last || (req.limit && (req.offset < 0 || req.count == 0)) {
+		return nil, ""
+	}
+	size := last - first + 1
+	if req.limit {
+		if req.offset >= size {
+			return nil, ""
+		}
+		size -= req.offset
+		if req.count > 0 && req.count < size {
+			size = req.count
+		}
+	}
+
+	if !req.rev {
+		from := first + req.offset
+		return zset.GetByRankRange(from, from+size-1, false), ""
+	}
+	from := last - req.offset
+	return zset.GetByRankRange(from, from-size+1, false), ""
+}
+
+func zsetNodesReply(nodes []*sortedset.SortedSetNode, withScores bool) string {
+	out := make([]string, 0, len(nodes)*2)
+	for _, node := range nodes {
+		out = append(out, node.Key())
+		if withScores {
+			out = append(out, formatScore(nodeScore(node)))
+		}
+	}
+	return toRespStrArr(out)
+}
+
+// zrangeCommand backs ZRANGE and its older forms; by and rev preset what the
+// command name implies, and allowed lists the options it accepts.
+func (s *RedisServer) zrangeCommand(args []string, by int, rev bool, allowed string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	req := zrangeRequest{key: args[1], start: args[2], stop: args[3], by: by, rev: rev}
+	if errResp := parseZrangeOptions(&req, args[4:], allowed); errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(req.key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		// Range arguments are still validated against an empty set.
+		zset = sortedset.New()
+	}
+	nodes, errResp := zrangeNodes(zset, req)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	return CommandResponse{Response: zsetNodesReply(nodes, req.withScores)}
+}
+
+func (s *RedisServer) zrangestoreCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("ZRANGESTORE")
+	}
+	req := zrangeRequest{key: args[2], start: args[3], stop: args[4]}
+	if errResp := parseZrangeOptions(&req, args[5:], "BYSCORE BYLEX REV LIMIT"); errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	src, found, wrongType := s.state.zsetAt(req.key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		src = sortedset.New()
+	}
+	nodes, errResp := zrangeNodes(src, req)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	dst := sortedset.New()
+	for _, node := range nodes {
+		dst.AddOrUpdate(node.Key(), node.Score(), nil)
+	}
+	size := s.state.storeZset(args[1], dst)
+	if size > 0 {
+		s.state.keyModified(notifyZset, "zrangestore", args[1])
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(size))}
+}
+
+// zpopCommand backs ZPOPMIN and ZPOPMAX.
+func (s *RedisServer) zpopCommand(args []string, highest bool) CommandResponse {
+	if len(args) != 2 && len(args) != 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		if n < 0 {
+			return CommandResponse{Error: "-ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found || count == 0 {
+		return CommandResponse{Response: "*0\r\n"}
+	}
+
+	nodes := s.state.popZset(args[1], zset, count, highest)
+	s.state.propagate(args)
+
+	return CommandResponse{Response: zsetNodesReply(nodes, true)}
+}
+
+// zsetPop removes up to count members with the lowest (or highest) scores
+// and returns them in pop order.
+func zsetPop(zset *sortedset.SortedSet, count int, highest bool) []*sortedset.SortedSetNode {
+	nodes := make([]*sortedset.SortedSetNode, 0, min(count, zset.GetCount()))
+	for len(nodes) < count && zset.GetCount() > 0 {
+		if highest {
+			nodes = append(nodes, zset.PopMax())
+		} else {
+			nodes = append(nodes, zset.PopMin())
+		}
+	}
+	return nodes
+}
+
+// popZset pops up to count members from zset, the sorted set at key, raising
+// the pop event and deleting the key once it is empty. The caller must hold
+// storageMu for writing.
+func (st *RedisState) popZset(key string, zset *sortedset.SortedSet, count int, highest bool) []*sortedset.SortedSetNode {
+	nodes := zsetPop(zset, count, highest)
+	st.keyModified(notifyZset, strings.ToLower(zpopCommandName(highest)), key)
+	if zset.GetCount() == 0 {
+		st.deleteKey(key)
+	}
+	return nodes
+}
+
+// zremrangeCommand backs ZREMRANGEBYRANK, ZREMRANGEBYSCORE and
+// ZREMRANGEBYLEX.
+func (s *RedisServer) zremrangeCommand(args []string, by int) CommandResponse {
+	if len(args) != 4 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	req := zrangeRequest{key: args[1], start: args[2], stop: args[3], by: by}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(req.key)
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		zset = sortedset.New()
+	}
+	nodes, errResp := zrangeNodes(zset, req)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	if len(nodes) == 0 {
+		return CommandResponse{Response: ":0\r\n"}
+	}
+
+	for _, node := range nodes {
+		zset.Remove(node.Key())
+	}
+	s.state.keyModified(notifyZset, strings.ToLower(args[0]), req.key)
+	if zset.GetCount() == 0 {
+		s.state.deleteKey(req.key)
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(len(nodes)))}
+}
+
+func (s *RedisServer) zrandmemberCommand(args []string) CommandResponse {
+	if len(args) < 2 || len(args) > 4 {
+		return wrongArgsError("ZRANDMEMBER")
+	}
+
+	withCount := len(args) >= 3
+	count := 1
+	if withCount {
+		n, err := strconv.Atoi(args[2])
+		if err != nil {
+			return CommandResponse{Error: RESP_ERR_NOT_INTEGER}
+		}
+		count = n
+	}
+	withScores := false
+	if len(args) == 4 {
+		if strings.ToUpper(args[3]) != "WITHSCORES" {
+			return CommandResponse{Error: RESP_ERR_SYNTAX}
+		}
+		withScores = true
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	zset, found, wrongType := s.state.zsetAt(args[1])
+	if wrongType {
+		return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+	}
+	if !found {
+		if withCount {
+			return CommandResponse{Response: "*0\r\n"}
+		}
+		return CommandResponse{Response: RESP_NULL_BULK}
+	}
+
+	if !withCount {
+		node := zset.GetByRank(rand.Intn(zset.GetCount())+1, false)
+		return CommandResponse{Response: toRespStr(node.Key())}
+	}
+
+	picks := randomPicks(zset.GetCount(), count)
+	nodes := make([]*sortedset.SortedSetNode, len(picks))
+	for i, pos := range picks {
+		nodes[i] = zset.GetByRank(pos+1, false)
+	}
+	return CommandResponse{Response: zsetNodesReply(nodes, withScores)}
+}
+
+// How ZUNION and ZINTER combine the scores of a member found in several
+// inputs.
+const (
+	zsetAggregateSum = iota
+	zsetAggregateMin
+	zsetAggregateMax
+)
+
+// zsetOperand is one input of ZUNION, ZINTER or ZDIFF: a sorted set, a plain
+// set whose members all score 1, or neither for a missing key.
+type zsetOperand struct {
+	zset   *sortedset.SortedSet
+	set    *setValue
+	weight float64
+}
+
+func (o zsetOperand) Len() int {
+	switch {
+	case o.zset != nil:
+		return o.zset.GetCount()
+	case o.set != nil:
+		return o.set.Len()
+	}
+	return 0
+}
+
+// Score returns the weighted score of member. As in Redis, a weighted score
+// that is NaN (0 * inf) counts as 0.
+func (o zsetOperand) Score(member string) (float64, bool) {
+	var score float64
+	switch {
+	case o.zset != nil:
+		node := o.zset.GetByKey(member)
+		if node == nil {
+			return 0, false
+		}
+		score = nodeScore(node)
+	case o.set != nil && o.set.Has(member):
+		score = 1
+	default:
+		return 0, false
+	}
+	return weighScore(score, o.weight), true
+}
+
+// Each calls fn with every member and its weighted score.
+func (o zsetOperand) Each(fn func(member string, score float64)) {
+	switch {
+	case o.zset != nil:
+		for _, node := range o.zset.GetByRankRange(1, -1, false) {
+			fn(node.Key(), weighScore(nodeScore(node), o.weight))
+		}
+	case o.set != nil:
+		for i := 0; i < o.set.Len(); i++ {
+			fn(o.set.At(i), weighScore(1, o.weight))
+		}
+	}
+}
+
+func weighScore(score, weight float64) float64 {
+	if weighted := score * weight; !math.IsNaN(weighted) {
+		return weighted
+	}
+	return 0
+}
+
+func zsetAggregate(aggregate int, acc, score float64) float64 {
+	switch aggregate {
+	case zsetAggregateMin:
+		return math.Min(acc, score)
+	case zsetAggregateMax:
+		return math.Max(acc, score)
+	}
+	// inf + -inf is NaN, which Redis turns into 0.
+	if sum := acc + score; !math.IsNaN(sum) {
+		return sum
+	}
+	return 0
+}
+
+// zsetAlgebraRequest is a parsed ZUNION/ZINTER/ZDIFF call.
+type zsetAlgebraRequest struct {
+	op         int
+	keys       []string
+	weights    []float64
+	aggregate  int
+	withScores bool
+}
+
+// parseZsetAlgebra parses "numkeys key [key ...]" and the options after it.
+// WEIGHTS and AGGREGATE are refused for ZDIFF, WITHSCORES for the STORE forms.
+func parseZsetAlgebra(cmd string, args []string, op int, store bool) (zsetAlgebraRequest, string) {
+	req := zsetAlgebraRequest{op: op}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return req, RESP_ERR_NOT_INTEGER
+	}
+	if numKeys <= 0 {
+		return req, "-ERR at least 1 input key is needed for '" + strings.ToLower(cmd) + "' command"
+	}
+	if numKeys > len(args)-1 {
+		return req, RESP_ERR_SYNTAX
+	}
+	req.keys = args[1 : 1+numKeys]
+	req.weights = make([]float64, numKeys)
+	for i := range req.weights {
+		req.weights[i] = 1
+	}
+
+	opts := args[1+numKeys:]
+	for i := 0; i < len(opts); i++ {
+		switch opt := strings.ToUpper(opts[i]); {
+		case opt == "WEIGHTS" && op != setOpDiff && i+numKeys < len(opts):
+			for j := range req.weights {
+				w, ok := parseFloatArg(opts[i+1+j])
+				if !ok {
+					return req, "-ERR weight value is not a float"
+				}
+				req.weights[j] = w
+			}
+			i += numKeys
+		case opt == "AGGREGATE" && op != setOpDiff && i+1 < len(opts):
+			switch strings.ToUpper(opts[i+1]) {
+			case "SUM":
+				req.aggregate = zsetAggregateSum
+			case "MIN":
+				req.aggregate = zsetAggregateMin
+			case "MAX":
+				req.aggregate = zsetAggregateMax
+			default:
+				return req, RESP_ERR_SYNTAX
+			}
+			i++
+		case opt == "WITHSCORES" && !store:
+			req.withScores = true
+		default:
+			return req, RESP_ERR_SYNTAX
+		}
+	}
+	return req, ""
+}
+
+// zsetAlgebra computes the union, intersection or difference req describes
+// into a new sorted set. The caller must hold storageMu for writing.
+func (st *RedisState) zsetAlgebra(req zsetAlgebraRequest) (*sortedset.SortedSet, string) {
+	operands := make([]zsetOperand, len(req.keys))
+	for i, key := range req.keys {
+		operands[i].weight = req.weights[i]
+		value, ok := st.lookupKey(key)
+		if !ok {
+			continue
+		}
+		switch v := value.val.(type) {
+		case *sortedset.SortedSet:
+			operands[i].zset = v
+		case *setValue:
+			operands[i].set = v
+		default:
+			return nil, RESP_ERR_WRONGTYPE
+		}
+	}
+
+	scores := make(map[string]float64)
+	switch req.op {
+	case setOpUnion:
+		for _, operand := range operands {
+			operand.Each(func(member string, score float64) {
+				if acc, ok := scores[member]; ok {
+					score = zsetAggregate(req.aggregate, acc, score)
+				}
+				scores[member] = score
+			})
+		}
+
+	case setOpInter:
+		// Probe the larger inputs with the members of the smallest one,
+		// which also settles the order scores are aggregated in.
+		sort.SliceStable(operands, func(i, j int) bool { return operands[i].Len() < operands[j].Len() })
+		operands[0].Each(func(member string, score float64) {
+			for _, other := range operands[1:] {
+				otherScore, ok := other.Score(member)
+				if !ok {
+					return
+				}
+				score = zsetAggregate(req.aggregate, score, otherScore)
+			}
+			scores[member] = score
+		})
+
+	case setOpDiff:
+		operands[0].Each(func(member string, score float64) {
+			for _, other := range operands[1:] {
+				if _, ok := other.Score(member); ok {
+					return
+				}
+			}
+			scores[member] = score
+		})
+	}
+
+	result := sortedset.New()
+	for member, score := range scores {
+		result.AddOrUpdate(member, zsetScore(score), nil)
+	}
+	return result, ""
+}
+
+// zsetAlgebraCommand backs ZUNION, ZINTER and ZDIFF.
+func (s *RedisServer) zsetAlgebraCommand(args []string, op int) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) < 3 {
+		return wrongArgsError(cmd)
+	}
+	req, errResp := parseZsetAlgebra(cmd, args[1:], op, false)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	result, errResp := s.state.zsetAlgebra(req)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	return CommandResponse{Response: zsetNodesReply(result.GetByRankRange(1, -1, false), req.withScores)}
+}
+
+// zsetAlgebraStoreCommand backs ZUNIONSTORE, ZINTERSTORE and ZDIFFSTORE.
+func (s *RedisServer) zsetAlgebraStoreCommand(args []string, op int) CommandResponse {
+	cmd := strings.ToUpper(args[0])
+	if len(args) < 4 {
+		return wrongArgsError(cmd)
+	}
+	req, errResp := parseZsetAlgebra(cmd, args[2:], op, true)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	result, errResp := s.state.zsetAlgebra(req)
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	size := s.state.storeZset(args[1], result)
+	if size > 0 {
+		s.state.keyModified(notifyZset, strings.ToLower(cmd), args[1])
+	}
+	s.state.propagate(args)
+
+	return CommandResponse{Response: toRespInt(int64(size))}
+}
+
+// zpopCommandName is the command a pop from the low or high end of a sorted
+// set is propagated as.
+func zpopCommandName(highest bool) string {
+	if highest {
+		return RESP_COMMAND_ZPOPMAX
+	}
+	return RESP_COMMAND_ZPOPMIN
+}
+
+// bzpopCommand backs BZPOPMIN and BZPOPMAX.
+func (s *RedisServer) bzpopCommand(args []string, highest bool) CommandResponse {
+	if len(args) < 3 {
+		return wrongArgsError(strings.ToUpper(args[0]))
+	}
+	timeout, errResp := parseBlockTimeout(args[len(args)-1])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys := args[1 : len(args)-1]
+
+	serve := func(key string) (CommandResponse, bool) {
+		zset, found, wrongType := s.state.zsetAt(key)
+		if !found || wrongType {
+			return CommandResponse{}, false
+		}
+		node := s.state.popZset(key, zset, 1, highest)[0]
+		s.state.propagate([]string{zpopCommandName(highest), key})
+		return CommandResponse{Response: toRespArr(key, node.Key(), formatScore(nodeScore(node)))}, true
+	}
+
+	s.state.storageMu.Lock()
+	for _, key := range keys {
+		if _, _, wrongType := s.state.zsetAt(key); wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := serve(key); served {
+			s.state.storageMu.Unlock()
+			return resp
+		}
+	}
+	if s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, timeout, RESP_NULL_ARRAY)
+}
+
+// parseZMPopArgs parses the "numkeys key [key ...] MIN|MAX [COUNT count]"
+// tail shared by ZMPOP and BZMPOP.
+func parseZMPopArgs(args []string) (keys []string, highest bool, count int, errResp string) {
+	if len(args) < 3 {
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, "-ERR numkeys should be greater than 0"
+	}
+	if numKeys > len(args)-2 {
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+	keys = args[1 : 1+numKeys]
+
+	switch strings.ToUpper(args[1+numKeys]) {
+	case "MIN":
+	case "MAX":
+		highest = true
+	default:
+		return nil, false, 0, RESP_ERR_SYNTAX
+	}
+
+	count = 1
+	if rest := args[2+numKeys:]; len(rest) > 0 {
+		if len(rest) != 2 || strings.ToUpper(rest[0]) != "COUNT" {
+			return nil, false, 0, RESP_ERR_SYNTAX
+		}
+		n, err := strconv.Atoi(rest[1])
+		if err != nil || n <= 0 {
+			return nil, false, 0, "-ERR count should be greater than 0"
+		}
+		count = n
+	}
+	return keys, highest, count, ""
+}
+
+// zmpopFrom pops up to count members from key when it holds a sorted set,
+// replying in the "key, [[member, score], ...]" shape ZMPOP and BZMPOP share.
+// The caller must hold storageMu for writing.
+func (s *RedisServer) zmpopFrom(key string, highest bool, count int) (CommandResponse, bool) {
+	zset, found, wrongType := s.state.zsetAt(key)
+	if !found || wrongType {
+		return CommandResponse{}, false
+	}
+	nodes := s.state.popZset(key, zset, count, highest)
+	s.state.propagate([]string{zpopCommandName(highest), key, strconv.Itoa(len(nodes))})
+
+	var b strings.Builder
+	b.WriteString("*2\r\n" + toRespStr(key) + "*" + strconv.Itoa(len(nodes)) + "\r\n")
+	for _, node := range nodes {
+		b.WriteString(toRespArr(node.Key(), formatScore(nodeScore(node))))
+	}
+	return CommandResponse{Response: b.String()}, true
+}
+
+func (s *RedisServer) zmpopCommand(args []string) CommandResponse {
+	if len(args) < 4 {
+		return wrongArgsError("ZMPOP")
+	}
+	keys, highest, count, errResp := parseZMPopArgs(args[1:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	s.state.storageMu.Lock()
+	defer s.state.storageMu.Unlock()
+
+	for _, key := range keys {
+		if _, _, wrongType := s.state.zsetAt(key); wrongType {
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := s.zmpopFrom(key, highest, count); served {
+			return resp
+		}
+	}
+	return CommandResponse{Response: RESP_NULL_ARRAY}
+}
+
+func (s *RedisServer) bzmpopCommand(args []string) CommandResponse {
+	if len(args) < 5 {
+		return wrongArgsError("BZMPOP")
+	}
+	timeout, errResp := parseBlockTimeout(args[1])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+	keys, highest, count, errResp := parseZMPopArgs(args[2:])
+	if errResp != "" {
+		return CommandResponse{Error: errResp}
+	}
+
+	serve := func(key string) (CommandResponse, bool) {
+		return s.zmpopFrom(key, highest, count)
+	}
+
+	s.state.storageMu.Lock()
+	for _, key := range keys {
+		if _, _, wrongType := s.state.zsetAt(key); wrongType {
+			s.state.storageMu.Unlock()
+			return CommandResponse{Error: RESP_ERR_WRONGTYPE}
+		}
+		if resp, served := serve(key); served {
+			s.state.storageMu.Unlock()
+			return resp
+		}
+	}
+	if s.inExec {
+		s.state.storageMu.Unlock()
+		return CommandResponse{Response: RESP_NULL_ARRAY}
+	}
+	client := s.state.blockClient(keys, serve)
+	s.state.storageMu.Unlock()
+
+	return s.waitBlocked(client, timeout, RESP_NULL_ARRAY)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestZaddFlags(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	runSteps(t, c, []testStep{
+		{cmd("ZADD", "z", "10", "m"), integer(1)},
+		{cmd("ZADD", "z", "GT", "5", "m"), integer(0)},
+		{cmd("ZSCORE", "z", "m"), bulk("10")},
+		{cmd("ZADD", "z", "GT", "CH", "15", "m"), integer(1)},
+		{cmd("ZADD", "z", "LT", "CH", "20", "m"), integer(0)},
+		{cmd("ZADD", "z", "LT", "CH", "12", "m", "1", "n"), integer(2)},
+		{cmd("ZADD", "z", "XX", "1", "new"), integer(0)},
+		{cmd("ZADD", "z", "NX", "1", "m", "2", "new"), integer(1)},
+		{cmd("ZADD", "z", "CH", "12", "m", "3", "new"), integer(1)},
+		{cmd("ZADD", "z", "NX", "INCR", "1", "m"), nilBulkReply},
+		{cmd("ZADD", "z", "INCR", "2.5", "m"), bulk("14.5")},
+		{cmd("ZADD", "z", "GT", "INCR", "-1", "m"), nilBulkReply},
+		{cmd("ZADD", "missing", "XX", "INCR", "1", "m"), nilBulkReply},
+		{cmd("ZADD", "missing", "XX", "1", "m"), integer(0)},
+		{cmd("TYPE", "missing"), "+none\r\n"},
+		{cmd("ZSCORE", "z", "m"), bulk("14.5")},
+		{cmd("ZMSCORE", "z", "m", "nope", "n"), array(bulk("14.5"), nilBulkReply, bulk("1"))},
+		{cmd("ZINCRBY", "z", "1", "m"), bulk("15.5")},
+		{cmd("ZINCRBY", "z", "5", "fresh"), bulk("5")},
+
+		{cmd("ZADD", "z", "NX", "XX", "1", "a"), errorReply("-ERR XX and NX options at the same time are not compatible")},
+		{cmd("ZADD", "z", "GT", "LT", "1", "a"), errorReply("-ERR GT, LT, and/or NX options at the same time are not compatible")},
+		{cmd("ZADD", "z", "GT", "NX", "1", "a"), errorReply("-ERR GT, LT, and/or NX options at the same time are not compatible")},
+		{cmd("ZADD", "z", "INCR", "1", "a", "2", "b"), errorReply("-ERR INCR option supports a single increment-element pair")},
+		{cmd("ZADD", "z", "1", "a", "2"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZADD", "z", "nan", "a"), errorReply(RESP_ERR_NOT_FLOAT)},
+		{cmd("ZADD", "z", "one", "a"), errorReply(RESP_ERR_NOT_FLOAT)},
+
+		{cmd("ZADD", "inf", "+inf", "a", "-inf", "b", "0", "c"), integer(3)},
+		{cmd("ZRANGE", "inf", "0", "-1", "WITHSCORES"), bulks("b", "-inf", "c", "0", "a", "inf")},
+		{cmd("ZINCRBY", "inf", "-inf", "a"), errorReply("-ERR resulting score is not a number (NaN)")},
+		{cmd("ZSCORE", "inf", "a"), bulk("inf")},
+	})
+}
+
+func TestZrangeByRank(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "ZADD", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e")
+	runSteps(t, c, []testStep{
+		{cmd("ZRANGE", "z", "0", "-1"), bulks("a", "b", "c", "d", "e")},
+		{cmd("ZRANGE", "z", "-2", "-1", "WITHSCORES"), bulks("d", "4", "e", "5")},
+		{cmd("ZRANGE", "z", "-100", "1"), bulks("a", "b")},
+		{cmd("ZRANGE", "z", "3", "100"), bulks("d", "e")},
+		{cmd("ZRANGE", "z", "3", "1"), emptyArrayReply},
+		{cmd("ZRANGE", "z", "5", "10"), emptyArrayReply},
+		{cmd("ZRANGE", "z", "0", "1", "REV"), bulks("e", "d")},
+		{cmd("ZRANGE", "z", "-1", "-1", "REV", "WITHSCORES"), bulks("a", "1")},
+		{cmd("ZREVRANGE", "z", "1", "2", "WITHSCORES"), bulks("d", "4", "c", "3")},
+		{cmd("ZRANGE", "missing", "0", "-1"), emptyArrayReply},
+		{cmd("ZRANGE", "z", "0", "x"), errorReply(RESP_ERR_NOT_INTEGER)},
+		{cmd("ZRANGE", "z", "0", "-1", "LIMIT", "0", "1"), errorReply("-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")},
+		{cmd("ZREVRANGE", "z", "0", "-1", "REV"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZRANK", "z", "c"), integer(2)},
+		{cmd("ZREVRANK", "z", "c"), integer(2)},
+		{cmd("ZREVRANK", "z", "a"), integer(4)},
+		{cmd("ZRANK", "z", "nope"), nilBulkReply},
+		{cmd("ZCARD", "z"), integer(5)},
+	})
+}
+
+func TestZrangeByScoreWithLimit(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "ZADD", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e")
+	runSteps(t, c, []testStep{
+		{cmd("ZRANGEBYSCORE", "z", "(1", "3"), bulks("b", "c")},
+		{cmd("ZRANGEBYSCORE", "z", "(1", "(3"), bulks("b")},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "1", "2"), bulks("b", "c")},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "2", "-1"), bulks("c", "d", "e")},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "4", "10"), bulks("e")},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "5", "10"), emptyArrayReply},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "-1", "2"), emptyArrayReply},
+		{cmd("ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "0", "0"), emptyArrayReply},
+		{cmd("ZRANGEBYSCORE", "z", "2", "4", "WITHSCORES", "LIMIT", "1", "1"), bulks("c", "3")},
+		{cmd("ZRANGEBYSCORE", "z", "4", "2"), emptyArrayReply},
+		{cmd("ZREVRANGEBYSCORE", "z", "4", "(1", "LIMIT", "1", "2"), bulks("c", "b")},
+		{cmd("ZREVRANGEBYSCORE", "z", "+inf", "-inf", "WITHSCORES", "LIMIT", "0", "1"), bulks("e", "5")},
+		{cmd("ZRANGE", "z", "(4", "+inf", "BYSCORE"), bulks("e")},
+		{cmd("ZRANGE", "z", "5", "1", "BYSCORE", "REV", "LIMIT", "0", "2", "WITHSCORES"), bulks("e", "5", "d", "4")},
+		{cmd("ZRANGE", "z", "1", "5", "BYSCORE", "REV"), emptyArrayReply},
+		{cmd("ZRANGEBYSCORE", "z", "a", "b"), errorReply("-ERR min or max is not a float")},
+		{cmd("ZRANGEBYSCORE", "z", "1", "2", "LIMIT", "1"), errorReply(RESP_ERR_SYNTAX)},
+		{cmd("ZRANGEBYSCORE", "z", "1", "2", "LIMIT", "x", "1"), errorReply(RESP_ERR_NOT_INTEGER)},
+		{cmd("ZCOUNT", "z", "(1", "3"), integer(2)},
+		{cmd("ZCOUNT", "z", "-inf", "+inf"), integer(5)},
+		{cmd("ZCOUNT", "z", "(5", "+inf"), integer(0)},
+	})
+}
+
+func TestZrangeByLexWithLimit(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "ZADD", "l", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+	runSteps(t, c, []testStep{
+		{cmd("ZRANGEBYLEX", "l", "-", "[c"), bulks("a", "b", "c")},
+		{cmd("ZRANGEBYLEX", "l", "(a", "(d"), bulks("b", "c")},
+		{cmd("ZRANGEBYLEX", "l", "[b", "+", "LIMIT", "1", "2"), bulks("c", "d")},
+		{cmd("ZRANGEBYLEX", "l", "-", "+", "LIMIT", "3", "-1"), bulks("d", "e")},
+		{cmd("ZRANGEBYLEX", "l", "+", "-"), emptyArrayReply},
+		{cmd("ZRANGEBYLEX", "l", "[aa", "[bb"), bulks("b")},
+		{cmd("ZREVRANGEBYLEX", "l", "[d", "(a", "LIMIT", "1", "2"), bulks("c", "b")},
+		{cmd("ZREVRANGEBYLEX", "l", "+", "-", "LIMIT", "0", "1"), bulks("e")},
+		{cmd("ZRANGE", "l", "[b", "[d", "BYLEX", "LIMIT", "1", "1"), bulks("c")},
+		{cmd("ZRANGE", "l", "(d", "-", "BYLEX", "REV"), bulks("c", "b", "a")},
+		{cmd("ZRANGEBYLEX", "l", "a", "[c"), errorReply("-ERR min or max not valid string range item")},
+		{cmd("ZRANGE", "l", "-", "+", "BYLEX", "WITHSCORES"), errorReply("-ERR syntax error, WITHSCORES not supported in combination with BYLEX")},
+		{cmd("ZRANGEBYLEX", "l", "-", "+", "WITHSCORES"), errorReply(RESP_ERR_SYNTAX)},
+	})
+}
+
+func TestZsetTiesOrderByMember(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "ZADD", "t", "1", "c", "1", "a", "1", "B", "1", "b", "0", "z")
+	runSteps(t, c, []testStep{
+		{cmd("ZRANGE", "t", "0", "-1"), bulks("z", "B", "a", "b", "c")},
+		{cmd("ZRANGE", "t", "0", "-1", "REV"), bulks("c", "b", "a", "B", "z")},
+		{cmd("ZRANGEBYSCORE", "t", "1", "1", "LIMIT", "1", "2"), bulks("a", "b")},
+		{cmd("ZRANK", "t", "b"), integer(3)},
+		// Changing the score of one member moves it among the ties.
+		{cmd("ZADD", "t", "1", "z"), integer(0)},
+		{cmd("ZRANGE", "t", "0", "-1"), bulks("B", "a", "b", "c", "z")},
+	})
+}
+
+func TestZsetRangeStoreAndRemove(t *testing.T) {
+	ts := startTestServer(t, nil)
+	c := ts.client(t)
+	c.expect(integer(5), "ZADD", "z", "1", "a", "2", "b", "3", "c", "4", "d", "5", "e")
+	c.expect(integer(5), "ZADD", "l", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+	runSteps(t, c, []testStep{
+		{cmd("ZRANGESTORE", "dst", "z", "1", "3", "BYSCORE", "LIMIT", "1", "5"), integer(2)},
+		{cmd("ZRANGE", "dst", "0", "-1", "WITHSCORES"), bulks("b", "2", "c", "3")},
+		{cmd("ZRANGESTORE", "dst", "z", "0", "1", "REV"), integer(2)},
+		{cmd("ZRANGE", "dst", "0", "-1"), bulks("d", "e")},
+		{cmd("ZRANGESTORE", "dst", "z", "10", "20", "BYSCORE"), integer(0)},
+		{cmd("TYPE", "dst"), "+none\r\n"},
+		{cmd("ZRANGESTORE", "dst", "z", "0", "-1", "WITHSCORES"), errorReply(RESP_ERR_SYNTAX)},
+
+		{cmd("ZREMRANGEBYRANK", "z", "0", "0"), integer(1)},
+		{cmd("ZREMRANGEBYSCORE", "z", "(4", "+inf"), integer(1)},
+		{cmd("ZREMRANGEBYSCORE", "z", "10", "20"), integer(0)},
+		{cmd("ZRANGE", "z", "0", "-1"), bulks("b", "c", "d")},
+		{cmd("ZREMRANGEBYLEX", "l", "[b", "(d"), integer(2)},
+		{cmd("ZRANGE", "l", "0", "-1"), bulks("a", "d", "e")},
+		{cmd("ZREMRANGEBYRANK", "l", "0", "-1"), integer(3)},
+		{cmd("TYPE", "l"), "+none\r\n"},
+
+		{cmd("ZPOPMIN", "z"), bulks("b", "2")},
+		{cmd("ZPOPMIN", "z", "0"), emptyArrayReply},
+		{cmd("ZPOPMAX", "z", "5"), bulks("d", "4", "c", "3")},
+		{cmd("TYPE", "z"), "+none\r\n"},
+		{cmd("ZPOPMAX", "z"), emptyArrayReply},
+		{cmd("ZPOPMIN", "z", "-1"), errorReply("-ERR value is out of range, must be positive")},
+	})
+}